@@ -432,7 +432,17 @@ sub gen_target_makefile {
         $mfc .= "TARG=$targ\n";
     }
     my @non_test_files = grep { !/_test\.go/ } @go_files;
+    # Files named like foo_linux.go are only built on that OS.
+    my %os_files;  # os -> [files]
+    foreach my $f (@non_test_files) {
+        push @{$os_files{$1}}, $f if $f =~ /_(linux|darwin|freebsd|windows)\.go$/;
+    }
+    @non_test_files = grep { !/_(linux|darwin|freebsd|windows)\.go$/ } @non_test_files;
     $mfc .= "GOFILES=@non_test_files\n";
+    foreach my $os (sort keys %os_files) {
+        $mfc .= "GOFILES_$os=@{$os_files{$os}}\n";
+    }
+    $mfc .= "GOFILES+=\$(GOFILES_\$(GOOS))\n" if %os_files;
     $mfc .= "include \$(GOROOT)/src/Make.$type\n";
 
     set_file_contents("$target_dir/Makefile", $mfc);
@@ -555,17 +565,26 @@ TARGET: clients/go/cammount
     =only_os_linux
 TARGET: clients/go/camsync
 TARGET: lib/go/camli/auth
+TARGET: lib/go/camli/blobhub
 TARGET: lib/go/camli/blobref
 TARGET: lib/go/camli/blobserver
+TARGET: lib/go/camli/blobserver/cache
+TARGET: lib/go/camli/blobserver/compress
 TARGET: lib/go/camli/blobserver/cond
+TARGET: lib/go/camli/blobserver/diskpacked
+TARGET: lib/go/camli/blobserver/encrypt
+TARGET: lib/go/camli/blobserver/erasure
 TARGET: lib/go/camli/blobserver/handlers
 TARGET: lib/go/camli/blobserver/localdisk
+TARGET: lib/go/camli/blobserver/memory
 TARGET: lib/go/camli/blobserver/remote
 TARGET: lib/go/camli/blobserver/replica
 TARGET: lib/go/camli/blobserver/shard
 TARGET: lib/go/camli/blobserver/s3
+TARGET: lib/go/camli/blobserver/storagetest
 TARGET: lib/go/camli/client
 TARGET: lib/go/camli/errorutil
+TARGET: lib/go/camli/gc
 TARGET: lib/go/camli/httputil
 TARGET: lib/go/camli/jsonconfig
 TARGET: lib/go/camli/jsonsign
@@ -584,6 +603,7 @@ TARGET: lib/go/camli/netutil
 TARGET: lib/go/camli/osutil
 TARGET: lib/go/camli/rollsum
 TARGET: lib/go/camli/schema
+TARGET: lib/go/camli/scrub
 TARGET: lib/go/camli/search
 TARGET: lib/go/camli/test
 TARGET: lib/go/camli/test/asserts
@@ -24,7 +24,9 @@ import (
 	"sort"
 
 	"camli/blobref"
+	"camli/blobserver"
 	"camli/blobserver/localdisk" // used for the blob cache
+	"camli/blobserver/memory"
 	"camli/client"
 	"camli/third_party/github.com/hanwen/go-fuse/fuse"
 )
@@ -47,6 +49,7 @@ func main() {
 	// Scans the arg list and sets up flags
 	debug := flag.Bool("debug", false, "print debugging messages.")
 	threaded := flag.Bool("threaded", true, "switch off threading; print debugging messages.")
+	memCacheMB := flag.Int("memcache", 0, "if non-zero, cache blobs in memory, up to this many megabytes, instead of in a temp directory.")
 	flag.Parse()
 
 	errorf := func(msg string, args ...interface{}) {
@@ -64,16 +67,22 @@ func main() {
 	}
 	client := client.NewOrFail() // automatic from flags
 
-	cacheDir, err := ioutil.TempDir("", "camlicache")
-	if err != nil {
-		errorf("Error creating temp cache directory: %v\n", err)
-	}
-	defer os.RemoveAll(cacheDir)
-	diskcache, err := localdisk.New(cacheDir)
-	if err != nil {
-		errorf("Error setting up local disk cache: %v", err)
+	var cache blobserver.Cache
+	if *memCacheMB > 0 {
+		cache = memory.New(int64(*memCacheMB) << 20)
+	} else {
+		cacheDir, err := ioutil.TempDir("", "camlicache")
+		if err != nil {
+			errorf("Error creating temp cache directory: %v\n", err)
+		}
+		defer os.RemoveAll(cacheDir)
+		diskcache, err := localdisk.New(cacheDir)
+		if err != nil {
+			errorf("Error setting up local disk cache: %v", err)
+		}
+		cache = diskcache
 	}
-	fetcher := NewCachingFetcher(diskcache, client)
+	fetcher := NewCachingFetcher(cache, client)
 
 	fs := NewCamliFileSystem(fetcher, root)
 	timing := fuse.NewTimingPathFilesystem(fs)
@@ -85,7 +94,7 @@ func main() {
 	state.Debug = *debug
 
 	mountPoint := flag.Arg(1)
-	err = state.Mount(mountPoint)
+	err := state.Mount(mountPoint)
 	if err != nil {
 		fmt.Printf("MountFuse fail: %v\n", err)
 		os.Exit(1)
@@ -17,7 +17,6 @@ limitations under the License.
 package main
 
 import (
-	"crypto/sha1"
 	"flag"
 	"fmt"
 	"io"
@@ -25,6 +24,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"camli/blobref"
 	"camli/client"
@@ -39,6 +39,9 @@ var flagPermanode = flag.Bool("permanode", false, "create a new permanode")
 var flagInit = flag.Bool("init", false, "first-time configuration.")
 var flagShare = flag.Bool("share", false, "create a camli share by haveref with the given blobrefs")
 var flagTransitive = flag.Bool("transitive", true, "share the transitive closure of the given blobrefs")
+var flagShareExpires = flag.Int64("share-expires", 0, "with --share, seconds until the share expires, or 0 for never")
+var flagShareMaxUses = flag.Int("share-maxuses", 0, "with --share, how many times the share may be opened, or 0 for unlimited")
+var flagRevokeShare = flag.Bool("revoke-share", false, "revoke the given shares")
 var flagRemove = flag.Bool("remove", false, "remove the list of blobrefs")
 var flagName = flag.String("name", "", "Optional name attribute to set on permanode when using -permanode and -file")
 var flagVerbose = flag.Bool("verbose", false, "be verbose")
@@ -47,6 +50,7 @@ var flagSetAttr = flag.Bool("set-attr", false, "set (replace) an attribute")
 var flagAddAttr = flag.Bool("add-attr", false, "add an attribute, additional if one already exists")
 
 var flagSplits = flag.Bool("debug-splits", false, "show splits")
+var flagHash = flag.String("hash", blobref.PreferredHash(), "hash function for new blobs: sha1 or sha256")
 
 var wereErrors = false
 
@@ -56,11 +60,11 @@ type Uploader struct {
 }
 
 func blobDetails(contents io.ReadSeeker) (bref *blobref.BlobRef, size int64, err os.Error) {
-	s1 := sha1.New()
+	h := blobref.NewHash()
 	contents.Seek(0, 0)
-	size, err = io.Copy(s1, contents)
+	size, err = io.Copy(h, contents)
 	if err == nil {
-		bref = blobref.FromHash("sha1", s1)
+		bref = blobref.FromPreferredHash(h)
 	}
 	return
 }
@@ -124,12 +128,12 @@ func (up *Uploader) UploadFile(filename string) (*client.PutResult, os.Error) {
 		dir.Close()
 		sort.SortStrings(dirNames)
 		// TODO: process dirName entries in parallel
-		for _, dirEntName := range dirNames {
-			pr, err := up.UploadFile(filename + "/" + dirEntName)
-			if err != nil {
-				return nil, err
-			}
-			ss.Add(pr.BlobRef)
+		entRefs, err := up.uploadDirEntries(filename, dirNames)
+		if err != nil {
+			return nil, err
+		}
+		for _, br := range entRefs {
+			ss.Add(br)
 		}
 		sspr, err := up.UploadMap(ss.Map())
 		if err != nil {
@@ -152,6 +156,105 @@ func (up *Uploader) UploadFile(filename string) (*client.PutResult, os.Error) {
 	return mappr, err
 }
 
+// maxBatchedFileSize is the biggest file whose contents camput
+// uploads in a batch with others. Bigger files are uploaded on their
+// own, so interrupted uploads of them can be resumed.
+const maxBatchedFileSize = 1 << 20
+
+// uploadDirEntries uploads the entries of directory dir, returning
+// the blobrefs of their schema blobs. Subdirectories and big files are
+// uploaded by UploadFile; the contents of the small files and the
+// schema blobs of all of them are uploaded together, saving a round
+// trip or two per file.
+func (up *Uploader) uploadDirEntries(dir string, names []string) ([]*blobref.BlobRef, os.Error) {
+	entRefs := make([]*blobref.BlobRef, len(names))
+	var handles []*client.UploadHandle
+	for i, name := range names {
+		filename := dir + "/" + name
+		fi, err := os.Lstat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsRegular() || fi.Size > maxBatchedFileSize {
+			pr, err := up.UploadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			entRefs[i] = pr.BlobRef
+			continue
+		}
+
+		if *flagVerbose {
+			log.Printf("Uploading filename: %s", filename)
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		ref, size, err := blobDetails(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		m := schema.NewCommonFileMap(filename, fi)
+		parts := []schema.ContentPart{{BlobRef: ref, Size: uint64(size)}}
+		if err = schema.PopulateRegularFileMap(m, size, parts); err != nil {
+			return nil, err
+		}
+		json, err := schema.MapToCamliJson(m)
+		if err != nil {
+			return nil, err
+		}
+		if *flagVerbose {
+			fmt.Printf("json: %s\n", json)
+		}
+		mh := client.NewUploadHandleFromString(json)
+		handles = append(handles, &client.UploadHandle{ref, size, &lazyFile{name: filename}}, mh)
+		entRefs[i] = mh.BlobRef
+	}
+	if _, err := up.UploadMulti(handles); err != nil {
+		return nil, err
+	}
+	return entRefs, nil
+}
+
+// lazyFile reads a file which is opened on the first Read and closed
+// at EOF, so a directory's worth of them can wait to be uploaded
+// without using up file descriptors.
+type lazyFile struct {
+	name string
+	f    *os.File
+	eof  bool
+}
+
+func (lf *lazyFile) Read(p []byte) (n int, err os.Error) {
+	if lf.eof {
+		return 0, os.EOF
+	}
+	if lf.f == nil {
+		if lf.f, err = os.Open(lf.name); err != nil {
+			return 0, err
+		}
+	}
+	n, err = lf.f.Read(p)
+	if err == os.EOF {
+		lf.eof = true
+		lf.Close()
+	}
+	return
+}
+
+// Close closes the file if it's open. The client closes the contents
+// of blobs the server already has rather than reading them.
+func (lf *lazyFile) Close() os.Error {
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
 func (up *Uploader) UploadMap(m map[string]interface{}) (*client.PutResult, os.Error) {
 	json, err := schema.MapToCamliJson(m)
 	if err != nil {
@@ -196,8 +299,16 @@ func (up *Uploader) UploadNewPermanode() (*client.PutResult, os.Error) {
 	return up.UploadAndSignMap(unsigned)
 }
 
-func (up *Uploader) UploadShare(target *blobref.BlobRef, transitive bool) (*client.PutResult, os.Error) {
+// UploadShare uploads a share of target, expiring after expires
+// seconds and usable maxUses times, unless they're 0.
+func (up *Uploader) UploadShare(target *blobref.BlobRef, transitive bool, expires int64, maxUses int) (*client.PutResult, os.Error) {
 	unsigned := schema.NewShareRef(schema.ShareHaveRef, target, transitive)
+	if expires > 0 {
+		schema.SetShareExpiration(unsigned, time.Nanoseconds()+expires*1e9)
+	}
+	if maxUses > 0 {
+		schema.SetShareMaxUses(unsigned, maxUses)
+	}
 	return up.UploadAndSignMap(unsigned)
 }
 
@@ -221,6 +332,8 @@ Usage: camput
   camput --blob <filename(s) to upload as blobs>
   camput --file <filename(s) to upload as blobs + JSON metadata>
   camput --share <blobref to share via haveref> [--transitive]
+         [--share-expires=<seconds>] [--share-maxuses=<n>]
+  camput --revoke-share <share blobref(s) to revoke>
 `)
 	flag.PrintDefaults()
 	os.Exit(1)
@@ -243,12 +356,16 @@ func main() {
 	jsonsign.AddFlags()
 	flag.Parse()
 
+	if err := blobref.SetPreferredHash(*flagHash); err != nil {
+		usage(err.String())
+	}
+
 	if *flagSplits {
 		showSplits()
 		return
 	}
 
-	nOpts := sumSet(flagFile, flagBlob, flagPermanode, flagInit, flagShare, flagRemove,
+	nOpts := sumSet(flagFile, flagBlob, flagPermanode, flagInit, flagShare, flagRevokeShare, flagRemove,
 		flagSetAttr, flagAddAttr)
 	if !(nOpts == 1 ||
 		(nOpts == 2 && *flagFile && *flagPermanode)) {
@@ -320,8 +437,20 @@ func main() {
 		if br == nil {
 			log.Fatalf("BlobRef is invalid: %q", flag.Arg(0))
 		}
-		pr, err := up.UploadShare(br, *flagTransitive)
+		pr, err := up.UploadShare(br, *flagTransitive, *flagShareExpires, *flagShareMaxUses)
 		handleResult("share", pr, err)
+	case *flagRevokeShare:
+		if flag.NArg() == 0 {
+			log.Fatalf("--revoke-share takes one or more share blobrefs")
+		}
+		for _, arg := range flag.Args() {
+			br := blobref.Parse(arg)
+			if br == nil {
+				log.Fatalf("BlobRef is invalid: %q", arg)
+			}
+			pr, err := up.UploadAndSignMap(schema.NewRevokeClaim(br))
+			handleResult("revoke", pr, err)
+		}
 	case *flagRemove:
 		if flag.NArg() == 0 {
 			log.Fatalf("--remove takes one or more blobrefs")
@@ -17,6 +17,7 @@ limitations under the License.
 package auth
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"http"
@@ -27,11 +28,71 @@ import (
 
 var kBasicAuthPattern *regexp.Regexp = regexp.MustCompile(`^Basic ([a-zA-Z0-9\+/=]+)`)
 
+// AccessPassword, with any username, allows everything.
 var AccessPassword string
 
+// A Scope is a kind of access a user or token may be given.
+type Scope string
+
+const (
+	ScopeRead   Scope = "read"   // fetching, enumerating and statting blobs
+	ScopeUpload Scope = "upload" // statting and uploading blobs
+	ScopeSearch Scope = "search" // the search handler
+	ScopeAdmin  Scope = "admin"  // everything, such as removing blobs and issuing tokens
+)
+
+// ParseScope returns the scope named s.
+func ParseScope(s string) (Scope, os.Error) {
+	switch sc := Scope(s); sc {
+	case ScopeRead, ScopeUpload, ScopeSearch, ScopeAdmin:
+		return sc, nil
+	}
+	return "", fmt.Errorf("auth: unknown scope %q", s)
+}
+
+// ParseScopes returns the scopes named by list.
+func ParseScopes(list []string) ([]Scope, os.Error) {
+	scopes := make([]Scope, len(list))
+	for i, s := range list {
+		var err os.Error
+		if scopes[i], err = ParseScope(s); err != nil {
+			return nil, err
+		}
+	}
+	return scopes, nil
+}
+
+// A User is a named user, with a password of their own.
+type User struct {
+	Name     string
+	Password string
+	Scopes   []Scope
+}
+
+// users are the named users, by name. They're only added while
+// starting up.
+var users = make(map[string]*User)
+
+// AddUser adds a named user, who authenticates with their name and
+// password.
+func AddUser(u *User) {
+	users[u.Name] = u
+}
+
+// tokens, if set, are the access tokens that may be given as
+// passwords.
+var tokens *TokenStore
+
+// SetTokenStore sets the store of access tokens accepted as passwords.
+func SetTokenStore(ts *TokenStore) {
+	tokens = ts
+}
+
 func TriedAuthorization(req *http.Request) bool {
 	// Currently a simple test just using HTTP basic auth
-	// (presumably over https); may expand.
+	// (presumably over https); may expand. A client certificate
+	// alone doesn't count, as browsers may send one meant for
+	// other sites along with a share URL.
 	return req.Header.Get("Authorization") != ""
 }
 
@@ -45,40 +106,111 @@ func SendUnauthorized(conn http.ResponseWriter) {
 	fmt.Fprintf(conn, "<h1>Unauthorized</h1>")
 }
 
-func IsAuthorized(req *http.Request) bool {
+// SendDenied answers a request that isn't allowed: with 403 Forbidden
+// if its credentials are valid but lack the needed scope, so clients
+// don't ask for others, and otherwise as SendUnauthorized.
+func SendDenied(conn http.ResponseWriter, req *http.Request) {
+	if requestScopes(req) == nil {
+		SendUnauthorized(conn)
+		return
+	}
+	conn.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(conn, "<h1>Forbidden</h1>")
+}
+
+// basicAuth returns the username and password of req's HTTP basic
+// auth, if any.
+func basicAuth(req *http.Request) (username, password string, ok bool) {
 	auth := req.Header.Get("Authorization")
 	if auth == "" {
-		return false
+		return
 	}
 	matches := kBasicAuthPattern.FindStringSubmatch(auth)
 	if len(matches) != 2 {
-		return false
+		return
 	}
 	encoded := matches[1]
 	enc := base64.StdEncoding
 	decBuf := make([]byte, enc.DecodedLen(len(encoded)))
 	n, err := enc.Decode(decBuf, []byte(encoded))
 	if err != nil {
-		return false
+		return
 	}
 	userpass := strings.Split(string(decBuf[0:n]), ":", 2)
 	if len(userpass) != 2 {
-		fmt.Println("didn't get two pieces")
-		return false
+		return
 	}
-	password := userpass[1] // username at index 0 is currently unused
-	return password != "" && password == AccessPassword
+	return userpass[0], userpass[1], true
+}
+
+// requestScopes returns the scopes req's credentials have: those of
+// AccessPassword, of a named user, or of an access token, and without
+// HTTP basic auth, those of a verified TLS client certificate. It
+// returns nil if there are no valid credentials.
+func requestScopes(req *http.Request) []Scope {
+	username, password, ok := basicAuth(req)
+	if !ok {
+		return clientCertScopes(req)
+	}
+	if password == "" {
+		return nil
+	}
+	if passwordMatches(password, AccessPassword) {
+		return []Scope{ScopeAdmin}
+	}
+	if u, ok := users[username]; ok && passwordMatches(password, u.Password) {
+		return u.Scopes
+	}
+	if tokens != nil {
+		if t := tokens.lookup(password); t != nil {
+			return t.Scopes
+		}
+	}
+	return nil
+}
+
+// passwordMatches reports whether given is want, taking the same time
+// for any given of want's length.
+func passwordMatches(given, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// Allowed reports whether req's credentials have any of scopes, or
+// the admin scope.
+func Allowed(req *http.Request, scopes ...Scope) bool {
+	for _, have := range requestScopes(req) {
+		if have == ScopeAdmin {
+			return true
+		}
+		for _, s := range scopes {
+			if have == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsAuthorized reports whether req's credentials have the admin scope,
+// allowing everything.
+func IsAuthorized(req *http.Request) bool {
+	return Allowed(req, ScopeAdmin)
 }
 
 // requireAuth wraps a function with another function that enforces
-// HTTP Basic Auth.
-func RequireAuth(handler func(conn http.ResponseWriter, req *http.Request)) func (conn http.ResponseWriter, req *http.Request) {
-	return func (conn http.ResponseWriter, req *http.Request) {
-		if IsAuthorized(req) {
+// HTTP Basic Auth or a client certificate, with the admin scope.
+func RequireAuth(handler func(conn http.ResponseWriter, req *http.Request)) func(conn http.ResponseWriter, req *http.Request) {
+	return RequireScope(handler, ScopeAdmin)
+}
+
+// RequireScope wraps a function with another function that enforces
+// HTTP Basic Auth or a client certificate, with any of scopes.
+func RequireScope(handler func(conn http.ResponseWriter, req *http.Request), scopes ...Scope) func(conn http.ResponseWriter, req *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		if Allowed(req, scopes...) {
 			handler(conn, req)
 		} else {
-			SendUnauthorized(conn)
+			SendDenied(conn, req)
 		}
 	}
 }
-
@@ -0,0 +1,118 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"http"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "camli/test/asserts"
+)
+
+func requestWith(username, password string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://example.com/camli/stat", nil)
+	req.SetBasicAuth(username, password)
+	return req
+}
+
+func TestScopes(t *testing.T) {
+	AccessPassword = "admin"
+	AddUser(&User{Name: "backup", Password: "robot", Scopes: []Scope{ScopeUpload}})
+	defer func() { users = make(map[string]*User) }()
+
+	req := requestWith("anyone", "admin")
+	Expect(t, IsAuthorized(req), "AccessPassword is admin")
+	Expect(t, Allowed(req, ScopeRead), "admin may read")
+
+	req = requestWith("backup", "robot")
+	Expect(t, Allowed(req, ScopeUpload), "user may upload")
+	Expect(t, Allowed(req, ScopeRead, ScopeUpload), "user may upload or read")
+	Expect(t, !Allowed(req, ScopeRead), "user may not read")
+	Expect(t, !IsAuthorized(req), "user isn't admin")
+
+	Expect(t, !Allowed(requestWith("other", "robot"), ScopeUpload), "user's password with other name")
+	Expect(t, !Allowed(requestWith("backup", ""), ScopeUpload), "empty password")
+}
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-auth-test")
+	AssertNil(t, err, "TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	ts, err := OpenTokenStore(path)
+	AssertNil(t, err, "OpenTokenStore of missing file")
+	SetTokenStore(ts)
+	defer SetTokenStore(nil)
+
+	secret, tok, err := ts.Issue("alice", "phone", []Scope{ScopeUpload, ScopeSearch})
+	AssertNil(t, err, "Issue")
+	Expect(t, Allowed(requestWith("", secret), ScopeSearch), "token may search")
+	Expect(t, !Allowed(requestWith("", secret), ScopeRead), "token may not read")
+
+	data, err := ioutil.ReadFile(path)
+	AssertNil(t, err, "ReadFile")
+	Expect(t, !strings.Contains(string(data), secret), "token not stored")
+	Expect(t, strings.Contains(string(data), tok.Hash), "token hash stored")
+
+	ts2, err := OpenTokenStore(path)
+	AssertNil(t, err, "OpenTokenStore")
+	tokens := ts2.Tokens()
+	AssertInt(t, 1, len(tokens), "tokens reopened")
+	ExpectString(t, "alice", tokens[0].User, "token user")
+	ExpectString(t, "phone", tokens[0].Label, "token label")
+	ExpectInt(t, 2, len(tokens[0].Scopes), "token scopes")
+
+	AssertNil(t, ts.Revoke(tok.Hash), "Revoke")
+	Expect(t, !Allowed(requestWith("", secret), ScopeSearch), "revoked token")
+	Expect(t, ts.Revoke(tok.Hash) == ErrNoToken, "revoking twice")
+	ts2, err = OpenTokenStore(path)
+	AssertNil(t, err, "OpenTokenStore after revoking")
+	ExpectInt(t, 0, len(ts2.Tokens()), "tokens after revoking")
+}
+
+func TestCapability(t *testing.T) {
+	SetCapabilitySecret(nil)
+	_, err := MintCapability(CapabilityBlob, "sha1-foo", time.Seconds()+60)
+	Expect(t, err == ErrNoCapabilitySecret, "minting without a secret")
+
+	SetCapabilitySecret([]byte("secret"))
+	defer SetCapabilitySecret(nil)
+	has := func(cap, scope, blobRef string) bool {
+		req, _ := http.NewRequest("GET", "http://example.com/camli/"+blobRef+"?cap="+cap, nil)
+		return HasCapability(req, scope, blobRef)
+	}
+	cap, err := MintCapability(CapabilityBlob, "sha1-foo", time.Seconds()+60)
+	AssertNil(t, err, "MintCapability")
+	Expect(t, has(cap, CapabilityBlob, "sha1-foo"), "capability")
+	Expect(t, !has(cap, CapabilityBlob, "sha1-bar"), "capability for other blob")
+	Expect(t, !has(cap, CapabilityDownload, "sha1-foo"), "capability for other scope")
+	Expect(t, !has(strings.Replace(cap, "blob.", "download.", 1), CapabilityDownload, "sha1-foo"), "capability with changed scope")
+	Expect(t, !has(cap+"0", CapabilityBlob, "sha1-foo"), "tampered capability")
+
+	expired, err := MintCapability(CapabilityBlob, "sha1-foo", time.Seconds()-1)
+	AssertNil(t, err, "MintCapability")
+	Expect(t, !has(expired, CapabilityBlob, "sha1-foo"), "expired capability")
+
+	SetCapabilitySecret([]byte("other"))
+	Expect(t, !has(cap, CapabilityBlob, "sha1-foo"), "capability after changing secret")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"fmt"
+	"http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capabilities are URL parameters letting a request fetch a blob or
+// download a file without other credentials, until they expire. They
+// name their scope, blob and expiration time, and are signed with an
+// HMAC keyed by the server's secret, so only the server mints them.
+const (
+	CapabilityBlob     = "blob"     // fetching the blob
+	CapabilityDownload = "download" // downloading the file the blob is the schema of
+)
+
+// CapabilityParam is the URL query parameter holding a capability.
+const CapabilityParam = "cap"
+
+var ErrNoCapabilitySecret = os.NewError("auth: no capability secret set")
+
+// capabilitySecret is the HMAC key of capabilities, or nil if none
+// are valid.
+var capabilitySecret []byte
+
+// SetCapabilitySecret sets the HMAC key of capabilities. Changing it
+// invalidates the capabilities already minted.
+func SetCapabilitySecret(secret []byte) {
+	capabilitySecret = secret
+}
+
+func capabilityMAC(scope, blobRef string, expires int64) string {
+	h := hmac.NewSHA1(capabilitySecret)
+	fmt.Fprintf(h, "%s\n%s\n%d", scope, blobRef, expires)
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+// MintCapability returns a capability for scope on blobRef, expiring
+// at expires, in seconds since the epoch.
+func MintCapability(scope, blobRef string, expires int64) (string, os.Error) {
+	if capabilitySecret == nil {
+		return "", ErrNoCapabilitySecret
+	}
+	return fmt.Sprintf("%s.%d.%s", scope, expires, capabilityMAC(scope, blobRef, expires)), nil
+}
+
+// HasCapability reports whether req's URL has an unexpired capability
+// for scope on blobRef.
+func HasCapability(req *http.Request, scope, blobRef string) bool {
+	cap := req.URL.Query().Get(CapabilityParam)
+	if cap == "" || capabilitySecret == nil {
+		return false
+	}
+	parts := strings.Split(cap, ".", -1)
+	if len(parts) != 3 || parts[0] != scope {
+		return false
+	}
+	expires, err := strconv.Atoi64(parts[1])
+	if err != nil || time.Seconds() > expires {
+		return false
+	}
+	want := capabilityMAC(scope, blobRef, expires)
+	return subtle.ConstantTimeCompare([]byte(parts[2]), []byte(want)) == 1
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"http"
+	"os"
+	"strings"
+	"time"
+)
+
+// clientCAs, if set, are the CAs a TLS client certificate must be
+// issued by to be accepted.
+var clientCAs *tls.CASet
+
+// clientCerts are the scopes of accepted client certificates, keyed
+// by "sha1:" and their lowercase hex fingerprint, or "CN=" and their
+// subject common name. They're only added while starting up.
+var clientCerts = make(map[string][]Scope)
+
+// SetClientCAs sets the CAs, as a PEM bundle, that issue the client
+// certificates accepted as credentials. Until it's called, client
+// certificates are ignored.
+func SetClientCAs(pemCerts []byte) os.Error {
+	cas := tls.NewCASet()
+	if !cas.SetFromPEM(pemCerts) {
+		return os.NewError("auth: no certificates in client CA bundle")
+	}
+	clientCAs = cas
+	return nil
+}
+
+// AddClientCert gives the client certificates matching match the
+// given scopes. match is either "sha1:" followed by a certificate's
+// hex SHA-1 fingerprint, or "CN=" followed by its subject common name.
+// A fingerprint match takes precedence over a common name one.
+func AddClientCert(match string, scopes []Scope) os.Error {
+	switch {
+	case strings.HasPrefix(match, "sha1:"):
+		fp := strings.ToLower(strings.Replace(match[len("sha1:"):], ":", "", -1))
+		if len(fp) != 2*sha1.Size {
+			return fmt.Errorf("auth: bad client certificate fingerprint %q", match)
+		}
+		match = "sha1:" + fp
+	case strings.HasPrefix(match, "CN="):
+		if match == "CN=" {
+			return fmt.Errorf("auth: empty client certificate common name")
+		}
+	default:
+		return fmt.Errorf("auth: client certificate %q isn't sha1:<fingerprint> or CN=<name>", match)
+	}
+	clientCerts[match] = scopes
+	return nil
+}
+
+// ClientCertFingerprint returns cert's fingerprint as AddClientCert
+// matches it.
+func ClientCertFingerprint(cert *x509.Certificate) string {
+	h := sha1.New()
+	h.Write(cert.Raw)
+	return fmt.Sprintf("sha1:%x", h.Sum())
+}
+
+// clientCertScopes returns the scopes of req's TLS client
+// certificate, or nil if it has none that's verified and mapped.
+func clientCertScopes(req *http.Request) []Scope {
+	if clientCAs == nil || req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	certs := req.TLS.PeerCertificates
+	if !verifiedClientChain(certs) {
+		return nil
+	}
+	leaf := certs[0]
+	if scopes, ok := clientCerts[ClientCertFingerprint(leaf)]; ok {
+		return scopes
+	}
+	if cn := leaf.Subject.CommonName; cn != "" {
+		if scopes, ok := clientCerts["CN="+cn]; ok {
+			return scopes
+		}
+	}
+	return nil
+}
+
+// verifiedClientChain reports whether certs, a client's certificate
+// followed by any intermediates it sent, chain up to one of clientCAs
+// and are all currently valid, and the client's certificate is for
+// client authentication. The TLS handshake only checks that the client
+// holds the key of certs[0].
+func verifiedClientChain(certs []*x509.Certificate) bool {
+	if !forClientAuth(certs[0]) {
+		return false
+	}
+	now := time.Seconds()
+	for i, cert := range certs {
+		if cert.NotBefore != nil && now < cert.NotBefore.Seconds() {
+			return false
+		}
+		if cert.NotAfter != nil && now > cert.NotAfter.Seconds() {
+			return false
+		}
+		if clientCAs.FindVerifiedParent(cert) != nil {
+			return true
+		}
+		if i+1 == len(certs) || cert.CheckSignatureFrom(certs[i+1]) != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// forClientAuth reports whether cert's extended key usage allows
+// client authentication. A certificate without one, such as a
+// server's or a CA's, isn't accepted.
+func forClientAuth(cert *x509.Certificate) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == x509.ExtKeyUsageClientAuth || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"http"
+	"testing"
+	"time"
+
+	. "camli/test/asserts"
+)
+
+// newCert returns a certificate for cn, valid from notBefore for a
+// day, and its key. It's signed by parent, or self-signed if parent
+// is nil. Unless it's a CA, it's for client authentication.
+func newCert(t *testing.T, cn string, isCA bool, notBefore int64, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	var usage []x509.ExtKeyUsage
+	if !isCA {
+		usage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	return newCertWithUsage(t, cn, isCA, usage, notBefore, parent, parentKey)
+}
+
+func newCertWithUsage(t *testing.T, cn string, isCA bool, usage []x509.ExtKeyUsage, notBefore int64, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	AssertNil(t, err, "GenerateKey")
+	template := &x509.Certificate{
+		SerialNumber:          []byte{1},
+		NotBefore:             time.SecondsToUTC(notBefore),
+		NotAfter:              time.SecondsToUTC(notBefore + 86400),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           usage,
+	}
+	template.Subject.CommonName = cn
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	AssertNil(t, err, "CreateCertificate")
+	cert, err := x509.ParseCertificate(der)
+	AssertNil(t, err, "ParseCertificate")
+	return cert, key
+}
+
+func requestWithCerts(certs ...*x509.Certificate) *http.Request {
+	req, _ := http.NewRequest("GET", "http://example.com/camli/stat", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: certs}
+	return req
+}
+
+func TestClientCert(t *testing.T) {
+	now := time.Seconds()
+	ca, caKey := newCert(t, "Test CA", true, now-60, nil, nil)
+	alice, _ := newCert(t, "alice", false, now-60, ca, caKey)
+	bob, _ := newCert(t, "bob", false, now-60, ca, caKey)
+	expired, _ := newCert(t, "alice", false, now-2*86400, ca, caKey)
+	selfSigned, _ := newCert(t, "alice", false, now-60, nil, nil)
+	intermediate, intermediateKey := newCert(t, "Test Intermediate", true, now-60, ca, caKey)
+	carol, _ := newCert(t, "carol", false, now-60, intermediate, intermediateKey)
+	dave, _ := newCert(t, "dave", false, now-60, ca, caKey)
+	server, _ := newCertWithUsage(t, "alice", false, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, now-60, ca, caKey)
+	noUsage, _ := newCertWithUsage(t, "alice", false, nil, now-60, ca, caKey)
+
+	AssertNil(t, AddClientCert("CN=alice", []Scope{ScopeUpload}), "AddClientCert by name")
+	AssertNil(t, AddClientCert(ClientCertFingerprint(bob), []Scope{ScopeAdmin}), "AddClientCert by fingerprint")
+	AssertNil(t, AddClientCert("CN=carol", []Scope{ScopeRead}), "AddClientCert of carol")
+	defer func() { clientCerts = make(map[string][]Scope) }()
+	ExpectErrorContains(t, AddClientCert("sha1:1234", nil), "fingerprint", "short fingerprint")
+	ExpectErrorContains(t, AddClientCert("alice", nil), "isn't", "unprefixed match")
+
+	Expect(t, !Allowed(requestWithCerts(alice), ScopeUpload), "client cert without client CAs")
+
+	pemCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	AssertNil(t, SetClientCAs(pemCA), "SetClientCAs")
+	defer func() { clientCAs = nil }()
+	Expect(t, SetClientCAs([]byte("garbage")) != nil, "SetClientCAs without certificates")
+
+	Expect(t, Allowed(requestWithCerts(alice), ScopeUpload), "cert matched by name may upload")
+	Expect(t, !Allowed(requestWithCerts(alice), ScopeRead), "cert matched by name may not read")
+	Expect(t, IsAuthorized(requestWithCerts(bob)), "cert matched by fingerprint is admin")
+	Expect(t, Allowed(requestWithCerts(carol, intermediate), ScopeRead), "cert via intermediate")
+	Expect(t, !Allowed(requestWithCerts(carol), ScopeRead), "cert without its intermediate")
+	Expect(t, !Allowed(requestWithCerts(expired), ScopeUpload), "expired cert")
+	Expect(t, !Allowed(requestWithCerts(selfSigned), ScopeUpload), "cert from other issuer")
+	Expect(t, !Allowed(requestWithCerts(dave), ScopeUpload), "unmapped cert")
+	Expect(t, !Allowed(requestWithCerts(server), ScopeUpload), "cert for server auth")
+	Expect(t, !Allowed(requestWithCerts(noUsage), ScopeUpload), "cert without extended key usage")
+
+	req := requestWithCerts(bob)
+	req.SetBasicAuth("someone", "wrong")
+	Expect(t, !Allowed(req, ScopeRead), "basic auth takes precedence over client cert")
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"camli/osutil"
+)
+
+// ErrNoToken is returned when revoking a token that isn't issued.
+var ErrNoToken = os.NewError("auth: no such token")
+
+// A Token is an access token that was issued. Only its hash is kept,
+// so the store's file doesn't hold credentials.
+type Token struct {
+	Hash    string  "hash"  // hex SHA-1 of the token; also its ID
+	User    string  "user"  // whom it's for
+	Label   string  "label" // such as "phone"
+	Scopes  []Scope "scopes"
+	Created string  "created" // RFC 3339
+}
+
+// A TokenStore keeps issued access tokens in a file.
+type TokenStore struct {
+	path string
+
+	mu     sync.Mutex
+	tokens map[string]*Token // by hash
+}
+
+// OpenTokenStore returns the store kept in the file at path, which is
+// created when the first token is issued.
+func OpenTokenStore(path string) (*TokenStore, os.Error) {
+	ts := &TokenStore{path: path, tokens: make(map[string]*Token)}
+	f, err := os.Open(path)
+	if osutil.ErrorIsNoEnt(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var list []*Token
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("auth: reading tokens from %s: %v", path, err)
+	}
+	for _, t := range list {
+		ts.tokens[t.Hash] = t
+	}
+	return ts, nil
+}
+
+func hashToken(secret string) string {
+	h := sha1.New()
+	io.WriteString(h, secret)
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+// Issue issues a token for user, returning the token itself, which
+// isn't stored.
+func (ts *TokenStore) Issue(user, label string, scopes []Scope) (secret string, t *Token, err os.Error) {
+	if len(scopes) == 0 {
+		return "", nil, os.NewError("auth: no scopes for token")
+	}
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", nil, err
+	}
+	secret = fmt.Sprintf("%x", buf)
+	t = &Token{
+		Hash:    hashToken(secret),
+		User:    user,
+		Label:   label,
+		Scopes:  scopes,
+		Created: time.UTC().Format(time.RFC3339),
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens[t.Hash] = t
+	if err := ts.save(); err != nil {
+		ts.tokens[t.Hash] = nil, false
+		return "", nil, err
+	}
+	return secret, t, nil
+}
+
+// Revoke revokes the token whose hash is given.
+func (ts *TokenStore) Revoke(hash string) os.Error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tokens[hash]
+	if !ok {
+		return ErrNoToken
+	}
+	ts.tokens[hash] = nil, false
+	if err := ts.save(); err != nil {
+		ts.tokens[hash] = t
+		return err
+	}
+	return nil
+}
+
+type tokensByCreated []*Token
+
+func (s tokensByCreated) Len() int           { return len(s) }
+func (s tokensByCreated) Less(i, j int) bool { return s[i].Created < s[j].Created }
+func (s tokensByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Tokens returns the issued tokens, oldest first.
+func (ts *TokenStore) Tokens() []*Token {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]*Token, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		list = append(list, t)
+	}
+	sort.Sort(tokensByCreated(list))
+	return list
+}
+
+func (ts *TokenStore) lookup(secret string) *Token {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.tokens[hashToken(secret)]
+}
+
+// save writes the tokens to the store's file, replacing it atomically.
+// ts.mu must be held.
+func (ts *TokenStore) save() os.Error {
+	list := make([]*Token, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		list = append(list, t)
+	}
+	sort.Sort(tokensByCreated(list))
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(ts.path), "."+filepath.Base(ts.path)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, ts.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package blobhub registers blob hubs which, unlike the default
+// in-memory blobserver.SimpleBlobHub, also learn of blobs received by
+// other processes, so Stat and EnumerateBlobs long-polls wake up for
+// them too. A storage's hub is chosen by the "blobHub" object of its
+// prefix in the server config.
+//
+// The "inotify" hub (Linux only) watches a localdisk root for blob
+// files written by anything, such as another camlistored or a cron
+// job:
+//
+//     "blobHub": { "type": "inotify" }
+//
+// Its optional "path" defaults to the storage's root.
+//
+// The "http" hub long-polls another server's "blobhub" handler, which
+// publishes the blobs received by one of its storages:
+//
+//     "blobHub": {
+//         "type": "http",
+//         "url": "http://otherhost:3179/bs-hub/",
+//         "password": "pass3179"
+//     }
+//
+// with, on the other server:
+//
+//     "/bs-hub/": {
+//         "handler": "blobhub",
+//         "handlerArgs": { "storage": "/bs/" }
+//     },
+//
+// Both hubs may notify listeners of a blob more than once.
+package blobhub
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/lru"
+)
+
+// recentBlobs is how many blobs a remoteHub remembers notifying, to
+// suppress duplicates.
+const recentBlobs = 1000
+
+// remoteHub is a SimpleBlobHub that is also notified of blobs received
+// elsewhere.
+type remoteHub struct {
+	blobserver.SimpleBlobHub
+	recent *lru.Cache // blobref string -> true
+}
+
+func newRemoteHub() *remoteHub {
+	return &remoteHub{recent: lru.New(recentBlobs)}
+}
+
+func (h *remoteHub) NotifyBlobReceived(br *blobref.BlobRef) {
+	h.recent.Add(br.String(), true)
+	h.SimpleBlobHub.NotifyBlobReceived(br)
+}
+
+// notifyRemote notifies listeners of a blob received elsewhere, unless
+// they were recently notified of it. This also keeps two servers
+// subscribed to each other from echoing blobs back and forth.
+func (h *remoteHub) notifyRemote(br *blobref.BlobRef) {
+	if _, ok := h.recent.Get(br.String()); ok {
+		return
+	}
+	h.NotifyBlobReceived(br)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobhub
+
+import (
+	"fmt"
+	"http/httptest"
+	"testing"
+	"time"
+
+	"camli/auth"
+	"camli/blobref"
+	"camli/blobserver/memory"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func expectNotified(t *testing.T, ch chan *blobref.BlobRef, want *blobref.BlobRef) {
+	select {
+	case got := <-ch:
+		ExpectString(t, want.String(), got.String(), "notified blob")
+	case <-time.After(1e9):
+		t.Errorf("timeout waiting for notification of %s", want)
+	}
+}
+
+func expectNotNotified(t *testing.T, ch chan *blobref.BlobRef) {
+	select {
+	case got := <-ch:
+		t.Errorf("unexpected notification of %s", got)
+	case <-time.After(50e6):
+	}
+}
+
+func TestRemoteDuplicatesSuppressed(t *testing.T) {
+	h := newRemoteHub()
+	ch := make(chan *blobref.BlobRef, 10)
+	h.RegisterListener(ch)
+	foo := (&test.Blob{"foo"}).BlobRef()
+	bar := (&test.Blob{"bar"}).BlobRef()
+
+	h.NotifyBlobReceived(foo)
+	expectNotified(t, ch, foo)
+	h.notifyRemote(foo)
+	expectNotNotified(t, ch)
+	h.notifyRemote(bar)
+	expectNotified(t, ch, bar)
+	h.notifyRemote(bar)
+	expectNotNotified(t, ch)
+}
+
+func TestPublishPoll(t *testing.T) {
+	auth.AccessPassword = "secret"
+	sto := memory.New(0)
+	server := httptest.NewServer(newPublisher(sto))
+	defer server.Close()
+	h := newHTTPHub(server.URL, "secret", 1)
+
+	res, err := h.poll(-1)
+	AssertNil(t, err, "initial poll")
+	ExpectInt(t, 0, int(res.Seq), "initial seq")
+
+	tb := &test.Blob{"foo"}
+	_, err = sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	res, err = h.poll(res.Seq)
+	AssertNil(t, err, "poll")
+	ExpectInt(t, 1, int(res.Seq), "seq after upload")
+	AssertInt(t, 1, len(res.BlobRefs), "blobs polled")
+	ExpectString(t, tb.BlobRef().String(), res.BlobRefs[0], "blob polled")
+
+	// Times out with nothing new.
+	res, err = h.poll(res.Seq)
+	AssertNil(t, err, "empty poll")
+	ExpectInt(t, 0, len(res.BlobRefs), "blobs in empty poll")
+
+	bad := newHTTPHub(server.URL, "wrong", 1)
+	_, err = bad.poll(-1)
+	Expect(t, err != nil, "poll with wrong password fails")
+}
+
+func TestPublisherMissed(t *testing.T) {
+	p := newPublisher(memory.New(0))
+	for i := 0; i < publishedBlobs+5; i++ {
+		p.publish((&test.Blob{fmt.Sprintf("blob %d", i)}).BlobRef())
+	}
+	res, _ := p.since(0)
+	Expect(t, res.Missed, "missed blobs reported")
+	ExpectInt(t, publishedBlobs, len(res.BlobRefs), "blobs listed")
+	ExpectString(t, (&test.Blob{"blob 5"}).BlobRef().String(), res.BlobRefs[0], "oldest blob listed")
+
+	res, _ = p.since(publishedBlobs + 3)
+	Expect(t, !res.Missed, "nothing missed")
+	ExpectInt(t, 2, len(res.BlobRefs), "blobs listed")
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobhub
+
+import (
+	"fmt"
+	"http"
+	"json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"camli/auth"
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+	"camli/jsonconfig"
+)
+
+const (
+	// publishedBlobs is how many recent blobs a publisher keeps
+	// for subscribers that fall behind.
+	publishedBlobs = 1000
+
+	defaultPollSeconds = 30
+	maxPollSeconds     = 60
+
+	// retryDelay is how long a subscriber waits after an error.
+	retryDelay = 10e9
+)
+
+func init() {
+	blobserver.RegisterBlobHubConstructor("http", newHTTPHubFromConfig)
+	blobserver.RegisterHandlerConstructor("blobhub", newPublisherFromConfig)
+}
+
+// pollResponse is the JSON response of a publisher.
+type pollResponse struct {
+	Seq      int64    "seq"      // of the last blob published
+	BlobRefs []string "blobRefs" // published after the requested seq
+	Missed   bool     "missed"   // if some were too old to list
+}
+
+// publisher serves the blobs received by a storage to subscribing
+// "http" hubs. A GET with "since" (a seq from an earlier response)
+// returns the blobs published since, waiting up to "maxwaitsec"
+// seconds for one if there are none yet. Without "since", it returns
+// just the current seq.
+type publisher struct {
+	mu     sync.Mutex
+	seq    int64
+	recent []string  // blobs published, recent[len(recent)-1] being seq
+	wake   chan bool // closed and replaced when a blob is published
+}
+
+func newPublisherFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, os.Error) {
+	name := conf.RequiredString("storage")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	return newPublisher(sto), nil
+}
+
+func newPublisher(sto blobserver.Storage) *publisher {
+	p := &publisher{wake: make(chan bool)}
+	ch := make(chan *blobref.BlobRef, 100)
+	sto.GetBlobHub().RegisterListener(ch)
+	go func() {
+		for br := range ch {
+			p.publish(br)
+		}
+	}()
+	return p
+}
+
+func (p *publisher) publish(br *blobref.BlobRef) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	p.recent = append(p.recent, br.String())
+	if len(p.recent) > publishedBlobs {
+		copy(p.recent, p.recent[1:])
+		p.recent = p.recent[:publishedBlobs]
+	}
+	close(p.wake)
+	p.wake = make(chan bool)
+}
+
+// since returns the blobs published after seq, and a channel that's
+// closed when the next blob is published.
+func (p *publisher) since(seq int64) (res *pollResponse, wake <-chan bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res = &pollResponse{Seq: p.seq, BlobRefs: []string{}}
+	if seq < 0 || seq >= p.seq {
+		return res, p.wake
+	}
+	n := p.seq - seq
+	if n > int64(len(p.recent)) {
+		n = int64(len(p.recent))
+		res.Missed = true
+	}
+	res.BlobRefs = append(res.BlobRefs, p.recent[int64(len(p.recent))-n:]...)
+	return res, p.wake
+}
+
+func (p *publisher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.Allowed(req, auth.ScopeRead) {
+		auth.SendDenied(rw, req)
+		return
+	}
+	if req.Method != "GET" {
+		httputil.BadRequestError(rw, "Inappropriate method.")
+		return
+	}
+	seq := int64(-1)
+	if s := req.FormValue("since"); s != "" {
+		var err os.Error
+		if seq, err = strconv.Atoi64(s); err != nil || seq < 0 {
+			httputil.BadRequestError(rw, "Invalid 'since' value.")
+			return
+		}
+	}
+	waitSeconds := 0
+	if s := req.FormValue("maxwaitsec"); s != "" {
+		waitSeconds, _ = strconv.Atoi(s)
+		if waitSeconds > maxPollSeconds {
+			waitSeconds = maxPollSeconds
+		}
+	}
+
+	res, wake := p.since(seq)
+	if seq >= 0 && len(res.BlobRefs) == 0 && waitSeconds > 0 {
+		timer := time.NewTimer(int64(waitSeconds) * 1e9)
+		defer timer.Stop()
+		select {
+		case <-wake:
+			res, _ = p.since(seq)
+		case <-timer.C:
+		}
+	}
+	httputil.ReturnJson(rw, res)
+}
+
+// httpHub is a hub also notified of the blobs published by another
+// server's "blobhub" handler.
+type httpHub struct {
+	*remoteHub
+	url, password string
+	pollSeconds   int
+	client        *http.Client
+}
+
+func newHTTPHubFromConfig(_ blobserver.Storage, conf jsonconfig.Obj) (blobserver.BlobHub, os.Error) {
+	url := conf.RequiredString("url")
+	password := conf.OptionalString("password", "")
+	pollSeconds := conf.OptionalInt("pollSeconds", defaultPollSeconds)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	h := newHTTPHub(url, password, pollSeconds)
+	go h.subscribe()
+	return h, nil
+}
+
+func newHTTPHub(url, password string, pollSeconds int) *httpHub {
+	return &httpHub{
+		remoteHub:   newRemoteHub(),
+		url:         url,
+		password:    password,
+		pollSeconds: pollSeconds,
+		client:      http.DefaultClient,
+	}
+}
+
+func (h *httpHub) poll(since int64) (*pollResponse, os.Error) {
+	url := h.url
+	if since >= 0 {
+		url = fmt.Sprintf("%s?since=%d&maxwaitsec=%d", h.url, since, h.pollSeconds)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.password != "" {
+		req.SetBasicAuth("username", h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("blobhub: %s returned %s", h.url, resp.Status)
+	}
+	res := new(pollResponse)
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, fmt.Errorf("blobhub: bad response from %s: %v", h.url, err)
+	}
+	return res, nil
+}
+
+// subscribe polls the publisher forever, starting from its current
+// seq: blobs published before then aren't interesting to anyone
+// waiting on this hub.
+func (h *httpHub) subscribe() {
+	since := int64(-1)
+	for {
+		res, err := h.poll(since)
+		if err != nil {
+			log.Printf("blobhub: polling %s: %v", h.url, err)
+			time.Sleep(retryDelay)
+			continue
+		}
+		if res.Missed {
+			log.Printf("blobhub: fell behind %s; some blob notifications missed", h.url)
+		}
+		if since >= 0 && res.Seq < since {
+			// The publisher restarted. Whatever it
+			// published since is lost.
+			log.Printf("blobhub: %s restarted; some blob notifications may be missed", h.url)
+		}
+		for _, s := range res.BlobRefs {
+			if br := blobref.Parse(s); br != nil {
+				h.notifyRemote(br)
+			}
+		}
+		since = res.Seq
+	}
+	panic("unreachable")
+}
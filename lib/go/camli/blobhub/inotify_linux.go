@@ -0,0 +1,147 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobhub
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/inotify"
+	"path/filepath"
+	"strings"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/jsonconfig"
+)
+
+func init() {
+	blobserver.RegisterBlobHubConstructor("inotify", newInotifyHubFromConfig)
+}
+
+// watchEvents are the events that may mean a blob file or blob
+// directory appeared. localdisk renames finished files into place;
+// other writers may create them directly.
+const watchEvents = inotify.IN_CREATE | inotify.IN_MOVED_TO | inotify.IN_CLOSE_WRITE
+
+// inotifyHub is a hub also notified of blob files appearing under a
+// localdisk root.
+type inotifyHub struct {
+	*remoteHub
+	root string
+	w    *inotify.Watcher
+}
+
+func newInotifyHubFromConfig(sto blobserver.Storage, conf jsonconfig.Obj) (blobserver.BlobHub, os.Error) {
+	root := conf.OptionalString("path", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if root == "" {
+		ds, ok := sto.(*localdisk.DiskStorage)
+		if !ok {
+			return nil, fmt.Errorf("inotify blobHub needs a \"path\" for storage type %T", sto)
+		}
+		root = ds.PartitionRoot("")
+	}
+	return newInotifyHub(root)
+}
+
+func newInotifyHub(root string) (*inotifyHub, os.Error) {
+	w, err := inotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	h := &inotifyHub{
+		remoteHub: newRemoteHub(),
+		root:      root,
+		w:         w,
+	}
+	if err := h.watchTree(root, false); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go h.run()
+	return h, nil
+}
+
+// watchTree watches dir and its subdirectories, other than queue
+// partitions, which are separate storages. If notifyExisting is set,
+// the blobs already in them are notified, as they may have been
+// written before the watch started.
+func (h *inotifyHub) watchTree(dir string, notifyExisting bool) os.Error {
+	if dir == filepath.Join(h.root, "partition") {
+		return nil
+	}
+	if err := h.w.AddWatch(dir, watchEvents); err != nil {
+		return fmt.Errorf("blobhub: watching %s: %v", dir, err)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name)
+		switch {
+		case fi.IsDirectory():
+			if err := h.watchTree(path, notifyExisting); err != nil {
+				return err
+			}
+		case fi.IsRegular() && notifyExisting:
+			h.notifyFile(path)
+		}
+	}
+	return nil
+}
+
+func (h *inotifyHub) notifyFile(path string) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, ".dat") {
+		// Such as a localdisk temp file.
+		return
+	}
+	if br := blobref.Parse(name[:len(name)-len(".dat")]); br != nil {
+		h.notifyRemote(br)
+	}
+}
+
+func (h *inotifyHub) run() {
+	for {
+		select {
+		case ev := <-h.w.Event:
+			switch {
+			case ev.Mask&inotify.IN_ISDIR != 0:
+				if ev.Mask&(inotify.IN_CREATE|inotify.IN_MOVED_TO) != 0 {
+					if err := h.watchTree(ev.Name, true); err != nil {
+						log.Printf("%v", err)
+					}
+				}
+			case ev.Mask&(inotify.IN_MOVED_TO|inotify.IN_CLOSE_WRITE) != 0:
+				h.notifyFile(ev.Name)
+			}
+		case err := <-h.w.Error:
+			log.Printf("blobhub: inotify error watching %s: %v", h.root, err)
+		}
+	}
+	panic("unreachable")
+}
@@ -18,6 +18,7 @@ package blobref
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -25,12 +26,60 @@ import (
 	"regexp"
 )
 
-var kBlobRefPattern *regexp.Regexp = regexp.MustCompile(`^([a-z0-9]+)-([a-f0-9]+)$`)
+// Pattern is the unanchored regular expression source matching a
+// blobref, with the hash name and digest as its two submatches.
+const Pattern = `([a-z0-9]+)-([a-f0-9]+)`
 
-var supportedDigests = map[string]func() hash.Hash{
-	"sha1": func() hash.Hash {
-		return sha1.New()
-	},
+var kBlobRefPattern *regexp.Regexp = regexp.MustCompile("^" + Pattern + "$")
+
+// hashType is a registered hash function.
+type hashType struct {
+	digestSize int              // in hex digits
+	newHash    func() hash.Hash // nil if only recognized, not supported
+}
+
+var hashTypes = make(map[string]hashType)
+
+// RegisterHash registers a hash function usable in blobrefs as
+// "<name>-<hex digest>". digestSize is the length of the digest in hex
+// digits. If newHash is nil, blobrefs of that name are validated but
+// not supported. It should be called from an init function.
+func RegisterHash(name string, digestSize int, newHash func() hash.Hash) {
+	if !kBlobRefPattern.MatchString(name + "-0") {
+		panic("blobref: invalid hash name " + name)
+	}
+	if _, dup := hashTypes[name]; dup {
+		panic("blobref: hash " + name + " already registered")
+	}
+	hashTypes[name] = hashType{digestSize, newHash}
+}
+
+func init() {
+	RegisterHash("sha1", 40, func() hash.Hash { return sha1.New() })
+	RegisterHash("sha256", 64, func() hash.Hash { return sha256.New() })
+	RegisterHash("md5", 32, nil)
+}
+
+var preferredHash = "sha1"
+
+// PreferredHash returns the name of the hash used for new blobs.
+func PreferredHash() string {
+	return preferredHash
+}
+
+// SetPreferredHash sets the hash used for new blobs by NewHash,
+// FromPreferredHash and FromString. The default is "sha1".
+func SetPreferredHash(name string) os.Error {
+	if ht, ok := hashTypes[name]; !ok || ht.newHash == nil {
+		return fmt.Errorf("blobref: unsupported hash %q", name)
+	}
+	preferredHash = name
+	return nil
+}
+
+// NewHash returns a new hash.Hash of the preferred hash function.
+func NewHash() hash.Hash {
+	return hashTypes[preferredHash].newHash()
 }
 
 // BlobRef is an immutable reference to a blob.
@@ -82,12 +131,14 @@ func (o *BlobRef) Equals(other *BlobRef) bool {
 	return o.hashName == other.hashName && o.digest == other.digest
 }
 
+// Hash returns a new hash.Hash of o's hash function, or nil if it's
+// not supported.
 func (o *BlobRef) Hash() hash.Hash {
-	fn, ok := supportedDigests[o.hashName]
-	if !ok {
+	ht, ok := hashTypes[o.hashName]
+	if !ok || ht.newHash == nil {
 		return nil // TODO: return an error here, not nil
 	}
-	return fn()
+	return ht.newHash()
 }
 
 func (o *BlobRef) HashMatches(h hash.Hash) bool {
@@ -95,8 +146,8 @@ func (o *BlobRef) HashMatches(h hash.Hash) bool {
 }
 
 func (o *BlobRef) IsSupported() bool {
-	_, ok := supportedDigests[o.hashName]
-	return ok
+	ht, ok := hashTypes[o.hashName]
+	return ok && ht.newHash != nil
 }
 
 func (o *BlobRef) Sum32() uint32 {
@@ -111,11 +162,6 @@ func (o *BlobRef) Sum32() uint32 {
 	return h32
 }
 
-var kExpectedDigestSize = map[string]int{
-	"md5":  32,
-	"sha1": 40,
-}
-
 func newBlob(hashName, digest string) *BlobRef {
 	strValue := fmt.Sprintf("%s-%s", hashName, digest)
 	return &BlobRef{strValue[0:len(hashName)],
@@ -124,8 +170,8 @@ func newBlob(hashName, digest string) *BlobRef {
 }
 
 func blobIfValid(hashname, digest string) *BlobRef {
-	expectedSize := kExpectedDigestSize[hashname]
-	if expectedSize != 0 && len(digest) != expectedSize {
+	ht, ok := hashTypes[hashname]
+	if ok && len(digest) != ht.digestSize {
 		return nil
 	}
 	return newBlob(hashname, digest)
@@ -135,6 +181,19 @@ func FromHash(hashfunc string, h hash.Hash) *BlobRef {
 	return newBlob(hashfunc, fmt.Sprintf("%x", h.Sum()))
 }
 
+// FromPreferredHash returns the blobref of h, a hash.Hash returned by
+// NewHash.
+func FromPreferredHash(h hash.Hash) *BlobRef {
+	return FromHash(preferredHash, h)
+}
+
+// FromString returns the blobref of s using the preferred hash.
+func FromString(s string) *BlobRef {
+	h := NewHash()
+	h.Write([]byte(s))
+	return FromPreferredHash(h)
+}
+
 func Sha1FromString(s string) *BlobRef {
 	s1 := sha1.New()
 	s1.Write([]byte(s))
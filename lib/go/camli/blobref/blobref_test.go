@@ -97,3 +97,34 @@ func TestJsonMarshal(t *testing.T) {
 		t.Errorf("got %q, want %q", g, e)
 	}
 }
+
+func TestSha256(t *testing.T) {
+	refStr := "sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	br := Parse(refStr)
+	Assert(t, br != nil, "parsed sha256 blobref")
+	ExpectString(t, "sha256", br.HashName(), "hash name")
+	Expect(t, br.IsSupported(), "sha256 should be supported")
+
+	hash := br.Hash()
+	hash.Write([]byte("foo"))
+	Expect(t, br.HashMatches(hash), "hash of bytes 'foo' matches")
+}
+
+func TestDigestSize(t *testing.T) {
+	Expect(t, Parse("sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a3") == nil, "short sha1 rejected")
+	Expect(t, Parse("sha256-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33") == nil, "short sha256 rejected")
+	br := Parse("md5-acbd18db4cc2f85cedef654fccc4a4d8")
+	Assert(t, br != nil, "parsed md5 blobref")
+	Expect(t, !br.IsSupported(), "md5 recognized but not supported")
+}
+
+func TestPreferredHash(t *testing.T) {
+	defer SetPreferredHash(PreferredHash())
+	ExpectString(t, "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", FromString("foo").String(), "default hash")
+	AssertNil(t, SetPreferredHash("sha256"), "SetPreferredHash(sha256)")
+	ExpectString(t, "sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		FromString("foo").String(), "preferred sha256")
+	Expect(t, SetPreferredHash("md5") != nil, "md5 can't be preferred")
+	Expect(t, SetPreferredHash("unknownfunc") != nil, "unknown hash can't be preferred")
+	ExpectString(t, "sha256", PreferredHash(), "preferred hash after errors")
+}
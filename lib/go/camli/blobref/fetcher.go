@@ -151,12 +151,18 @@ type MemoryStore struct {
 }
 
 func (s *MemoryStore) AddBlob(hashtype crypto.Hash, data string) (*BlobRef, os.Error) {
-	if hashtype != crypto.SHA1 {
+	var hashName string
+	switch hashtype {
+	case crypto.SHA1:
+		hashName = "sha1"
+	case crypto.SHA256:
+		hashName = "sha256"
+	default:
 		return nil, os.NewError("blobref: unsupported hash type")
 	}
 	hash := hashtype.New()
 	hash.Write([]byte(data))
-	bstr := fmt.Sprintf("sha1-%x", hash.Sum())
+	bstr := fmt.Sprintf("%s-%x", hashName, hash.Sum())
 	s.lk.Lock()
 	defer s.lk.Unlock()
 	if s.m == nil {
@@ -0,0 +1,68 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"camli/blobref"
+)
+
+// FetchMulti fetches blobs from fetcher as described by
+// BatchFetcher.FetchMulti, in one round trip if fetcher is a
+// BatchFetcher and with FetchStreaming otherwise.
+func FetchMulti(fetcher blobref.StreamingFetcher, blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error {
+	if bf, ok := fetcher.(BatchFetcher); ok {
+		return bf.FetchMulti(blobs, fn)
+	}
+	for _, br := range blobs {
+		rc, size, err := fetcher.FetchStreaming(br)
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(blobref.SizedBlobRef{br, size}, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReceiveBlobs sends blobs to sto as described by
+// BatchReceiver.ReceiveBlobs, in one round trip if sto is a
+// BatchReceiver and with ReceiveBlob otherwise.
+func ReceiveBlobs(sto BlobReceiver, blobs []blobref.SizedBlobRef, contents []io.Reader) os.Error {
+	if br, ok := sto.(BatchReceiver); ok {
+		return br.ReceiveBlobs(blobs, contents)
+	}
+	for i, sb := range blobs {
+		got, err := sto.ReceiveBlob(sb.BlobRef, contents[i])
+		if err != nil {
+			return err
+		}
+		if got.Size != sb.Size {
+			return fmt.Errorf("received %d bytes of %s; expected %d", got.Size, sb.BlobRef, sb.Size)
+		}
+	}
+	return nil
+}
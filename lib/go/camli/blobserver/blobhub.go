@@ -119,6 +119,15 @@ func (h *SimpleBlobHub) UnregisterBlobListener(blob *blobref.BlobRef, ch chan *b
 	}
 }
 
+// BlobHubSetter is implemented by storages whose blob hub can be
+// replaced, such as by one created from the server config with
+// CreateBlobHub.
+type BlobHubSetter interface {
+	// SetBlobHub sets the storage's hub. It must be called before
+	// the hub is first used.
+	SetBlobHub(hub BlobHub)
+}
+
 type SimpleBlobHubPartitionMap struct {
 	hubLock sync.Mutex
 	hub     BlobHub
@@ -128,11 +137,14 @@ func (spm *SimpleBlobHubPartitionMap) GetBlobHub() BlobHub {
 	spm.hubLock.Lock()
 	defer spm.hubLock.Unlock()
 	if spm.hub == nil {
-		// TODO: in the future, allow for different blob hub
-		// implementations rather than the
-		// everything-in-memory-on-a-single-machine SimpleBlobHub.
 		spm.hub = new(SimpleBlobHub)
 	}
 	return spm.hub
 }
 
+func (spm *SimpleBlobHubPartitionMap) SetBlobHub(hub BlobHub) {
+	spm.hubLock.Lock()
+	defer spm.hubLock.Unlock()
+	spm.hub = hub
+}
+
@@ -0,0 +1,311 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package cache registers the "cache" blobserver storage type, which
+keeps a local copy of recently used blobs from a slower origin
+storage, such as S3 or a remote server.
+
+Fetches are served from the cache when possible and fill it
+otherwise. Uploads go to the origin and, on the way, to the cache.
+When the cached blobs total more than maxCacheBytes, the least
+recently used ones are removed from the cache (never from the
+origin).
+
+Example low-level config:
+
+     "/cached-s3/": {
+         "handler": "storage-cache",
+         "handlerArgs": {
+            "origin": "/s3/",
+            "cache": "/localcache/",
+            "maxCacheBytes": 1073741824
+          }
+     },
+*/
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+type cacheStorage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	origin, cache blobserver.Storage
+	maxSize       int64
+
+	mu   sync.Mutex // guards following
+	m    map[string]*list.Element
+	lru  *list.List // of blobref.SizedBlobRef; front is most recently used
+	size int64      // sum of cached blob sizes
+
+	stats cacheStats
+}
+
+type cacheStats struct {
+	hits, misses int64 // fetches
+	fills        int64 // blobs added to the cache on a miss or upload
+	evictions    int64
+	evictedBytes int64
+	errors       int64 // failures filling or evicting; not fatal
+	lastError    os.Error
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
+	originPrefix := config.RequiredString("origin")
+	cachePrefix := config.RequiredString("cache")
+	maxSize := config.RequiredInt("maxCacheBytes")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("cache: maxCacheBytes must be positive, not %d", maxSize)
+	}
+	origin, err := ld.GetStorage(originPrefix)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := ld.GetStorage(cachePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return newCacheStorage(origin, cache, int64(maxSize))
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("cache", blobserver.StorageConstructor(newFromConfig))
+}
+
+// newCacheStorage returns a cache over origin, accounting for the
+// blobs already in cache.
+func newCacheStorage(origin, cache blobserver.Storage, maxSize int64) (*cacheStorage, os.Error) {
+	sto := &cacheStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		origin:                    origin,
+		cache:                     cache,
+		maxSize:                   maxSize,
+		m:                         make(map[string]*list.Element),
+		lru:                       list.New(),
+	}
+	err := blobserver.EnumerateAll(cache, func(sb blobref.SizedBlobRef) os.Error {
+		sto.mu.Lock()
+		defer sto.mu.Unlock()
+		sto.m[sb.BlobRef.String()] = sto.lru.PushBack(sb)
+		sto.size += sb.Size
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cache: enumerating existing cache: %v", err)
+	}
+	sto.evict()
+	return sto, nil
+}
+
+func (sto *cacheStorage) addError(err os.Error) {
+	log.Printf("cache: %v", err)
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	sto.stats.errors++
+	sto.stats.lastError = err
+}
+
+// touch marks b as recently used, returning whether it's tracked as
+// cached.
+func (sto *cacheStorage) touch(b *blobref.BlobRef) bool {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	ele, ok := sto.m[b.String()]
+	if ok {
+		sto.lru.MoveToFront(ele)
+	}
+	return ok
+}
+
+// added records that sb was put in the cache, and evicts older blobs
+// if that puts it over budget.
+func (sto *cacheStorage) added(sb blobref.SizedBlobRef) {
+	sto.mu.Lock()
+	key := sb.BlobRef.String()
+	if ele, ok := sto.m[key]; ok {
+		sto.lru.MoveToFront(ele)
+	} else {
+		sto.m[key] = sto.lru.PushFront(sb)
+		sto.size += sb.Size
+		sto.stats.fills++
+	}
+	sto.mu.Unlock()
+	sto.evict()
+}
+
+// evict removes least recently used blobs from the cache until it's
+// within budget. A blob larger than the whole budget is evicted too.
+func (sto *cacheStorage) evict() {
+	var victims []*blobref.BlobRef
+	sto.mu.Lock()
+	for sto.size > sto.maxSize {
+		ele := sto.lru.Back()
+		sb := ele.Value.(blobref.SizedBlobRef)
+		sto.lru.Remove(ele)
+		sto.m[sb.BlobRef.String()] = nil, false
+		sto.size -= sb.Size
+		sto.stats.evictions++
+		sto.stats.evictedBytes += sb.Size
+		victims = append(victims, sb.BlobRef)
+	}
+	sto.mu.Unlock()
+	if len(victims) == 0 {
+		return
+	}
+	if err := sto.cache.Remove(victims); err != nil {
+		sto.addError(fmt.Errorf("evicting %d blobs: %v", len(victims), err))
+	}
+}
+
+// forget stops tracking blobs, after they've been removed from the
+// cache.
+func (sto *cacheStorage) forget(blobs []*blobref.BlobRef) {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	for _, b := range blobs {
+		key := b.String()
+		if ele, ok := sto.m[key]; ok {
+			sto.lru.Remove(ele)
+			sto.m[key] = nil, false
+			sto.size -= ele.Value.(blobref.SizedBlobRef).Size
+		}
+	}
+}
+
+func (sto *cacheStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
+	if sto.touch(b) {
+		file, size, err = sto.cache.FetchStreaming(b)
+		if err == nil {
+			sto.mu.Lock()
+			sto.stats.hits++
+			sto.mu.Unlock()
+			return
+		}
+		// Removed from the cache behind our back.
+		sto.forget([]*blobref.BlobRef{b})
+	}
+	sto.mu.Lock()
+	sto.stats.misses++
+	sto.mu.Unlock()
+
+	file, size, err = sto.origin.FetchStreaming(b)
+	if err != nil || size > sto.maxSize {
+		return
+	}
+	sb, err := sto.cache.ReceiveBlob(b, file)
+	file.Close()
+	if err != nil {
+		sto.addError(fmt.Errorf("filling %s: %v", b, err))
+		return sto.origin.FetchStreaming(b)
+	}
+	sto.added(sb)
+	file, size, err = sto.cache.FetchStreaming(b)
+	if err != nil {
+		// Maybe evicted already by concurrent fills.
+		return sto.origin.FetchStreaming(b)
+	}
+	return
+}
+
+func (sto *cacheStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	// Write to the origin, teeing to the cache as we go.
+	pr, pw := io.Pipe()
+	cachec := make(chan cacheResult, 1)
+	go func() {
+		sb, err := sto.cache.ReceiveBlob(b, pr)
+		// Unblock the tee if the cache gave up early.
+		io.Copy(ioutil.Discard, pr)
+		cachec <- cacheResult{sb, err}
+	}()
+	sb, err = sto.origin.ReceiveBlob(b, io.TeeReader(source, pw))
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	cr := <-cachec
+	if err != nil {
+		if cr.err == nil {
+			// Don't keep a cached copy of a blob the
+			// origin doesn't have.
+			sto.cache.Remove([]*blobref.BlobRef{b})
+		}
+		return
+	}
+	if cr.err != nil {
+		sto.addError(fmt.Errorf("write-through of %s: %v", b, cr.err))
+	} else {
+		sto.added(cr.sb)
+	}
+	sto.GetBlobHub().NotifyBlobReceived(b)
+	return sb, nil
+}
+
+type cacheResult struct {
+	sb  blobref.SizedBlobRef
+	err os.Error
+}
+
+func (sto *cacheStorage) Remove(blobs []*blobref.BlobRef) os.Error {
+	if err := sto.origin.Remove(blobs); err != nil {
+		return err
+	}
+	err := sto.cache.Remove(blobs)
+	sto.forget(blobs)
+	return err
+}
+
+func (sto *cacheStorage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	// Answer what we can from the cache, and ask the origin
+	// about the rest.
+	var found []blobref.SizedBlobRef
+	var need []*blobref.BlobRef
+	sto.mu.Lock()
+	for _, b := range blobs {
+		if ele, ok := sto.m[b.String()]; ok {
+			found = append(found, ele.Value.(blobref.SizedBlobRef))
+		} else {
+			need = append(need, b)
+		}
+	}
+	sto.mu.Unlock()
+	for _, sb := range found {
+		dest <- sb
+	}
+	if len(need) == 0 {
+		return nil
+	}
+	return sto.origin.Stat(dest, need, waitSeconds)
+}
+
+func (sto *cacheStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return sto.origin.EnumerateBlobs(dest, after, limit, waitSeconds)
+}
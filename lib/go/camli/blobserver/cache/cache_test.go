@@ -0,0 +1,109 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func fetch(t *testing.T, sto *cacheStorage, tb *test.Blob) {
+	rc, _, err := sto.FetchStreaming(tb.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	ExpectString(t, tb.Contents, string(data), "fetched contents")
+}
+
+func TestReadThrough(t *testing.T) {
+	origin, cache := memory.New(0), memory.New(0)
+	sto, err := newCacheStorage(origin, cache, 25)
+	AssertNil(t, err, "newCacheStorage")
+
+	a := &test.Blob{strings.Repeat("a", 10)}
+	b := &test.Blob{strings.Repeat("b", 10)}
+	c := &test.Blob{strings.Repeat("c", 10)}
+	for _, tb := range []*test.Blob{a, b, c} {
+		_, err := origin.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob to origin")
+	}
+
+	fetch(t, sto, a)
+	fetch(t, sto, a)
+	fetch(t, sto, b)
+	ExpectInt(t, 2, cache.NumBlobs(), "cached blobs")
+	ExpectInt(t, 1, int(sto.stats.hits), "hits")
+	ExpectInt(t, 2, int(sto.stats.misses), "misses")
+
+	// a is now older than b, and goes when c comes in.
+	fetch(t, sto, c)
+	ExpectInt(t, 2, cache.NumBlobs(), "cached blobs after eviction")
+	ExpectInt(t, 1, int(sto.stats.evictions), "evictions")
+	_, _, err = cache.FetchStreaming(a.BlobRef())
+	Expect(t, err != nil, "least recently used blob evicted")
+	ExpectInt(t, 3, origin.NumBlobs(), "origin untouched by eviction")
+
+	fetch(t, sto, a)
+	ExpectInt(t, 4, int(sto.stats.misses), "misses after refetch")
+}
+
+func TestWriteThrough(t *testing.T) {
+	origin, cache := memory.New(0), memory.New(0)
+	sto, err := newCacheStorage(origin, cache, 1<<20)
+	AssertNil(t, err, "newCacheStorage")
+
+	tb := &test.Blob{"write me"}
+	sb, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	tb.AssertMatches(t, &sb)
+	ExpectInt(t, 1, origin.NumBlobs(), "blobs on origin")
+	ExpectInt(t, 1, cache.NumBlobs(), "blobs in cache")
+
+	fetch(t, sto, tb)
+	ExpectInt(t, 1, int(sto.stats.hits), "hits")
+	ExpectInt(t, 0, int(sto.stats.misses), "misses")
+}
+
+func TestExistingCache(t *testing.T) {
+	origin, cache := memory.New(0), memory.New(0)
+	for _, s := range []string{"one", "two", "three"} {
+		tb := &test.Blob{s}
+		_, err := cache.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob to cache")
+	}
+	sto, err := newCacheStorage(origin, cache, 8)
+	AssertNil(t, err, "newCacheStorage")
+	Expect(t, sto.size <= 8, "existing cache trimmed to budget")
+	ExpectInt(t, len(sto.m), cache.NumBlobs(), "tracked blobs match cache")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto, err := newCacheStorage(memory.New(0), memory.New(0), 1<<20)
+			AssertNil(t, err, "newCacheStorage")
+			return sto, nil
+		},
+	})
+}
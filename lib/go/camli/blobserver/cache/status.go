@@ -0,0 +1,91 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"html"
+	"http"
+	"os"
+
+	"camli/auth"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+// statusHandler serves the hit/miss statistics of a cache storage.
+// Example config:
+//
+//     "/cache-status/": {
+//         "handler": "cache-status",
+//         "handlerArgs": {
+//            "cache": "/cached-s3/"
+//          }
+//     },
+type statusHandler struct {
+	name string
+	sto  *cacheStorage
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("cache-status", newStatusFromConfig)
+}
+
+func newStatusFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Handler, err os.Error) {
+	name := conf.RequiredString("cache")
+	if err = conf.Validate(); err != nil {
+		return
+	}
+	bs, err := ld.GetStorage(name)
+	if err != nil {
+		return
+	}
+	sto, ok := bs.(*cacheStorage)
+	if !ok {
+		return nil, fmt.Errorf("cache-status: prefix %s (type %T) isn't a cache storage", name, bs)
+	}
+	return &statusHandler{name, sto}, nil
+}
+
+func (h *statusHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.IsAuthorized(req) {
+		auth.SendDenied(rw, req)
+		return
+	}
+	sto := h.sto
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	st := &sto.stats
+
+	fmt.Fprintf(rw, "<h1>%s Cache Status</h1>", h.name)
+	fmt.Fprintf(rw, "<h2>Stats:</h2><ul>")
+	fmt.Fprintf(rw, "<li>Cached blobs: %d</li>", len(sto.m))
+	fmt.Fprintf(rw, "<li>Cached bytes: %d of %d</li>", sto.size, sto.maxSize)
+	fmt.Fprintf(rw, "<li>Hits: %d</li>", st.hits)
+	fmt.Fprintf(rw, "<li>Misses: %d</li>", st.misses)
+	if total := st.hits + st.misses; total > 0 {
+		fmt.Fprintf(rw, "<li>Hit rate: %.1f%%</li>", 100*float64(st.hits)/float64(total))
+	}
+	fmt.Fprintf(rw, "<li>Fills: %d</li>", st.fills)
+	fmt.Fprintf(rw, "<li>Evictions: %d blobs, %d bytes</li>", st.evictions, st.evictedBytes)
+	fmt.Fprintf(rw, "<li>Errors: %d</li>", st.errors)
+	fmt.Fprintf(rw, "</ul>")
+
+	if st.lastError != nil {
+		fmt.Fprintf(rw, "<h2>Last Error:</h2><p>%s</p>", html.EscapeString(st.lastError.String()))
+	}
+}
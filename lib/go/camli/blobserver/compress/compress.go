@@ -0,0 +1,305 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package compress registers the "compress" blobserver storage type,
+which compresses blobs before storing them in another storage.
+
+Each blob is stored in the backend as a new blob which starts with a
+one line header naming the codec and the original blobref and size:
+
+   "camli-compressed " <codec> " " <blobref> " " <size> "\n"
+
+followed by the encoded blob. Blobs which are already compressed
+(according to package magic) or which don't shrink are stored with
+the "none" codec.
+
+The mapping from original to stored blobrefs is kept in memory and
+logged to the optional local indexFile. If the index file is missing
+or its last write was cut short, the mapping is rebuilt at startup by
+reading the header of each blob in the backend. Without an indexFile
+that happens at every startup.
+
+Example low-level config:
+
+     "/compressed/": {
+         "handler": "storage-compress",
+         "handlerArgs": {
+            "backend": "/bigdisk/",
+            "level": 6,
+            "indexFile": "/var/camlistore/compress.index"
+          }
+     },
+*/
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+	"camli/magic"
+)
+
+const headerMagic = "camli-compressed "
+
+// maxHeaderLen bounds the header line, to avoid reading all of a
+// blob which isn't ours while rebuilding the index.
+const maxHeaderLen = 512
+
+// A codec decodes blobs stored with its name in the header.
+type codec func(r io.Reader) io.ReadCloser
+
+var codecs = map[string]codec{
+	"none":  func(r io.Reader) io.ReadCloser { return nopCloser{r} },
+	"flate": flate.NewReader,
+}
+
+// alreadyCompressed are MIME types not worth compressing again.
+var alreadyCompressed = map[string]bool{
+	"image/jpeg":          true,
+	"image/png":           true,
+	"image/gif":           true,
+	"application/x-gzip":  true,
+	"application/x-bzip2": true,
+	"application/zip":     true,
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() os.Error { return nil }
+
+type mapping struct {
+	stored *blobref.BlobRef // blobref in the backend
+	size   int64            // original size
+}
+
+type storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	backend   blobserver.Storage
+	level     int
+	indexPath string // or empty
+
+	index blobserver.SortedIndex // original blobref to *mapping
+
+	mu         sync.Mutex // guards following, and changes to index
+	indexLog   *os.File   // or nil
+	rebuilding bool       // whether rebuildIndex is writing indexLog
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	backendPrefix := config.RequiredString("backend")
+	level := config.OptionalInt("level", flate.DefaultCompression)
+	indexPath := config.OptionalString("indexFile", "")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return nil, fmt.Errorf("compress: invalid level %d", level)
+	}
+	backend, err := ld.GetStorage(backendPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(backend, level, indexPath)
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("compress", blobserver.StorageConstructor(newFromConfig))
+}
+
+func newStorage(backend blobserver.Storage, level int, indexPath string) (*storage, os.Error) {
+	sto := &storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		backend:                   backend,
+		level:                     level,
+		indexPath:                 indexPath,
+	}
+	if err := sto.openIndex(); err != nil {
+		return nil, err
+	}
+	return sto, nil
+}
+
+// readHeader parses the header line of a stored blob.
+func readHeader(r *bufio.Reader) (codecName string, br *blobref.BlobRef, size int64, err os.Error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || !bytes.HasPrefix(line, []byte(headerMagic)) {
+		err = os.NewError("compress: not a compressed blob")
+		return
+	}
+	fields := strings.Fields(string(line[len(headerMagic):]))
+	if len(fields) != 3 {
+		err = fmt.Errorf("compress: bad header %q", line)
+		return
+	}
+	codecName = fields[0]
+	br = blobref.Parse(fields[1])
+	size, serr := strconv.Atoi64(fields[2])
+	if br == nil || serr != nil || size < 0 {
+		err = fmt.Errorf("compress: bad header %q", line)
+		return
+	}
+	if _, ok := codecs[codecName]; !ok {
+		err = fmt.Errorf("compress: unknown codec %q", codecName)
+	}
+	return
+}
+
+func (sto *storage) lookup(br *blobref.BlobRef) (m *mapping, ok bool) {
+	_, v, ok := sto.index.Get(br.String())
+	if !ok {
+		return nil, false
+	}
+	return v.(*mapping), true
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() (err os.Error) {
+	for _, c := range rc.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+func (sto *storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	m, ok := sto.lookup(br)
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	rc, _, err := sto.backend.FetchStreaming(m.stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, _ := bufio.NewReaderSize(rc, maxHeaderLen)
+	codecName, storedRef, _, err := readHeader(r)
+	if err != nil {
+		rc.Close()
+		return nil, 0, err
+	}
+	if storedRef.String() != br.String() {
+		rc.Close()
+		return nil, 0, fmt.Errorf("compress: backend blob %s holds %s, not %s", m.stored, storedRef, br)
+	}
+	dec := codecs[codecName](r)
+	return &readCloser{io.LimitReader(dec, m.size), []io.Closer{dec, rc}}, m.size, nil
+}
+
+func (sto *storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	hash := br.Hash()
+	if hash == nil {
+		err = fmt.Errorf("compress: unsupported blobref hash type of %q", br.String())
+		return
+	}
+	var raw bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &raw), source)
+	if err != nil {
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	if m, ok := sto.lookup(br); ok {
+		return blobref.SizedBlobRef{br, m.size}, nil
+	}
+
+	codecName, body := sto.encode(raw.Bytes())
+	var stored bytes.Buffer
+	fmt.Fprintf(&stored, "%s%s %s %d\n", headerMagic, codecName, br, size)
+	stored.Write(body)
+	storedHash := sha1.New()
+	storedHash.Write(stored.Bytes())
+	storedRef := blobref.FromHash("sha1", storedHash)
+	if _, err = sto.backend.ReceiveBlob(storedRef, &stored); err != nil {
+		return
+	}
+
+	sto.mu.Lock()
+	err = sto.setMapping(br.String(), &mapping{storedRef, size})
+	sto.mu.Unlock()
+	if err != nil {
+		return
+	}
+	sto.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{br, size}, nil
+}
+
+// encode returns the codec name and encoded form of data.
+func (sto *storage) encode(data []byte) (string, []byte) {
+	if alreadyCompressed[magic.MimeType(data)] {
+		return "none", data
+	}
+	var buf bytes.Buffer
+	w := flate.NewWriter(&buf, sto.level)
+	w.Write(data)
+	if err := w.Close(); err != nil || buf.Len() >= len(data) {
+		return "none", data
+	}
+	return "flate", buf.Bytes()
+}
+
+func (sto *storage) Remove(blobs []*blobref.BlobRef) os.Error {
+	var stored []*blobref.BlobRef
+	var keys []string
+	for _, br := range blobs {
+		if m, ok := sto.lookup(br); ok {
+			stored = append(stored, m.stored)
+			keys = append(keys, br.String())
+		}
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	if err := sto.backend.Remove(stored); err != nil {
+		return err
+	}
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	for _, key := range keys {
+		if err := sto.setMapping(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sto *storage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return blobserver.StatFromIndex(&sto.index, sto.GetBlobHub(), dest, blobs, waitSeconds)
+}
+
+func (sto *storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return blobserver.EnumerateFromIndex(&sto.index, sto.GetBlobHub(), dest, after, limit, waitSeconds)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+// storedBlob returns the single blob in backend.
+func storedBlob(t *testing.T, backend blobserver.Storage) []byte {
+	var refs []*blobref.BlobRef
+	blobserver.EnumerateAll(backend, func(sb blobref.SizedBlobRef) os.Error {
+		refs = append(refs, sb.BlobRef)
+		return nil
+	})
+	AssertInt(t, 1, len(refs), "backend blobs")
+	rc, _, err := backend.FetchStreaming(refs[0])
+	AssertNil(t, err, "backend fetch")
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	AssertNil(t, err, "backend read")
+	return data
+}
+
+func TestCompressible(t *testing.T) {
+	backend := memory.New(0)
+	sto, err := newStorage(backend, flate.DefaultCompression, "")
+	AssertNil(t, err, "newStorage")
+	tb := &test.Blob{strings.Repeat(`{"camliVersion": 1, "camliType": "file"}`, 100)}
+	storagetest.Upload(t, sto, tb)
+	storagetest.ExpectContents(t, sto, tb)
+
+	stored := storedBlob(t, backend)
+	Expect(t, bytes.HasPrefix(stored, []byte(headerMagic+"flate ")), "stored with flate")
+	Expect(t, len(stored) < len(tb.Contents), "stored blob is smaller")
+
+	// Stat and enumerate report the original size.
+	ch := make(chan blobref.SizedBlobRef, 1)
+	AssertNil(t, sto.Stat(ch, tb.BlobRefSlice(), 0), "Stat")
+	sb := <-ch
+	tb.AssertMatches(t, &sb)
+	ech := make(chan blobref.SizedBlobRef, 1)
+	AssertNil(t, sto.EnumerateBlobs(ech, "", 10, 0), "EnumerateBlobs")
+	sb = <-ech
+	tb.AssertMatches(t, &sb)
+}
+
+func TestAlreadyCompressed(t *testing.T) {
+	backend := memory.New(0)
+	sto, err := newStorage(backend, flate.DefaultCompression, "")
+	AssertNil(t, err, "newStorage")
+	jpeg := &test.Blob{"\xff\xd8\xff\xe0" + strings.Repeat("x", 1000)}
+	storagetest.Upload(t, sto, jpeg)
+	storagetest.ExpectContents(t, sto, jpeg)
+	Expect(t, bytes.HasPrefix(storedBlob(t, backend), []byte(headerMagic+"none ")), "JPEG stored uncompressed")
+}
+
+func TestRebuild(t *testing.T) {
+	backend := memory.New(0)
+	sto, err := newStorage(backend, flate.DefaultCompression, "")
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{strings.Repeat("foo", 100)}
+	bar := &test.Blob{"bar"}
+	storagetest.Upload(t, sto, foo)
+	storagetest.Upload(t, sto, bar)
+	// A blob not written by us is skipped.
+	junk := &test.Blob{"some other blob"}
+	_, err = backend.ReceiveBlob(junk.BlobRef(), junk.Reader())
+	AssertNil(t, err, "upload junk to backend")
+
+	sto, err = newStorage(backend, flate.DefaultCompression, "")
+	AssertNil(t, err, "newStorage")
+	storagetest.ExpectContents(t, sto, foo)
+	storagetest.ExpectContents(t, sto, bar)
+	_, _, err = sto.FetchStreaming(junk.BlobRef())
+	Expect(t, err == os.ENOENT, "junk blob not found")
+
+	AssertNil(t, sto.Remove(foo.BlobRefSlice()), "Remove")
+	_, _, err = sto.FetchStreaming(foo.BlobRef())
+	Expect(t, err == os.ENOENT, "removed blob not found")
+}
+
+func TestIndexFile(t *testing.T) {
+	indexPath := fmt.Sprintf("%s/camli-compress-index-%d", os.TempDir(), os.Getpid())
+	defer os.Remove(indexPath)
+	os.Remove(indexPath)
+
+	backend := memory.New(0)
+	sto, err := newStorage(backend, flate.DefaultCompression, indexPath)
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{strings.Repeat("foo", 100)}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, sto, foo)
+	storagetest.Upload(t, sto, bar)
+	AssertNil(t, sto.Remove(foo.BlobRefSlice()), "Remove")
+
+	// Replaying the index doesn't read the backend's blobs.
+	sto, err = newStorage(memory.New(0), flate.DefaultCompression, indexPath)
+	AssertNil(t, err, "newStorage")
+	got := storagetest.EnumerateAll(t, sto)
+	ExpectInt(t, 1, len(got), "blobs from index")
+	ExpectString(t, bar.BlobRef().String(), got[0].BlobRef.String(), "blob from index")
+
+	// A torn last line makes the index be rebuilt from the backend,
+	// which also has a blob uploaded without the index.
+	f, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0600)
+	AssertNil(t, err, "opening index")
+	_, err = f.Write([]byte("put sha1-"))
+	f.Close()
+	AssertNil(t, err, "tearing index")
+	noIndex, err := newStorage(backend, flate.DefaultCompression, "")
+	AssertNil(t, err, "newStorage")
+	storagetest.Upload(t, noIndex, &test.Blob{"baz"})
+	sto, err = newStorage(backend, flate.DefaultCompression, indexPath)
+	AssertNil(t, err, "newStorage")
+	ExpectInt(t, 2, len(storagetest.EnumerateAll(t, sto)), "blobs after rebuilding torn index")
+	contents, err := ioutil.ReadFile(indexPath)
+	AssertNil(t, err, "reading rebuilt index")
+	Expect(t, strings.HasSuffix(string(contents), "\n"), "rebuilt index isn't torn")
+
+	// A corrupt line is an error, not a silent rebuild.
+	AssertNil(t, ioutil.WriteFile(indexPath, []byte("bogus\n"), 0600), "writing bad index")
+	_, err = newStorage(backend, flate.DefaultCompression, indexPath)
+	ExpectErrorContains(t, err, "bad index", "opening bad index")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto, err := newStorage(memory.New(0), flate.DefaultCompression, "")
+			AssertNil(t, err, "newStorage")
+			return sto, nil
+		},
+	})
+}
@@ -14,33 +14,67 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package cond registers the "cond" conditional blobserver storage type
+to select routing of get/put operations on blobs to other storage
+targets as a function of their content.
+
+Blobs are written to the "write" target, which is either a storage
+prefix or an object of the form
+
+     {"if": predicate, "then": target, "else": target}
+
+where the "then" and "else" targets may themselves be conditions.
+See parsePredicate for the predicates.
+
+Reads go to the "read" target, or to the first of a list of targets
+that has the blob.
+
+Example config:
+
+      "/bs-routed/": {
+          "handler": "storage-cond",
+          "handlerArgs": {
+              "write": {
+                  "if": {"and": [{"isSchema": true}, {"maxSize": 65536}]},
+                  "then": "/ssd/",
+                  "else": {
+                      "if": {"mimeType": "image/"},
+                      "then": "/photos/",
+                      "else": "/s3/"
+                  }
+              },
+              "read": ["/ssd/", "/photos/", "/s3/"]
+          }
+      },
+*/
 package cond
 
 import (
 	"bytes"
-	"fmt"
-	"json"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/jsonconfig"
-	"camli/schema"
 )
 
 var _ = log.Printf
 
 const buffered = 8
 
-type storageFunc func(src io.Reader) (dest blobserver.Storage, overRead []byte, err os.Error)
+// A storageFunc picks where to write a blob read from src. rest is
+// the whole blob, to read instead of src, and must be closed.
+type storageFunc func(src io.Reader) (dest blobserver.Storage, rest io.ReadCloser, err os.Error)
 
 type condStorage struct {
 	*blobserver.SimpleBlobHubPartitionMap
 
 	storageForReceive storageFunc
-	read              blobserver.Storage
+	read              []blobserver.Storage // tried in order
 	remove            blobserver.Storage
 }
 
@@ -54,7 +88,7 @@ func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (storage blobserve
 	}
 
 	receive := conf.OptionalStringOrObject("write")
-	read := conf.RequiredString("read")
+	read := conf.RequiredStringOrList("read")
 	remove := conf.OptionalString("remove", "")
 	if err := conf.Validate(); err != nil {
 		return nil, err
@@ -67,92 +101,164 @@ func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (storage blobserve
 		}
 	}
 
-	sto.read, err = ld.GetStorage(read)
-	if err != nil {
-                        return
-        }
+	for _, prefix := range read {
+		readSto, err := ld.GetStorage(prefix)
+		if err != nil {
+			return nil, err
+		}
+		sto.read = append(sto.read, readSto)
+	}
 
 	if remove != "" {
 		sto.remove, err = ld.GetStorage(remove)
 		if err != nil {
-                        return
+			return
 		}
 	}
 	return sto, nil
 }
 
+// A picker chooses where to write a blob, given its start.
+type picker func(pb *peekedBlob) blobserver.Storage
+
 func buildStorageForReceive(ld blobserver.Loader, confOrString interface{}) (storageFunc, os.Error) {
-	// Static configuration from a string
-	if s, ok := confOrString.(string); ok {
-		sto, err := ld.GetStorage(s)
-		if err != nil {
-			return nil, err
-		}
-		f := func(io.Reader) (blobserver.Storage, []byte, os.Error) {
-			return sto, nil, nil
+	pick, peek, needSize, err := buildPicker(ld, confOrString)
+	if err != nil {
+		return nil, err
+	}
+	if peek == 0 && !needSize {
+		// Static configuration; no need to look at the blob.
+		sto := pick(nil)
+		f := func(src io.Reader) (blobserver.Storage, io.ReadCloser, os.Error) {
+			return sto, ioutil.NopCloser(src), nil
 		}
 		return f, nil
 	}
+	return func(src io.Reader) (dest blobserver.Storage, rest io.ReadCloser, err os.Error) {
+		pb, rest, err := peekBlob(src, peek, needSize)
+		if err != nil {
+			return
+		}
+		return pick(pb), rest, nil
+	}, nil
+}
 
-	conf := jsonconfig.Obj(confOrString.(map[string]interface{}))
+// peekBlob reads the first peek bytes of the blob in src, or if
+// needSize is set, all of it, counting its size. rest is the whole
+// blob, which is only held in memory up to spoolMemory bytes.
+func peekBlob(src io.Reader, peek int64, needSize bool) (pb *peekedBlob, rest io.ReadCloser, err os.Error) {
+	// TODO: make decisions earlier, by parsing JSON as it
+	// comes in, not after we have up to 1 MB.
+	pb = &peekedBlob{size: -1}
+	if !needSize {
+		var buf bytes.Buffer
+		_, err = io.Copyn(&buf, src, peek)
+		if err != nil && err != os.EOF {
+			return nil, nil, err
+		}
+		pb.buf = buf.Bytes()
+		return pb, ioutil.NopCloser(io.MultiReader(bytes.NewBuffer(buf.Bytes()), src)), nil
+	}
 
-	ifStr := conf.RequiredString("if")
-	// TODO: let 'then' and 'else' point to not just strings but either
-	// a string or a JSON object with another condition, and then
-	// call buildStorageForReceive on it recursively
-	thenTarget := conf.RequiredString("then")
-	elseTarget := conf.RequiredString("else")
-	if err := conf.Validate(); err != nil {
-		return nil, err
+	if peek < spoolMemory {
+		peek = spoolMemory
+	}
+	var buf bytes.Buffer
+	_, err = io.Copyn(&buf, src, peek)
+	pb.buf, pb.size = buf.Bytes(), int64(buf.Len())
+	if err == os.EOF {
+		return pb, ioutil.NopCloser(bytes.NewBuffer(buf.Bytes())), nil
 	}
-	thenSto, err := ld.GetStorage(thenTarget)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	elseSto, err := ld.GetStorage(elseTarget)
+	f, err := ioutil.TempFile("", "camli-cond")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	switch ifStr {
-	case "isSchema":
-		return isSchemaPicker(thenSto, elseSto), nil
+	sf := &spoolFile{f}
+	n, err := io.Copy(f, src)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
 	}
-	return nil, fmt.Errorf("cond: unsupported 'if' type of %q", ifStr)
+	if err != nil {
+		sf.Close()
+		return nil, nil, err
+	}
+	pb.size += n
+	return pb, &readCloser{io.MultiReader(bytes.NewBuffer(buf.Bytes()), f), sf}, nil
 }
 
-func isSchemaPicker(thenSto, elseSto blobserver.Storage) storageFunc {
-	return func(src io.Reader) (dest blobserver.Storage, overRead []byte, err os.Error) {
-		// TODO: make decision earlier, by parsing JSON as it comes in,
-		// not after we have up to 1 MB.
-		var buf bytes.Buffer
-		_, err = io.Copyn(&buf, src, 1<<20)
-		if err != nil && err != os.EOF {
-			return
-		}
-		ss := new(schema.Superset)
-		if err = json.NewDecoder(bytes.NewBuffer(buf.Bytes())).Decode(ss); err != nil {
-			log.Printf("cond: json parse failure => not schema => else")
-			return elseSto, buf.Bytes(), nil
+// spoolFile is a temporary file, removed when closed.
+type spoolFile struct {
+	*os.File
+}
+
+func (sf *spoolFile) Close() os.Error {
+	err := sf.File.Close()
+	os.Remove(sf.Name())
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// buildPicker returns the picker for a write target, how many bytes
+// of a blob it needs to see, and whether it needs the blob's size.
+func buildPicker(ld blobserver.Loader, confOrString interface{}) (pick picker, peek int64, needSize bool, err os.Error) {
+	if s, ok := confOrString.(string); ok {
+		sto, err := ld.GetStorage(s)
+		if err != nil {
+			return nil, 0, false, err
 		}
-		if ss.Type == "" {
-			log.Printf("cond: json => but not schema => else")
-			return elseSto, buf.Bytes(), nil
+		return func(*peekedBlob) blobserver.Storage { return sto }, 0, false, nil
+	}
+
+	conf := jsonconfig.Obj(confOrString.(map[string]interface{}))
+	ifv := conf.RequiredStringOrObject("if")
+	thenv := conf.RequiredStringOrObject("then")
+	elsev := conf.RequiredStringOrObject("else")
+	if err = conf.Validate(); err != nil {
+		return
+	}
+	pred, err := parsePredicate(ifv)
+	if err != nil {
+		return
+	}
+	thenPick, thenPeek, thenSize, err := buildPicker(ld, thenv)
+	if err != nil {
+		return
+	}
+	elsePick, elsePeek, elseSize, err := buildPicker(ld, elsev)
+	if err != nil {
+		return
+	}
+	needSize = pred.needsSize() || thenSize || elseSize
+	peek = pred.peekSize()
+	if thenPeek > peek {
+		peek = thenPeek
+	}
+	if elsePeek > peek {
+		peek = elsePeek
+	}
+	pick = func(pb *peekedBlob) blobserver.Storage {
+		if pred.match(pb) {
+			return thenPick(pb)
 		}
-		log.Printf("cond: json => schema => then")
-		return thenSto, buf.Bytes(), nil
+		return elsePick(pb)
 	}
+	return pick, peek, needSize, nil
 }
 
 func (sto *condStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
-	destSto, overRead, err := sto.storageForReceive(source)
+	destSto, rest, err := sto.storageForReceive(source)
 	if err != nil {
 		return
 	}
-	if len(overRead) > 0 {
-		source = io.MultiReader(bytes.NewBuffer(overRead), source)
-	}
-	return destSto.ReceiveBlob(b, source)
+	defer rest.Close()
+	return destSto.ReceiveBlob(b, rest)
 }
 
 func (sto *condStorage) Remove(blobs []*blobref.BlobRef) os.Error {
@@ -163,32 +269,102 @@ func (sto *condStorage) Remove(blobs []*blobref.BlobRef) os.Error {
 }
 
 func (sto *condStorage) IsFetcherASeeker() bool {
-	_, ok := sto.read.(blobref.SeekFetcher)
-	return ok
+	for _, s := range sto.read {
+		if _, ok := s.(blobref.SeekFetcher); !ok {
+			return false
+		}
+	}
+	return len(sto.read) > 0
 }
 
 func (sto *condStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
-	if sto.read != nil {
-		return sto.read.FetchStreaming(b)
-	}
 	err = os.NewError("cond: Read not configured")
+	for _, s := range sto.read {
+		file, size, err = s.FetchStreaming(b)
+		if err == nil {
+			return
+		}
+	}
 	return
 }
 
 func (sto *condStorage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
-	if sto.read != nil {
-		return sto.read.Stat(dest, blobs, waitSeconds)
+	switch len(sto.read) {
+	case 0:
+		return os.NewError("cond: Read not configured")
+	case 1:
+		return sto.read[0].Stat(dest, blobs, waitSeconds)
+	}
+
+	// Ask each read target in turn for the blobs not yet found. As
+	// with reads, a target that fails is skipped; only if all of
+	// them fail is that an error.
+	need := blobs
+	var lastErr os.Error
+	failed := 0
+	for _, s := range sto.read {
+		if len(need) == 0 {
+			return nil
+		}
+		ch := make(chan blobref.SizedBlobRef, len(need))
+		err := s.Stat(ch, need, 0)
+		close(ch)
+		if err != nil {
+			log.Printf("cond: stat on read target failed: %v", err)
+			lastErr = err
+			failed++
+		}
+		found := make(map[string]bool)
+		for sb := range ch {
+			found[sb.BlobRef.String()] = true
+			dest <- sb
+		}
+		var still []*blobref.BlobRef
+		for _, b := range need {
+			if !found[b.String()] {
+				still = append(still, b)
+			}
+		}
+		need = still
 	}
-	return os.NewError("cond: Read not configured")
+	if failed == len(sto.read) {
+		return lastErr
+	}
+	if len(need) > 0 && waitSeconds > 0 {
+		// Only wait on the first (primary) target.
+		return sto.read[0].Stat(dest, need, waitSeconds)
+	}
+	return nil
 }
 
 func (sto *condStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
-	if sto.read != nil {
-		return sto.read.EnumerateBlobs(dest, after, limit, waitSeconds)
+	switch len(sto.read) {
+	case 0:
+		close(dest)
+		return os.NewError("cond: Read not configured")
+	case 1:
+		return sto.read[0].EnumerateBlobs(dest, after, limit, waitSeconds)
 	}
-	return os.NewError("cond: Read not configured")
+	return blobserver.MergedEnumerate(dest, sto.read, after, limit, waitSeconds)
 }
 
+// StorageStats sums the stats of the read targets, whose blobs are
+// the ones enumerated. A blob held by more than one is counted more
+// than once.
+func (sto *condStorage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	if len(sto.read) == 0 {
+		return nil, os.NewError("cond: Read not configured")
+	}
+	stats := make([]*blobserver.StorageStats, len(sto.read))
+	for i, s := range sto.read {
+		st, err := blobserver.GetStorageStats(s)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = st
+	}
+	return blobserver.SumStorageStats(stats), nil
+}
 
 func init() {
 	blobserver.RegisterStorageConstructor("cond", blobserver.StorageConstructor(newFromConfig))
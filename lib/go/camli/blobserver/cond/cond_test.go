@@ -0,0 +1,210 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cond
+
+import (
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"strings"
+	"testing"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/jsonconfig"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+type testLoader map[string]blobserver.Storage
+
+func (ld testLoader) GetStorage(prefix string) (blobserver.Storage, os.Error) {
+	if sto, ok := ld[prefix]; ok {
+		return sto, nil
+	}
+	return nil, fmt.Errorf("no storage %q", prefix)
+}
+
+func (ld testLoader) GetHandlerType(prefix string) string { return "" }
+
+func (ld testLoader) GetHandler(prefix string) (interface{}, os.Error) {
+	return ld.GetStorage(prefix)
+}
+
+func newCond(t *testing.T, ld testLoader, config string) blobserver.Storage {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &m); err != nil {
+		t.Fatalf("bad test config: %v", err)
+	}
+	sto, err := newFromConfig(ld, jsonconfig.Obj(m))
+	if err != nil {
+		t.Fatalf("newFromConfig: %v", err)
+	}
+	return sto
+}
+
+func TestWritePredicates(t *testing.T) {
+	ld := testLoader{"/ssd/": memory.New(0), "/photos/": memory.New(0), "/s3/": memory.New(0), "/claims/": memory.New(0)}
+	sto := newCond(t, ld, `{
+		"write": {
+			"if": {"camliType": "claim"},
+			"then": "/claims/",
+			"else": {
+				"if": {"or": [{"mimeType": "image/"}, {"minSize": 100}]},
+				"then": {
+					"if": {"not": {"mimeType": "image/"}},
+					"then": "/s3/",
+					"else": "/photos/"
+				},
+				"else": "/ssd/"
+			}
+		},
+		"read": "/ssd/"
+	}`)
+
+	tests := []struct {
+		contents string
+		want     string
+	}{
+		{`{"camliVersion": 1, "camliType": "claim"}`, "/claims/"},
+		{`{"camliVersion": 1, "camliType": "permanode"}`, "/ssd/"},
+		{"small", "/ssd/"},
+		{strings.Repeat("x", 99), "/ssd/"},
+		{strings.Repeat("x", 100), "/s3/"},
+		{"\xff\xd8\xff\xe0 tiny jpeg", "/photos/"},
+	}
+	for _, tt := range tests {
+		tb := &test.Blob{tt.contents}
+		_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		for prefix, mem := range ld {
+			_, _, err := mem.FetchStreaming(tb.BlobRef())
+			Expect(t, (err == nil) == (prefix == tt.want),
+				fmt.Sprintf("blob %.20q: on %s = %v; want it on %s", tt.contents, prefix, err == nil, tt.want))
+		}
+	}
+}
+
+func TestSizePredicates(t *testing.T) {
+	ld := testLoader{"/small/": memory.New(0), "/big/": memory.New(0)}
+	sto := newCond(t, ld, `{
+		"write": {"if": {"maxSize": 1500000}, "then": "/small/", "else": "/big/"},
+		"read": ["/small/", "/big/"]
+	}`)
+
+	// Both are bigger than what's kept in memory while counting.
+	small := &test.Blob{strings.Repeat("s", 1500000)}
+	big := &test.Blob{strings.Repeat("b", 1500001)}
+	for _, tb := range []*test.Blob{small, big} {
+		sb, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		ExpectInt(t, len(tb.Contents), int(sb.Size), "received size")
+	}
+	ExpectInt(t, 1, ld["/small/"].(*memory.Storage).NumBlobs(), "blobs on /small/")
+	ExpectInt(t, 1, ld["/big/"].(*memory.Storage).NumBlobs(), "blobs on /big/")
+	rc, _, err := ld["/big/"].FetchStreaming(big.BlobRef())
+	AssertNil(t, err, "big blob on /big/")
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	Expect(t, string(data) == big.Contents, "big blob contents")
+}
+
+func TestParsePredicateErrors(t *testing.T) {
+	for _, bad := range []string{
+		`"isFoo"`,
+		`{"maxSize": 1, "minSize": 2}`,
+		`{"maxSize": "big"}`,
+		`{"and": []}`,
+		`{"frob": 1}`,
+		`{}`,
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(bad), &v); err != nil {
+			t.Fatalf("bad test JSON %s: %v", bad, err)
+		}
+		_, err := parsePredicate(v)
+		Expect(t, err != nil, "expected error parsing "+bad)
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	ld := testLoader{"/fast/": memory.New(0), "/archive/": memory.New(0)}
+	sto := newCond(t, ld, `{"write": "/fast/", "read": ["/fast/", "/archive/"]}`)
+
+	onFast := &test.Blob{"on fast"}
+	onArchive := &test.Blob{"on archive"}
+	_, err := sto.ReceiveBlob(onFast.BlobRef(), onFast.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	_, err = ld["/archive/"].ReceiveBlob(onArchive.BlobRef(), onArchive.Reader())
+	AssertNil(t, err, "ReceiveBlob to archive")
+
+	for _, tb := range []*test.Blob{onFast, onArchive} {
+		rc, _, err := sto.FetchStreaming(tb.BlobRef())
+		AssertNil(t, err, "FetchStreaming")
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		ExpectString(t, tb.Contents, string(data), "fetched contents")
+	}
+
+	missing := &test.Blob{"nowhere"}
+	_, _, err = sto.FetchStreaming(missing.BlobRef())
+	Expect(t, err != nil, "fetch of missing blob fails")
+
+	ch := make(chan blobref.SizedBlobRef, 3)
+	err = sto.Stat(ch, []*blobref.BlobRef{onFast.BlobRef(), onArchive.BlobRef(), missing.BlobRef()}, 0)
+	AssertNil(t, err, "Stat")
+	ExpectInt(t, 2, len(ch), "blobs found by Stat")
+}
+
+// failingStatStorage is a storage whose Stat always fails.
+type failingStatStorage struct {
+	*memory.Storage
+}
+
+func (failingStatStorage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return os.NewError("stat failed")
+}
+
+func TestStatFallback(t *testing.T) {
+	ld := testLoader{"/broken/": failingStatStorage{memory.New(0)}, "/archive/": memory.New(0)}
+	sto := newCond(t, ld, `{"read": ["/broken/", "/archive/"]}`)
+	tb := &test.Blob{"on archive"}
+	_, err := ld["/archive/"].ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob to archive")
+
+	ch := make(chan blobref.SizedBlobRef, 1)
+	err = sto.Stat(ch, tb.BlobRefSlice(), 0)
+	AssertNil(t, err, "Stat with a failing first target")
+	ExpectInt(t, 1, len(ch), "blobs found by Stat")
+
+	ld = testLoader{"/broken/": failingStatStorage{memory.New(0)}, "/broken2/": failingStatStorage{memory.New(0)}}
+	sto = newCond(t, ld, `{"read": ["/broken/", "/broken2/"]}`)
+	ch = make(chan blobref.SizedBlobRef, 1)
+	Expect(t, sto.Stat(ch, tb.BlobRefSlice(), 0) != nil, "Stat with all targets failing")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			ld := testLoader{"/bs/": memory.New(0)}
+			return newCond(t, ld, `{"write": "/bs/", "read": "/bs/", "remove": "/bs/"}`), nil
+		},
+	})
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cond
+
+import (
+	"bytes"
+	"fmt"
+	"json"
+	"os"
+	"strings"
+
+	"camli/magic"
+	"camli/schema"
+)
+
+const (
+	// schemaPeek is how much of a blob is read to decide whether
+	// it's a schema blob.
+	schemaPeek = 1 << 20
+
+	mimePeek = 1024
+
+	// spoolMemory is how much of a blob whose size is needed is
+	// kept in memory while counting it. The rest goes to a
+	// temporary file.
+	spoolMemory = 1 << 20
+)
+
+// peekedBlob is the start of a blob being received, which predicates
+// match against.
+type peekedBlob struct {
+	buf  []byte // up to the largest peekSize of the predicates; all of it if shorter
+	size int64  // of the whole blob, if a predicate needsSize; else -1
+
+	parsed bool
+	ss     *schema.Superset // nil if not a schema blob; valid if parsed
+}
+
+func (pb *peekedBlob) superset() *schema.Superset {
+	if !pb.parsed {
+		pb.parsed = true
+		ss := new(schema.Superset)
+		err := json.NewDecoder(bytes.NewBuffer(pb.buf)).Decode(ss)
+		if err == nil && ss.Type != "" {
+			pb.ss = ss
+		}
+	}
+	return pb.ss
+}
+
+type predicate interface {
+	// peekSize returns how many leading bytes of a blob match
+	// needs to see.
+	peekSize() int64
+	// needsSize returns whether match needs the blob's size,
+	// which is only known once all of it has been received.
+	needsSize() bool
+	match(pb *peekedBlob) bool
+}
+
+type isSchemaPred struct{}
+
+func (isSchemaPred) peekSize() int64 { return schemaPeek }
+
+func (isSchemaPred) needsSize() bool { return false }
+
+func (isSchemaPred) match(pb *peekedBlob) bool { return pb.superset() != nil }
+
+type camliTypePred string
+
+func (camliTypePred) peekSize() int64 { return schemaPeek }
+
+func (camliTypePred) needsSize() bool { return false }
+
+func (p camliTypePred) match(pb *peekedBlob) bool {
+	ss := pb.superset()
+	return ss != nil && ss.Type == string(p)
+}
+
+// mimeTypePred matches a sniffed MIME type, or, if it ends in a
+// slash, a MIME type prefix such as "image/".
+type mimeTypePred string
+
+func (mimeTypePred) peekSize() int64 { return mimePeek }
+
+func (mimeTypePred) needsSize() bool { return false }
+
+func (p mimeTypePred) match(pb *peekedBlob) bool {
+	mt := magic.MimeType(pb.buf)
+	if strings.HasSuffix(string(p), "/") {
+		return strings.HasPrefix(mt, string(p))
+	}
+	return mt == string(p)
+}
+
+// maxSizePred matches blobs of at most that many bytes.
+type maxSizePred int64
+
+func (maxSizePred) peekSize() int64 { return 0 }
+
+func (maxSizePred) needsSize() bool { return true }
+
+func (p maxSizePred) match(pb *peekedBlob) bool { return pb.size <= int64(p) }
+
+// minSizePred matches blobs of at least that many bytes.
+type minSizePred int64
+
+func (minSizePred) peekSize() int64 { return 0 }
+
+func (minSizePred) needsSize() bool { return true }
+
+func (p minSizePred) match(pb *peekedBlob) bool { return pb.size >= int64(p) }
+
+type andPred []predicate
+
+func (p andPred) peekSize() int64 { return maxPeek(p) }
+
+func (p andPred) needsSize() bool { return anyNeedsSize(p) }
+
+func (p andPred) match(pb *peekedBlob) bool {
+	for _, sub := range p {
+		if !sub.match(pb) {
+			return false
+		}
+	}
+	return true
+}
+
+type orPred []predicate
+
+func (p orPred) peekSize() int64 { return maxPeek(p) }
+
+func (p orPred) needsSize() bool { return anyNeedsSize(p) }
+
+func (p orPred) match(pb *peekedBlob) bool {
+	for _, sub := range p {
+		if sub.match(pb) {
+			return true
+		}
+	}
+	return false
+}
+
+type notPred struct {
+	p predicate
+}
+
+func (p notPred) peekSize() int64 { return p.p.peekSize() }
+
+func (p notPred) needsSize() bool { return p.p.needsSize() }
+
+func (p notPred) match(pb *peekedBlob) bool { return !p.p.match(pb) }
+
+func maxPeek(preds []predicate) (n int64) {
+	for _, p := range preds {
+		if pn := p.peekSize(); pn > n {
+			n = pn
+		}
+	}
+	return
+}
+
+func anyNeedsSize(preds []predicate) bool {
+	for _, p := range preds {
+		if p.needsSize() {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePredicate parses the JSON value of an "if". It's either the
+// string "isSchema", or an object with one of the keys:
+//
+//     "isSchema":  true
+//     "camliType": "claim"
+//     "mimeType":  "image/jpeg" (or a prefix, like "image/")
+//     "maxSize":   65536
+//     "minSize":   65536
+//     "and":       [predicate, ...]
+//     "or":        [predicate, ...]
+//     "not":       predicate
+//
+// The size predicates need the whole blob before a target can be
+// picked, so blobs written through one are first counted, spooling
+// what doesn't fit in spoolMemory to a temporary file.
+func parsePredicate(v interface{}) (predicate, os.Error) {
+	switch v := v.(type) {
+	case string:
+		if v == "isSchema" {
+			return isSchemaPred{}, nil
+		}
+		return nil, fmt.Errorf("cond: unsupported 'if' type of %q", v)
+	case map[string]interface{}:
+		var key string
+		var arg interface{}
+		for k, ka := range v {
+			if strings.HasPrefix(k, "_") {
+				// Comment, as in jsonconfig.
+				continue
+			}
+			if key != "" {
+				return nil, fmt.Errorf("cond: predicate has both %q and %q; use \"and\" or \"or\"", key, k)
+			}
+			key, arg = k, ka
+		}
+		return parsePredicateKey(key, arg)
+	}
+	return nil, fmt.Errorf("cond: predicate must be a string or object, not %T", v)
+}
+
+func parsePredicateKey(key string, arg interface{}) (predicate, os.Error) {
+	switch key {
+	case "isSchema":
+		if b, ok := arg.(bool); ok {
+			if b {
+				return isSchemaPred{}, nil
+			}
+			return notPred{isSchemaPred{}}, nil
+		}
+	case "camliType", "mimeType":
+		if s, ok := arg.(string); ok && s != "" {
+			if key == "camliType" {
+				return camliTypePred(s), nil
+			}
+			return mimeTypePred(s), nil
+		}
+	case "maxSize", "minSize":
+		if f, ok := arg.(float64); ok && f >= 0 {
+			if key == "maxSize" {
+				return maxSizePred(int64(f)), nil
+			}
+			return minSizePred(int64(f)), nil
+		}
+	case "and", "or":
+		l, ok := arg.([]interface{})
+		if !ok || len(l) == 0 {
+			break
+		}
+		preds := make([]predicate, len(l))
+		for i, sub := range l {
+			p, err := parsePredicate(sub)
+			if err != nil {
+				return nil, err
+			}
+			preds[i] = p
+		}
+		if key == "and" {
+			return andPred(preds), nil
+		}
+		return orPred(preds), nil
+	case "not":
+		p, err := parsePredicate(arg)
+		if err != nil {
+			return nil, err
+		}
+		return notPred{p}, nil
+	case "":
+		return nil, os.NewError("cond: empty predicate")
+	default:
+		return nil, fmt.Errorf("cond: unknown predicate %q", key)
+	}
+	return nil, fmt.Errorf("cond: bad argument %v for predicate %q", arg, key)
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package diskpacked registers the "diskpacked" blobserver storage type,
+storing blobs appended to a small number of large pack files, rather
+than one file per blob like localdisk.
+
+Each pack file is a sequence of records:
+
+   "[" <blobref> " " <size> "]" <size bytes of blob>
+   "[" <blobref> " tombstone]"
+
+Uploads write their records concurrently, each into space reserved
+after the previous record, so a failed or interrupted upload can leave
+a record whose data doesn't match its blobref. Such records are
+skipped when a pack is scanned.
+
+A separate index file maps each blobref to its pack number, data
+offset and size. The index is a log of lines which is replayed at
+startup, and can always be re-created from the packs alone.
+
+Example low-level config:
+
+     "/storage/": {
+         "handler": "storage-diskpacked",
+         "handlerArgs": {
+            "path": "/var/camlistore/blobs",
+            "maxFileSize": 536870912
+          }
+     },
+*/
+package diskpacked
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+// defaultMaxFileSize is the size at which a new pack file is started.
+const defaultMaxFileSize = 512 << 20
+
+const indexFileName = "index.kv"
+
+type blobMeta struct {
+	pack   int
+	offset int64 // of the blob's data, after the record header
+	size   int64
+}
+
+type storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+	root        string
+	maxFileSize int64
+
+	index blobserver.SortedIndex // blobref to blobMeta
+
+	mu      sync.Mutex // guards following, and changes to index
+	current *os.File   // pack file being appended to
+	curPack int
+	curSize int64    // including space reserved for data being written
+	idxFile *os.File // index log, opened for append
+}
+
+var _ blobserver.Storage = (*storage)(nil)
+
+// New returns a diskpacked storage rooted at dir, which must already
+// exist. If maxFileSize is 0, a default is used.
+func New(dir string, maxFileSize int64) (blobserver.Storage, os.Error) {
+	return newStorage(dir, maxFileSize)
+}
+
+func newStorage(dir string, maxFileSize int64) (*storage, os.Error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat directory %q: %v", dir, err)
+	}
+	if !fi.IsDirectory() {
+		return nil, fmt.Errorf("Path %q isn't a directory", dir)
+	}
+	if maxFileSize <= 0 {
+		maxFileSize = defaultMaxFileSize
+	}
+	s := &storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		root:                      dir,
+		maxFileSize:               maxFileSize,
+	}
+	if err := s.openIndex(); err != nil {
+		return nil, err
+	}
+	if err := s.openCurrentPack(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	path := config.RequiredString("path")
+	maxFileSize := config.OptionalInt("maxFileSize", 0)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return newStorage(path, int64(maxFileSize))
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("diskpacked", blobserver.StorageConstructor(newFromConfig))
+}
+
+var packPattern = regexp.MustCompile(`^pack-([0-9]+)\.blobs$`)
+
+func packName(n int) string {
+	return fmt.Sprintf("pack-%05d.blobs", n)
+}
+
+func (s *storage) packPath(n int) string {
+	return filepath.Join(s.root, packName(n))
+}
+
+// packNumbers returns the pack numbers present in the root
+// directory, in ascending order.
+func (s *storage) packNumbers() ([]int, os.Error) {
+	d, err := os.Open(s.root)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, name := range names {
+		if m := packPattern.FindStringSubmatch(name); m != nil {
+			n, err := strconv.Atoi(m[1])
+			if err == nil {
+				nums = append(nums, n)
+			}
+		}
+	}
+	sort.SortInts(nums)
+	return nums, nil
+}
+
+// openCurrentPack opens the highest-numbered pack for appending,
+// creating pack 0 if none exist.
+func (s *storage) openCurrentPack() os.Error {
+	nums, err := s.packNumbers()
+	if err != nil {
+		return err
+	}
+	n := 0
+	if len(nums) > 0 {
+		n = nums[len(nums)-1]
+	}
+	return s.openPack(n)
+}
+
+// openPack sets the current append pack to number n.
+// Must be called with s.mu held, or before s is shared.
+func (s *storage) openPack(n int) os.Error {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	f, err := os.OpenFile(s.packPath(n), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.current, s.curPack, s.curSize = f, n, size
+	return nil
+}
+
+type readSeekCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func (s *storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return s.Fetch(br)
+}
+
+func (s *storage) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	meta, ok := s.lookup(br.String())
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	f, err := os.Open(s.packPath(meta.pack))
+	if err != nil {
+		return nil, 0, err
+	}
+	return readSeekCloser{io.NewSectionReader(f, meta.offset, meta.size), f}, meta.size, nil
+}
+
+func (s *storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	// Spool to a temp file first, so the digest can be verified and
+	// the size known before anything is appended to a pack.
+	tempFile, err := ioutil.TempFile(s.root, "receive-"+br.String())
+	if err != nil {
+		return
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	hash := br.Hash()
+	if hash == nil {
+		err = fmt.Errorf("diskpacked: unsupported blobref hash type of %q", br.String())
+		return
+	}
+	size, err := io.Copy(io.MultiWriter(hash, tempFile), source)
+	if err != nil {
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	if _, err = tempFile.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	if meta, ok := s.lookup(br.String()); ok {
+		s.mu.Unlock()
+		return blobref.SizedBlobRef{br, meta.size}, nil
+	}
+	meta, err := s.reserve(br, size)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	if err = s.writeData(meta, tempFile); err != nil {
+		// The record stays in the pack, but with data which
+		// doesn't match its blobref it's never indexed.
+		return
+	}
+	s.mu.Lock()
+	if err = s.logPut(br.String(), &meta); err == nil {
+		s.setIndex(br.String(), &meta)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		// The record is in the pack, so a reindex would find
+		// it. But don't acknowledge a write we can't look up.
+		return
+	}
+
+	s.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{br, size}, nil
+}
+
+// reserve writes the header of a record for a blob of size bytes to
+// the current pack, starting a new pack if the current one is full,
+// and sets aside the space for its data after the header. Records
+// after it may be written before its data is.
+// s.mu must be held.
+func (s *storage) reserve(br *blobref.BlobRef, size int64) (blobMeta, os.Error) {
+	if s.curSize > 0 && s.curSize+size > s.maxFileSize {
+		if err := s.openPack(s.curPack + 1); err != nil {
+			return blobMeta{}, err
+		}
+	}
+	header := fmt.Sprintf("[%s %d]", br.String(), size)
+	recStart := s.curSize
+	if _, err := s.current.WriteAt([]byte(header), recStart); err != nil {
+		s.truncateCurrent(recStart)
+		return blobMeta{}, err
+	}
+	s.curSize += int64(len(header)) + size
+	return blobMeta{pack: s.curPack, offset: recStart + int64(len(header)), size: size}, nil
+}
+
+// writeData writes and syncs the data of a record reserved as meta,
+// without s.mu held.
+func (s *storage) writeData(meta blobMeta, r io.Reader) os.Error {
+	f, err := os.OpenFile(s.packPath(meta.pack), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 32<<10)
+	off, end := meta.offset, meta.offset+meta.size
+	for off < end {
+		n, err := r.Read(buf[:min(int64(len(buf)), end-off)])
+		if n > 0 {
+			if _, werr := f.WriteAt(buf[:n], off); werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if off != end {
+		return fmt.Errorf("diskpacked: wrote %d bytes of a blob; expected %d", off-meta.offset, meta.size)
+	}
+	return f.Sync()
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// truncateCurrent discards a partially-written record at the end of
+// the current pack.
+func (s *storage) truncateCurrent(size int64) {
+	if err := s.current.Truncate(size); err != nil {
+		log.Printf("diskpacked: failed to truncate %s to %d: %v", s.current.Name(), size, err)
+	}
+	s.curSize = size
+}
+
+// Remove appends a tombstone record for each existing blob. The
+// space isn't reclaimed until an offline Compact.
+func (s *storage) Remove(blobs []*blobref.BlobRef) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, br := range blobs {
+		key := br.String()
+		if _, ok := s.lookup(key); !ok {
+			continue
+		}
+		tomb := fmt.Sprintf("[%s tombstone]", key)
+		if _, err := s.current.WriteAt([]byte(tomb), s.curSize); err != nil {
+			s.truncateCurrent(s.curSize)
+			return err
+		}
+		s.curSize += int64(len(tomb))
+		if err := s.logDelete(key, s.curPack, s.curSize); err != nil {
+			return err
+		}
+		s.setIndex(key, nil)
+	}
+	return s.current.Sync()
+}
+
+// lookup returns where key is stored.
+func (s *storage) lookup(key string) (meta blobMeta, ok bool) {
+	_, v, ok := s.index.Get(key)
+	if !ok {
+		return blobMeta{}, false
+	}
+	return v.(blobMeta), true
+}
+
+// setIndex sets or (if meta is nil) deletes key from the in-memory
+// index. s.mu must be held.
+func (s *storage) setIndex(key string, meta *blobMeta) {
+	if meta == nil {
+		s.index.Delete(key)
+	} else {
+		s.index.Set(key, meta.size, *meta)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskpacked
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"camli/blobserver"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+var (
+	epochLock sync.Mutex
+	rootEpoch = 0
+)
+
+func newTempDir(t *testing.T) string {
+	epochLock.Lock()
+	rootEpoch++
+	path := fmt.Sprintf("%s/camli-diskpacked-%d-%d", os.TempDir(), os.Getpid(), rootEpoch)
+	epochLock.Unlock()
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatalf("Failed to create temp directory %q: %v", path, err)
+	}
+	return path
+}
+
+func TestReceiveFetch(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, s, foo)
+	storagetest.Upload(t, s, bar)
+	storagetest.Upload(t, s, foo) // dup
+	storagetest.ExpectContents(t, s, foo)
+	storagetest.ExpectContents(t, s, bar)
+
+	_, _, err = s.Fetch((&test.Blob{"missing"}).BlobRef())
+	if err != os.ENOENT {
+		t.Errorf("expected ENOENT for missing blob; got %v", err)
+	}
+
+	_, err = s.ReceiveBlob(foo.BlobRef(), bar.Reader())
+	if err == nil {
+		t.Errorf("expected error receiving blob with wrong digest")
+	}
+}
+
+func TestEnumerateSorted(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 64) // tiny packs, to span many
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+
+	const blobsToMake = 50
+	for i := 0; i < blobsToMake; i++ {
+		storagetest.Upload(t, s, &test.Blob{fmt.Sprintf("blob-%d", i)})
+	}
+	nums, err := s.packNumbers()
+	AssertNil(t, err, "packNumbers")
+	Expect(t, len(nums) > 1, "expected multiple packs")
+
+	got := storagetest.Enumerate(t, s, "", 1000)
+	ExpectInt(t, blobsToMake, len(got), "number of enumerated blobs")
+	for i := 1; i < len(got); i++ {
+		if got[i-1].BlobRef.String() >= got[i].BlobRef.String() {
+			t.Fatalf("enumerate not sorted at index %d", i)
+		}
+	}
+
+	limited := storagetest.Enumerate(t, s, got[9].BlobRef.String(), 5)
+	ExpectInt(t, 5, len(limited), "number of blobs with limit")
+	ExpectString(t, got[10].BlobRef.String(), limited[0].BlobRef.String(), "first blob after")
+}
+
+func TestRemoveAndReopen(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, s, foo)
+	storagetest.Upload(t, s, bar)
+	AssertNil(t, s.Remove(foo.BlobRefSlice()), "Remove")
+	ExpectInt(t, 1, len(storagetest.Enumerate(t, s, "", 10)), "blobs after remove")
+	s.close()
+
+	// Reopening replays the index log.
+	s, err = newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	ExpectInt(t, 1, len(storagetest.Enumerate(t, s, "", 10)), "blobs after reopen")
+	storagetest.ExpectContents(t, s, bar)
+	s.close()
+
+	// Rebuilding the index from the packs honors the tombstone.
+	AssertNil(t, os.Remove(s.indexPath()), "removing index")
+	s, err = newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	got := storagetest.Enumerate(t, s, "", 10)
+	ExpectInt(t, 1, len(got), "blobs after reindex")
+	ExpectString(t, bar.BlobRef().String(), got[0].BlobRef.String(), "remaining blob")
+	s.close()
+}
+
+func TestCrashRecovery(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{"foo"}
+	storagetest.Upload(t, s, foo)
+	s.close()
+
+	// Simulate a crash after a pack write but before the index
+	// write, followed by a torn partial record.
+	bar := &test.Blob{"bar!"}
+	f, err := os.OpenFile(s.packPath(0), os.O_WRONLY|os.O_APPEND, 0600)
+	AssertNil(t, err, "opening pack")
+	fmt.Fprintf(f, "[%s %d]%s", bar.BlobRef(), bar.Size(), bar.Contents)
+	fmt.Fprintf(f, "[sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33 300]abc")
+	f.Close()
+
+	s, err = newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+	ExpectInt(t, 2, len(storagetest.Enumerate(t, s, "", 10)), "blobs after recovery")
+	storagetest.ExpectContents(t, s, bar)
+
+	baz := &test.Blob{"bazzz"}
+	storagetest.Upload(t, s, baz)
+	storagetest.ExpectContents(t, s, baz)
+}
+
+func TestCompact(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, s, foo)
+	storagetest.Upload(t, s, bar)
+	AssertNil(t, s.Remove(foo.BlobRefSlice()), "Remove")
+	before, err := os.Stat(s.packPath(0))
+	AssertNil(t, err, "stat pack")
+	s.close()
+
+	AssertNil(t, Compact(dir), "Compact")
+
+	after, err := os.Stat(s.packPath(0))
+	AssertNil(t, err, "stat pack")
+	Expect(t, after.Size < before.Size, "pack shrank")
+
+	s, err = newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+	got := storagetest.Enumerate(t, s, "", 10)
+	ExpectInt(t, 1, len(got), "blobs after compact")
+	storagetest.ExpectContents(t, s, bar)
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, s, foo)
+	storagetest.Upload(t, s, bar)
+	AssertNil(t, s.Remove(foo.BlobRefSlice()), "Remove")
+
+	// Crash after replacing the pack, before rebuilding the index.
+	AssertNil(t, s.compactPack(0), "compactPack")
+	s.close()
+	_, err = os.Stat(s.indexPath())
+	Expect(t, err != nil, "index removed by compaction")
+
+	s, err = newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+	ExpectInt(t, 1, len(storagetest.Enumerate(t, s, "", 10)), "blobs after restart")
+	storagetest.ExpectContents(t, s, bar)
+}
+
+func TestConcurrentReceive(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 256)
+	AssertNil(t, err, "newStorage")
+
+	const blobsToMake = 20
+	blobs := make([]*test.Blob, blobsToMake)
+	done := make(chan bool)
+	for i := range blobs {
+		blobs[i] = &test.Blob{fmt.Sprintf("concurrent blob %d", i)}
+		go func(tb *test.Blob) {
+			storagetest.Upload(t, s, tb)
+			done <- true
+		}(blobs[i])
+	}
+	for _ = range blobs {
+		<-done
+	}
+	for _, tb := range blobs {
+		storagetest.ExpectContents(t, s, tb)
+	}
+	s.close()
+
+	// The packs alone have every blob.
+	AssertNil(t, os.Remove(s.indexPath()), "removing index")
+	s, err = newStorage(dir, 256)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+	ExpectInt(t, blobsToMake, len(storagetest.Enumerate(t, s, "", 100)), "blobs after reindex")
+}
+
+func TestSkipBadRecord(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+
+	// A record whose data write failed, followed by a good one.
+	s.mu.Lock()
+	_, err = s.reserve(foo.BlobRef(), foo.Size())
+	s.mu.Unlock()
+	AssertNil(t, err, "reserve")
+	storagetest.Upload(t, s, bar)
+	s.close()
+	AssertNil(t, os.Remove(s.indexPath()), "removing index")
+
+	s, err = newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+	got := storagetest.Enumerate(t, s, "", 10)
+	ExpectInt(t, 1, len(got), "blobs after reindex")
+	storagetest.ExpectContents(t, s, bar)
+	_, _, err = s.Fetch(foo.BlobRef())
+	Expect(t, err == os.ENOENT, "unwritten blob not indexed")
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := newStorage(dir, 0)
+	AssertNil(t, err, "newStorage")
+	defer s.close()
+	foo := &test.Blob{"foo"}
+	storagetest.Upload(t, s, foo)
+
+	AssertNil(t, s.Quarantine(foo.BlobRef()), "Quarantine")
+	if _, _, err := s.Fetch(foo.BlobRef()); err != os.ENOENT {
+		t.Errorf("expected ENOENT for quarantined blob; got %v", err)
+	}
+	data, err := ioutil.ReadFile(s.quarantinePath(foo.BlobRef()))
+	AssertNil(t, err, "reading quarantined file")
+	ExpectString(t, foo.Contents, string(data), "quarantined contents")
+	AssertNil(t, s.Quarantine(foo.BlobRef()), "Quarantine of missing blob")
+
+	storagetest.Upload(t, s, foo)
+	storagetest.ExpectContents(t, s, foo)
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			dir := newTempDir(t)
+			s, err := newStorage(dir, 0)
+			AssertNil(t, err, "newStorage")
+			return s, func() {
+				s.close()
+				os.RemoveAll(dir)
+			}
+		},
+	})
+}
@@ -0,0 +1,431 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskpacked
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"camli/blobref"
+	"camli/osutil"
+)
+
+// The index file is a log of lines, replayed in order at startup:
+//
+//   put <blobref> <pack> <offset> <size>
+//   del <blobref> <pack> <end>
+//
+// where <end> is the pack offset just past the tombstone record.
+
+// maxHeaderLen bounds a pack record header, to detect garbage.
+const maxHeaderLen = 512
+
+func (s *storage) indexPath() string {
+	return filepath.Join(s.root, indexFileName)
+}
+
+// openIndex loads the index log, rebuilding it from the packs if
+// it's missing, and then indexes any records which made it into a
+// pack but not into the index before a crash.
+func (s *storage) openIndex() os.Error {
+	f, err := os.Open(s.indexPath())
+	if osutil.ErrorIsNoEnt(err) {
+		return s.rebuildIndex()
+	}
+	if err != nil {
+		return err
+	}
+	indexedEnd, goodLen, err := s.replayIndex(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("diskpacked: corrupt index %s (remove it to rebuild): %v", s.indexPath(), err)
+	}
+	if fi, err := os.Stat(s.indexPath()); err == nil && fi.Size > goodLen {
+		// A torn final line from a crash. The pack recovery
+		// below will re-index its record.
+		log.Printf("diskpacked: truncating partial last line of index")
+		if err := os.Truncate(s.indexPath(), goodLen); err != nil {
+			return err
+		}
+	}
+
+	s.idxFile, err = os.OpenFile(s.indexPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	nums, err := s.packNumbers()
+	if err != nil {
+		return err
+	}
+	for _, n := range nums {
+		if err := s.recoverPack(n, indexedEnd[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayIndex reads the index log into the index, returning the
+// highest indexed pack offset seen for each pack and the length of
+// the log up to its last complete line.
+func (s *storage) replayIndex(r io.Reader) (indexedEnd map[int]int64, goodLen int64, err os.Error) {
+	indexedEnd = make(map[int]int64)
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadString('\n')
+		if err == os.EOF {
+			return indexedEnd, goodLen, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		goodLen += int64(len(line))
+		f := strings.Fields(line)
+		badLine := fmt.Errorf("bad line %d: %q", lineNum, line)
+		switch {
+		case len(f) == 5 && f[0] == "put":
+			pack, err1 := strconv.Atoi(f[2])
+			offset, err2 := strconv.Atoi64(f[3])
+			size, err3 := strconv.Atoi64(f[4])
+			if err1 != nil || err2 != nil || err3 != nil || blobref.Parse(f[1]) == nil {
+				return nil, 0, badLine
+			}
+			meta := blobMeta{pack: pack, offset: offset, size: size}
+			s.setIndex(f[1], &meta)
+			if end := offset + size; end > indexedEnd[pack] {
+				indexedEnd[pack] = end
+			}
+		case len(f) == 4 && f[0] == "del":
+			pack, err1 := strconv.Atoi(f[2])
+			end, err2 := strconv.Atoi64(f[3])
+			if err1 != nil || err2 != nil {
+				return nil, 0, badLine
+			}
+			s.setIndex(f[1], nil)
+			if end > indexedEnd[pack] {
+				indexedEnd[pack] = end
+			}
+		default:
+			return nil, 0, badLine
+		}
+	}
+	panic("unreachable")
+}
+
+// recoverPack indexes any records in pack n after offset from.
+func (s *storage) recoverPack(n int, from int64) os.Error {
+	added := 0
+	end, err := s.scanPack(n, from, func(key string, meta *blobMeta, end int64) os.Error {
+		added++
+		if meta == nil {
+			s.setIndex(key, nil)
+			return s.logDelete(key, n, end)
+		}
+		s.setIndex(key, meta)
+		return s.logPut(key, meta)
+	})
+	if err != nil {
+		return err
+	}
+	if added > 0 {
+		log.Printf("diskpacked: recovered %d unindexed records from %s", added, packName(n))
+	}
+	return s.truncateTornPack(n, end)
+}
+
+// truncateTornPack removes a partially written record from the end
+// of pack n, if its last good record ended at end.
+func (s *storage) truncateTornPack(n int, end int64) os.Error {
+	fi, err := os.Stat(s.packPath(n))
+	if err != nil {
+		return err
+	}
+	if fi.Size <= end {
+		return nil
+	}
+	log.Printf("diskpacked: truncating %d bytes of partial record from %s", fi.Size-end, packName(n))
+	return os.Truncate(s.packPath(n), end)
+}
+
+type scanFunc func(key string, meta *blobMeta, end int64) os.Error
+
+// scanPack reads the records of pack n starting at offset from,
+// calling fn for each blob (with meta set) or tombstone (meta nil).
+// It returns the offset just past the last complete record. A
+// truncated or garbage record stops the scan without an error.
+func (s *storage) scanPack(n int, from int64, fn scanFunc) (end int64, err os.Error) {
+	f, err := os.Open(s.packPath(n))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(from, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(f)
+	end = from
+	for end < fi.Size {
+		header, err := readHeader(r)
+		if err != nil {
+			log.Printf("diskpacked: %s at offset %d: %v", packName(n), end, err)
+			return end, nil
+		}
+		dataStart := end + int64(len(header))
+		fields := strings.Fields(header[1 : len(header)-1])
+		if len(fields) != 2 || blobref.Parse(fields[0]) == nil {
+			log.Printf("diskpacked: %s at offset %d: bad record header %q", packName(n), end, header)
+			return end, nil
+		}
+		if fields[1] == "tombstone" {
+			if err := fn(fields[0], nil, dataStart); err != nil {
+				return end, err
+			}
+			end = dataStart
+			continue
+		}
+		size, err := strconv.Atoi64(fields[1])
+		if err != nil || size < 0 || dataStart+size > fi.Size {
+			log.Printf("diskpacked: %s at offset %d: truncated or bad record %q", packName(n), end, header)
+			return end, nil
+		}
+		br := blobref.Parse(fields[0])
+		h := br.Hash()
+		if h == nil {
+			h = sha1.New() // can't verify; only skip it
+		}
+		if _, err := io.Copyn(h, r, size); err != nil {
+			return end, err
+		}
+		if !br.HashMatches(h) {
+			// A write which failed, or was cut short by a
+			// crash while later records were written.
+			log.Printf("diskpacked: %s at offset %d: data doesn't match %s; skipping", packName(n), end, fields[0])
+			end = dataStart + size
+			continue
+		}
+		if err := fn(fields[0], &blobMeta{pack: n, offset: dataStart, size: size}, dataStart+size); err != nil {
+			return end, err
+		}
+		end = dataStart + size
+	}
+	return end, nil
+}
+
+// readHeader reads a "[...]" record header.
+func readHeader(r *bufio.Reader) (string, os.Error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if c != '[' {
+		return "", fmt.Errorf("expected '[', got %q", c)
+	}
+	buf := []byte{c}
+	for len(buf) < maxHeaderLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, c)
+		if c == ']' {
+			return string(buf), nil
+		}
+	}
+	return "", os.NewError("record header too long")
+}
+
+func (s *storage) logPut(key string, meta *blobMeta) os.Error {
+	_, err := fmt.Fprintf(s.idxFile, "put %s %d %d %d\n", key, meta.pack, meta.offset, meta.size)
+	return err
+}
+
+func (s *storage) logDelete(key string, pack int, end int64) os.Error {
+	_, err := fmt.Fprintf(s.idxFile, "del %s %d %d\n", key, pack, end)
+	return err
+}
+
+// rebuildIndex discards the in-memory index and re-creates the
+// index file by scanning every pack.
+func (s *storage) rebuildIndex() os.Error {
+	if s.idxFile != nil {
+		s.idxFile.Close()
+		s.idxFile = nil
+	}
+	s.index.Clear()
+
+	tmpPath := s.indexPath() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	s.idxFile = tmp
+	nums, err := s.packNumbers()
+	if err != nil {
+		return err
+	}
+	for _, n := range nums {
+		if err := s.recoverPack(n, 0); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, s.indexPath()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// tmp stays open for appending; it's now the index file.
+	return nil
+}
+
+// Reindex rebuilds the index of the diskpacked storage in dir from
+// its pack files. It must not be run while a server is using dir.
+func Reindex(dir string) os.Error {
+	s, err := newStorage(dir, 0)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return s.rebuildIndex()
+}
+
+// Compact rewrites the pack files of the diskpacked storage in dir,
+// dropping removed and duplicate blobs, and then rebuilds the index.
+// The index file is removed before the first pack is replaced, so an
+// interrupted Compact is finished by a rebuild at the next start.
+// It must not be run while a server is using dir.
+func Compact(dir string) os.Error {
+	s, err := newStorage(dir, 0)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	nums, err := s.packNumbers()
+	if err != nil {
+		return err
+	}
+	for _, n := range nums {
+		if err := s.compactPack(n); err != nil {
+			return err
+		}
+	}
+	return s.rebuildIndex()
+}
+
+// compactPack rewrites pack n to contain only the records which the
+// current index refers to.
+func (s *storage) compactPack(n int) os.Error {
+	src, err := os.Open(s.packPath(n))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpPath := s.packPath(n) + ".compact"
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // harmless after a successful rename
+	dropped := 0
+	_, err = s.scanPack(n, 0, func(key string, meta *blobMeta, end int64) os.Error {
+		if meta == nil {
+			dropped++
+			return nil
+		}
+		if live, ok := s.lookup(key); !ok || live.pack != meta.pack || live.offset != meta.offset {
+			dropped++
+			return nil
+		}
+		if _, err := fmt.Fprintf(dst, "[%s %d]", key, meta.size); err != nil {
+			return err
+		}
+		_, err := io.Copy(dst, io.NewSectionReader(src, meta.offset, meta.size))
+		return err
+	})
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if dropped == 0 {
+		return nil
+	}
+	log.Printf("diskpacked: compacted %s, dropping %d records", packName(n), dropped)
+	if err := s.dropIndexFile(); err != nil {
+		return err
+	}
+	if n == s.curPack && s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	if err := os.Rename(tmpPath, s.packPath(n)); err != nil {
+		return err
+	}
+	if n == s.curPack {
+		return s.openPack(n)
+	}
+	return nil
+}
+
+// dropIndexFile removes the index file before a compaction first
+// replaces a pack, so that if the compaction doesn't finish, the next
+// start rebuilds the index from the packs rather than trusting its
+// offsets into the old ones.
+func (s *storage) dropIndexFile() os.Error {
+	if s.idxFile == nil {
+		return nil // already dropped
+	}
+	s.idxFile.Close()
+	s.idxFile = nil
+	if err := os.Remove(s.indexPath()); err != nil && !osutil.ErrorIsNoEnt(err) {
+		return err
+	}
+	d, err := os.Open(s.root)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *storage) close() {
+	if s.current != nil {
+		s.current.Close()
+	}
+	if s.idxFile != nil {
+		s.idxFile.Close()
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskpacked
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"camli/blobref"
+)
+
+// quarantineDirName is the directory, under the root, that corrupt
+// blobs are copied to as individual files.
+const quarantineDirName = "quarantine"
+
+func (s *storage) quarantinePath(br *blobref.BlobRef) string {
+	return filepath.Join(s.root, quarantineDirName, br.String()+".dat")
+}
+
+// Quarantine copies a blob's record out of its pack into the
+// quarantine directory, then removes it.
+func (s *storage) Quarantine(br *blobref.BlobRef) os.Error {
+	rc, _, err := s.Fetch(br)
+	if err == os.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := os.MkdirAll(filepath.Join(s.root, quarantineDirName), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.quarantinePath(br), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return s.Remove([]*blobref.BlobRef{br})
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskpacked
+
+import (
+	"os"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/osutil"
+)
+
+// StorageStats counts the blobs in the index. Bytes is the size of
+// the live blobs, not of the pack files, which may be larger until
+// compacted.
+func (s *storage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	st := &blobserver.StorageStats{}
+	s.index.Each(func(_ string, size int64, _ interface{}) {
+		st.Blobs++
+		st.Bytes += size
+	})
+	free, err := osutil.DiskFree(s.root)
+	if err != nil {
+		return nil, err
+	}
+	st.FreeBytes = free
+	return st, nil
+}
+
+func (s *storage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return blobserver.StatFromIndex(&s.index, s.GetBlobHub(), dest, blobs, waitSeconds)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A sealed message is:
+//
+//   magic | iv | AES-256-CTR(plaintext) | HMAC-SHA256(magic | iv | ciphertext)
+//
+// The AES and HMAC keys are both derived from the key file's master key.
+const magic = "camli-encrypted-v1\n"
+
+const (
+	ivSize   = aes.BlockSize
+	macSize  = 32
+	overhead = len(magic) + ivSize + macSize
+)
+
+var errBadMessage = os.NewError("encrypt: message not sealed by this key, or corrupt")
+
+type crypter struct {
+	aesKey []byte
+	macKey []byte
+}
+
+func deriveKey(master []byte, purpose string) []byte {
+	h := hmac.NewSHA256(master)
+	io.WriteString(h, purpose)
+	return h.Sum()
+}
+
+func newCrypter(master []byte) (*crypter, os.Error) {
+	if len(master) < 16 {
+		return nil, fmt.Errorf("encrypt: master key too short (%d bytes); want at least 16", len(master))
+	}
+	return &crypter{
+		aesKey: deriveKey(master, "camli-encrypt aes"),
+		macKey: deriveKey(master, "camli-encrypt hmac"),
+	}, nil
+}
+
+// readKeyFile reads a hex-encoded master key, such as one generated
+// with "openssl rand -hex 32".
+func readKeyFile(path string) ([]byte, os.Error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: key file %q isn't hex: %v", path, err)
+	}
+	return key, nil
+}
+
+func (c *crypter) mac(msg []byte) []byte {
+	h := hmac.NewSHA256(c.macKey)
+	h.Write(msg)
+	return h.Sum()
+}
+
+// seal encrypts and authenticates plain, with a random IV.
+func (c *crypter) seal(plain []byte) ([]byte, os.Error) {
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(magic)+ivSize+len(plain), len(plain)+overhead)
+	copy(out, magic)
+	iv := out[len(magic) : len(magic)+ivSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(out[len(magic)+ivSize:], plain)
+	return append(out, c.mac(out)...), nil
+}
+
+// open verifies and decrypts a message made by seal.
+func (c *crypter) open(sealed []byte) ([]byte, os.Error) {
+	if len(sealed) < overhead || !bytes.HasPrefix(sealed, []byte(magic)) {
+		return nil, errBadMessage
+	}
+	body, sum := sealed[:len(sealed)-macSize], sealed[len(sealed)-macSize:]
+	if subtle.ConstantTimeCompare(c.mac(body), sum) != 1 {
+		return nil, errBadMessage
+	}
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := body[len(magic) : len(magic)+ivSize]
+	ciphertext := body[len(magic)+ivSize:]
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plain, ciphertext)
+	return plain, nil
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package encrypt registers the "encrypt" blobserver storage type, which
+encrypts blobs before storing them in another, untrusted storage
+(such as S3 or a remote server).
+
+Each blob is stored in the backend as a new blob whose contents are
+the encrypted (AES-256-CTR) and authenticated (HMAC-SHA256) plaintext
+blobref and blob. The backend only ever sees ciphertext and the
+blobrefs of ciphertext.
+
+The mapping from plaintext to ciphertext blobrefs is kept in memory
+and logged, encrypted, to the optional local indexFile. If the index
+file is missing or its last write was cut short, the mapping is
+rebuilt at startup by fetching and decrypting every blob in the
+backend. Without an indexFile that happens at every startup, which
+for a large or remote backend is slow and costly, so indexFile should
+only be left out for small backends.
+
+Example low-level config:
+
+     "/enc-s3/": {
+         "handler": "storage-encrypt",
+         "handlerArgs": {
+            "backend": "/s3/",
+            "keyFile": "/home/camli/.camli/encrypt.key",
+            "indexFile": "/home/camli/.camli/encrypt-s3.index"
+          }
+     },
+
+The key file holds a hex-encoded random master key, such as the
+output of "openssl rand -hex 32".
+*/
+package encrypt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+type mapping struct {
+	enc  *blobref.BlobRef // ciphertext blobref, in the backend
+	size int64            // plaintext size
+}
+
+type storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	backend   blobserver.Storage
+	crypter   *crypter
+	indexPath string // or empty
+
+	index blobserver.SortedIndex // plaintext blobref to *mapping
+
+	mu         sync.Mutex // guards following, and changes to index
+	indexLog   *os.File   // or nil
+	rebuilding bool       // whether rebuildIndex is writing indexLog
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	backendPrefix := config.RequiredString("backend")
+	keyFile := config.RequiredString("keyFile")
+	indexPath := config.OptionalString("indexFile", "")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	backend, err := ld.GetStorage(backendPrefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(backend, key, indexPath)
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("encrypt", blobserver.StorageConstructor(newFromConfig))
+}
+
+func newStorage(backend blobserver.Storage, key []byte, indexPath string) (*storage, os.Error) {
+	c, err := newCrypter(key)
+	if err != nil {
+		return nil, err
+	}
+	sto := &storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		backend:                   backend,
+		crypter:                   c,
+		indexPath:                 indexPath,
+	}
+	if err := sto.openIndex(); err != nil {
+		return nil, err
+	}
+	return sto, nil
+}
+
+// sealBlob returns the backend blob contents for the plaintext blob br.
+func (sto *storage) sealBlob(br *blobref.BlobRef, data []byte) ([]byte, os.Error) {
+	plain := make([]byte, 0, len(br.String())+1+len(data))
+	plain = append(plain, br.String()...)
+	plain = append(plain, '\n')
+	plain = append(plain, data...)
+	return sto.crypter.seal(plain)
+}
+
+// openBlob decrypts the backend blob contents sealed, returning the
+// plaintext blobref and blob.
+func (sto *storage) openBlob(sealed []byte) (*blobref.BlobRef, []byte, os.Error) {
+	plain, err := sto.crypter.open(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	nl := bytes.IndexByte(plain, '\n')
+	if nl < 0 {
+		return nil, nil, errBadMessage
+	}
+	br := blobref.Parse(string(plain[:nl]))
+	if br == nil {
+		return nil, nil, errBadMessage
+	}
+	return br, plain[nl+1:], nil
+}
+
+func (sto *storage) lookup(br *blobref.BlobRef) (m *mapping, ok bool) {
+	_, v, ok := sto.index.Get(br.String())
+	if !ok {
+		return nil, false
+	}
+	return v.(*mapping), true
+}
+
+func (sto *storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	m, ok := sto.lookup(br)
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	rc, _, err := sto.backend.FetchStreaming(m.enc)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	sealed, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	plainRef, data, err := sto.openBlob(sealed)
+	if err != nil {
+		return nil, 0, fmt.Errorf("encrypt: backend blob %s for %s: %v", m.enc, br, err)
+	}
+	if plainRef.String() != br.String() {
+		return nil, 0, fmt.Errorf("encrypt: backend blob %s holds %s, not %s", m.enc, plainRef, br)
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), int64(len(data)), nil
+}
+
+func (sto *storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	hash := br.Hash()
+	if hash == nil {
+		err = fmt.Errorf("encrypt: unsupported blobref hash type of %q", br.String())
+		return
+	}
+	var buf bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &buf), source)
+	if err != nil {
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	if m, ok := sto.lookup(br); ok {
+		return blobref.SizedBlobRef{br, m.size}, nil
+	}
+
+	sealed, err := sto.sealBlob(br, buf.Bytes())
+	if err != nil {
+		return
+	}
+	encHash := sha1.New()
+	encHash.Write(sealed)
+	encRef := blobref.FromHash("sha1", encHash)
+	if _, err = sto.backend.ReceiveBlob(encRef, bytes.NewBuffer(sealed)); err != nil {
+		return
+	}
+
+	sto.mu.Lock()
+	err = sto.setMapping(br.String(), &mapping{encRef, size})
+	sto.mu.Unlock()
+	if err != nil {
+		return
+	}
+	sto.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{br, size}, nil
+}
+
+func (sto *storage) Remove(blobs []*blobref.BlobRef) os.Error {
+	var encs []*blobref.BlobRef
+	var keys []string
+	for _, br := range blobs {
+		if m, ok := sto.lookup(br); ok {
+			encs = append(encs, m.enc)
+			keys = append(keys, br.String())
+		}
+	}
+	if len(encs) == 0 {
+		return nil
+	}
+	if err := sto.backend.Remove(encs); err != nil {
+		return err
+	}
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	for _, key := range keys {
+		if err := sto.setMapping(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sto *storage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return blobserver.StatFromIndex(&sto.index, sto.GetBlobHub(), dest, blobs, waitSeconds)
+}
+
+func (sto *storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return blobserver.EnumerateFromIndex(&sto.index, sto.GetBlobHub(), dest, after, limit, waitSeconds)
+}
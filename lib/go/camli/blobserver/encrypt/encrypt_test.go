@@ -0,0 +1,175 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestSealOpen(t *testing.T) {
+	c, err := newCrypter(testKey)
+	AssertNil(t, err, "newCrypter")
+	sealed, err := c.seal([]byte("hello"))
+	AssertNil(t, err, "seal")
+	plain, err := c.open(sealed)
+	AssertNil(t, err, "open")
+	ExpectString(t, "hello", string(plain), "opened")
+
+	sealed[len(magic)+ivSize] ^= 1
+	_, err = c.open(sealed)
+	Expect(t, err == errBadMessage, "tampered message rejected")
+
+	other, _ := newCrypter([]byte("fedcba9876543210fedcba9876543210"))
+	sealed, _ = c.seal([]byte("hello"))
+	_, err = other.open(sealed)
+	Expect(t, err == errBadMessage, "message under other key rejected")
+}
+
+func TestReceiveFetch(t *testing.T) {
+	backend := memory.New(0)
+	sto, err := newStorage(backend, testKey, "")
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{"foo, a secret"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, sto, foo)
+	storagetest.Upload(t, sto, bar)
+	storagetest.Upload(t, sto, foo) // dup
+	storagetest.ExpectContents(t, sto, foo)
+	storagetest.ExpectContents(t, sto, bar)
+
+	_, err = sto.ReceiveBlob(foo.BlobRef(), bar.Reader())
+	Expect(t, err != nil, "wrong digest rejected")
+
+	got := storagetest.EnumerateAll(t, sto)
+	ExpectInt(t, 2, len(got), "plaintext blobs")
+	for _, sb := range got {
+		if sb.BlobRef.String() == foo.BlobRef().String() {
+			ExpectInt(t, int(foo.Size()), int(sb.Size), "enumerated plaintext size")
+		}
+	}
+
+	encs := storagetest.EnumerateAll(t, backend)
+	ExpectInt(t, 2, len(encs), "backend blobs")
+	for _, sb := range encs {
+		rc, _, err := backend.FetchStreaming(sb.BlobRef)
+		AssertNil(t, err, "backend fetch")
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		Expect(t, !bytes.Contains(data, []byte("secret")), "backend blob is encrypted")
+		Expect(t, !strings.Contains(string(data), foo.BlobRef().String()), "backend blob hides blobref")
+	}
+
+	AssertNil(t, sto.Remove(foo.BlobRefSlice()), "Remove")
+	ExpectInt(t, 1, len(storagetest.EnumerateAll(t, sto)), "plaintext blobs after remove")
+	ExpectInt(t, 1, len(storagetest.EnumerateAll(t, backend)), "backend blobs after remove")
+}
+
+func TestRebuildFromBackend(t *testing.T) {
+	backend := memory.New(0)
+	sto, err := newStorage(backend, testKey, "")
+	AssertNil(t, err, "newStorage")
+	blobs := []*test.Blob{&test.Blob{"one"}, &test.Blob{"two"}, &test.Blob{"three"}}
+	for _, tb := range blobs {
+		storagetest.Upload(t, sto, tb)
+	}
+	// A blob not written by us is skipped.
+	junk := &test.Blob{"not encrypted"}
+	_, err = backend.ReceiveBlob(junk.BlobRef(), junk.Reader())
+	AssertNil(t, err, "upload junk to backend")
+
+	sto, err = newStorage(backend, testKey, "")
+	AssertNil(t, err, "newStorage")
+	ExpectInt(t, len(blobs), len(storagetest.EnumerateAll(t, sto)), "blobs after rebuild")
+	for _, tb := range blobs {
+		storagetest.ExpectContents(t, sto, tb)
+	}
+
+	// Under a different key, nothing is found.
+	sto, err = newStorage(backend, []byte("fedcba9876543210fedcba9876543210"), "")
+	AssertNil(t, err, "newStorage")
+	ExpectInt(t, 0, len(storagetest.EnumerateAll(t, sto)), "blobs under other key")
+}
+
+func TestIndexFile(t *testing.T) {
+	indexPath := fmt.Sprintf("%s/camli-encrypt-index-%d", os.TempDir(), os.Getpid())
+	defer os.Remove(indexPath)
+	os.Remove(indexPath)
+
+	backend := memory.New(0)
+	sto, err := newStorage(backend, testKey, indexPath)
+	AssertNil(t, err, "newStorage")
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, sto, foo)
+	storagetest.Upload(t, sto, bar)
+	AssertNil(t, sto.Remove(foo.BlobRefSlice()), "Remove")
+
+	contents, err := ioutil.ReadFile(indexPath)
+	AssertNil(t, err, "reading index")
+	Expect(t, !strings.Contains(string(contents), bar.BlobRef().String()), "index is encrypted")
+
+	// Replaying the index doesn't need the backend's blobs.
+	sto, err = newStorage(memory.New(0), testKey, indexPath)
+	AssertNil(t, err, "newStorage")
+	got := storagetest.EnumerateAll(t, sto)
+	ExpectInt(t, 1, len(got), "blobs from index")
+	ExpectString(t, bar.BlobRef().String(), got[0].BlobRef.String(), "blob from index")
+
+	// A torn last line makes the index be rebuilt from the backend,
+	// which still has bar.
+	f, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0600)
+	AssertNil(t, err, "opening index")
+	_, err = f.Write([]byte("0123abcd"))
+	f.Close()
+	AssertNil(t, err, "tearing index")
+	noIndex, err := newStorage(backend, testKey, "")
+	AssertNil(t, err, "newStorage")
+	storagetest.Upload(t, noIndex, &test.Blob{"baz"})
+	sto, err = newStorage(backend, testKey, indexPath)
+	AssertNil(t, err, "newStorage")
+	ExpectInt(t, 2, len(storagetest.EnumerateAll(t, sto)), "blobs after rebuilding torn index")
+	contents, err = ioutil.ReadFile(indexPath)
+	AssertNil(t, err, "reading rebuilt index")
+	Expect(t, strings.HasSuffix(string(contents), "\n"), "rebuilt index isn't torn")
+
+	// A wrong key can't read the index.
+	_, err = newStorage(backend, []byte("fedcba9876543210fedcba9876543210"), indexPath)
+	ExpectErrorContains(t, err, "bad index", "opening index with wrong key")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto, err := newStorage(memory.New(0), testKey, "")
+			AssertNil(t, err, "newStorage")
+			return sto, nil
+		},
+	})
+}
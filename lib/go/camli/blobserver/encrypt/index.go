@@ -0,0 +1,203 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/osutil"
+)
+
+// The index file is a log of lines, each the hex encoding of a sealed
+// message which is one of:
+//
+//   put <plain blobref> <ciphertext blobref> <plain size>
+//   del <plain blobref>
+
+// openIndex loads the plaintext to ciphertext mapping from the index
+// file, or rebuilds it from the backend.
+func (sto *storage) openIndex() os.Error {
+	if sto.indexPath == "" {
+		return sto.rebuildIndex()
+	}
+	f, err := os.Open(sto.indexPath)
+	if osutil.ErrorIsNoEnt(err) {
+		return sto.rebuildIndex()
+	}
+	if err != nil {
+		return err
+	}
+	torn, err := sto.replayIndex(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("encrypt: bad index %s (remove it to rebuild): %v", sto.indexPath, err)
+	}
+	if torn {
+		// The last write was cut short, so its blob is in the
+		// backend but can't be found without a rebuild.
+		log.Printf("encrypt: partial last line of %s; rebuilding index", sto.indexPath)
+		return sto.rebuildIndex()
+	}
+	sto.indexLog, err = os.OpenFile(sto.indexPath, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// replayIndex loads the index file's records. torn is whether its
+// last line is incomplete.
+func (sto *storage) replayIndex(f *os.File) (torn bool, err os.Error) {
+	r := bufio.NewReader(f)
+	for lineNum := 1; ; lineNum++ {
+		line, err := r.ReadString('\n')
+		if err == os.EOF {
+			return line != "", nil
+		}
+		if err != nil {
+			return false, err
+		}
+		sealed, err := hex.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			return false, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		plain, err := sto.crypter.open(sealed)
+		if err != nil {
+			return false, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		fields := strings.Fields(string(plain))
+		switch {
+		case len(fields) == 4 && fields[0] == "put":
+			enc := blobref.Parse(fields[2])
+			size, err := strconv.Atoi64(fields[3])
+			if enc == nil || err != nil || blobref.Parse(fields[1]) == nil {
+				return false, fmt.Errorf("line %d: bad put record", lineNum)
+			}
+			sto.index.Set(fields[1], size, &mapping{enc, size})
+		case len(fields) == 2 && fields[0] == "del":
+			sto.index.Delete(fields[1])
+		default:
+			return false, fmt.Errorf("line %d: unknown record", lineNum)
+		}
+	}
+	panic("unreachable")
+}
+
+// setMapping records (or if m is nil, deletes) the mapping for the
+// plaintext blobref key, logging it to the index file first.
+// sto.mu must be held.
+func (sto *storage) setMapping(key string, m *mapping) os.Error {
+	var rec string
+	if m == nil {
+		rec = "del " + key
+	} else {
+		rec = fmt.Sprintf("put %s %s %d", key, m.enc, m.size)
+	}
+	if sto.indexLog != nil {
+		sealed, err := sto.crypter.seal([]byte(rec))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(sto.indexLog, "%s\n", hex.EncodeToString(sealed)); err != nil {
+			return err
+		}
+		// A mapping lost in a crash would leave its blob
+		// unreachable until the index is rebuilt. A rebuild
+		// syncs its new index once, at the end.
+		if !sto.rebuilding {
+			if err := sto.indexLog.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if m == nil {
+		sto.index.Delete(key)
+	} else {
+		sto.index.Set(key, m.size, m)
+	}
+	return nil
+}
+
+// rebuildIndex re-creates the mapping by fetching and decrypting every
+// blob in the backend, writing a fresh index file if configured.
+// Backend blobs which weren't sealed with this key are skipped.
+func (sto *storage) rebuildIndex() os.Error {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	if sto.indexLog != nil {
+		sto.indexLog.Close()
+		sto.indexLog = nil
+	}
+	sto.index.Clear()
+
+	var tmpPath string
+	if sto.indexPath != "" {
+		tmpPath = sto.indexPath + ".tmp"
+		tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		sto.indexLog = tmp
+	}
+
+	sto.rebuilding = true
+	defer func() { sto.rebuilding = false }()
+	found, skipped := 0, 0
+	err := blobserver.EnumerateAll(sto.backend, func(sb blobref.SizedBlobRef) os.Error {
+		rc, _, err := sto.backend.FetchStreaming(sb.BlobRef)
+		if err != nil {
+			return err
+		}
+		sealed, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		plainRef, data, err := sto.openBlob(sealed)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		found++
+		return sto.setMapping(plainRef.String(), &mapping{sb.BlobRef, int64(len(data))})
+	})
+	if err != nil {
+		if sto.indexLog != nil {
+			sto.indexLog.Close()
+			sto.indexLog = nil
+			os.Remove(tmpPath)
+		}
+		return fmt.Errorf("encrypt: rebuilding index from backend: %v", err)
+	}
+	log.Printf("encrypt: rebuilt index from backend: %d blobs, %d skipped", found, skipped)
+	if sto.indexLog != nil {
+		if err := sto.indexLog.Sync(); err != nil {
+			return err
+		}
+		// indexLog stays open for appending after the rename.
+		if err := os.Rename(tmpPath, sto.indexPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
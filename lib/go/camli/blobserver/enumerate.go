@@ -0,0 +1,276 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"camli/blobref"
+)
+
+const enumerateAllBatch = 1000
+
+// EnumerateAll calls fn for each blob in src, in sorted order, without
+// waiting for new blobs. It stops at the first error from either src
+// or fn.
+func EnumerateAll(src Storage, fn func(sb blobref.SizedBlobRef) os.Error) os.Error {
+	return EnumerateAllAfter(src, "", fn)
+}
+
+// EnumerateAllAfter is like EnumerateAll, but starts after the blobref
+// after.
+func EnumerateAllAfter(src Storage, after string, fn func(sb blobref.SizedBlobRef) os.Error) os.Error {
+	for {
+		ch := make(chan blobref.SizedBlobRef, 16)
+		errch := make(chan os.Error, 1)
+		go func() {
+			errch <- src.EnumerateBlobs(ch, after, enumerateAllBatch, 0)
+		}()
+		n := 0
+		var fnErr os.Error
+		for sb := range ch {
+			n++
+			after = sb.BlobRef.String()
+			if fnErr == nil {
+				fnErr = fn(sb)
+			}
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+		if n < enumerateAllBatch {
+			return nil
+		}
+	}
+	panic("unreachable")
+}
+
+// A BlobIndex is an in-memory index of a storage's blobs, for
+// storages which can't cheaply stat or enumerate what they store
+// (such as wrappers around another storage). Its methods must be safe
+// for concurrent use.
+type BlobIndex interface {
+	// StatIndex returns those of blobs in the index, with
+	// their sizes, and those missing from it.
+	StatIndex(blobs []*blobref.BlobRef) (found []blobref.SizedBlobRef, missing []*blobref.BlobRef)
+
+	// EnumerateIndex returns up to limit blobs in the index,
+	// sorted after after.
+	EnumerateIndex(after string, limit uint) []blobref.SizedBlobRef
+}
+
+// StatFromIndex implements Storage.Stat for a storage with a
+// BlobIndex, waiting on hub for up to waitSeconds for blobs which
+// aren't there yet.
+func StatFromIndex(idx BlobIndex, hub BlobHub, dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	found, missing := idx.StatIndex(blobs)
+	for _, sb := range found {
+		dest <- sb
+	}
+	if len(missing) == 0 || waitSeconds == 0 {
+		return nil
+	}
+	if waitSeconds > 60 {
+		// TODO: use a flag, defaulting to 60?
+		waitSeconds = 60
+	}
+
+	ch := make(chan *blobref.BlobRef, 1)
+	for _, br := range missing {
+		hub.RegisterBlobListener(br, ch)
+		defer hub.UnregisterBlobListener(br, ch)
+	}
+
+	// Re-check: a blob may have arrived before the listeners
+	// were registered.
+	found, missing = idx.StatIndex(missing)
+	for _, sb := range found {
+		dest <- sb
+	}
+	needed := len(missing)
+
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	for needed > 0 {
+		select {
+		case <-timer.C:
+			// Done waiting.
+			return nil
+		case br := <-ch:
+			if found, _ := idx.StatIndex([]*blobref.BlobRef{br}); len(found) == 1 {
+				dest <- found[0]
+				needed--
+			}
+		}
+	}
+	return nil
+}
+
+// EnumerateFromIndex implements Storage.EnumerateBlobs for a storage
+// with a BlobIndex, waiting on hub for up to waitSeconds for a blob if
+// there are none after after yet.
+func EnumerateFromIndex(idx BlobIndex, hub BlobHub, dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+
+	sbs := idx.EnumerateIndex(after, limit)
+	if len(sbs) == 0 && waitSeconds > 0 {
+		// Wait for waitSeconds for any blob to possibly appear.
+		ch := make(chan *blobref.BlobRef, 1)
+		hub.RegisterListener(ch)
+		defer hub.UnregisterListener(ch)
+		if sbs = idx.EnumerateIndex(after, limit); len(sbs) == 0 {
+			timer := time.NewTimer(int64(waitSeconds) * 1e9)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				// Done waiting.
+				return nil
+			case <-ch:
+				// Something arrived. Just re-scan.
+				sbs = idx.EnumerateIndex(after, limit)
+			}
+		}
+	}
+	for _, sb := range sbs {
+		dest <- sb
+	}
+	return nil
+}
+
+// keysAfter returns up to limit of the sorted keys which sort after
+// after.
+func keysAfter(sorted []string, after string, limit uint) []string {
+	i := sort.SearchStrings(sorted, after)
+	if i < len(sorted) && sorted[i] == after {
+		i++
+	}
+	keys := sorted[i:]
+	if uint(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// A SortedIndex is a BlobIndex held in memory, mapping blobrefs to
+// their sizes and to a value of the storage's choosing. The sorted
+// keys for EnumerateIndex are kept until the next change. Its zero
+// value is an empty index, and it's safe for concurrent use.
+type SortedIndex struct {
+	mu     sync.Mutex
+	m      map[string]indexEntry
+	sorted []string // sorted keys of m, or nil if dirty
+}
+
+type indexEntry struct {
+	size int64
+	val  interface{}
+}
+
+// Get returns the size and value of key.
+func (ix *SortedIndex) Get(key string) (size int64, val interface{}, ok bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e, ok := ix.m[key]
+	return e.size, e.val, ok
+}
+
+// Set adds key to the index, or replaces its size and value.
+func (ix *SortedIndex) Set(key string, size int64, val interface{}) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.m == nil {
+		ix.m = make(map[string]indexEntry)
+	}
+	if _, ok := ix.m[key]; !ok {
+		ix.sorted = nil
+	}
+	ix.m[key] = indexEntry{size, val}
+}
+
+// Delete removes key from the index, if present.
+func (ix *SortedIndex) Delete(key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, ok := ix.m[key]; ok {
+		ix.m[key] = indexEntry{}, false
+		ix.sorted = nil
+	}
+}
+
+// Clear removes every key from the index.
+func (ix *SortedIndex) Clear() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.m = nil
+	ix.sorted = nil
+}
+
+// Len returns the number of keys in the index.
+func (ix *SortedIndex) Len() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.m)
+}
+
+// Each calls fn for each key in the index, in no particular order.
+// fn mustn't change the index.
+func (ix *SortedIndex) Each(fn func(key string, size int64, val interface{})) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for key, e := range ix.m {
+		fn(key, e.size, e.val)
+	}
+}
+
+// StatIndex implements BlobIndex.
+func (ix *SortedIndex) StatIndex(blobs []*blobref.BlobRef) (found []blobref.SizedBlobRef, missing []*blobref.BlobRef) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, br := range blobs {
+		if e, ok := ix.m[br.String()]; ok {
+			found = append(found, blobref.SizedBlobRef{br, e.size})
+		} else {
+			missing = append(missing, br)
+		}
+	}
+	return
+}
+
+// EnumerateIndex implements BlobIndex.
+func (ix *SortedIndex) EnumerateIndex(after string, limit uint) []blobref.SizedBlobRef {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.sorted == nil {
+		ix.sorted = make([]string, 0, len(ix.m))
+		for key := range ix.m {
+			ix.sorted = append(ix.sorted, key)
+		}
+		sort.SortStrings(ix.sorted)
+	}
+	keys := keysAfter(ix.sorted, after, limit)
+	sbs := make([]blobref.SizedBlobRef, 0, len(keys))
+	for _, key := range keys {
+		sbs = append(sbs, blobref.SizedBlobRef{blobref.Parse(key), ix.m[key].size})
+	}
+	return sbs
+}
@@ -0,0 +1,413 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package erasure registers the "erasure" blobserver storage type, which
+splits each blob into Reed-Solomon coded shards stored across several
+backends. With D data and P parity shards, any D shards suffice to
+rebuild a blob, so up to P backends may be lost or corrupt, at a
+storage cost of (D+P)/D rather than a replica's full copies.
+
+There must be exactly D+P backends; shard i of every blob is stored
+in backend i as a blob of its own, starting with a header line:
+
+   "camli-erasure " <blobref> " " <size> " " <i> " " <D> " " <P> "\n"
+
+The index of which shards exist is rebuilt at startup from these
+headers. If repairOnStart is set, every shard is then read and
+checked in the background, and those missing from any backend (for
+instance, after replacing a failed disk) or corrupt are re-created.
+
+Example low-level config:
+
+     "/erasure/": {
+         "handler": "storage-erasure",
+         "handlerArgs": {
+            "backends": ["/d1/", "/d2/", "/d3/", "/d4/", "/d5/", "/d6/"],
+            "dataShards": 4,
+            "parityShards": 2,
+            "minWritesForSuccess": 5,
+            "repairOnStart": true
+          }
+     },
+*/
+package erasure
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+const headerMagic = "camli-erasure "
+
+type blobInfo struct {
+	size   int64
+	shards []*blobref.BlobRef // by shard number; nil if missing
+}
+
+// present returns the number of shards known to exist.
+func (bi *blobInfo) present() int {
+	n := 0
+	for _, s := range bi.shards {
+		if s != nil {
+			n++
+		}
+	}
+	return n
+}
+
+type storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	backendPrefixes []string
+	backends        []blobserver.Storage
+	codec           *rsCodec
+
+	// Minimum number of shard writes that must succeed before
+	// acknowledging success to the client.
+	minWritesForSuccess int
+
+	// index holds the blobs with enough shards to rebuild, as
+	// *blobInfo. A blobInfo isn't changed once it's in the index.
+	index blobserver.SortedIndex
+
+	mu      sync.Mutex           // guards following, and changes to index
+	partial map[string]*blobInfo // blobs with too few shards to rebuild
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	prefixes := config.RequiredList("backends")
+	data := config.RequiredInt("dataShards")
+	parity := config.RequiredInt("parityShards")
+	minWrites := config.OptionalInt("minWritesForSuccess", len(prefixes))
+	repair := config.OptionalBool("repairOnStart", false)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if data+parity != len(prefixes) {
+		return nil, fmt.Errorf("erasure: have %d backends; need dataShards+parityShards = %d", len(prefixes), data+parity)
+	}
+	backends := make([]blobserver.Storage, len(prefixes))
+	for i, prefix := range prefixes {
+		sto, err := ld.GetStorage(prefix)
+		if err != nil {
+			return nil, err
+		}
+		backends[i] = sto
+	}
+	sto, err := newStorage(backends, data, parity, minWrites)
+	if err != nil {
+		return nil, err
+	}
+	sto.backendPrefixes = prefixes
+	if repair {
+		go func() {
+			n, err := sto.repair()
+			log.Printf("erasure: repaired %d blobs; error = %v", n, err)
+		}()
+	}
+	return sto, nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("erasure", blobserver.StorageConstructor(newFromConfig))
+}
+
+func newStorage(backends []blobserver.Storage, data, parity, minWrites int) (*storage, os.Error) {
+	codec, err := newRSCodec(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	if minWrites < data || minWrites > data+parity {
+		return nil, fmt.Errorf("erasure: minWritesForSuccess must be between %d and %d", data, data+parity)
+	}
+	sto := &storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		backends:                  backends,
+		codec:                     codec,
+		minWritesForSuccess:       minWrites,
+		partial:                   make(map[string]*blobInfo),
+	}
+	if err := sto.rebuildIndex(); err != nil {
+		return nil, err
+	}
+	return sto, nil
+}
+
+// shardBlob returns the blobref and contents of shard n of blob br.
+func (sto *storage) shardBlob(br *blobref.BlobRef, size int64, n int, shard []byte) (*blobref.BlobRef, []byte) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%s %d %d %d %d\n", headerMagic, br, size, n, sto.codec.data, sto.codec.parity)
+	buf.Write(shard)
+	h := sha1.New()
+	h.Write(buf.Bytes())
+	return blobref.FromHash("sha1", h), buf.Bytes()
+}
+
+// lookup returns the size and shards of a rebuildable blob.
+func (sto *storage) lookup(br *blobref.BlobRef) (size int64, shards []*blobref.BlobRef, ok bool) {
+	_, v, ok := sto.index.Get(br.String())
+	if !ok {
+		return 0, nil, false
+	}
+	bi := v.(*blobInfo)
+	return bi.size, bi.shards, true
+}
+
+// fetchShard fetches and verifies shard n of br from its backend.
+func (sto *storage) fetchShard(br *blobref.BlobRef, size int64, n int, shardRef *blobref.BlobRef) ([]byte, os.Error) {
+	rc, _, err := sto.backends[n].FetchStreaming(shardRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	h := shardRef.Hash()
+	contents, err := ioutil.ReadAll(io.TeeReader(rc, h))
+	if err != nil {
+		return nil, err
+	}
+	if !shardRef.HashMatches(h) {
+		return nil, blobserver.ErrCorruptBlob
+	}
+	hdr, err := parseHeader(contents)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.br.String() != br.String() || hdr.size != size || hdr.n != n {
+		return nil, fmt.Errorf("erasure: shard %s isn't shard %d of %s", shardRef, n, br)
+	}
+	shard := contents[hdr.len:]
+	if len(shard) != sto.codec.shardSize(size) {
+		return nil, fmt.Errorf("erasure: shard %s has wrong length %d", shardRef, len(shard))
+	}
+	return shard, nil
+}
+
+// fetchShards returns all shards of br, reconstructing any missing
+// or corrupt ones. It tries the data shards first, and only fetches
+// parity shards if needed.
+func (sto *storage) fetchShards(br *blobref.BlobRef, size int64, shardRefs []*blobref.BlobRef) ([][]byte, os.Error) {
+	shards := make([][]byte, len(shardRefs))
+	fetch := func(nums []int) {
+		var wg sync.WaitGroup
+		for _, n := range nums {
+			if shardRefs[n] == nil {
+				continue
+			}
+			n := n
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				shard, err := sto.fetchShard(br, size, n, shardRefs[n])
+				if err != nil {
+					log.Printf("erasure: fetching shard %d of %s: %v", n, br, err)
+					return
+				}
+				shards[n] = shard
+			}()
+		}
+		wg.Wait()
+	}
+	var dataNums, parityNums []int
+	for n := range shards {
+		if n < sto.codec.data {
+			dataNums = append(dataNums, n)
+		} else {
+			parityNums = append(parityNums, n)
+		}
+	}
+	fetch(dataNums)
+	for n := 0; n < sto.codec.data; n++ {
+		if shards[n] == nil {
+			fetch(parityNums)
+			break
+		}
+	}
+	if err := sto.codec.reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("erasure: can't rebuild %s: %v", br, err)
+	}
+	return shards, nil
+}
+
+func (sto *storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	size, shardRefs, ok := sto.lookup(br)
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	shards, err := sto.fetchShards(br, size, shardRefs)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := sto.codec.join(shards, size)
+	h := br.Hash()
+	h.Write(data)
+	if !br.HashMatches(h) {
+		return nil, 0, fmt.Errorf("erasure: rebuilt %s doesn't match its digest", br)
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), size, nil
+}
+
+func (sto *storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	hash := br.Hash()
+	if hash == nil {
+		err = fmt.Errorf("erasure: unsupported blobref hash type of %q", br.String())
+		return
+	}
+	var buf bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &buf), source)
+	if err != nil {
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	if size0, _, ok := sto.lookup(br); ok {
+		return blobref.SizedBlobRef{br, size0}, nil
+	}
+
+	shards := sto.codec.split(buf.Bytes())
+	sto.codec.encode(shards)
+	nums := make([]int, len(shards))
+	for n := range nums {
+		nums[n] = n
+	}
+	written, err := sto.writeShards(br, size, shards, nums)
+	if len(written) < sto.minWritesForSuccess {
+		// Don't leave a blob behind which we didn't acknowledge.
+		for n, ref := range written {
+			sto.backends[n].Remove([]*blobref.BlobRef{ref})
+		}
+		if err == nil {
+			err = fmt.Errorf("erasure: wrote %d shards; need %d", len(written), sto.minWritesForSuccess)
+		}
+		return
+	}
+
+	sto.mu.Lock()
+	bi := &blobInfo{size: size, shards: make([]*blobref.BlobRef, len(shards))}
+	for n, ref := range written {
+		bi.shards[n] = ref
+	}
+	sto.setInfo(br.String(), bi)
+	sto.mu.Unlock()
+
+	sto.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{br, size}, nil
+}
+
+// writeShards writes the shards numbered nums to their backends,
+// returning the blobrefs of those written successfully and the
+// last error.
+func (sto *storage) writeShards(br *blobref.BlobRef, size int64, shards [][]byte, nums []int) (map[int]*blobref.BlobRef, os.Error) {
+	type result struct {
+		n   int
+		ref *blobref.BlobRef
+		err os.Error
+	}
+	resc := make(chan result, len(nums))
+	for _, n := range nums {
+		ref, contents := sto.shardBlob(br, size, n, shards[n])
+		go func(n int) {
+			_, err := sto.backends[n].ReceiveBlob(ref, bytes.NewBuffer(contents))
+			resc <- result{n, ref, err}
+		}(n)
+	}
+	written := make(map[int]*blobref.BlobRef)
+	var lastErr os.Error
+	for _ = range nums {
+		res := <-resc
+		if res.err != nil {
+			log.Printf("erasure: writing shard %d of %s: %v", res.n, br, res.err)
+			lastErr = res.err
+			continue
+		}
+		written[res.n] = res.ref
+	}
+	return written, lastErr
+}
+
+// info returns what's known of key's shards, whether or not there
+// are enough to rebuild it. sto.mu must be held.
+func (sto *storage) info(key string) *blobInfo {
+	if _, v, ok := sto.index.Get(key); ok {
+		return v.(*blobInfo)
+	}
+	return sto.partial[key]
+}
+
+// setInfo sets or (if bi is nil) deletes key's shards, in the index
+// if there are enough to rebuild it. sto.mu must be held.
+func (sto *storage) setInfo(key string, bi *blobInfo) {
+	if bi != nil && bi.present() >= sto.codec.data {
+		sto.index.Set(key, bi.size, bi)
+		sto.partial[key] = nil, false
+		return
+	}
+	sto.index.Delete(key)
+	if bi == nil {
+		sto.partial[key] = nil, false
+	} else {
+		sto.partial[key] = bi
+	}
+}
+
+func (sto *storage) Remove(blobs []*blobref.BlobRef) os.Error {
+	toRemove := make([][]*blobref.BlobRef, len(sto.backends))
+	sto.mu.Lock()
+	for _, br := range blobs {
+		bi := sto.info(br.String())
+		if bi == nil {
+			continue
+		}
+		for n, ref := range bi.shards {
+			if ref != nil {
+				toRemove[n] = append(toRemove[n], ref)
+			}
+		}
+		sto.setInfo(br.String(), nil)
+	}
+	sto.mu.Unlock()
+
+	var reterr os.Error
+	for n, refs := range toRemove {
+		if len(refs) == 0 {
+			continue
+		}
+		if err := sto.backends[n].Remove(refs); err != nil {
+			reterr = err
+		}
+	}
+	return reterr
+}
+
+func (sto *storage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return blobserver.StatFromIndex(&sto.index, sto.GetBlobHub(), dest, blobs, waitSeconds)
+}
+
+func (sto *storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return blobserver.EnumerateFromIndex(&sto.index, sto.GetBlobHub(), dest, after, limit, waitSeconds)
+}
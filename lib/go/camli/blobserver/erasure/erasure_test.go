@@ -0,0 +1,237 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erasure
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func newBackends(n int) ([]blobserver.Storage, []*memory.Storage) {
+	sto := make([]blobserver.Storage, n)
+	mem := make([]*memory.Storage, n)
+	for i := range sto {
+		mem[i] = memory.New(0)
+		sto[i] = mem[i]
+	}
+	return sto, mem
+}
+
+// wipe removes every blob from a backend, as if its disk were replaced.
+func wipe(t *testing.T, s blobserver.Storage) {
+	var all []*blobref.BlobRef
+	for _, sb := range storagetest.EnumerateAll(t, s) {
+		all = append(all, sb.BlobRef)
+	}
+	AssertNil(t, s.Remove(all), "wiping backend")
+}
+
+var testBlobs = []*test.Blob{
+	&test.Blob{""},
+	&test.Blob{"a"},
+	&test.Blob{"some blob which is longer than four bytes"},
+}
+
+func TestReceiveFetchDegraded(t *testing.T) {
+	backends, mem := newBackends(6)
+	sto, err := newStorage(backends, 4, 2, 6)
+	AssertNil(t, err, "newStorage")
+	for _, tb := range testBlobs {
+		storagetest.Upload(t, sto, tb)
+	}
+	for _, m := range mem {
+		ExpectInt(t, len(testBlobs), m.NumBlobs(), "shards in backend")
+	}
+
+	// Losing any two backends still allows reading.
+	wipe(t, backends[1])
+	wipe(t, backends[4])
+	for _, tb := range testBlobs {
+		storagetest.ExpectContents(t, sto, tb)
+	}
+
+	// Restarting notices the lost shards, but can still read.
+	sto, err = newStorage(backends, 4, 2, 6)
+	AssertNil(t, err, "newStorage")
+	for _, tb := range testBlobs {
+		storagetest.ExpectContents(t, sto, tb)
+	}
+
+	// A third loss is too many.
+	wipe(t, backends[0])
+	_, _, err = sto.FetchStreaming(testBlobs[2].BlobRef())
+	Expect(t, err != nil, "fetch with three lost shards fails")
+}
+
+func TestRepair(t *testing.T) {
+	backends, mem := newBackends(5)
+	sto, err := newStorage(backends, 3, 2, 5)
+	AssertNil(t, err, "newStorage")
+	for _, tb := range testBlobs {
+		storagetest.Upload(t, sto, tb)
+	}
+
+	wipe(t, backends[2])
+	n, err := sto.repair()
+	AssertNil(t, err, "repair")
+	ExpectInt(t, len(testBlobs), n, "blobs repaired")
+	ExpectInt(t, len(testBlobs), mem[2].NumBlobs(), "shards in replaced backend")
+
+	// Now two other backends can be lost.
+	wipe(t, backends[0])
+	wipe(t, backends[4])
+	sto, err = newStorage(backends, 3, 2, 5)
+	AssertNil(t, err, "newStorage")
+	for _, tb := range testBlobs {
+		storagetest.ExpectContents(t, sto, tb)
+	}
+}
+
+// faultyBackend is a backend which can corrupt the shards it's
+// asked for, until they're removed, and run a func after the next
+// EnumerateBlobs.
+type faultyBackend struct {
+	blobserver.Storage
+	corrupt        map[string]bool
+	afterEnumerate func()
+}
+
+func newFaultyBackend() *faultyBackend {
+	return &faultyBackend{Storage: memory.New(0), corrupt: make(map[string]bool)}
+}
+
+func (fb *faultyBackend) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	rc, size, err := fb.Storage.FetchStreaming(br)
+	if err != nil || !fb.corrupt[br.String()] {
+		return rc, size, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	data[len(data)-1] ^= 1
+	return ioutil.NopCloser(bytes.NewBuffer(data)), size, nil
+}
+
+func (fb *faultyBackend) Remove(blobs []*blobref.BlobRef) os.Error {
+	for _, br := range blobs {
+		fb.corrupt[br.String()] = false, false
+	}
+	return fb.Storage.Remove(blobs)
+}
+
+func (fb *faultyBackend) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	err := fb.Storage.EnumerateBlobs(dest, after, limit, waitSeconds)
+	if fn := fb.afterEnumerate; fn != nil {
+		fb.afterEnumerate = nil
+		fn()
+	}
+	return err
+}
+
+func TestRepairCorrupt(t *testing.T) {
+	faulty := make([]*faultyBackend, 5)
+	backends := make([]blobserver.Storage, len(faulty))
+	for i := range faulty {
+		faulty[i] = newFaultyBackend()
+		backends[i] = faulty[i]
+	}
+	sto, err := newStorage(backends, 3, 2, 5)
+	AssertNil(t, err, "newStorage")
+	for _, tb := range testBlobs {
+		storagetest.Upload(t, sto, tb)
+	}
+	_, shards, ok := sto.lookup(testBlobs[2].BlobRef())
+	Assert(t, ok, "blob in index")
+	faulty[1].corrupt[shards[1].String()] = true
+
+	n, err := sto.repair()
+	AssertNil(t, err, "repair")
+	ExpectInt(t, 1, n, "blobs repaired")
+	ExpectInt(t, 0, len(faulty[1].corrupt), "corrupt shards left")
+
+	// The rewritten shard is good, so two other backends can be lost.
+	wipe(t, backends[0])
+	wipe(t, backends[4])
+	sto, err = newStorage(backends, 3, 2, 5)
+	AssertNil(t, err, "newStorage")
+	storagetest.ExpectContents(t, sto, testBlobs[2])
+}
+
+func TestRepairKeepsNewBlobs(t *testing.T) {
+	faulty := make([]*faultyBackend, 3)
+	backends := make([]blobserver.Storage, len(faulty))
+	for i := range faulty {
+		faulty[i] = newFaultyBackend()
+		backends[i] = faulty[i]
+	}
+	sto, err := newStorage(backends, 2, 1, 3)
+	AssertNil(t, err, "newStorage")
+	storagetest.Upload(t, sto, testBlobs[0])
+
+	// Upload a blob once the scan has read every backend, so it
+	// doesn't see it.
+	faulty[2].afterEnumerate = func() {
+		storagetest.Upload(t, sto, testBlobs[1])
+	}
+	_, err = sto.repair()
+	AssertNil(t, err, "repair")
+	storagetest.ExpectContents(t, sto, testBlobs[0])
+	storagetest.ExpectContents(t, sto, testBlobs[1])
+	ExpectInt(t, 2, len(storagetest.EnumerateAll(t, sto)), "enumerated blobs")
+}
+
+func TestRemoveAndEnumerate(t *testing.T) {
+	backends, mem := newBackends(3)
+	sto, err := newStorage(backends, 2, 1, 3)
+	AssertNil(t, err, "newStorage")
+	for _, tb := range testBlobs {
+		storagetest.Upload(t, sto, tb)
+	}
+	AssertNil(t, sto.Remove(testBlobs[1].BlobRefSlice()), "Remove")
+	for _, m := range mem {
+		ExpectInt(t, len(testBlobs)-1, m.NumBlobs(), "shards after remove")
+	}
+
+	got := storagetest.EnumerateAll(t, sto)
+	ExpectInt(t, len(testBlobs)-1, len(got), "enumerated blobs")
+	for i := 1; i < len(got); i++ {
+		Expect(t, got[i-1].BlobRef.String() < got[i].BlobRef.String(), "enumerate sorted")
+	}
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			backends, _ := newBackends(5)
+			sto, err := newStorage(backends, 3, 2, 5)
+			AssertNil(t, err, "newStorage")
+			return sto, nil
+		},
+	})
+}
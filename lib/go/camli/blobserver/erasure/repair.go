@@ -0,0 +1,305 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erasure
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// maxHeaderLen bounds a shard's header line.
+const maxHeaderLen = 512
+
+type shardHeader struct {
+	br           *blobref.BlobRef
+	size         int64
+	n            int
+	data, parity int
+	len          int // of the header line, including its newline
+}
+
+func parseHeader(contents []byte) (*shardHeader, os.Error) {
+	nl := bytes.IndexByte(contents, '\n')
+	if nl < 0 || !bytes.HasPrefix(contents, []byte(headerMagic)) {
+		return nil, os.NewError("erasure: not a shard")
+	}
+	fields := strings.Fields(string(contents[len(headerMagic):nl]))
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("erasure: bad shard header %q", contents[:nl])
+	}
+	h := &shardHeader{br: blobref.Parse(fields[0]), len: nl + 1}
+	var err [4]os.Error
+	h.size, err[0] = strconv.Atoi64(fields[1])
+	h.n, err[1] = strconv.Atoi(fields[2])
+	h.data, err[2] = strconv.Atoi(fields[3])
+	h.parity, err[3] = strconv.Atoi(fields[4])
+	if h.br == nil || err[0] != nil || err[1] != nil || err[2] != nil || err[3] != nil {
+		return nil, fmt.Errorf("erasure: bad shard header %q", contents[:nl])
+	}
+	return h, nil
+}
+
+// readHeader reads just the header line of a shard blob in backend n.
+func (sto *storage) readHeader(n int, ref *blobref.BlobRef) (*shardHeader, os.Error) {
+	rc, _, err := sto.backends[n].FetchStreaming(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	r, _ := bufio.NewReaderSize(rc, maxHeaderLen)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, os.NewError("erasure: not a shard")
+	}
+	return parseHeader(line)
+}
+
+// readShard reads all of a shard blob in backend n, verifying it
+// against its blobref. A shard which doesn't match is
+// blobserver.ErrCorruptBlob.
+func (sto *storage) readShard(n int, ref *blobref.BlobRef) (*shardHeader, os.Error) {
+	rc, _, err := sto.backends[n].FetchStreaming(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	h := ref.Hash()
+	if h == nil {
+		return nil, os.NewError("erasure: not a shard")
+	}
+	contents, err := ioutil.ReadAll(io.TeeReader(rc, h))
+	if err != nil {
+		return nil, err
+	}
+	if !ref.HashMatches(h) {
+		return nil, blobserver.ErrCorruptBlob
+	}
+	return parseHeader(contents)
+}
+
+// scanShards reads the header of every blob in every backend,
+// returning what shards exist of each blob. If verify is set, each
+// shard is read in full and corrupt ones are left out, so that
+// repair re-creates them.
+func (sto *storage) scanShards(verify bool) (map[string]*blobInfo, os.Error) {
+	index := make(map[string]*blobInfo)
+	total := len(sto.backends)
+	for n := range sto.backends {
+		skipped, corrupt := 0, 0
+		err := blobserver.EnumerateAll(sto.backends[n], func(sb blobref.SizedBlobRef) os.Error {
+			var hdr *shardHeader
+			var err os.Error
+			if verify {
+				hdr, err = sto.readShard(n, sb.BlobRef)
+			} else {
+				hdr, err = sto.readHeader(n, sb.BlobRef)
+			}
+			if err == blobserver.ErrCorruptBlob {
+				log.Printf("erasure: blob %s in backend %d is corrupt", sb.BlobRef, n)
+				corrupt++
+				return nil
+			}
+			if err != nil || hdr.n != n || hdr.data != sto.codec.data || hdr.parity != sto.codec.parity {
+				skipped++
+				return nil
+			}
+			key := hdr.br.String()
+			bi, ok := index[key]
+			if !ok {
+				bi = &blobInfo{size: hdr.size, shards: make([]*blobref.BlobRef, total)}
+				index[key] = bi
+			}
+			if bi.size != hdr.size {
+				log.Printf("erasure: shard %s of %s disagrees about its size; skipping", sb.BlobRef, key)
+				skipped++
+				return nil
+			}
+			bi.shards[n] = sb.BlobRef
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("erasure: reading backend %d: %v", n, err)
+		}
+		if skipped > 0 {
+			log.Printf("erasure: skipped %d blobs in backend %d which aren't our shards", skipped, n)
+		}
+		if corrupt > 0 {
+			log.Printf("erasure: %d corrupt shards in backend %d", corrupt, n)
+		}
+	}
+	return index, nil
+}
+
+// logLost logs how many blobs have too few shards to rebuild.
+// sto.mu must be held.
+func (sto *storage) logLost() {
+	if lost := len(sto.partial); lost > 0 {
+		log.Printf("erasure: %d blobs have too few shards to rebuild", lost)
+	}
+}
+
+// rebuildIndex re-creates the index of shards by reading the header
+// of every blob in every backend.
+func (sto *storage) rebuildIndex() os.Error {
+	index, err := sto.scanShards(false)
+	if err != nil {
+		return err
+	}
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	sto.index.Clear()
+	sto.partial = make(map[string]*blobInfo)
+	for key, bi := range index {
+		sto.setInfo(key, bi)
+	}
+	sto.logLost()
+	return nil
+}
+
+// snapshot returns the shards known of each blob.
+func (sto *storage) snapshot() map[string]*blobInfo {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	snap := make(map[string]*blobInfo)
+	sto.index.Each(func(key string, _ int64, v interface{}) {
+		snap[key] = v.(*blobInfo)
+	})
+	for key, bi := range sto.partial {
+		snap[key] = bi
+	}
+	return snap
+}
+
+// merge updates the index with the shards found by a scan, which
+// started when the index was before. Blobs received or repaired
+// during the scan keep their shards, adding only those the scan
+// found in addition; those removed during it stay removed. Any other
+// blob now has exactly the shards the scan found.
+func (sto *storage) merge(before, scanned map[string]*blobInfo) {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range scanned {
+		keys[key] = true
+	}
+	for key := range keys {
+		live, sc := sto.info(key), scanned[key]
+		switch {
+		case live == nil:
+			if before[key] == nil && sc != nil {
+				sto.setInfo(key, sc)
+			}
+		case live == before[key]:
+			sto.setInfo(key, sc)
+		case sc != nil:
+			merged := &blobInfo{size: live.size, shards: make([]*blobref.BlobRef, len(live.shards))}
+			copy(merged.shards, live.shards)
+			for n, ref := range sc.shards {
+				if merged.shards[n] == nil && live.size == sc.size {
+					merged.shards[n] = ref
+				}
+			}
+			sto.setInfo(key, merged)
+		}
+	}
+	sto.logLost()
+}
+
+// repair reads and verifies every shard in the backends, and
+// re-creates those which are missing or corrupt, such as after a
+// backend is replaced with an empty one. Blobs received while it
+// runs are left as they are. It returns the number of blobs
+// repaired, and the last error.
+func (sto *storage) repair() (repaired int, err os.Error) {
+	before := sto.snapshot()
+	scanned, err := sto.scanShards(true)
+	if err != nil {
+		return 0, err
+	}
+	sto.merge(before, scanned)
+
+	type damaged struct {
+		br      *blobref.BlobRef
+		size    int64
+		shards  []*blobref.BlobRef
+		missing []int
+	}
+	var todo []damaged
+	sto.index.Each(func(key string, _ int64, v interface{}) {
+		bi := v.(*blobInfo)
+		if bi.present() == len(bi.shards) {
+			return
+		}
+		d := damaged{br: blobref.Parse(key), size: bi.size, shards: bi.shards}
+		for n, ref := range bi.shards {
+			if ref == nil {
+				d.missing = append(d.missing, n)
+			}
+		}
+		todo = append(todo, d)
+	})
+
+	for _, d := range todo {
+		shards, ferr := sto.fetchShards(d.br, d.size, d.shards)
+		if ferr != nil {
+			log.Printf("erasure: repair of %s: %v", d.br, ferr)
+			err = ferr
+			continue
+		}
+		// A corrupt copy of a shard has the blobref of the
+		// shard it should be, so a backend could keep it
+		// rather than the rewrite.
+		for _, n := range d.missing {
+			ref, _ := sto.shardBlob(d.br, d.size, n, shards[n])
+			sto.backends[n].Remove([]*blobref.BlobRef{ref})
+		}
+		written, werr := sto.writeShards(d.br, d.size, shards, d.missing)
+		if werr != nil {
+			err = werr
+		}
+		if len(written) == 0 {
+			continue
+		}
+		sto.mu.Lock()
+		if bi := sto.info(d.br.String()); bi != nil {
+			fixed := &blobInfo{size: bi.size, shards: make([]*blobref.BlobRef, len(bi.shards))}
+			copy(fixed.shards, bi.shards)
+			for n, ref := range written {
+				fixed.shards[n] = ref
+			}
+			sto.setInfo(d.br.String(), fixed)
+		}
+		sto.mu.Unlock()
+		if len(written) == len(d.missing) {
+			repaired++
+		}
+	}
+	return
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erasure
+
+import (
+	"fmt"
+	"os"
+)
+
+// This file implements a systematic Reed-Solomon code over GF(2^8):
+// the first data shards are the blob itself and any data of the
+// data+parity shards suffice to recover it.
+
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	if b == 0 {
+		panic("erasure: division by zero")
+	}
+	return gfExp[gfLog[a]-gfLog[b]+255]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]*n)%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	out := newMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of the square matrix m, by Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, os.Error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, os.NewError("erasure: singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		if v := work[c][c]; v != 1 {
+			for i := range work[c] {
+				work[c][i] = gfDiv(work[c][i], v)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+	inv := newMatrix(n, n)
+	for r := range inv {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
+
+type rsCodec struct {
+	data, parity int
+	// enc is the (data+parity) x data encoding matrix. Its top
+	// data rows are the identity.
+	enc matrix
+}
+
+func newRSCodec(data, parity int) (*rsCodec, os.Error) {
+	if data < 1 || parity < 0 || data+parity > 255 {
+		return nil, fmt.Errorf("erasure: invalid shard counts %d+%d", data, parity)
+	}
+	total := data + parity
+	vm := newMatrix(total, data)
+	for r := range vm {
+		for c := range vm[r] {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+	topInv, err := vm[:data].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &rsCodec{data: data, parity: parity, enc: vm.mul(topInv)}, nil
+}
+
+// encode computes the parity shards from the data shards. All
+// len(shards) == data+parity shards must be allocated and of the same
+// size.
+func (c *rsCodec) encode(shards [][]byte) {
+	c.computeRows(shards[:c.data], c.enc[c.data:], shards[c.data:])
+}
+
+// computeRows sets each out[i] to the product of rows[i] and in.
+func (c *rsCodec) computeRows(in [][]byte, rows matrix, out [][]byte) {
+	for i, row := range rows {
+		o := out[i]
+		for j := range o {
+			o[j] = 0
+		}
+		for k, coef := range row {
+			if coef == 0 {
+				continue
+			}
+			for j, b := range in[k] {
+				o[j] ^= gfMul(coef, b)
+			}
+		}
+	}
+}
+
+// reconstruct fills in the nil shards, given at least data non-nil
+// shards of equal size.
+func (c *rsCodec) reconstruct(shards [][]byte) os.Error {
+	var have []int
+	size := 0
+	for i, s := range shards {
+		if s != nil {
+			have = append(have, i)
+			size = len(s)
+		}
+	}
+	if len(have) < c.data {
+		return fmt.Errorf("erasure: have %d shards; need %d", len(have), c.data)
+	}
+	if len(have) == len(shards) {
+		return nil
+	}
+	have = have[:c.data]
+	sub := newMatrix(c.data, c.data)
+	in := make([][]byte, c.data)
+	for i, n := range have {
+		copy(sub[i], c.enc[n])
+		in[i] = shards[n]
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	var rows matrix
+	var out [][]byte
+	for i := 0; i < c.data; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			rows = append(rows, dec[i])
+			out = append(out, shards[i])
+		}
+	}
+	c.computeRows(in, rows, out)
+
+	rows, out = nil, nil
+	for i := c.data; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			rows = append(rows, c.enc[i])
+			out = append(out, shards[i])
+		}
+	}
+	c.computeRows(shards[:c.data], rows, out)
+	return nil
+}
+
+// shardSize returns the size of each shard of a blob of size bytes.
+func (c *rsCodec) shardSize(size int64) int {
+	n := int((size + int64(c.data) - 1) / int64(c.data))
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// split divides data into c.data equal-sized, zero-padded data
+// shards, and allocates the parity shards.
+func (c *rsCodec) split(data []byte) [][]byte {
+	shardSize := c.shardSize(int64(len(data)))
+	buf := make([]byte, shardSize*(c.data+c.parity))
+	copy(buf, data)
+	shards := make([][]byte, c.data+c.parity)
+	for i := range shards {
+		shards[i] = buf[i*shardSize : (i+1)*shardSize]
+	}
+	return shards
+}
+
+// join concatenates the data shards, truncated to size bytes.
+func (c *rsCodec) join(shards [][]byte, size int64) []byte {
+	out := make([]byte, 0, len(shards[0])*c.data)
+	for _, s := range shards[:c.data] {
+		out = append(out, s...)
+	}
+	if int64(len(out)) > size {
+		out = out[:size]
+	}
+	return out
+}
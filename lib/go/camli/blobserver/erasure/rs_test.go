@@ -0,0 +1,74 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erasure
+
+import (
+	"bytes"
+	"rand"
+	"testing"
+)
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rand.Intn(256))
+	}
+	return b
+}
+
+func TestReconstruct(t *testing.T) {
+	for _, counts := range [][2]int{{1, 1}, {4, 2}, {3, 3}, {10, 4}} {
+		data, parity := counts[0], counts[1]
+		c, err := newRSCodec(data, parity)
+		if err != nil {
+			t.Fatalf("newRSCodec(%d, %d): %v", data, parity, err)
+		}
+		blob := randBytes(1000 + rand.Intn(100))
+		shards := c.split(blob)
+		c.encode(shards)
+		for trial := 0; trial < 20; trial++ {
+			got := make([][]byte, len(shards))
+			for i := range shards {
+				got[i] = append([]byte(nil), shards[i]...)
+			}
+			for _, i := range rand.Perm(len(shards))[:parity] {
+				got[i] = nil
+			}
+			if err := c.reconstruct(got); err != nil {
+				t.Fatalf("%d+%d: reconstruct: %v", data, parity, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(shards[i], got[i]) {
+					t.Fatalf("%d+%d: shard %d differs after reconstruct", data, parity, i)
+				}
+			}
+			if !bytes.Equal(blob, c.join(got, int64(len(blob)))) {
+				t.Fatalf("%d+%d: joined blob differs", data, parity)
+			}
+		}
+	}
+}
+
+func TestTooFewShards(t *testing.T) {
+	c, _ := newRSCodec(4, 2)
+	shards := c.split(randBytes(100))
+	c.encode(shards)
+	shards[0], shards[2], shards[5] = nil, nil, nil
+	if err := c.reconstruct(shards); err == nil {
+		t.Errorf("expected error reconstructing from 3 of 4+2 shards")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"http"
+	"os"
+	"strconv"
+	"time"
+
+	"camli/auth"
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+)
+
+const (
+	defaultCapabilitySeconds = 24 * 60 * 60
+	maxCapabilitySeconds     = 30 * 24 * 60 * 60
+)
+
+// CreateCapabilityHandler returns a handler minting capabilities, URL
+// parameters that let anyone holding them fetch a blob or download a
+// file until they expire. See doc/protocol/blob-capability-protocol.txt.
+func CreateCapabilityHandler(storage blobserver.StorageConfiger) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleCapability(conn, req, storage)
+	}
+}
+
+func handleCapability(conn http.ResponseWriter, req *http.Request, storage blobserver.StorageConfiger) {
+	if req.Method != "POST" {
+		httputil.BadRequestError(conn, "Inappropriate method.")
+		return
+	}
+	br := blobref.Parse(req.FormValue("blob"))
+	if br == nil {
+		httputil.BadRequestError(conn, "Missing or invalid 'blob' parameter.")
+		return
+	}
+	scope := req.FormValue("scope")
+	switch scope {
+	case "":
+		scope = auth.CapabilityBlob
+	case auth.CapabilityBlob, auth.CapabilityDownload:
+	default:
+		httputil.BadRequestError(conn, "Invalid 'scope' parameter.")
+		return
+	}
+	seconds := int64(defaultCapabilitySeconds)
+	if s := req.FormValue("expires"); s != "" {
+		var err os.Error
+		if seconds, err = strconv.Atoi64(s); err != nil || seconds <= 0 {
+			httputil.BadRequestError(conn, "Invalid 'expires' parameter.")
+			return
+		}
+		if seconds > maxCapabilitySeconds {
+			seconds = maxCapabilitySeconds
+		}
+	}
+	expires := time.Seconds() + seconds
+	cap, err := auth.MintCapability(scope, br.String(), expires)
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	ret := map[string]interface{}{
+		"blobRef":    br.String(),
+		"scope":      scope,
+		"expires":    time.SecondsToUTC(expires).Format(time.RFC3339),
+		"capability": cap,
+	}
+	conf := storage.Config()
+	switch {
+	case scope == auth.CapabilityBlob:
+		ret["url"] = conf.URLBase + "/camli/" + br.String() + "?" + auth.CapabilityParam + "=" + cap
+	case scope == auth.CapabilityDownload && conf.DownloadURLBase != "":
+		ret["url"] = conf.DownloadURLBase + br.String() + "?" + auth.CapabilityParam + "=" + cap
+	}
+	httputil.ReturnJson(conn, ret)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"log"
+	"os"
+
+	"camli/auth"
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+)
+
+// maxFetchBlobs is the most blobs one fetch-blobs request may ask for.
+const maxFetchBlobs = 1000
+
+// FetchBlobsContentType is the type of a fetch-blobs response. See
+// doc/protocol/blob-fetch-protocol.txt.
+const FetchBlobsContentType = "application/x-camli-blobs"
+
+// CreateFetchBlobsHandler returns a handler sending many blobs in one
+// response. Like GetHandler, it checks authorization itself, so that
+// shared blobs may be fetched.
+func CreateFetchBlobsHandler(fetcher blobref.StreamingFetcher, shares *ShareChecker) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleFetchBlobs(conn, req, fetcher, shares)
+	}
+}
+
+func handleFetchBlobs(conn http.ResponseWriter, req *http.Request, fetcher blobref.StreamingFetcher, shares *ShareChecker) {
+	if req.Method != "GET" && req.Method != "POST" {
+		httputil.BadRequestError(conn, "Invalid method.")
+		return
+	}
+	blobs := make([]*blobref.BlobRef, 0)
+	for n := 1; ; n++ {
+		key := fmt.Sprintf("blob%d", n)
+		value := req.FormValue(key)
+		if value == "" {
+			break
+		}
+		if n > maxFetchBlobs {
+			httputil.BadRequestError(conn, "Too many blobs requested")
+			return
+		}
+		ref := blobref.Parse(value)
+		if ref == nil {
+			httputil.BadRequestError(conn, "Bogus blobref for key "+key)
+			return
+		}
+		blobs = append(blobs, ref)
+	}
+
+	switch {
+	case auth.Allowed(req, auth.ScopeRead):
+	case auth.TriedAuthorization(req):
+		log.Printf("Attempted authorization failed on %s", req.URL)
+		sendUnauthorized(conn)
+		return
+	default:
+		opened, ok := allowedViaSharing(conn, req, blobs, fetcher, shares)
+		if !ok || !useShare(conn, shares, opened) {
+			return
+		}
+	}
+
+	conn.Header().Set("Content-Type", FetchBlobsContentType)
+	sent := false
+	err := blobserver.FetchMulti(fetcher, blobs, func(sb blobref.SizedBlobRef, r io.Reader) os.Error {
+		sent = true
+		fmt.Fprintf(conn, "%s %d\n", sb.BlobRef, sb.Size)
+		n, err := io.Copyn(conn, r, sb.Size)
+		if err != nil {
+			return fmt.Errorf("sent %d of %d bytes of %s: %v", n, sb.Size, sb.BlobRef, err)
+		}
+		return nil
+	})
+	if err == nil {
+		return
+	}
+	if !sent {
+		httputil.ServerError(conn, err)
+		return
+	}
+	// As in serveBlobRef, it's too late to tell the client, but
+	// a truncated response tells it something went wrong.
+	log.Printf("Error sending blobs: %v", err)
+	killConnection(conn)
+}
@@ -28,23 +28,22 @@ import (
 	"os"
 	"io"
 	"io/ioutil"
-	"json"
 	"log"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 )
 
-var kGetPattern *regexp.Regexp = regexp.MustCompile(`/camli/([a-z0-9]+)-([a-f0-9]+)$`)
+var kGetPattern *regexp.Regexp = regexp.MustCompile(`/camli/` + blobref.Pattern + `$`)
 
 type GetHandler struct {
 	Fetcher           blobref.StreamingFetcher
 	AllowGlobalAccess bool
+	Shares            *ShareChecker // or nil if blobs can't be shared
 }
 
-func CreateGetHandler(fetcher blobref.StreamingFetcher) func(http.ResponseWriter, *http.Request) {
-	gh := &GetHandler{Fetcher: fetcher}
+func CreateGetHandler(fetcher blobref.StreamingFetcher, shares *ShareChecker) func(http.ResponseWriter, *http.Request) {
+	gh := &GetHandler{Fetcher: fetcher, Shares: shares}
 	return func(conn http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/camli/sha1-deadbeef00000000000000000000000000000000" {
 			// Test handler.
@@ -71,19 +70,35 @@ func (h *GetHandler) ServeHTTP(conn http.ResponseWriter, req *http.Request) {
 	}
 
 	switch {
-	case h.AllowGlobalAccess || auth.IsAuthorized(req):
-		serveBlobRef(conn, req, blobRef, h.Fetcher)
+	case h.AllowGlobalAccess:
+		serveBlobRef(conn, req, blobRef, h.Fetcher, cachePublic, nil)
+	case auth.Allowed(req, auth.ScopeRead):
+		serveBlobRef(conn, req, blobRef, h.Fetcher, cachePrivate, nil)
+	case auth.HasCapability(req, auth.CapabilityBlob, blobRef.String()):
+		serveBlobRef(conn, req, blobRef, h.Fetcher, cachePrivate, nil)
 	case auth.TriedAuthorization(req):
 		log.Printf("Attempted authorization failed on %s", req.URL)
 		sendUnauthorized(conn)
 	default:
-		handleGetViaSharing(conn, req, blobRef, h.Fetcher)
+		handleGetViaSharing(conn, req, blobRef, h.Fetcher, h.Shares)
 	}
 }
 
-// serveBlobRef sends 'blobref' to 'conn' as directed by the Range header in 'req'
+// blobCaching is how a served blob may be cached.
+type blobCaching int
+
+const (
+	cachePublic     blobCaching = iota // by anyone, as the request needed no auth
+	cachePrivate                       // only by the client, as the request needed auth
+	cacheRevalidate                    // only by the client, asking before each use
+)
+
+// serveBlobRef sends 'blobref' to 'conn' as directed by the Range header in 'req'.
+// If use isn't nil, it's called before the blob is sent, but not for a
+// 304 Not Modified response, and the request is refused if it returns
+// false.
 func serveBlobRef(conn http.ResponseWriter, req *http.Request,
-blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
+blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher, caching blobCaching, use func() bool) {
 
 	file, size, err := fetcher.FetchStreaming(blobRef)
 	switch err {
@@ -100,28 +115,21 @@ blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
 
 	defer file.Close()
 
-	seeker, isSeeker := file.(io.Seeker)
-	reqRange := httprange.FromRequest(req)
-	if reqRange.SkipBytes() != 0 && isSeeker {
-		// TODO: set the Range-specific response headers too,
-		// acknowledging that we honored the content range
-		// request.
-		_, err = seeker.Seek(reqRange.SkipBytes(), 0)
-		if err != nil {
-			httputil.ServerError(conn, err)
-			return
-		}
+	// Blobs never change, so their blobref is a strong validator and
+	// they can be cached forever, unless the request might later be
+	// refused.
+	etag := `"` + blobRef.String() + `"`
+	var notModified bool
+	if caching == cacheRevalidate {
+		notModified = httputil.ServeRevalidated(conn, req, etag)
+	} else {
+		notModified = httputil.ServeImmutable(conn, req, etag, caching == cachePrivate)
 	}
-
-	var input io.Reader = file
-	if reqRange.LimitBytes() != -1 {
-		input = io.LimitReader(file, reqRange.LimitBytes())
+	if notModified {
+		return
 	}
-
-	remainBytes := size - reqRange.SkipBytes()
-	if reqRange.LimitBytes() != -1 &&
-		reqRange.LimitBytes() < remainBytes {
-		remainBytes = reqRange.LimitBytes()
+	if use != nil && !use() {
+		return
 	}
 
 	// Assume this generic content type by default.  For better
@@ -129,7 +137,8 @@ blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
 	// certain cases (no Range requests, etc) but this isn't part
 	// of the Camli spec at all.  We just do it to ease demos.
 	contentType := "application/octet-stream"
-	if reqRange.IsWholeFile() {
+	var input io.Reader = file
+	if req.Header.Get("Range") == "" {
 		const peekSize = 1024
 		bufReader, _ := bufio.NewReaderSize(input, peekSize)
 		header, _ := bufReader.Peek(peekSize)
@@ -144,49 +153,53 @@ blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
 			}
 		}
 		input = bufReader
-
-		conn.Header().Set("Content-Length", strconv.Itoa64(size))
 	}
-
 	conn.Header().Set("Content-Type", contentType)
-	if !reqRange.IsWholeFile() {
-		conn.Header().Set("Content-Range",
-			fmt.Sprintf("bytes %d-%d/%d", reqRange.SkipBytes(),
-				reqRange.SkipBytes()+remainBytes,
-				size))
-		conn.WriteHeader(http.StatusPartialContent)
-	}
-	bytesCopied, err := io.Copy(conn, input)
+
+	// Fetchers that can't seek have ranges skipped by reading.
+	err = httprange.ServeContent(conn, req, input, size, etag, 0)
 
 	// If there's an error at this point, it's too late to tell the client,
 	// as they've already been receiving bytes.  But they should be smart enough
 	// to verify the digest doesn't match.  But we close the (chunked) response anyway,
 	// to further signal errors.
-	killConnection := func() {
-		if hj, ok := conn.(http.Hijacker); ok {
-			if closer, _, err := hj.Hijack(); err != nil {
-				closer.Close()
-			}
-		}
-	}
-
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error sending file: %v, err=%v\n", blobRef, err)
-		killConnection()
-		return
+		killConnection(conn)
 	}
+}
 
-	if bytesCopied != remainBytes {
-		fmt.Fprintf(os.Stderr, "Error sending file: %v, copied=%d, not %d\n", blobRef,
-			bytesCopied, remainBytes)
-		killConnection()
-		return
+// killConnection closes conn's connection without finishing the
+// response, so the client sees it failed.
+func killConnection(conn http.ResponseWriter) {
+	if hj, ok := conn.(http.Hijacker); ok {
+		if closer, _, err := hj.Hijack(); err == nil {
+			closer.Close()
+		}
 	}
 }
 
 // Unauthenticated user.  Be paranoid.
 func handleGetViaSharing(conn http.ResponseWriter, req *http.Request,
-blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
+blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher, shares *ShareChecker) {
+	opened, ok := allowedViaSharing(conn, req, []*blobref.BlobRef{blobRef}, fetcher, shares)
+	if !ok {
+		return
+	}
+	// Shares can be revoked or used up, so clients must ask again
+	// before reusing their copy, and that doesn't count as a use.
+	serveBlobRef(conn, req, blobRef, fetcher, cacheRevalidate, func() bool {
+		return useShare(conn, shares, opened)
+	})
+}
+
+// allowedViaSharing reports whether the request's "via" chain of
+// blobs, starting at a share that shares allows, leads to each of
+// blobs. If so, it returns the share whose target is among blobs, if
+// any, which the caller should use with useShare. If not, the request
+// has been answered, after a delay.
+func allowedViaSharing(conn http.ResponseWriter, req *http.Request,
+blobs []*blobref.BlobRef, fetcher blobref.StreamingFetcher, shares *ShareChecker) (opened *share, ok bool) {
 
 	viaPathOkay := false
 	startTime := time.Nanoseconds()
@@ -205,48 +218,63 @@ blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
 		for _, vs := range strings.Split(via, ",", -1) {
 			if br := blobref.Parse(vs); br == nil {
 				httputil.BadRequestError(conn, "Malformed blobref in via param")
-				return
+				return nil, false
 			} else {
 				viaBlobs = append(viaBlobs, br)
 			}
 		}
 	}
 
-	fetchChain := make([]*blobref.BlobRef, 0)
-	fetchChain = append(fetchChain, viaBlobs...)
-	fetchChain = append(fetchChain, blobRef)
+	if shares == nil {
+		log.Printf("Sharing isn't enabled; refusing %s", req.URL)
+		sendUnauthorized(conn)
+		return nil, false
+	}
+	for _, blobRef := range blobs {
+		fetchChain := make([]*blobref.BlobRef, 0)
+		fetchChain = append(fetchChain, viaBlobs...)
+		fetchChain = append(fetchChain, blobRef)
+		s, ok := fetchChainOkay(fetchChain, fetcher, shares)
+		if !ok {
+			sendUnauthorized(conn)
+			return nil, false
+		}
+		if len(fetchChain) == 2 {
+			opened = s
+		}
+	}
+
+	viaPathOkay = true
+	return opened, true
+}
+
+// useShare records a use of s, whose target is about to be sent, if
+// it's not nil. If s is used up, the request is refused.
+func useShare(conn http.ResponseWriter, shares *ShareChecker, s *share) bool {
+	if s == nil || shares.use(s) {
+		return true
+	}
+	log.Printf("Share %s is used up", s.ref)
+	sendUnauthorized(conn)
+	return false
+}
+
+// fetchChainOkay reports whether the first blob of fetchChain is a
+// share that shares allows, which it returns, and each of the others
+// is referenced by the one before it.
+func fetchChainOkay(fetchChain []*blobref.BlobRef, fetcher blobref.StreamingFetcher, shares *ShareChecker) (s *share, ok bool) {
 	for i, br := range fetchChain {
 		switch i {
 		case 0:
-			file, size, err := fetcher.FetchStreaming(br)
-			if err != nil {
-				log.Printf("Fetch chain 0 of %s failed: %v", br.String(), err)
-				sendUnauthorized(conn)
-				return
-			}
-			defer file.Close()
-			if size > maxJsonSize {
-				log.Printf("Fetch chain 0 of %s too large", br.String())
-				sendUnauthorized(conn)
-				return
+			var err os.Error
+			if s, err = shares.share(br); err != nil {
+				log.Printf("Fetch chain 0 of %s isn't a usable share: %v", br.String(), err)
+				return nil, false
 			}
-			jd := json.NewDecoder(file)
-			m := make(map[string]interface{})
-			if err := jd.Decode(&m); err != nil {
-				log.Printf("Fetch chain 0 of %s wasn't JSON: %v", br.String(), err)
-				sendUnauthorized(conn)
-				return
-			}
-			if m["camliType"].(string) != "share" {
-				log.Printf("Fetch chain 0 of %s wasn't a share", br.String())
-				sendUnauthorized(conn)
-				return
-			}
-			if len(fetchChain) > 1 && fetchChain[1].String() != m["target"].(string) {
+			if len(fetchChain) > 1 && fetchChain[1].String() != s.target {
 				log.Printf("Fetch chain 0->1 (%s -> %q) unauthorized, expected hop to %q",
-					br.String(), fetchChain[1].String(), m["target"])
-				sendUnauthorized(conn)
-				return
+					br.String(), fetchChain[1].String(), s.target)
+				return nil, false
 			}
 		case len(fetchChain) - 1:
 			// Last one is fine (as long as its path up to here has been proven, and it's
@@ -256,31 +284,25 @@ blobRef *blobref.BlobRef, fetcher blobref.StreamingFetcher) {
 			file, _, err := fetcher.FetchStreaming(br)
 			if err != nil {
 				log.Printf("Fetch chain %d of %s failed: %v", i, br.String(), err)
-				sendUnauthorized(conn)
-				return
+				return nil, false
 			}
 			defer file.Close()
 			lr := io.LimitReader(file, maxJsonSize)
 			slurpBytes, err := ioutil.ReadAll(lr)
 			if err != nil {
 				log.Printf("Fetch chain %d of %s failed in slurp: %v", i, br.String(), err)
-				sendUnauthorized(conn)
-				return
+				return nil, false
 			}
+			// Blobrefs in schema blobs are JSON strings.
 			saught := fetchChain[i+1].String()
-			if bytes.IndexAny(slurpBytes, saught) == -1 {
+			if bytes.Index(slurpBytes, []byte(`"`+saught+`"`)) == -1 {
 				log.Printf("Fetch chain %d of %s failed; no reference to %s",
 					i, br.String(), saught)
-				sendUnauthorized(conn)
-				return
+				return nil, false
 			}
 		}
 	}
-
-	viaPathOkay = true
-
-	serveBlobRef(conn, req, blobRef, fetcher)
-
+	return s, true
 }
 
 // TODO: copied this from lib/go/schema, but this might not be ideal.
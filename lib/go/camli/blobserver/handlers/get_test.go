@@ -0,0 +1,73 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"http"
+	"http/httptest"
+	"testing"
+
+	"camli/auth"
+	"camli/blobserver/memory"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func getBlob(t *testing.T, gh *GetHandler, tb *test.Blob, header map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "http://example.com/camli/"+tb.BlobRef().String(), nil)
+	AssertNil(t, err, "NewRequest")
+	req.SetBasicAuth("username", "pass")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	rw.Code = 200
+	gh.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestGetCaching(t *testing.T) {
+	auth.AccessPassword = "pass"
+	sto := memory.New(0)
+	tb := &test.Blob{"foo"}
+	_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	gh := &GetHandler{Fetcher: sto}
+	etag := `"` + tb.BlobRef().String() + `"`
+
+	rw := getBlob(t, gh, tb, nil)
+	ExpectInt(t, 200, rw.Code, "status")
+	ExpectString(t, "foo", rw.Body.String(), "body")
+	ExpectString(t, etag, rw.HeaderMap.Get("ETag"), "ETag")
+	ExpectString(t, "private, max-age=31536000, immutable", rw.HeaderMap.Get("Cache-Control"), "Cache-Control")
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		rw = getBlob(t, gh, tb, map[string]string{"If-None-Match": inm})
+		ExpectInt(t, 304, rw.Code, "status with If-None-Match "+inm)
+		ExpectString(t, "", rw.Body.String(), "body with If-None-Match "+inm)
+	}
+	rw = getBlob(t, gh, tb, map[string]string{"If-None-Match": `"other"`})
+	ExpectInt(t, 200, rw.Code, "status with other If-None-Match")
+
+	gh.AllowGlobalAccess = true
+	rw = getBlob(t, gh, tb, nil)
+	ExpectString(t, "public, max-age=31536000, immutable", rw.HeaderMap.Get("Cache-Control"), "Cache-Control with global access")
+
+	// A missing blob gets a 404, even if the client has it cached.
+	rw = getBlob(t, gh, &test.Blob{"bar"}, map[string]string{"If-None-Match": "*"})
+	ExpectInt(t, 404, rw.Code, "status of missing blob")
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// Resumable uploads, per doc/protocol/blob-upload-resume.txt.
+//
+// If the storage is a blobserver.PartialUploader, the start of each
+// upload that fails partway, after more than minPartialUpload bytes,
+// is kept in its PartialUploadDir, as
+// <blobref>/<size>-<partBlobRef>.part, for partialUploadExpiry
+// seconds. Stat offers them as "alreadyHavePartially", and an upload
+// named by one's resume key continues it.
+
+const partialUploadExpiry = 86400
+
+// minPartialUpload is how much of an upload must be received before
+// it's recorded at all. Anything smaller is cheaper to send again
+// than to copy to disk as it arrives; camput batches files up to this
+// size.
+var minPartialUpload int64 = 1 << 20
+
+var resumeKeyPattern = regexp.MustCompile(`^resume-` + blobref.Pattern + `-([0-9]+)-` + blobref.Pattern + `$`)
+
+type partialUpload struct {
+	blob    *blobref.BlobRef
+	size    int64
+	partRef *blobref.BlobRef // of the first size bytes of blob
+}
+
+func (p *partialUpload) resumeKey() string {
+	return fmt.Sprintf("resume-%s-%d-%s", p.blob, p.size, p.partRef)
+}
+
+func (p *partialUpload) path(dir string) string {
+	return filepath.Join(dir, p.blob.String(), fmt.Sprintf("%d-%s.part", p.size, p.partRef))
+}
+
+// parseResumeKey returns the partial upload named by key, or nil if
+// it isn't a valid resume key.
+func parseResumeKey(key string) *partialUpload {
+	m := resumeKeyPattern.FindStringSubmatch(key)
+	if m == nil {
+		return nil
+	}
+	blob := blobref.Parse(m[1] + "-" + m[2])
+	partRef := blobref.Parse(m[4] + "-" + m[5])
+	size, err := strconv.Atoi64(m[3])
+	if blob == nil || partRef == nil || err != nil || size <= 0 || partRef.HashName() != blob.HashName() {
+		return nil
+	}
+	return &partialUpload{blob, size, partRef}
+}
+
+// partialUploadDir returns where sto's partial uploads are kept, or ""
+// if they aren't.
+func partialUploadDir(sto interface{}) string {
+	if pu, ok := sto.(blobserver.PartialUploader); ok {
+		return pu.PartialUploadDir()
+	}
+	return ""
+}
+
+// listPartialUploads returns blob's partial uploads in dir, removing
+// any that have expired.
+func listPartialUploads(dir string, blob *blobref.BlobRef) []*partialUpload {
+	blobDir := filepath.Join(dir, blob.String())
+	d, err := os.Open(blobDir)
+	if err != nil {
+		return nil
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return nil
+	}
+	var ups []*partialUpload
+	now := time.Seconds()
+	for _, fi := range fis {
+		if now-fi.Mtime_ns/1e9 > partialUploadExpiry {
+			os.Remove(filepath.Join(blobDir, fi.Name))
+			continue
+		}
+		if !strings.HasSuffix(fi.Name, ".part") {
+			// A partial upload being recorded.
+			continue
+		}
+		p := parseResumeKey(fmt.Sprintf("resume-%s-%s", blob, fi.Name[:len(fi.Name)-len(".part")]))
+		if p != nil && p.size == fi.Size {
+			ups = append(ups, p)
+		}
+	}
+	// Fails unless it's now empty.
+	os.Remove(blobDir)
+	return ups
+}
+
+var (
+	expiryMu   sync.Mutex
+	lastExpiry = make(map[string]int64) // dir -> seconds
+)
+
+// expirePartialUploads removes the expired partial uploads of every
+// blob in dir, at most once an hour.
+func expirePartialUploads(dir string) {
+	expiryMu.Lock()
+	now := time.Seconds()
+	if now-lastExpiry[dir] < 3600 {
+		expiryMu.Unlock()
+		return
+	}
+	lastExpiry[dir] = now
+	expiryMu.Unlock()
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if blob := blobref.Parse(name); blob != nil {
+			listPartialUploads(dir, blob)
+		}
+	}
+}
+
+// partialWriter records an upload of blob as it's received, to keep
+// as a partial upload if it fails. Until more than minPartialUpload
+// bytes have been received, it only holds them in memory. Its Write
+// never fails, so a problem recording doesn't fail the upload itself.
+type partialWriter struct {
+	dir  string
+	blob *blobref.BlobRef
+	buf  []byte   // what's been received, until f is created
+	f    *os.File // or nil
+	h    hash.Hash
+	n    int64
+	err  os.Error
+}
+
+func newPartialWriter(dir string, blob *blobref.BlobRef) *partialWriter {
+	return &partialWriter{dir: dir, blob: blob, h: blob.Hash()}
+}
+
+func (pw *partialWriter) Write(p []byte) (int, os.Error) {
+	if pw.err != nil {
+		return len(p), nil
+	}
+	pw.h.Write(p)
+	pw.n += int64(len(p))
+	if pw.f != nil {
+		_, pw.err = pw.f.Write(p)
+		return len(p), nil
+	}
+	pw.buf = append(pw.buf, p...)
+	if pw.n > minPartialUpload {
+		if pw.err = pw.start(); pw.err != nil {
+			log.Printf("Error recording upload of %s: %v", pw.blob, pw.err)
+		}
+		pw.buf = nil
+	}
+	return len(p), nil
+}
+
+// start creates the file recording the upload and writes what's been
+// received so far to it.
+func (pw *partialWriter) start() os.Error {
+	blobDir := filepath.Join(pw.dir, pw.blob.String())
+	if err := os.MkdirAll(blobDir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(blobDir, "tmp")
+	if err != nil {
+		return err
+	}
+	pw.f = f
+	_, err = f.Write(pw.buf)
+	return err
+}
+
+func (pw *partialWriter) discard() {
+	pw.buf = nil
+	if pw.f != nil {
+		pw.f.Close()
+		os.Remove(pw.f.Name())
+	}
+}
+
+// keep keeps what was recorded as a partial upload.
+func (pw *partialWriter) keep() {
+	if pw.err != nil || pw.f == nil {
+		pw.discard()
+		return
+	}
+	p := &partialUpload{pw.blob, pw.n, blobref.FromHash(pw.blob.HashName(), pw.h)}
+	err := pw.f.Close()
+	if err == nil {
+		err = os.Rename(pw.f.Name(), p.path(pw.dir))
+	}
+	if err != nil {
+		log.Printf("Error keeping partial upload of %s: %v", pw.blob, err)
+		os.Remove(pw.f.Name())
+		return
+	}
+	log.Printf("Kept partial upload of %s: %d bytes", pw.blob, pw.n)
+}
+
+// receiveResumable receives blob from r, continuing the partial upload
+// resume if it's non-nil. If dir isn't empty, the start of the upload
+// is kept there if it fails partway after minPartialUpload bytes.
+func receiveResumable(sto blobserver.BlobReceiver, dir string, blob *blobref.BlobRef, resume *partialUpload, r io.Reader) (blobref.SizedBlobRef, os.Error) {
+	if dir == "" {
+		return sto.ReceiveBlob(blob, r)
+	}
+	var oldPath string
+	if resume != nil {
+		oldPath = resume.path(dir)
+		f, err := os.Open(oldPath)
+		if err != nil {
+			return blobref.SizedBlobRef{}, fmt.Errorf("partial upload %s not found; it may have expired", resume.resumeKey())
+		}
+		defer f.Close()
+		r = io.MultiReader(f, r)
+	}
+	expirePartialUploads(dir)
+	pw := newPartialWriter(dir, blob)
+	sb, err := sto.ReceiveBlob(blob, io.TeeReader(r, pw))
+	switch {
+	case err == nil || err == blobserver.ErrCorruptBlob:
+		// Done with, or no use resuming.
+		pw.discard()
+		if oldPath != "" {
+			os.Remove(oldPath)
+		}
+	case resume != nil && pw.n <= resume.size:
+		// Nothing more was received.
+		pw.discard()
+	default:
+		pw.keep()
+		if oldPath != "" {
+			os.Remove(oldPath)
+		}
+	}
+	return sb, err
+}
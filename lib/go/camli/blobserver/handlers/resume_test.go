@@ -0,0 +1,191 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/client"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+// resumeStorage is a memory storage keeping partial uploads in a
+// temp directory.
+type resumeStorage struct {
+	*memory.Storage
+	dir string
+}
+
+func newResumeStorage(t *testing.T) *resumeStorage {
+	dir, err := ioutil.TempDir("", "camli-resume-test")
+	AssertNil(t, err, "TempDir")
+	return &resumeStorage{memory.New(0), dir}
+}
+
+func (s *resumeStorage) PartialUploadDir() string {
+	return s.dir
+}
+
+func (s *resumeStorage) Config() *blobserver.Config {
+	return &blobserver.Config{Writable: true, Readable: true}
+}
+
+// failingReader returns an error after its string.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, os.Error) {
+	n, err := f.r.Read(p)
+	if err == os.EOF {
+		err = os.NewError("connection reset")
+	}
+	return n, err
+}
+
+var resumeBlob = &test.Blob{strings.Repeat("0123456789", 1000)}
+
+func init() {
+	// Record uploads smaller than resumeBlob.
+	minPartialUpload = 1000
+}
+
+// interruptUpload receives the first n bytes of resumeBlob, then
+// fails, returning the partial upload kept.
+func interruptUpload(t *testing.T, sto *resumeStorage, n int) *partialUpload {
+	_, err := receiveResumable(sto, sto.dir, resumeBlob.BlobRef(), nil,
+		&failingReader{strings.NewReader(resumeBlob.Contents[:n])})
+	Assert(t, err != nil, "interrupted upload fails")
+	ups := listPartialUploads(sto.dir, resumeBlob.BlobRef())
+	AssertInt(t, 1, len(ups), "partial uploads kept")
+	return ups[0]
+}
+
+func TestResumeKey(t *testing.T) {
+	p := &partialUpload{resumeBlob.BlobRef(), 123, (&test.Blob{"foo"}).BlobRef()}
+	key := p.resumeKey()
+	got := parseResumeKey(key)
+	Assert(t, got != nil, "parsed resume key")
+	ExpectString(t, key, got.resumeKey(), "round trip")
+
+	for _, bad := range []string{
+		"",
+		resumeBlob.BlobRef().String(),
+		"resume-" + resumeBlob.BlobRef().String() + "-0-" + p.partRef.String(),
+		"resume-" + resumeBlob.BlobRef().String() + "-123-md5-acbd18db4cc2f85cedef654fccc4a4d8",
+		"resume-../../etc-123-" + p.partRef.String(),
+	} {
+		Expect(t, parseResumeKey(bad) == nil, fmt.Sprintf("rejected key %q", bad))
+	}
+}
+
+func TestPartialUploadKept(t *testing.T) {
+	sto := newResumeStorage(t)
+	defer os.RemoveAll(sto.dir)
+
+	p := interruptUpload(t, sto, 4000)
+	ExpectInt(t, 4000, int(p.size), "partial upload size")
+	ExpectString(t, (&test.Blob{resumeBlob.Contents[:4000]}).BlobRef().String(), p.partRef.String(), "partBlobRef")
+	ExpectInt(t, 0, sto.NumBlobs(), "blobs after interrupted upload")
+
+	// Resuming, but interrupted again, replaces it.
+	_, err := receiveResumable(sto, sto.dir, resumeBlob.BlobRef(), p,
+		&failingReader{strings.NewReader(resumeBlob.Contents[4000:7000])})
+	Assert(t, err != nil, "interrupted resume fails")
+	ups := listPartialUploads(sto.dir, resumeBlob.BlobRef())
+	AssertInt(t, 1, len(ups), "partial uploads after second interruption")
+	ExpectInt(t, 7000, int(ups[0].size), "partial upload size after resume")
+
+	sb, err := receiveResumable(sto, sto.dir, resumeBlob.BlobRef(), ups[0],
+		strings.NewReader(resumeBlob.Contents[7000:]))
+	AssertNil(t, err, "completed resume")
+	ExpectInt(t, int(resumeBlob.Size()), int(sb.Size), "received size")
+	ExpectInt(t, 1, sto.NumBlobs(), "blobs after resume")
+	ExpectInt(t, 0, len(listPartialUploads(sto.dir, resumeBlob.BlobRef())), "partial uploads after resume")
+}
+
+func TestSmallUploadNotKept(t *testing.T) {
+	sto := newResumeStorage(t)
+	defer os.RemoveAll(sto.dir)
+
+	_, err := receiveResumable(sto, sto.dir, resumeBlob.BlobRef(), nil,
+		&failingReader{strings.NewReader(resumeBlob.Contents[:int(minPartialUpload)])})
+	Assert(t, err != nil, "interrupted upload fails")
+	ExpectInt(t, 0, len(listPartialUploads(sto.dir, resumeBlob.BlobRef())), "partial uploads")
+	_, err = os.Stat(filepath.Join(sto.dir, resumeBlob.BlobRef().String()))
+	Expect(t, err != nil, "nothing recorded")
+}
+
+func TestPartialUploadExpiry(t *testing.T) {
+	sto := newResumeStorage(t)
+	defer os.RemoveAll(sto.dir)
+
+	p := interruptUpload(t, sto, 2000)
+	old := (time.Seconds() - partialUploadExpiry - 60) * 1e9
+	AssertNil(t, os.Chtimes(p.path(sto.dir), old, old), "Chtimes")
+	ExpectInt(t, 0, len(listPartialUploads(sto.dir, resumeBlob.BlobRef())), "partial uploads after expiry")
+	_, err := os.Stat(p.path(sto.dir))
+	Expect(t, err != nil, "expired partial upload removed")
+}
+
+func TestClientResume(t *testing.T) {
+	sto := newResumeStorage(t)
+	defer os.RemoveAll(sto.dir)
+	interruptUpload(t, sto, 6000)
+
+	var uploaded int64
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/camli/stat":
+			CreateStatHandler(sto)(rw, req)
+		case "/camli/upload":
+			uploaded = req.ContentLength
+			CreateUploadHandler(sto)(rw, req)
+		default:
+			http.Error(rw, "unsupported", 400)
+		}
+	}))
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", "camli-resume-test")
+	AssertNil(t, err, "TempFile")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = io.Copy(f, resumeBlob.Reader())
+	AssertNil(t, err, "writing temp file")
+	f.Seek(0, os.SEEK_SET)
+
+	c := client.New(server.URL, "")
+	c.SetLogger(nil)
+	pr, err := c.Upload(&client.UploadHandle{resumeBlob.BlobRef(), resumeBlob.Size(), f})
+	AssertNil(t, err, "Upload")
+	Expect(t, !pr.Skipped, "blob uploaded")
+	ExpectInt(t, 1, sto.NumBlobs(), "blobs on server")
+	Expect(t, uploaded > 0 && uploaded < resumeBlob.Size()-5000, fmt.Sprintf("only the rest uploaded; sent %d bytes", uploaded))
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonsign"
+	"camli/osutil"
+	"camli/schema"
+)
+
+// A ShareChecker decides whether share blobs may be used to fetch
+// blobs without auth: a share must be signed by one of the owners,
+// and be unexpired, unrevoked and not used up.
+//
+// Shares are revoked by "revoke" claims signed by an owner. Those
+// already in the storage are found by scanning it, and no share is
+// allowed until the scan is done; later ones are noticed as the
+// storage receives them. Uses, the revocations found and how far the
+// scan got are kept in a state file, if any, so that the scan happens
+// once, resuming where it stopped after a restart. Without a state
+// file it's repeated at every start. Revoke claims put in the storage
+// other than through the server after the scan aren't seen; removing
+// the state file makes the next start scan again.
+//
+// A legacy ShareChecker, for storage configured without shares,
+// instead honors any share blob, as before owners were configured.
+type ShareChecker struct {
+	fetcher   blobref.StreamingFetcher // of shares, claims and owners' public keys
+	owners    map[string]bool          // public key blobrefs
+	statePath string                   // or empty to keep state in memory
+	legacy    bool                     // whether shares are honored unchecked
+
+	mu        sync.Mutex
+	scanned   bool            // whether the storage's revocations are all known
+	scanAfter string          // last blobref scanned, if not scanned
+	revoked   map[string]bool // share blobref -> revoked
+	uses      map[string]int  // share blobref -> times opened
+}
+
+// scanRetryDelay is how long to wait, in nanoseconds, before scanning
+// the storage for revocations again after an error.
+const scanRetryDelay = 60e9
+
+// scanSaveInterval is how many blobs are scanned for revocations
+// between saves of the scan's progress.
+const scanSaveInterval = 1000
+
+// shareState is the JSON of a ShareChecker's state file.
+type shareState struct {
+	Revoked   []string       "revoked"
+	Uses      map[string]int "uses"
+	Scanned   bool           "scanned"
+	ScanAfter string         "scanAfter"
+}
+
+// share is a verified share blob.
+type share struct {
+	ref     *blobref.BlobRef
+	target  string
+	expires int64 // nanoseconds since the epoch, or 0 for never
+	maxUses int   // or 0 for unlimited
+}
+
+// NewShareChecker returns a checker of the shares in sto, signed by
+// any of owners, keeping its state in the file at statePath if it's
+// not empty.
+func NewShareChecker(sto blobserver.Storage, owners []*blobref.BlobRef, statePath string) (*ShareChecker, os.Error) {
+	sc := &ShareChecker{
+		fetcher:   sto,
+		owners:    make(map[string]bool),
+		statePath: statePath,
+		revoked:   make(map[string]bool),
+		uses:      make(map[string]int),
+	}
+	for _, br := range owners {
+		sc.owners[br.String()] = true
+	}
+	if statePath != "" {
+		if err := sc.loadState(); err != nil {
+			return nil, err
+		}
+	}
+	// Listen before scanning, so no revocation falls in between.
+	ch := make(chan *blobref.BlobRef, 100)
+	sto.GetBlobHub().RegisterListener(ch)
+	go func() {
+		for br := range ch {
+			sc.noticeBlob(br)
+		}
+	}()
+	if !sc.scanned {
+		go sc.scanRevocations(sto)
+	}
+	return sc, nil
+}
+
+// NewLegacyShareChecker returns a checker which honors any share blob
+// in fetcher, signed or not. Such shares never expire, get used up or
+// get revoked.
+func NewLegacyShareChecker(fetcher blobref.StreamingFetcher) *ShareChecker {
+	return &ShareChecker{fetcher: fetcher, legacy: true, scanned: true}
+}
+
+// scanRevocations notices the revoke claims already in sto, after
+// any blobs scanned before a restart, retrying until it can enumerate
+// all of them.
+func (sc *ShareChecker) scanRevocations(sto blobserver.Storage) {
+	for {
+		sc.mu.Lock()
+		after := sc.scanAfter
+		sc.mu.Unlock()
+		n := 0
+		err := blobserver.EnumerateAllAfter(sto, after, func(sb blobref.SizedBlobRef) os.Error {
+			if sb.Size <= maxJsonSize {
+				sc.noticeBlob(sb.BlobRef)
+			}
+			sc.mu.Lock()
+			defer sc.mu.Unlock()
+			sc.scanAfter = sb.BlobRef.String()
+			if n++; n%scanSaveInterval == 0 {
+				if err := sc.saveState(); err != nil {
+					log.Printf("Error saving share state: %v", err)
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			break
+		}
+		log.Printf("Error scanning for share revocations; shares refused until it succeeds: %v", err)
+		time.Sleep(scanRetryDelay)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.scanned = true
+	sc.scanAfter = ""
+	if err := sc.saveState(); err != nil {
+		log.Printf("Error saving share state: %v", err)
+	}
+}
+
+func (sc *ShareChecker) loadState() os.Error {
+	f, err := os.Open(sc.statePath)
+	if osutil.ErrorIsNoEnt(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var state shareState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return fmt.Errorf("handlers: reading share state from %s: %v", sc.statePath, err)
+	}
+	for _, s := range state.Revoked {
+		sc.revoked[s] = true
+	}
+	for s, n := range state.Uses {
+		sc.uses[s] = n
+	}
+	sc.scanned, sc.scanAfter = state.Scanned, state.ScanAfter
+	return nil
+}
+
+// saveState writes the state file, if any, replacing it atomically.
+// sc.mu must be held.
+func (sc *ShareChecker) saveState() os.Error {
+	if sc.statePath == "" {
+		return nil
+	}
+	state := &shareState{
+		Revoked:   make([]string, 0, len(sc.revoked)),
+		Uses:      sc.uses,
+		Scanned:   sc.scanned,
+		ScanAfter: sc.scanAfter,
+	}
+	for s := range sc.revoked {
+		state.Revoked = append(state.Revoked, s)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(sc.statePath), "."+filepath.Base(sc.statePath)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sc.statePath)
+}
+
+// fetchJSON returns the contents of br, if it's a small JSON blob.
+func (sc *ShareChecker) fetchJSON(br *blobref.BlobRef) ([]byte, os.Error) {
+	file, size, err := sc.fetcher.FetchStreaming(br)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if size > maxJsonSize {
+		return nil, os.NewError("too large")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxJsonSize))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, os.NewError("not JSON")
+	}
+	return data, nil
+}
+
+// verify verifies that data, a signed JSON blob, was signed by an
+// owner, returning its payload.
+func (sc *ShareChecker) verify(data []byte) (map[string]interface{}, os.Error) {
+	vr := jsonsign.NewVerificationRequest(string(data), sc.fetcher)
+	if !vr.Verify() {
+		return nil, vr.Err
+	}
+	if !sc.owners[vr.CamliSigner.String()] {
+		return nil, fmt.Errorf("signed by %s, not an owner", vr.CamliSigner)
+	}
+	return vr.PayloadMap, nil
+}
+
+// share returns the share br, if it's valid and may still be used.
+func (sc *ShareChecker) share(br *blobref.BlobRef) (*share, os.Error) {
+	data, err := sc.fetchJSON(br)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if sc.legacy {
+		err = json.Unmarshal(data, &m)
+	} else {
+		m, err = sc.verify(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t, _ := m["camliType"].(string); t != "share" {
+		return nil, os.NewError("not a share")
+	}
+	s := &share{ref: br}
+	s.target, _ = m["target"].(string)
+	if sc.legacy {
+		return s, nil
+	}
+	if v, ok := m["expires"].(string); ok {
+		if s.expires = schema.NanosFromRFC3339(v); s.expires < 0 {
+			return nil, fmt.Errorf("bad expiration time %q", v)
+		}
+		if time.Nanoseconds() > s.expires {
+			return nil, os.NewError("expired")
+		}
+	}
+	if v, ok := m["maxUses"].(float64); ok {
+		s.maxUses = int(v)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.scanned {
+		return nil, os.NewError("still scanning for revocations")
+	}
+	if sc.revoked[br.String()] {
+		return nil, os.NewError("revoked")
+	}
+	if s.maxUses > 0 && sc.uses[br.String()] >= s.maxUses {
+		return nil, os.NewError("used up")
+	}
+	return s, nil
+}
+
+// use records that s was opened, its target fetched, reporting
+// whether it could be. Only the uses of shares with a maximum are
+// counted.
+func (sc *ShareChecker) use(s *share) bool {
+	if s.maxUses == 0 {
+		return true
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	key := s.ref.String()
+	if sc.uses[key] >= s.maxUses {
+		return false
+	}
+	sc.uses[key]++
+	if err := sc.saveState(); err != nil {
+		log.Printf("Error saving share state: %v", err)
+	}
+	return true
+}
+
+// noticeBlob revokes a share if br is an owner's claim revoking it.
+func (sc *ShareChecker) noticeBlob(br *blobref.BlobRef) {
+	data, err := sc.fetchJSON(br)
+	if err != nil || !bytes.Contains(data, []byte(`"revoke"`)) {
+		return
+	}
+	m, err := sc.verify(data)
+	if err != nil {
+		log.Printf("Ignoring possible revoke claim %s: %v", br, err)
+		return
+	}
+	if t, _ := m["claimType"].(string); m["camliType"] != "claim" || t != "revoke" {
+		return
+	}
+	target, _ := m["target"].(string)
+	if blobref.Parse(target) == nil {
+		log.Printf("Revoke claim %s has a bad target %q", br, target)
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.revoked[target] {
+		return
+	}
+	sc.revoked[target] = true
+	if err := sc.saveState(); err != nil {
+		log.Printf("Error saving share state: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"http"
+	"http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver/memory"
+	"camli/jsonsign"
+	"camli/schema"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+const testSecring = "../../jsonsign/testdata/test-secring.gpg"
+
+// shareEnv is a storage with the test owner's public key.
+type shareEnv struct {
+	t     *testing.T
+	sto   *memory.Storage
+	owner *blobref.BlobRef
+}
+
+func newShareEnv(t *testing.T) *shareEnv {
+	entity, err := jsonsign.EntityFromSecring("26F5ABDA", testSecring)
+	AssertNil(t, err, "EntityFromSecring")
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	AssertNil(t, err, "ArmoredPublicKey")
+	env := &shareEnv{t: t, sto: memory.New(0)}
+	env.owner = env.put(armored)
+	return env
+}
+
+func (env *shareEnv) put(s string) *blobref.BlobRef {
+	tb := &test.Blob{s}
+	_, err := env.sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(env.t, err, "ReceiveBlob")
+	return tb.BlobRef()
+}
+
+func (env *shareEnv) putSigned(m map[string]interface{}) *blobref.BlobRef {
+	m["camliSigner"] = env.owner.String()
+	unsigned, err := schema.MapToCamliJson(m)
+	AssertNil(env.t, err, "MapToCamliJson")
+	sr := &jsonsign.SignRequest{
+		UnsignedJson:      unsigned,
+		Fetcher:           env.sto,
+		ServerMode:        true,
+		SecretKeyringPath: testSecring,
+	}
+	signed, err := sr.Sign()
+	AssertNil(env.t, err, "Sign")
+	return env.put(signed)
+}
+
+// newScannedShareChecker returns a ShareChecker of env's shares once
+// it has scanned for revocations.
+func (env *shareEnv) newScannedShareChecker() *ShareChecker {
+	sc, err := NewShareChecker(env.sto, []*blobref.BlobRef{env.owner}, "")
+	AssertNil(env.t, err, "NewShareChecker")
+	for i := 0; i < 100; i++ {
+		if sc.isScanned() {
+			return sc
+		}
+		time.Sleep(10e6)
+	}
+	env.t.Fatalf("share checker didn't finish scanning")
+	return nil
+}
+
+func (sc *ShareChecker) isScanned() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.scanned
+}
+
+// getVia fetches br via share, returning the response status.
+func getVia(gh *GetHandler, br, share *blobref.BlobRef) int {
+	return getViaRequest(gh, br, share.String(), nil).Code
+}
+
+// getViaRequest fetches br via the comma-separated chain of blobrefs
+// via, with the given request headers.
+func getViaRequest(gh *GetHandler, br *blobref.BlobRef, via string, header map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://example.com/camli/"+br.String()+"?via="+via, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	rw.Code = 200
+	gh.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestShareChecks(t *testing.T) {
+	env := newShareEnv(t)
+	target := env.put("foo")
+	gh := &GetHandler{Fetcher: env.sto, Shares: env.newScannedShareChecker()}
+
+	m := schema.NewShareRef(schema.ShareHaveRef, target, false)
+	schema.SetShareMaxUses(m, 2)
+	limited := env.putSigned(m)
+	ExpectInt(t, 200, getVia(gh, target, limited), "first use")
+	ExpectInt(t, 200, getVia(gh, target, limited), "second use")
+	ExpectInt(t, 401, getVia(gh, target, limited), "third use")
+
+	m = schema.NewShareRef(schema.ShareHaveRef, target, false)
+	schema.SetShareExpiration(m, time.Nanoseconds()-1e9)
+	ExpectInt(t, 401, getVia(gh, target, env.putSigned(m)), "expired share")
+
+	m = schema.NewShareRef(schema.ShareHaveRef, target, false)
+	unsigned, _ := schema.MapToCamliJson(m)
+	ExpectInt(t, 401, getVia(gh, target, env.put(unsigned)), "unsigned share")
+
+	share := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, target, false))
+	ExpectInt(t, 200, getVia(gh, target, share), "share")
+	other := &GetHandler{Fetcher: env.sto, Shares: &ShareChecker{fetcher: env.sto, owners: map[string]bool{}, scanned: true}}
+	ExpectInt(t, 401, getVia(other, target, share), "share not signed by an owner")
+	ExpectInt(t, 401, getVia(&GetHandler{Fetcher: env.sto}, target, share), "share without sharing enabled")
+}
+
+func TestLegacyShares(t *testing.T) {
+	env := newShareEnv(t)
+	target := env.put("foo")
+	gh := &GetHandler{Fetcher: env.sto, Shares: NewLegacyShareChecker(env.sto)}
+
+	m := schema.NewShareRef(schema.ShareHaveRef, target, false)
+	unsigned, _ := schema.MapToCamliJson(m)
+	ExpectInt(t, 200, getVia(gh, target, env.put(unsigned)), "unsigned share")
+
+	m = schema.NewShareRef(schema.ShareHaveRef, target, false)
+	schema.SetShareMaxUses(m, 1)
+	limited := env.putSigned(m)
+	ExpectInt(t, 200, getVia(gh, target, limited), "first use")
+	ExpectInt(t, 200, getVia(gh, target, limited), "second use, maxUses ignored")
+	ExpectInt(t, 401, getVia(gh, target, env.put("foo!")), "not a share")
+}
+
+func TestShareRevoked(t *testing.T) {
+	env := newShareEnv(t)
+	target := env.put("foo")
+	gh := &GetHandler{Fetcher: env.sto, Shares: env.newScannedShareChecker()}
+
+	share := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, target, false))
+	ExpectInt(t, 200, getVia(gh, target, share), "share before revoking")
+	env.putSigned(schema.NewRevokeClaim(share))
+	// The claim is noticed asynchronously.
+	for i := 0; i < 20; i++ {
+		if getVia(gh, target, share) == 401 {
+			return
+		}
+		time.Sleep(50e6)
+	}
+	t.Errorf("share still usable after revoking")
+}
+
+func TestShareRevokedBeforeStart(t *testing.T) {
+	env := newShareEnv(t)
+	target := env.put("foo")
+	revoked := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, target, false))
+	env.putSigned(schema.NewRevokeClaim(revoked))
+	share := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, target, true))
+
+	unscanned := &ShareChecker{
+		fetcher: env.sto,
+		owners:  map[string]bool{env.owner.String(): true},
+		revoked: make(map[string]bool),
+		uses:    make(map[string]int),
+	}
+	gh := &GetHandler{Fetcher: env.sto, Shares: unscanned}
+	ExpectInt(t, 401, getVia(gh, target, share), "share before the revocation scan")
+
+	gh.Shares = env.newScannedShareChecker()
+	ExpectInt(t, 401, getVia(gh, target, revoked), "share revoked before starting")
+	ExpectInt(t, 200, getVia(gh, target, share), "other share")
+}
+
+func TestShareScanState(t *testing.T) {
+	statePath := fmt.Sprintf("%s/camli-share-state-%d", os.TempDir(), os.Getpid())
+	defer os.Remove(statePath)
+	os.Remove(statePath)
+
+	env := newShareEnv(t)
+	target := env.put("foo")
+	revoked := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, target, false))
+	env.putSigned(schema.NewRevokeClaim(revoked))
+	owners := []*blobref.BlobRef{env.owner}
+	sc, err := NewShareChecker(env.sto, owners, statePath)
+	AssertNil(t, err, "NewShareChecker")
+	for i := 0; i < 100 && !sc.isScanned(); i++ {
+		time.Sleep(10e6)
+	}
+	Expect(t, sc.isScanned(), "first start scans")
+
+	// A restart trusts the finished scan, so shares are usable
+	// at once and the revocation it found still holds.
+	sc, err = NewShareChecker(env.sto, owners, statePath)
+	AssertNil(t, err, "NewShareChecker")
+	Expect(t, sc.isScanned(), "restart doesn't rescan")
+	gh := &GetHandler{Fetcher: env.sto, Shares: sc}
+	ExpectInt(t, 401, getVia(gh, target, revoked), "share revoked before the restart")
+	share := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, target, false))
+	ExpectInt(t, 200, getVia(gh, target, share), "other share")
+}
+
+func TestShareChainReferences(t *testing.T) {
+	env := newShareEnv(t)
+	member := env.put("member")
+	other := env.put("other")
+	set := env.put(`{"camliVersion": 1, "camliType": "static-set", "members": ["` + member.String() + `"]}`)
+	share := env.putSigned(schema.NewShareRef(schema.ShareHaveRef, set, true))
+	gh := &GetHandler{Fetcher: env.sto, Shares: env.newScannedShareChecker()}
+
+	via := share.String() + "," + set.String()
+	ExpectInt(t, 200, getViaRequest(gh, member, via, nil).Code, "blob referenced by the hop")
+	ExpectInt(t, 401, getViaRequest(gh, other, via, nil).Code, "blob not referenced by the hop")
+}
+
+func TestShareCaching(t *testing.T) {
+	env := newShareEnv(t)
+	target := env.put("foo")
+	m := schema.NewShareRef(schema.ShareHaveRef, target, false)
+	schema.SetShareMaxUses(m, 1)
+	share := env.putSigned(m)
+	gh := &GetHandler{Fetcher: env.sto, Shares: env.newScannedShareChecker()}
+
+	etag := `"` + target.String() + `"`
+	rw := getViaRequest(gh, target, share.String(), map[string]string{"If-None-Match": etag})
+	ExpectInt(t, 304, rw.Code, "revalidation")
+	ExpectString(t, "private, no-cache", rw.HeaderMap.Get("Cache-Control"), "Cache-Control")
+	rw = getViaRequest(gh, target, share.String(), nil)
+	ExpectInt(t, 200, rw.Code, "use after revalidating")
+	ExpectString(t, "private, no-cache", rw.HeaderMap.Get("Cache-Control"), "Cache-Control")
+	ExpectInt(t, 401, getVia(gh, target, share), "use after the last")
+}
@@ -35,6 +35,31 @@ func CreateStatHandler(storage blobserver.Storage) func(http.ResponseWriter, *ht
 
 const maxStatBlobs = 1000
 
+// partialStatResponse lists the partial uploads in dir of the blobs
+// in toStat which aren't in statRes.
+func partialStatResponse(dir string, toStat []*blobref.BlobRef, statRes []map[string]interface{}) []map[string]interface{} {
+	have := make(map[string]bool)
+	for _, ah := range statRes {
+		have[ah["blobRef"].(string)] = true
+	}
+	partial := make([]map[string]interface{}, 0)
+	for _, br := range toStat {
+		if have[br.String()] {
+			continue
+		}
+		have[br.String()] = true
+		for _, p := range listPartialUploads(dir, br) {
+			partial = append(partial, map[string]interface{}{
+				"blobRef":     p.blob.String(),
+				"size":        p.size,
+				"partBlobRef": p.partRef.String(),
+				"resumeKey":   p.resumeKey(),
+			})
+		}
+	}
+	return partial
+}
+
 func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.BlobStatter) {
 	toStat := make([]*blobref.BlobRef, 0)
 	switch req.Method {
@@ -88,6 +113,7 @@ func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.
 
 	statRes := make([]map[string]interface{}, 0)
 	if len(toStat) > 0 {
+		blobserver.NotifyWillStat(storage, toStat)
 		blobch := make(chan blobref.SizedBlobRef)
 		resultch := make(chan os.Error, 1)
 		go func() {
@@ -114,6 +140,9 @@ func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.
 	configer, _ := storage.(blobserver.Configer)
 	ret := commonUploadResponse(configer, req)
 	ret["stat"] = statRes
+	if dir := partialUploadDir(storage); dir != "" {
+		ret["alreadyHavePartially"] = partialStatResponse(dir, toStat, statRes)
+	}
 	ret["canLongPoll"] = true
 	httputil.ReturnJson(conn, ret)
 }
@@ -0,0 +1,45 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"http"
+
+	"camli/blobserver"
+	"camli/httputil"
+)
+
+func CreateStorageStatsHandler(storage blobserver.Storage) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleStorageStats(conn, req, storage)
+	}
+}
+
+func handleStorageStats(conn http.ResponseWriter, req *http.Request, storage blobserver.Storage) {
+	st, err := blobserver.GetStorageStats(storage)
+	if err == blobserver.ErrStatsUnsupported {
+		conn.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(conn, "This storage doesn't support stats.\n")
+		return
+	}
+	if err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	httputil.ReturnJson(conn, st)
+}
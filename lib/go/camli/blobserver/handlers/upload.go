@@ -52,6 +52,7 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request, blobRece
 	}
 
 	receivedBlobs := make([]blobref.SizedBlobRef, 0, 10)
+	partialDir := partialUploadDir(blobReceiver)
 
 	multipart, err := req.MultipartReader()
 	if multipart == nil {
@@ -88,10 +89,20 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request, blobRece
 
 		formName := params["name"]
 		ref := blobref.Parse(formName)
+		var resume *partialUpload
+		if ref == nil && partialDir != "" {
+			if resume = parseResumeKey(formName); resume != nil {
+				ref = resume.blob
+			}
+		}
 		if ref == nil {
 			addError(fmt.Sprintf("Ignoring form key %q", formName))
 			continue
 		}
+		if !ref.IsSupported() {
+			addError(fmt.Sprintf("Ignoring blob %s with unsupported hash function", ref))
+			continue
+		}
 
 		if oldAppEngineHappySpec {
 			_, hasContentType := mimePart.Header["Content-Type"]
@@ -107,7 +118,7 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request, blobRece
 			}
 		}
 
-		blobGot, err := blobReceiver.ReceiveBlob(ref, mimePart)
+		blobGot, err := receiveResumable(blobReceiver, partialDir, ref, resume, mimePart)
 		if err != nil {
 			addError(fmt.Sprintf("Error receiving blob %v: %v\n", ref, err))
 			break
@@ -149,7 +160,7 @@ func commonUploadResponse(configer blobserver.Configer, req *http.Request) map[s
 }
 
 // NOTE: not part of the spec at present.  old.  might be re-introduced.
-var kPutPattern *regexp.Regexp = regexp.MustCompile(`^/camli/([a-z0-9]+)-([a-f0-9]+)$`)
+var kPutPattern *regexp.Regexp = regexp.MustCompile(`^/camli/` + blobref.Pattern + `$`)
 
 // NOTE: not part of the spec at present.  old.  might be re-introduced.
 func CreateNonStandardPutHandler(storage blobserver.Storage) func(http.ResponseWriter, *http.Request) {
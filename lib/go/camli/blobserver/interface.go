@@ -49,6 +49,61 @@ type QueueCreator interface {
 	CreateQueue(name string) (Storage, os.Error)
 }
 
+// Quarantiner is implemented by Storage interfaces which can set a
+// corrupt blob aside for inspection rather than deleting it.  This is
+// used by the scrubber.
+type Quarantiner interface {
+	// Quarantine moves the blob out of the storage, which then
+	// behaves as if it had been removed, so a good copy can be
+	// received in its place.  Quarantining a missing blob isn't an
+	// error.
+	Quarantine(blob *blobref.BlobRef) os.Error
+}
+
+// StorageStats describes what a storage holds.
+type StorageStats struct {
+	Blobs     int64 "blobs"     // number of blobs
+	Bytes     int64 "bytes"     // total size of the blobs
+	FreeBytes int64 "freeBytes" // room for new blobs, or -1 if unknown
+}
+
+// StorageStatser is implemented by Storage interfaces which can count
+// their blobs without enumerating them all.
+type StorageStatser interface {
+	StorageStats() (*StorageStats, os.Error)
+}
+
+// PartialUploader is implemented by Storage interfaces which have a
+// local directory where the upload handler can keep the start of
+// uploads that fail partway, so clients can resume them. See
+// doc/protocol/blob-upload-resume.txt.
+type PartialUploader interface {
+	// PartialUploadDir returns the directory, or "" if partial
+	// uploads aren't kept.
+	PartialUploadDir() string
+}
+
+// BatchFetcher is implemented by Storage interfaces which can fetch
+// many blobs in one round trip, such as remote storage. Use the
+// FetchMulti function to fetch from any storage.
+type BatchFetcher interface {
+	// FetchMulti calls fn with each of blobs the storage has, in
+	// the order given, skipping missing ones. The blob's contents
+	// are only readable until fn returns. An error from fn stops
+	// the fetch and is returned.
+	FetchMulti(blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error
+}
+
+// BatchReceiver is implemented by Storage interfaces which can
+// receive many blobs in one round trip, such as remote storage. Use
+// the ReceiveBlobs function to send to any storage.
+type BatchReceiver interface {
+	// ReceiveBlobs receives blobs, of the given sizes, reading each
+	// from the corresponding contents. It returns an error unless
+	// all were received.
+	ReceiveBlobs(blobs []blobref.SizedBlobRef, contents []io.Reader) os.Error
+}
+
 type MaxEnumerateConfig interface {
 	// Returns the max that this storage interface is capable
 	// of enumerating at once.
@@ -59,6 +114,9 @@ type BlobEnumerator interface {
 	// EnumerateBobs sends at most limit SizedBlobRef into dest,
 	// sorted, as long as they are lexigraphically greater than
 	// after (if provided).
+	// Blobs of different hash functions are sorted together by
+	// their full blobref strings, which is the same as sorting by
+	// hash name and then digest.
 	// limit will be supplied and sanity checked by caller.
 	// waitSeconds is the max time to wait for any blobs to exist,
 	// or 0 for no delay.
@@ -91,6 +149,11 @@ type Config struct {
 
 	// the "http://host:port" and optional path (but without trailing slash) to have "/camli/*" appended
 	URLBase string
+
+	// DownloadURLBase, if not empty, is the URL of a UI's download
+	// handler for the storage's files, to have a file schema
+	// blobref appended.
+	DownloadURLBase string
 }
 
 type Configer interface {
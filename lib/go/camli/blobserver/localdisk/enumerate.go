@@ -69,6 +69,10 @@ func readBlobs(opts readBlobRequest) os.Error {
 		}
 		fullPath := dirFullPath + "/" + name
 		fi, err := os.Stat(fullPath)
+		if errorIsNoEnt(err) {
+			// Removed since it was listed.
+			continue
+		}
 		if err != nil {
 			return &enumerateError{"localdisk: stat of file " + fullPath, err}
 		}
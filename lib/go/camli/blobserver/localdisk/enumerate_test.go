@@ -20,10 +20,12 @@ import (
 	"camli/blobref"
 	. "camli/test/asserts"
 
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -84,6 +86,44 @@ func TestEnumerate(t *testing.T) {
         ExpectNil(t, <-errCh, "EnumerateBlobs return value")
 }
 
+func sha256Blob(t *testing.T, ds *DiskStorage, val string) *blobref.BlobRef {
+	h := sha256.New()
+	h.Write([]byte(val))
+	br := blobref.FromHash("sha256", h)
+	_, err := ds.ReceiveBlob(br, strings.NewReader(val))
+	AssertNil(t, err, "ReceiveBlob of sha256 blob")
+	return br
+}
+
+func enumerateAll(ds *DiskStorage, after string) []string {
+	ch := make(chan blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, after, 5000, 0)
+	var refs []string
+	for sb := range ch {
+		refs = append(refs, sb.BlobRef.String())
+	}
+	return refs
+}
+
+func TestEnumerateMixedHashes(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	foo := &testBlob{"foo"}
+	foo.ExpectUploadBlob(t, ds)
+	sha256Blob(t, ds, "foo")
+	sha256Blob(t, ds, "baar")
+
+	refs := enumerateAll(ds, "")
+	AssertInt(t, 3, len(refs), "blobs enumerated")
+	Expect(t, sort.StringsAreSorted(refs), "mixed hashes enumerated in string order")
+	ExpectString(t, foo.BlobRef().String(), refs[0], "sha1 blob first")
+
+	refs = enumerateAll(ds, "sha1-ffffffffffffffffffffffffffffffffffffffff")
+	AssertInt(t, 2, len(refs), "blobs enumerated after all sha1s")
+	ExpectString(t, "sha256", blobref.Parse(refs[0]).HashName(), "hash after all sha1s")
+}
+
 func TestEnumerateEmpty(t *testing.T) {
 	ds := NewStorage(t)
 	defer cleanUp(ds)
@@ -38,6 +38,8 @@ type DiskStorage struct {
 	// queue partitions to mirror new blobs into (when partition
 	// above is the empty string)
 	mirrorPartitions []*DiskStorage
+
+	stats diskStats
 }
 
 func New(root string) (storage *DiskStorage, err os.Error) {
@@ -124,9 +126,13 @@ func (ds *DiskStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int
 func (ds *DiskStorage) Remove(blobs []*blobref.BlobRef) os.Error {
 	for _, blob := range blobs {
 		fileName := ds.blobPath(ds.partition, blob)
-		err := os.Remove(fileName)
+		fi, err := os.Lstat(fileName)
+		if err == nil {
+			err = os.Remove(fileName)
+		}
 		switch {
 		case err == nil:
+			ds.blobRemoved(blob, fi.Size)
 			continue
 		case errorIsNoEnt(err):
 			log.Printf("Deleting already-deleted file; harmless.")
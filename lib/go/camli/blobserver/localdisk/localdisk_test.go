@@ -19,6 +19,7 @@ package localdisk
 import (
 	"camli/blobref"
 	"camli/blobserver"
+	"camli/blobserver/storagetest"
 	. "camli/test/asserts"
 	"crypto/sha1"
 	"fmt"
@@ -206,3 +207,103 @@ func TestMissingGetReturnsNoEnt(t *testing.T) {
 		t.Errorf("expected nil blob; got a value")
 	}
 }
+
+func TestQuarantine(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	_, err := ds.CreateQueue("some-queue")
+	AssertNil(t, err, "CreateQueue")
+	foo := &testBlob{"foo"}
+	foo.ExpectUploadBlob(t, ds)
+
+	AssertNil(t, ds.Quarantine(foo.BlobRef()), "Quarantine")
+	if _, _, err := ds.Fetch(foo.BlobRef()); err != os.ENOENT {
+		t.Errorf("expected ENOENT for quarantined blob; got %v", err)
+	}
+	_, err = os.Stat(ds.blobPath(quarantinePartition, foo.BlobRef()))
+	AssertNil(t, err, "stat of quarantined file")
+	_, err = os.Stat(ds.blobPath("queue-some-queue", foo.BlobRef()))
+	Expect(t, errorIsNoEnt(err), "quarantined blob removed from queue")
+	AssertNil(t, ds.Quarantine(foo.BlobRef()), "Quarantine of missing blob")
+
+	// A good copy can be received again.
+	foo.ExpectUploadBlob(t, ds)
+	_, err = os.Stat(ds.blobPath("queue-some-queue", foo.BlobRef()))
+	AssertNil(t, err, "stat of re-received blob in queue")
+}
+
+func expectStats(t *testing.T, ds *DiskStorage, blobs, size int64, what string) {
+	st, err := ds.StorageStats()
+	AssertNil(t, err, "StorageStats")
+	ExpectInt(t, int(blobs), int(st.Blobs), what+" blobs")
+	ExpectInt(t, int(size), int(st.Bytes), what+" bytes")
+}
+
+func TestStorageStats(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	q, err := ds.CreateQueue("some-queue")
+	AssertNil(t, err, "CreateQueue")
+	queue := q.(*DiskStorage)
+	foo := &testBlob{"foo"}
+	bar := &testBlob{"baar"}
+	foo.ExpectUploadBlob(t, ds)
+
+	// The first call walks the partition.
+	expectStats(t, ds, 1, 3, "initial")
+	foo.ExpectUploadBlob(t, ds)
+	bar.ExpectUploadBlob(t, ds)
+	expectStats(t, ds, 2, 7, "after upload")
+	expectStats(t, queue, 2, 7, "queue after upload")
+
+	AssertNil(t, queue.Remove(foo.BlobRefSlice()), "Remove from queue")
+	expectStats(t, queue, 1, 4, "queue after remove")
+	AssertNil(t, ds.Quarantine(bar.BlobRef()), "Quarantine")
+	expectStats(t, ds, 1, 3, "after quarantine")
+	expectStats(t, queue, 0, 0, "queue after quarantine")
+}
+
+func TestStorageStatsDuringChanges(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	var blobs []*testBlob
+	for i := 0; i < 200; i++ {
+		tb := &testBlob{fmt.Sprintf("blob %d", i)}
+		blobs = append(blobs, tb)
+		if i < 100 {
+			tb.ExpectUploadBlob(t, ds)
+		}
+	}
+
+	// Receive and remove blobs while the first call walks the
+	// partition, which mustn't hold them up or miscount them.
+	done := make(chan bool)
+	go func() {
+		for i, tb := range blobs {
+			if i < 50 {
+				ExpectNil(t, ds.Remove(tb.BlobRefSlice()), "Remove")
+			} else if i >= 100 {
+				tb.ExpectUploadBlob(t, ds)
+			}
+		}
+		done <- true
+	}()
+	_, err := ds.StorageStats()
+	AssertNil(t, err, "StorageStats")
+	<-done
+
+	var size int64
+	for _, tb := range blobs[50:] {
+		size += tb.Size()
+	}
+	expectStats(t, ds, 150, size, "after concurrent changes")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			ds := NewStorage(t)
+			return ds, func() { cleanUp(ds) }
+		},
+	})
+}
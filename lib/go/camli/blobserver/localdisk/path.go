@@ -40,6 +40,17 @@ func (ds *DiskStorage) blobPath(partition string, b *blobref.BlobRef) string {
 	return filepath.Join(ds.blobDirectory(partition, b), BlobFileBaseName(b))
 }
 
+// resumePartition is where the upload handler keeps partial uploads.
+const resumePartition = "resume"
+
+func (ds *DiskStorage) PartialUploadDir() string {
+	if ds.partition != "" {
+		// Queues aren't uploaded to.
+		return ""
+	}
+	return ds.PartitionRoot(resumePartition)
+}
+
 func (ds *DiskStorage) PartitionRoot(partition string) string {
 	if partition == "" {
 		return ds.root
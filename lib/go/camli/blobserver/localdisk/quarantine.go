@@ -0,0 +1,62 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"fmt"
+	"os"
+
+	"camli/blobref"
+)
+
+// quarantinePartition is where corrupt blobs are moved, keeping their
+// usual path within it.
+const quarantinePartition = "quarantine"
+
+// Quarantine moves a blob's file into the quarantine partition. Queue
+// partitions hard-link the same (corrupt) file, so the blob is removed
+// from them too; receiving a good copy mirrors it to them again.
+func (ds *DiskStorage) Quarantine(blob *blobref.BlobRef) os.Error {
+	if ds.partition != "" {
+		return fmt.Errorf("can't quarantine from queue partition %q", ds.partition)
+	}
+	fileName := ds.blobPath("", blob)
+	fi, err := os.Lstat(fileName)
+	if err != nil {
+		if errorIsNoEnt(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(ds.blobDirectory(quarantinePartition, blob), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(fileName, ds.blobPath(quarantinePartition, blob)); err != nil {
+		return err
+	}
+	ds.blobRemoved(blob, fi.Size)
+	for _, mirror := range ds.mirrorPartitions {
+		err := os.Remove(ds.blobPath(mirror.partition, blob))
+		switch {
+		case err == nil:
+			mirror.blobRemoved(blob, fi.Size)
+		case !errorIsNoEnt(err):
+			return err
+		}
+	}
+	return nil
+}
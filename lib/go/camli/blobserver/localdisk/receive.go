@@ -73,7 +73,7 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 	}
 
 	fileName := ds.blobPath("", blobRef)
-	if err = os.Rename(tempFile.Name(), fileName); err != nil {
+	if err = ds.renameBlobFile(blobRef, tempFile.Name(), fileName, written); err != nil {
 		return
 	}
 
@@ -104,6 +104,7 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 				log.Fatalf("got link error %T %#v", err, err)
 				return
 			}
+			mirror.blobAdded(blobRef, stat.Size)
 			log.Printf("Mirrored to partition %q", pname)
 		}
 	}
@@ -0,0 +1,205 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"os"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/osutil"
+)
+
+// diskStats counts the blobs of a DiskStorage's partition. They're
+// counted by walking the partition the first time they're asked for,
+// and kept up to date by ReceiveBlob, Remove and Quarantine after
+// that. Blob files added or removed by other processes aren't
+// noticed until the server restarts.
+//
+// The walk doesn't hold mu, so receives and removes aren't held up by
+// it. Those that happen during the walk note their blob's bucket, a
+// first-level directory under its hash's, and the noted buckets are
+// counted again once the walk is done.
+type diskStats struct {
+	mu          sync.Mutex
+	walked      *sync.Cond // on mu; signaled when a walk ends
+	loaded      bool
+	walking     bool
+	changed     map[string]bool // buckets changed during the walk
+	blobs, size int64
+}
+
+// bucketCount is the number and size of the blobs in a bucket.
+type bucketCount struct {
+	blobs, size int64
+}
+
+// statsBucket returns the bucket of blob, as a directory relative to
+// the partition root.
+func statsBucket(blob *blobref.BlobRef) string {
+	d := blob.Digest()
+	if len(d) < 3 {
+		d = d + "___"
+	}
+	return blob.HashName() + "/" + d[0:3]
+}
+
+func (ds *DiskStorage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	st := &ds.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for !st.loaded {
+		if st.walking {
+			st.walked.Wait()
+			continue
+		}
+		if err := ds.walkStats(); err != nil {
+			return nil, err
+		}
+	}
+	free, err := osutil.DiskFree(ds.root)
+	if err != nil {
+		return nil, err
+	}
+	return &blobserver.StorageStats{
+		Blobs:     st.blobs,
+		Bytes:     st.size,
+		FreeBytes: free,
+	}, nil
+}
+
+// walkStats counts the partition's blobs. It's called with stats.mu
+// held, and releases it during the walk.
+func (ds *DiskStorage) walkStats() os.Error {
+	st := &ds.stats
+	if st.walked == nil {
+		st.walked = sync.NewCond(&st.mu)
+	}
+	st.walking = true
+	st.changed = make(map[string]bool)
+	defer func() {
+		st.walking = false
+		st.changed = nil
+		st.walked.Broadcast()
+	}()
+
+	st.mu.Unlock()
+	buckets, err := ds.countBlobs("")
+	st.mu.Lock()
+	if err != nil {
+		return err
+	}
+	for bucket := range st.changed {
+		recount, err := ds.countBlobs(bucket)
+		if err != nil {
+			return err
+		}
+		buckets[bucket] = nil, false
+		if bc, ok := recount[bucket]; ok {
+			buckets[bucket] = bc
+		}
+	}
+	st.blobs, st.size = 0, 0
+	for _, bc := range buckets {
+		st.blobs += bc.blobs
+		st.size += bc.size
+	}
+	st.loaded = true
+	return nil
+}
+
+// countBlobs counts the blobs under dir, relative to the partition
+// root, by bucket. A missing dir has none.
+func (ds *DiskStorage) countBlobs(dir string) (map[string]*bucketCount, os.Error) {
+	buckets := make(map[string]*bucketCount)
+	root := ds.PartitionRoot(ds.partition)
+	if dir != "" {
+		if _, err := os.Stat(root + "/" + dir); errorIsNoEnt(err) {
+			return buckets, nil
+		}
+	}
+	ch := make(chan blobref.SizedBlobRef, 100)
+	errc := make(chan os.Error, 1)
+	remain := ^uint(0)
+	go func() {
+		errc <- readBlobs(readBlobRequest{
+			ch:       ch,
+			dirRoot:  root,
+			pathInto: dir,
+			remain:   &remain,
+		})
+		close(ch)
+	}()
+	for sb := range ch {
+		bucket := statsBucket(sb.BlobRef)
+		bc, ok := buckets[bucket]
+		if !ok {
+			bc = new(bucketCount)
+			buckets[bucket] = bc
+		}
+		bc.blobs++
+		bc.size += sb.Size
+	}
+	return buckets, <-errc
+}
+
+// noteChange notes that blob's bucket changed if a walk is counting
+// it. stats.mu must be held.
+func (st *diskStats) noteChange(blob *blobref.BlobRef) {
+	if st.walking {
+		st.changed[statsBucket(blob)] = true
+	}
+}
+
+// renameBlobFile renames a finished temp file to the blob file
+// fileName, counting the blob unless it replaced an existing copy.
+func (ds *DiskStorage) renameBlobFile(blob *blobref.BlobRef, tempName, fileName string, size int64) os.Error {
+	ds.stats.mu.Lock()
+	defer ds.stats.mu.Unlock()
+	_, err := os.Lstat(fileName)
+	isNew := err != nil
+	if err := os.Rename(tempName, fileName); err != nil {
+		return err
+	}
+	ds.stats.noteChange(blob)
+	if isNew {
+		ds.stats.blobs++
+		ds.stats.size += size
+	}
+	return nil
+}
+
+// blobAdded records a new blob file of the given size in ds's
+// partition.
+func (ds *DiskStorage) blobAdded(blob *blobref.BlobRef, size int64) {
+	ds.stats.mu.Lock()
+	defer ds.stats.mu.Unlock()
+	ds.stats.noteChange(blob)
+	ds.stats.blobs++
+	ds.stats.size += size
+}
+
+// blobRemoved records the removal of a blob file of the given size
+// from ds's partition.
+func (ds *DiskStorage) blobRemoved(blob *blobref.BlobRef, size int64) {
+	ds.stats.mu.Lock()
+	defer ds.stats.mu.Unlock()
+	ds.stats.noteChange(blob)
+	ds.stats.blobs--
+	ds.stats.size -= size
+}
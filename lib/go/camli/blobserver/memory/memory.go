@@ -0,0 +1,274 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package memory registers the "memory" blobserver storage type,
+keeping all blobs in memory. It's mostly useful for tests and as a
+bounded cache in front of a slower storage.
+
+Example low-level config:
+
+     "/cache/": {
+         "handler": "storage-memory",
+         "handlerArgs": {
+            "maxSize": 104857600
+          }
+     },
+
+If maxSize (in bytes) is non-zero, the least recently used blobs are
+evicted to keep the total size of the stored blobs under it.
+*/
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+// Storage is an in-memory blobserver.Storage. It also implements
+// blobserver.Cache and blobserver.QueueCreator.
+type Storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	maxSize int64 // or 0 for unlimited
+	isQueue bool
+
+	index blobserver.SortedIndex // blobref to its *list.Element in lru
+
+	mu     sync.Mutex // guards following, and changes to index
+	lru    *list.List // of *entry; front is most recently used
+	size   int64      // sum of blob sizes
+	queues []*Storage
+}
+
+type entry struct {
+	br   *blobref.BlobRef
+	data []byte
+}
+
+var _ blobserver.Storage = (*Storage)(nil)
+var _ blobserver.Cache = (*Storage)(nil)
+var _ blobserver.QueueCreator = (*Storage)(nil)
+
+// New returns a new in-memory Storage. If maxSize is non-zero, least
+// recently used blobs are evicted to keep the sum of the blobs' sizes
+// at most maxSize bytes.
+func New(maxSize int64) *Storage {
+	return &Storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		maxSize:                   maxSize,
+		lru:                       list.New(),
+	}
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	maxSize := config.OptionalInt("maxSize", 0)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if maxSize < 0 {
+		return nil, fmt.Errorf("memory: invalid negative maxSize %d", maxSize)
+	}
+	return New(int64(maxSize)), nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("memory", blobserver.StorageConstructor(newFromConfig))
+}
+
+// NumBlobs returns the number of blobs currently stored.
+func (s *Storage) NumBlobs() int {
+	return s.index.Len()
+}
+
+// StorageStats reports the blobs currently stored. FreeBytes is the
+// room left under maxSize before blobs are evicted, or -1 if there's
+// no maxSize.
+func (s *Storage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &blobserver.StorageStats{
+		Blobs:     int64(s.index.Len()),
+		Bytes:     s.size,
+		FreeBytes: -1,
+	}
+	if s.maxSize > 0 {
+		st.FreeBytes = s.maxSize - s.size
+	}
+	return st, nil
+}
+
+// SumBlobSize returns the total size of the blobs currently stored.
+func (s *Storage) SumBlobSize() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+type readSeekNopCloser struct {
+	*io.SectionReader
+}
+
+func (readSeekNopCloser) Close() os.Error { return nil }
+
+// byteReaderAt implements io.ReaderAt over a byte slice.
+type byteReaderAt []byte
+
+func (b byteReaderAt) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	if off >= int64(len(b)) {
+		return 0, os.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = os.EOF
+	}
+	return
+}
+
+func (s *Storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return s.Fetch(br)
+}
+
+func (s *Storage) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ele, ok := s.lookup(br.String())
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	s.lru.MoveToFront(ele)
+	data := ele.Value.(*entry).data
+	size := int64(len(data))
+	return readSeekNopCloser{io.NewSectionReader(byteReaderAt(data), 0, size)}, size, nil
+}
+
+func (s *Storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	if s.isQueue {
+		err = os.NewError("memory: refusing upload directly to queue")
+		return
+	}
+	hash := br.Hash()
+	if hash == nil {
+		err = fmt.Errorf("memory: unsupported blobref hash type of %q", br.String())
+		return
+	}
+	var buf bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &buf), source)
+	if err != nil {
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	data := buf.Bytes()
+
+	s.mu.Lock()
+	s.add(br, data)
+	queues := s.queues
+	for _, q := range queues {
+		q.mu.Lock()
+		q.add(br, data)
+		q.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	s.GetBlobHub().NotifyBlobReceived(br)
+	for _, q := range queues {
+		q.GetBlobHub().NotifyBlobReceived(br)
+	}
+	return blobref.SizedBlobRef{br, size}, nil
+}
+
+// lookup returns key's element in s.lru.
+func (s *Storage) lookup(key string) (ele *list.Element, ok bool) {
+	_, v, ok := s.index.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*list.Element), true
+}
+
+// add stores data as br, evicting old blobs if needed. s.mu must be
+// held.
+func (s *Storage) add(br *blobref.BlobRef, data []byte) {
+	key := br.String()
+	if ele, ok := s.lookup(key); ok {
+		s.lru.MoveToFront(ele)
+		return
+	}
+	s.index.Set(key, int64(len(data)), s.lru.PushFront(&entry{br, data}))
+	s.size += int64(len(data))
+	for s.maxSize > 0 && s.size > s.maxSize && s.lru.Len() > 1 {
+		s.remove(s.lru.Back().Value.(*entry).br.String())
+	}
+}
+
+// remove deletes key, if present. s.mu must be held.
+func (s *Storage) remove(key string) {
+	ele, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	s.lru.Remove(ele)
+	s.index.Delete(key)
+	s.size -= int64(len(ele.Value.(*entry).data))
+}
+
+func (s *Storage) Remove(blobs []*blobref.BlobRef) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, br := range blobs {
+		s.remove(br.String())
+	}
+	return nil
+}
+
+var validQueueName = regexp.MustCompile(`^[a-zA-Z0-9\-\_]+$`)
+
+// CreateQueue returns a new Storage which receives a copy of every
+// blob subsequently uploaded to s. Queues are never size-limited.
+func (s *Storage) CreateQueue(name string) (blobserver.Storage, os.Error) {
+	if !validQueueName.MatchString(name) {
+		return nil, fmt.Errorf("invalid queue name %q", name)
+	}
+	if s.isQueue {
+		return nil, fmt.Errorf("can't create queue %q on a queue", name)
+	}
+	q := New(0)
+	q.isQueue = true
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues = append(s.queues, q)
+	return q, nil
+}
+
+func (s *Storage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return blobserver.StatFromIndex(&s.index, s.GetBlobHub(), dest, blobs, waitSeconds)
+}
+
+func (s *Storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return blobserver.EnumerateFromIndex(&s.index, s.GetBlobHub(), dest, after, limit, waitSeconds)
+}
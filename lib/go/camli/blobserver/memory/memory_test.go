@@ -0,0 +1,146 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func expectMissing(t *testing.T, s *Storage, tb *test.Blob) {
+	if _, _, err := s.Fetch(tb.BlobRef()); err != os.ENOENT {
+		t.Errorf("expected ENOENT fetching %q; got %v", tb.Contents, err)
+	}
+}
+
+func TestReceiveFetchRemove(t *testing.T) {
+	s := New(0)
+	foo := &test.Blob{"foo"}
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, s, foo)
+	storagetest.Upload(t, s, bar)
+	storagetest.Upload(t, s, foo) // dup
+	storagetest.ExpectContents(t, s, foo)
+	storagetest.ExpectContents(t, s, bar)
+	ExpectInt(t, 2, s.NumBlobs(), "NumBlobs")
+	ExpectInt(t, 7, int(s.SumBlobSize()), "SumBlobSize")
+
+	_, err := s.ReceiveBlob(foo.BlobRef(), bar.Reader())
+	if err == nil {
+		t.Errorf("expected error receiving blob with wrong digest")
+	}
+
+	AssertNil(t, s.Remove(foo.BlobRefSlice()), "Remove")
+	expectMissing(t, s, foo)
+	storagetest.ExpectContents(t, s, bar)
+	ExpectInt(t, 4, int(s.SumBlobSize()), "SumBlobSize after remove")
+}
+
+func TestEnumerateSorted(t *testing.T) {
+	s := New(0)
+	const blobsToMake = 20
+	for i := 0; i < blobsToMake; i++ {
+		storagetest.Upload(t, s, &test.Blob{fmt.Sprintf("blob-%d", i)})
+	}
+	got := storagetest.Enumerate(t, s, "", 1000)
+	ExpectInt(t, blobsToMake, len(got), "number of enumerated blobs")
+	for i := 1; i < len(got); i++ {
+		if got[i-1].BlobRef.String() >= got[i].BlobRef.String() {
+			t.Fatalf("enumerate not sorted at index %d", i)
+		}
+	}
+
+	limited := storagetest.Enumerate(t, s, got[9].BlobRef.String(), 5)
+	ExpectInt(t, 5, len(limited), "number of blobs with limit")
+	ExpectString(t, got[10].BlobRef.String(), limited[0].BlobRef.String(), "first blob after")
+}
+
+func TestEvictLRU(t *testing.T) {
+	a := &test.Blob{"aaaa"}
+	b := &test.Blob{"bbbb"}
+	c := &test.Blob{"cccc"}
+	s := New(10)
+	storagetest.Upload(t, s, a)
+	storagetest.Upload(t, s, b)
+	storagetest.ExpectContents(t, s, a) // a is now more recent than b
+	storagetest.Upload(t, s, c)
+	expectMissing(t, s, b)
+	storagetest.ExpectContents(t, s, a)
+	storagetest.ExpectContents(t, s, c)
+	ExpectInt(t, 8, int(s.SumBlobSize()), "SumBlobSize")
+
+	// A blob larger than maxSize is kept, alone.
+	big := &test.Blob{"0123456789abc"}
+	storagetest.Upload(t, s, big)
+	ExpectInt(t, 1, s.NumBlobs(), "NumBlobs after big blob")
+	storagetest.ExpectContents(t, s, big)
+}
+
+func TestQueue(t *testing.T) {
+	s := New(0)
+	foo := &test.Blob{"foo"}
+	storagetest.Upload(t, s, foo)
+
+	qs, err := s.CreateQueue("sync-to-foo")
+	AssertNil(t, err, "CreateQueue")
+	q := qs.(*Storage)
+	_, err = s.CreateQueue("bad/name")
+	ExpectErrorContains(t, err, "invalid queue name", "CreateQueue with bad name")
+
+	bar := &test.Blob{"bar!"}
+	storagetest.Upload(t, s, bar)
+	got := storagetest.Enumerate(t, q, "", 10)
+	ExpectInt(t, 1, len(got), "blobs in queue")
+	ExpectString(t, bar.BlobRef().String(), got[0].BlobRef.String(), "queued blob")
+
+	_, err = q.ReceiveBlob(foo.BlobRef(), foo.Reader())
+	Expect(t, err != nil, "upload to queue refused")
+
+	// Removing from the queue leaves the source alone.
+	AssertNil(t, q.Remove(bar.BlobRefSlice()), "Remove from queue")
+	ExpectInt(t, 0, q.NumBlobs(), "blobs in queue after remove")
+	storagetest.ExpectContents(t, s, bar)
+}
+
+func TestStatWait(t *testing.T) {
+	s := New(0)
+	foo := &test.Blob{"foo"}
+	dest := make(chan blobref.SizedBlobRef, 1)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- s.Stat(dest, foo.BlobRefSlice(), 5)
+	}()
+	storagetest.Upload(t, s, foo)
+	sb := <-dest
+	foo.AssertMatches(t, &sb)
+	AssertNil(t, <-errch, "Stat return value")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			return New(0), nil
+		},
+	})
+}
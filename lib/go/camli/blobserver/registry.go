@@ -36,9 +36,14 @@ type Loader interface {
 type StorageConstructor func(Loader, jsonconfig.Obj) (Storage, os.Error)
 type HandlerConstructor func(Loader, jsonconfig.Obj) (http.Handler, os.Error)
 
+// BlobHubConstructor returns a hub for the given storage, which also
+// learns of blobs written by other processes.
+type BlobHubConstructor func(Storage, jsonconfig.Obj) (BlobHub, os.Error)
+
 var mapLock sync.Mutex
 var storageConstructors = make(map[string]StorageConstructor)
 var handlerConstructors = make(map[string]HandlerConstructor)
+var blobHubConstructors = make(map[string]BlobHubConstructor)
 
 func RegisterStorageConstructor(typ string, ctor StorageConstructor) {
 	mapLock.Lock()
@@ -77,3 +82,28 @@ func CreateHandler(typ string, loader Loader, config jsonconfig.Obj) (http.Handl
 	}
 	return ctor(loader, config)
 }
+
+func RegisterBlobHubConstructor(typ string, ctor BlobHubConstructor) {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+	if _, ok := blobHubConstructors[typ]; ok {
+		panic("blobserver: BlobHubConstructor already registered for type: " + typ)
+	}
+	blobHubConstructors[typ] = ctor
+}
+
+// CreateBlobHub creates a hub for sto from config, whose "type" key
+// names a registered BlobHubConstructor.
+func CreateBlobHub(sto Storage, config jsonconfig.Obj) (BlobHub, os.Error) {
+	typ := config.RequiredString("type")
+	if typ == "" {
+		return nil, os.NewError("blobserver: BlobHub config is missing its \"type\"")
+	}
+	mapLock.Lock()
+	ctor, ok := blobHubConstructors[typ]
+	mapLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("blobserver: BlobHub type %q not known or loaded", typ)
+	}
+	return ctor(sto, config)
+}
@@ -77,10 +77,31 @@ func (sto *remoteStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (
 	return pr.SizedBlobRef(), nil
 }
 
+// ReceiveBlobs makes remoteStorage a blobserver.BatchReceiver,
+// uploading with as few round trips as the client can.
+func (sto *remoteStorage) ReceiveBlobs(blobs []blobref.SizedBlobRef, contents []io.Reader) os.Error {
+	handles := make([]*client.UploadHandle, len(blobs))
+	for i, sb := range blobs {
+		handles[i] = &client.UploadHandle{
+			BlobRef:  sb.BlobRef,
+			Size:     sb.Size,
+			Contents: contents[i],
+		}
+	}
+	_, err := sto.client.UploadMulti(handles)
+	return err
+}
+
 func (sto *remoteStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
 	return sto.client.FetchStreaming(b)
 }
 
+// FetchMulti makes remoteStorage a blobserver.BatchFetcher, fetching
+// with as few round trips as the client can.
+func (sto *remoteStorage) FetchMulti(blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error {
+	return sto.client.FetchMulti(blobs, fn)
+}
+
 func (sto *remoteStorage) MaxEnumerate() uint { return 1000 }
 
 func (sto *remoteStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
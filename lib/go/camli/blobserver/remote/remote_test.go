@@ -0,0 +1,169 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"camli/auth"
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/handlers"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/client"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+type storageAndConfig struct {
+	blobserver.Storage
+	config *blobserver.Config
+}
+
+func (s *storageAndConfig) Config() *blobserver.Config {
+	return s.config
+}
+
+// newTestServer starts a blob server over a memory storage, standing
+// in for a remote camlistored. Like camlistored's handlers, but
+// without auth.
+func newTestServer() *httptest.Server {
+	sto := &storageAndConfig{memory.New(0), &blobserver.Config{
+		Writable: true,
+		Readable: true,
+		IsQueue:  true, // permits removes
+	}}
+	get := &handlers.GetHandler{Fetcher: sto, AllowGlobalAccess: true}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		action := req.URL.Path
+		if strings.HasPrefix(action, "/camli/") {
+			action = action[len("/camli/"):]
+		}
+		switch {
+		case action == "enumerate-blobs":
+			handlers.CreateEnumerateHandler(sto)(rw, req)
+		case action == "fetch-blobs":
+			handlers.CreateFetchBlobsHandler(sto, nil)(rw, req)
+		case action == "stat":
+			handlers.CreateStatHandler(sto)(rw, req)
+		case action == "upload" && req.Method == "POST":
+			handlers.CreateUploadHandler(sto)(rw, req)
+		case action == "remove" && req.Method == "POST":
+			handlers.CreateRemoveHandler(sto)(rw, req)
+		case req.Method == "GET":
+			get.ServeHTTP(rw, req)
+		default:
+			http.Error(rw, "unsupported", 400)
+		}
+	}))
+	sto.config.URLBase = server.URL
+	return server
+}
+
+func newTestStorage(server *httptest.Server) *remoteStorage {
+	c := client.New(server.URL, "pass")
+	c.SetLogger(nil)
+	return &remoteStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		client:                    c,
+	}
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			server := newTestServer()
+			return newTestStorage(server), func() { server.Close() }
+		},
+	})
+}
+
+func TestFetchMulti(t *testing.T) {
+	auth.AccessPassword = "pass"
+	server := newTestServer()
+	defer server.Close()
+	sto := newTestStorage(server)
+
+	blobs := []*test.Blob{&test.Blob{"foo"}, &test.Blob{"bar"}, &test.Blob{"baz"}}
+	for _, tb := range blobs[:2] {
+		_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+
+	// The missing "baz" is asked for first, and skipped.
+	refs := []*blobref.BlobRef{blobs[2].BlobRef(), blobs[1].BlobRef(), blobs[0].BlobRef()}
+	var got []string
+	err := blobserver.FetchMulti(sto, refs, func(sb blobref.SizedBlobRef, r io.Reader) os.Error {
+		data, err := ioutil.ReadAll(r)
+		AssertNil(t, err, "reading "+sb.BlobRef.String())
+		ExpectInt(t, len(data), int(sb.Size), "size of "+sb.BlobRef.String())
+		got = append(got, string(data))
+		return nil
+	})
+	AssertNil(t, err, "FetchMulti")
+	ExpectString(t, "bar foo", strings.Join(got, " "), "blobs fetched")
+
+	auth.AccessPassword = "other"
+	err = sto.FetchMulti(refs, func(blobref.SizedBlobRef, io.Reader) os.Error { return nil })
+	Expect(t, err != nil, "FetchMulti with wrong password fails")
+}
+
+func TestReceiveBlobs(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	sto := newTestStorage(server)
+	sto.client.SetUploadBatchBytes(8)
+
+	// "foo" is already there, and "bar" is sent twice; the rest
+	// take two batches.
+	blobs := []*test.Blob{&test.Blob{"foo"}, &test.Blob{"bar"}, &test.Blob{"bazz"},
+		&test.Blob{"bar"}, &test.Blob{"quux"}}
+	_, err := sto.ReceiveBlob(blobs[0].BlobRef(), blobs[0].Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	sbs := make([]blobref.SizedBlobRef, len(blobs))
+	contents := make([]io.Reader, len(blobs))
+	for i, tb := range blobs {
+		sbs[i] = blobref.SizedBlobRef{tb.BlobRef(), tb.Size()}
+		contents[i] = bytes.NewBufferString(tb.Contents)
+	}
+	err = blobserver.ReceiveBlobs(sto, sbs, contents)
+	AssertNil(t, err, "ReceiveBlobs")
+
+	for _, tb := range blobs {
+		rc, size, err := sto.FetchStreaming(tb.BlobRef())
+		AssertNil(t, err, "fetching "+tb.Contents)
+		rc.Close()
+		ExpectInt(t, len(tb.Contents), int(size), "size of "+tb.Contents)
+	}
+	stats := sto.client.Stats()
+	ExpectInt(t, 4, stats.Uploads.Blobs, "blobs uploaded")
+	ExpectInt(t, 6, stats.UploadRequests.Blobs, "blobs asked to upload")
+
+	other := &test.Blob{"other"}
+	sbs = []blobref.SizedBlobRef{blobref.SizedBlobRef{other.BlobRef(), other.Size() + 1}}
+	err = blobserver.ReceiveBlobs(sto, sbs, []io.Reader{other.Reader()})
+	Expect(t, err != nil, "ReceiveBlobs of wrong size fails")
+}
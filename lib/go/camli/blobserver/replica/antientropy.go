@@ -0,0 +1,167 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/errorutil"
+)
+
+const antiEntropyBatch = 1000
+
+// replicaStats tracks read-repair and anti-entropy progress, for the
+// status page.
+type replicaStats struct {
+	errorutil.StatusLog
+
+	lk             sync.Mutex // protects following
+	passes         int64      // completed anti-entropy passes
+	lastPassStart  *time.Time // or nil
+	lastPassEnd    *time.Time // or nil
+	examined       int64      // blobs looked at in the current or last pass
+	divergent      int64      // of those, blobs missing from some replica
+	missingCounts  []int64    // per replica, blobs found missing in the current or last pass
+	copies         int64      // blobs copied by anti-entropy, ever
+	readRepairs    int64      // blobs copied by read-repair, ever
+	repairsDropped int64      // read-repairs skipped because the queue was full, ever
+}
+
+func (st *replicaStats) incr(v *int64) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	*v++
+}
+
+func (sto *replicaStorage) antiEntropyLoop() {
+	for {
+		sto.antiEntropyPass()
+		sto.stats.SetStatus("Idle; next pass in %d seconds", sto.antiEntropyInterval/1e9)
+		time.Sleep(sto.antiEntropyInterval)
+	}
+}
+
+// antiEntropyPass enumerates the union of all replicas and copies
+// each blob to the replicas missing it.
+func (sto *replicaStorage) antiEntropyPass() {
+	st := &sto.stats
+	st.lk.Lock()
+	st.lastPassStart = time.UTC()
+	st.examined, st.divergent = 0, 0
+	st.missingCounts = make([]int64, len(sto.replicas))
+	st.lk.Unlock()
+
+	after := ""
+	for {
+		st.SetStatus("Comparing replicas after %q", after)
+		sbs, err := sto.mergedBatch(after)
+		if err != nil {
+			st.AddError(fmt.Errorf("replica: anti-entropy enumerate: %v", err))
+			return
+		}
+		if len(sbs) == 0 {
+			break
+		}
+		sto.reconcile(sbs)
+		after = sbs[len(sbs)-1].BlobRef.String()
+	}
+
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.passes++
+	st.lastPassEnd = time.UTC()
+}
+
+// mergedBatch returns the next batch of blobs present on any replica.
+func (sto *replicaStorage) mergedBatch(after string) ([]blobref.SizedBlobRef, os.Error) {
+	ch := make(chan blobref.SizedBlobRef, buffered)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- blobserver.MergedEnumerate(ch, sto.replicas, after, antiEntropyBatch, 0)
+	}()
+	var sbs []blobref.SizedBlobRef
+	for sb := range ch {
+		sbs = append(sbs, sb)
+	}
+	return sbs, <-errch
+}
+
+// reconcile stats sbs on every replica, and copies any missing blobs
+// from a replica which has them. That includes blobs whose Remove
+// failed on some replica, which is why Remove reports such failures.
+func (sto *replicaStorage) reconcile(sbs []blobref.SizedBlobRef) {
+	st := &sto.stats
+	blobs := make([]*blobref.BlobRef, len(sbs))
+	for i, sb := range sbs {
+		blobs[i] = sb.BlobRef
+	}
+	// has[i] is the set of blobs replica i has.
+	has := make([]map[string]bool, len(sto.replicas))
+	for i, replica := range sto.replicas {
+		has[i] = make(map[string]bool)
+		ch := make(chan blobref.SizedBlobRef, len(blobs))
+		if err := replica.Stat(ch, blobs, 0); err != nil {
+			st.AddError(fmt.Errorf("replica: anti-entropy stat of replica %d: %v", i, err))
+			// Don't copy to a replica we can't see.
+			has[i] = nil
+			continue
+		}
+		close(ch)
+		for sb := range ch {
+			has[i][sb.BlobRef.String()] = true
+		}
+	}
+
+	for _, b := range blobs {
+		key := b.String()
+		src := -1
+		var missing []int
+		for i := range sto.replicas {
+			switch {
+			case has[i] == nil:
+			case has[i][key]:
+				src = i
+			default:
+				missing = append(missing, i)
+			}
+		}
+		st.lk.Lock()
+		st.examined++
+		if len(missing) > 0 {
+			st.divergent++
+			for _, i := range missing {
+				st.missingCounts[i]++
+			}
+		}
+		st.lk.Unlock()
+		if src < 0 {
+			continue
+		}
+		for _, i := range missing {
+			if err := copyBlob(b, sto.replicas[src], sto.replicas[i]); err != nil {
+				st.AddError(fmt.Errorf("replica: anti-entropy copy of %s to replica %d: %v", b, i, err))
+				continue
+			}
+			st.incr(&st.copies)
+		}
+	}
+}
@@ -21,16 +21,22 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/jsonconfig"
+	"camli/osutil"
 )
 
 var _ = log.Printf
 
 const buffered = 8
 
+// repairQueueSize is how many blobs may wait to be read-repaired.
+// Repairs beyond it are dropped, to be made by anti-entropy instead.
+const repairQueueSize = 100
+
 type replicaStorage struct {
 	*blobserver.SimpleBlobHubPartitionMap
 
@@ -40,6 +46,24 @@ type replicaStorage struct {
 	// Minimum number of writes that must succeed before
 	// acknowledging success to the client.
 	minWritesForSuccess int
+
+	// antiEntropyInterval is how often to compare the replicas
+	// and copy blobs to those missing them, or 0 to never.
+	antiEntropyInterval int64 // nanoseconds
+
+	repairOnce sync.Once // starts the read-repair worker
+	repairq    chan *repairReq
+
+	repairMu  sync.Mutex      // guards repairing
+	repairing map[string]bool // blobs queued or being read-repaired
+
+	stats replicaStats
+}
+
+type repairReq struct {
+	b    *blobref.BlobRef
+	src  blobserver.Storage
+	dsts []blobserver.Storage
 }
 
 func (sto *replicaStorage) GetBlobHub() blobserver.BlobHub {
@@ -53,6 +77,7 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobser
 	sto.replicaPrefixes = config.RequiredList("backends")
 	nReplicas := len(sto.replicaPrefixes)
 	sto.minWritesForSuccess = config.OptionalInt("minWritesForSuccess", nReplicas)
+	antiEntropySeconds := config.OptionalInt("antiEntropyInterval", 0)
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -70,6 +95,10 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobser
 		}
 		sto.replicas[i] = replicaSto
 	}
+	if antiEntropySeconds > 0 {
+		sto.antiEntropyInterval = int64(antiEntropySeconds) * 1e9
+		go sto.antiEntropyLoop()
+	}
 	return sto, nil
 }
 
@@ -79,15 +108,85 @@ func (sto *replicaStorage) weightedRandomReplicas() []blobserver.Storage {
 }
 
 func (sto *replicaStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
+	var missing []blobserver.Storage
+	var failErr os.Error
 	for _, replica := range sto.weightedRandomReplicas() {
 		file, size, err = replica.FetchStreaming(b)
 		if err == nil {
+			if len(missing) > 0 {
+				// Read-repair: copy the blob to the replicas
+				// which didn't have it, without delaying
+				// this fetch.
+				sto.queueRepair(b, replica, missing)
+			}
 			return
 		}
+		if osutil.ErrorIsNoEnt(err) {
+			missing = append(missing, replica)
+		} else {
+			// The replica may well have the blob, but
+			// couldn't be read; don't copy it there.
+			failErr = err
+		}
+	}
+	if failErr != nil {
+		err = failErr
 	}
 	return
 }
 
+// queueRepair queues a read-repair of b from src to dsts, unless b is
+// already queued or the queue is full.
+func (sto *replicaStorage) queueRepair(b *blobref.BlobRef, src blobserver.Storage, dsts []blobserver.Storage) {
+	sto.repairOnce.Do(func() {
+		sto.repairq = make(chan *repairReq, repairQueueSize)
+		sto.repairing = make(map[string]bool)
+		go sto.repairLoop()
+	})
+	key := b.String()
+	sto.repairMu.Lock()
+	defer sto.repairMu.Unlock()
+	if sto.repairing[key] {
+		return
+	}
+	select {
+	case sto.repairq <- &repairReq{b, src, dsts}:
+		sto.repairing[key] = true
+	default:
+		sto.stats.incr(&sto.stats.repairsDropped)
+	}
+}
+
+func (sto *replicaStorage) repairLoop() {
+	for req := range sto.repairq {
+		sto.readRepair(req.b, req.src, req.dsts)
+		sto.repairMu.Lock()
+		sto.repairing[req.b.String()] = false, false
+		sto.repairMu.Unlock()
+	}
+}
+
+// readRepair copies b from src to each of dsts.
+func (sto *replicaStorage) readRepair(b *blobref.BlobRef, src blobserver.Storage, dsts []blobserver.Storage) {
+	for _, dst := range dsts {
+		if err := copyBlob(b, src, dst); err != nil {
+			sto.stats.AddError(fmt.Errorf("replica: read-repair of %s: %v", b, err))
+			continue
+		}
+		sto.stats.incr(&sto.stats.readRepairs)
+	}
+}
+
+func copyBlob(b *blobref.BlobRef, src, dst blobserver.Storage) os.Error {
+	rc, _, err := src.FetchStreaming(b)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = dst.ReceiveBlob(b, rc)
+	return err
+}
+
 func (sto *replicaStorage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
 	if waitSeconds > 0 {
 		// TODO: handle waitSeconds in-memory, waiting on the blobhub, not going
@@ -189,6 +288,9 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 	return
 }
 
+// Remove removes blobs from every replica. It fails unless every
+// replica succeeded, since anti-entropy would otherwise copy the blobs
+// back from a replica which still has them; the caller should retry.
 func (sto *replicaStorage) Remove(blobs []*blobref.BlobRef) os.Error {
 	errch := make(chan os.Error, buffered)
 	removeFrom := func(s blobserver.Storage) {
@@ -198,24 +300,19 @@ func (sto *replicaStorage) Remove(blobs []*blobref.BlobRef) os.Error {
 		go removeFrom(replica)
 	}
 	var reterr os.Error
-	nSuccess := 0
-	for _ = range errch {
+	nFailed := 0
+	for _ = range sto.replicas {
 		if err := <-errch; err != nil {
 			reterr = err
-		} else {
-			nSuccess++
+			nFailed++
 		}
 	}
-	if nSuccess > 0 {
-		// TODO: decide on the return value. for now this is best
-		// effort and we return nil if any of the blobservers said
-		// success.  maybe a bit weird, though.
-		return nil
+	if reterr != nil {
+		return fmt.Errorf("replica: remove failed on %d of %d replicas: %v", nFailed, len(sto.replicas), reterr)
 	}
-	return reterr
+	return nil
 }
 
-
 func (sto *replicaStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
 	// TODO: option to enumerate from one or from all merged.  for
 	// now we'll just do all, even though it's kinda a waste.  at
@@ -224,6 +321,36 @@ func (sto *replicaStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, afte
 	return blobserver.MergedEnumerate(dest, sto.replicas, after, limit, waitSeconds)
 }
 
+// StorageStats reports the fullest replica's blobs, which is the best
+// guess at how many distinct blobs they hold between them, and the
+// least free space of any replica, since new blobs go to all of them.
+// Replicas whose stats can't be had are skipped unless all fail.
+func (sto *replicaStorage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	var ret *blobserver.StorageStats
+	var lastErr os.Error
+	for i, replica := range sto.replicas {
+		st, err := blobserver.GetStorageStats(replica)
+		if err != nil {
+			lastErr = fmt.Errorf("replica %s: %v", sto.replicaPrefixes[i], err)
+			continue
+		}
+		if ret == nil {
+			ret = st
+			continue
+		}
+		if st.Blobs > ret.Blobs {
+			ret.Blobs, ret.Bytes = st.Blobs, st.Bytes
+		}
+		if st.FreeBytes >= 0 && (ret.FreeBytes < 0 || st.FreeBytes < ret.FreeBytes) {
+			ret.FreeBytes = st.FreeBytes
+		}
+	}
+	if ret == nil {
+		return nil, lastErr
+	}
+	return ret, nil
+}
+
 func init() {
 	blobserver.RegisterStorageConstructor("replica", blobserver.StorageConstructor(newFromConfig))
 }
@@ -0,0 +1,210 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func newTestReplica(n int) (*replicaStorage, []*memory.Storage) {
+	sto := &replicaStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		minWritesForSuccess:       n,
+	}
+	var mems []*memory.Storage
+	for i := 0; i < n; i++ {
+		mem := memory.New(0)
+		mems = append(mems, mem)
+		sto.replicaPrefixes = append(sto.replicaPrefixes, fmt.Sprintf("/r%d/", i))
+		sto.replicas = append(sto.replicas, mem)
+	}
+	return sto, mems
+}
+
+func TestReadRepair(t *testing.T) {
+	sto, mems := newTestReplica(3)
+	tb := &test.Blob{"repair me"}
+	_, err := mems[2].ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	rc, _, err := sto.FetchStreaming(tb.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	ExpectString(t, tb.Contents, string(data), "fetched contents")
+
+	// Read-repair runs in the background.
+	for i := 0; i < 100 && (mems[0].NumBlobs() == 0 || mems[1].NumBlobs() == 0); i++ {
+		time.Sleep(10e6)
+	}
+	ExpectInt(t, 1, mems[0].NumBlobs(), "blobs on replica 0")
+	ExpectInt(t, 1, mems[1].NumBlobs(), "blobs on replica 1")
+
+	sto.stats.lk.Lock()
+	defer sto.stats.lk.Unlock()
+	ExpectInt(t, 2, int(sto.stats.readRepairs), "read repairs")
+}
+
+// brokenStorage is a replica which fails every fetch and remove.
+type brokenStorage struct {
+	blobserver.Storage
+}
+
+var errBroken = os.NewError("broken replica")
+
+func (s brokenStorage) FetchStreaming(b *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return nil, 0, errBroken
+}
+
+func (s brokenStorage) Remove(blobs []*blobref.BlobRef) os.Error {
+	return errBroken
+}
+
+// blockingStorage is a replica whose uploads wait for a value on
+// release.
+type blockingStorage struct {
+	blobserver.Storage
+	release chan bool
+}
+
+func (s blockingStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, os.Error) {
+	<-s.release
+	return s.Storage.ReceiveBlob(b, source)
+}
+
+func TestReadRepairOnlyMissing(t *testing.T) {
+	sto, mems := newTestReplica(3)
+	sto.replicas[0] = brokenStorage{mems[0]}
+	tb := &test.Blob{"repair me"}
+	_, err := mems[2].ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	rc, _, err := sto.FetchStreaming(tb.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	rc.Close()
+	for i := 0; i < 100 && mems[1].NumBlobs() == 0; i++ {
+		time.Sleep(10e6)
+	}
+	ExpectInt(t, 1, mems[1].NumBlobs(), "blobs on missing replica")
+	ExpectInt(t, 0, mems[0].NumBlobs(), "blobs on failing replica")
+
+	// A blob missing from the working replicas reports the
+	// failing one's error, not that it doesn't exist.
+	_, _, err = sto.FetchStreaming((&test.Blob{"nowhere"}).BlobRef())
+	Expect(t, err == errBroken, "fetch error from failing replica")
+}
+
+func TestReadRepairQueue(t *testing.T) {
+	sto, mems := newTestReplica(2)
+	release := make(chan bool)
+	sto.replicas[0] = blockingStorage{mems[0], release}
+	a, b := &test.Blob{"a"}, &test.Blob{"b"}
+	for _, tb := range []*test.Blob{a, b} {
+		_, err := mems[1].ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+
+	fetch := func(tb *test.Blob) {
+		rc, _, err := sto.FetchStreaming(tb.BlobRef())
+		AssertNil(t, err, "FetchStreaming")
+		rc.Close()
+	}
+	fetch(a)
+	// Wait for the worker to take a's repair and block in it.
+	for i := 0; i < 100 && len(sto.repairq) > 0; i++ {
+		time.Sleep(10e6)
+	}
+	fetch(b)
+	fetch(b)
+	fetch(a)
+	ExpectInt(t, 1, len(sto.repairq), "queued repairs")
+
+	release <- true
+	release <- true
+	for i := 0; i < 100 && mems[0].NumBlobs() < 2; i++ {
+		time.Sleep(10e6)
+	}
+	ExpectInt(t, 2, mems[0].NumBlobs(), "blobs on repaired replica")
+	sto.stats.lk.Lock()
+	defer sto.stats.lk.Unlock()
+	ExpectInt(t, 2, int(sto.stats.readRepairs), "read repairs")
+}
+
+func TestRemoveFailure(t *testing.T) {
+	sto, mems := newTestReplica(2)
+	sto.replicas[1] = brokenStorage{mems[1]}
+	tb := &test.Blob{"keep me"}
+	for _, mem := range mems {
+		_, err := mem.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+	err := sto.Remove(tb.BlobRefSlice())
+	ExpectErrorContains(t, err, "1 of 2 replicas", "Remove with a failing replica")
+}
+
+func TestAntiEntropy(t *testing.T) {
+	sto, mems := newTestReplica(2)
+	for i := 0; i < 10; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob-%d", i)}
+		// Even blobs go to replica 0 and odd ones to replica 1;
+		// multiples of 3 go to both.
+		if i%2 == 0 || i%3 == 0 {
+			_, err := mems[0].ReceiveBlob(tb.BlobRef(), tb.Reader())
+			AssertNil(t, err, "ReceiveBlob")
+		}
+		if i%2 == 1 || i%3 == 0 {
+			_, err := mems[1].ReceiveBlob(tb.BlobRef(), tb.Reader())
+			AssertNil(t, err, "ReceiveBlob")
+		}
+	}
+	sto.antiEntropyPass()
+
+	ExpectInt(t, 10, mems[0].NumBlobs(), "blobs on replica 0")
+	ExpectInt(t, 10, mems[1].NumBlobs(), "blobs on replica 1")
+
+	st := &sto.stats
+	ExpectInt(t, 1, int(st.passes), "passes")
+	ExpectInt(t, 10, int(st.examined), "examined")
+	ExpectInt(t, 6, int(st.divergent), "divergent")
+	ExpectInt(t, 6, int(st.copies), "copies")
+	ExpectInt(t, 3, int(st.missingCounts[0]), "missing from replica 0")
+	ExpectInt(t, 3, int(st.missingCounts[1]), "missing from replica 1")
+
+	sto.antiEntropyPass()
+	ExpectInt(t, 0, int(st.divergent), "divergent on second pass")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto, _ := newTestReplica(3)
+			return sto, nil
+		},
+	})
+}
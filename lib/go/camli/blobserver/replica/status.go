@@ -0,0 +1,107 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"fmt"
+	"html"
+	"http"
+	"os"
+	"time"
+
+	"camli/auth"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+// statusHandler serves the read-repair and anti-entropy status of a
+// replica storage. Example config:
+//
+//     "/replica-status/": {
+//         "handler": "replica-status",
+//         "handlerArgs": {
+//            "replica": "/repl/"
+//          }
+//     },
+type statusHandler struct {
+	name string
+	sto  *replicaStorage
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("replica-status", newStatusFromConfig)
+}
+
+func newStatusFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Handler, err os.Error) {
+	name := conf.RequiredString("replica")
+	if err = conf.Validate(); err != nil {
+		return
+	}
+	bs, err := ld.GetStorage(name)
+	if err != nil {
+		return
+	}
+	sto, ok := bs.(*replicaStorage)
+	if !ok {
+		return nil, fmt.Errorf("replica-status: prefix %s (type %T) isn't a replica storage", name, bs)
+	}
+	return &statusHandler{name, sto}, nil
+}
+
+func (h *statusHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.IsAuthorized(req) {
+		auth.SendDenied(rw, req)
+		return
+	}
+	st := &h.sto.stats
+	st.lk.Lock()
+	defer st.lk.Unlock()
+
+	fmt.Fprintf(rw, "<h1>%s Replica Status</h1><p><b>Current status: </b>%s</p>",
+		h.name, html.EscapeString(st.Status()))
+
+	fmt.Fprintf(rw, "<h2>Stats:</h2><ul>")
+	if h.sto.antiEntropyInterval > 0 {
+		fmt.Fprintf(rw, "<li>Anti-entropy interval: %d seconds</li>", h.sto.antiEntropyInterval/1e9)
+	} else {
+		fmt.Fprintf(rw, "<li>Anti-entropy: disabled</li>")
+	}
+	fmt.Fprintf(rw, "<li>Anti-entropy passes completed: %d</li>", st.passes)
+	if st.lastPassStart != nil {
+		fmt.Fprintf(rw, "<li>Last pass started: %s</li>", st.lastPassStart.Format(time.RFC3339))
+	}
+	if st.lastPassEnd != nil {
+		fmt.Fprintf(rw, "<li>Last pass finished: %s</li>", st.lastPassEnd.Format(time.RFC3339))
+	}
+	fmt.Fprintf(rw, "<li>Blobs examined in pass: %d</li>", st.examined)
+	fmt.Fprintf(rw, "<li>Divergent blobs in pass: %d</li>", st.divergent)
+	fmt.Fprintf(rw, "<li>Blobs copied by anti-entropy: %d</li>", st.copies)
+	fmt.Fprintf(rw, "<li>Blobs copied by read-repair: %d</li>", st.readRepairs)
+	fmt.Fprintf(rw, "<li>Read-repairs skipped (queue full): %d</li>", st.repairsDropped)
+	fmt.Fprintf(rw, "<li>Errors: %d</li>", st.TotalErrors())
+	fmt.Fprintf(rw, "</ul>")
+
+	if len(st.missingCounts) > 0 {
+		fmt.Fprintf(rw, "<h2>Missing Blobs by Replica:</h2><ul>")
+		for i, n := range st.missingCounts {
+			fmt.Fprintf(rw, "<li>%s: %d</li>\n", html.EscapeString(h.sto.replicaPrefixes[i]), n)
+		}
+		fmt.Fprintf(rw, "</ul>")
+	}
+
+	st.WriteRecentErrorsHTML(rw)
+}
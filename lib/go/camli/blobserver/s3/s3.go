@@ -30,6 +30,8 @@ type s3Storage struct {
 	*blobserver.SimpleBlobHubPartitionMap
 	s3Client *s3.Client
 	bucket   string
+
+	statsCache statsCache
 }
 
 func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
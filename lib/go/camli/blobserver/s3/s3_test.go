@@ -0,0 +1,151 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"camli/blobserver"
+	"camli/blobserver/storagetest"
+	"camli/misc/amazon/s3"
+)
+
+// fakeS3 is an http.RoundTripper standing in for Amazon S3, storing
+// objects in memory. It implements just what s3.Client uses.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte // bucket -> key -> object
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: make(map[string]map[string][]byte)}
+}
+
+func response(code int, body []byte) *http.Response {
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewBuffer(body)),
+		ContentLength: int64(len(body)),
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return res
+}
+
+func (f *fakeS3) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	if req.Header.Get("Authorization") == "" {
+		return response(http.StatusForbidden, nil), nil
+	}
+	bucket := strings.Replace(req.URL.Host, ".s3.amazonaws.com", "", 1)
+	key := strings.TrimLeft(req.URL.Path, "/")
+
+	var body []byte
+	if req.Body != nil {
+		var err os.Error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objs, ok := f.buckets[bucket]
+	if !ok {
+		objs = make(map[string][]byte)
+		f.buckets[bucket] = objs
+	}
+
+	switch {
+	case req.Method == "GET" && key == "":
+		return f.list(objs, req), nil
+	case req.Method == "GET" || req.Method == "HEAD":
+		obj, ok := objs[key]
+		if !ok {
+			return response(http.StatusNotFound, nil), nil
+		}
+		res := response(http.StatusOK, obj)
+		if req.Method == "HEAD" {
+			res.Body = ioutil.NopCloser(bytes.NewBuffer(nil))
+		}
+		return res, nil
+	case req.Method == "PUT":
+		objs[key] = body
+		return response(http.StatusOK, nil), nil
+	case req.Method == "DELETE":
+		objs[key] = nil, false
+		return response(http.StatusNoContent, nil), nil
+	}
+	return response(http.StatusMethodNotAllowed, nil), nil
+}
+
+func (f *fakeS3) list(objs map[string][]byte, req *http.Request) *http.Response {
+	marker := req.FormValue("marker")
+	maxKeys, err := strconv.Atoi(req.FormValue("max-keys"))
+	if err != nil || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+	var keys []string
+	for key := range objs {
+		if key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.SortStrings(keys)
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(objs[key]))
+	}
+	buf.WriteString("</ListBucketResult>")
+	return response(http.StatusOK, buf.Bytes())
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto := &s3Storage{
+				SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+				s3Client: &s3.Client{
+					Auth:       &s3.Auth{AccessKey: "key", SecretAccessKey: "secret"},
+					HttpClient: &http.Client{Transport: newFakeS3()},
+				},
+				bucket: "camli-test",
+			}
+			return sto, nil
+		},
+		// S3 has no way to wait for an object.
+		SkipStatWait: true,
+	})
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// statsCacheSeconds is how long the stats found by listing the whole
+// bucket are reused. S3 can't count a bucket's objects any faster.
+const statsCacheSeconds = 3600
+
+type statsCache struct {
+	mu    sync.Mutex
+	stats *blobserver.StorageStats
+	when  int64 // seconds since epoch of stats
+}
+
+// StorageStats returns the blobs listed in the bucket as of up to
+// statsCacheSeconds ago. Buckets don't fill up, so FreeBytes is always
+// unknown.
+func (sto *s3Storage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	c := &sto.statsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Seconds()
+	if c.stats != nil && now-c.when < statsCacheSeconds {
+		st := *c.stats
+		return &st, nil
+	}
+	st := &blobserver.StorageStats{FreeBytes: -1}
+	after := ""
+	for {
+		objs, err := sto.s3Client.ListBucket(sto.bucket, after, sto.MaxEnumerate())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if blobref.Parse(obj.Key) != nil {
+				st.Blobs++
+				st.Bytes += obj.Size
+			}
+		}
+		if len(objs) < int(sto.MaxEnumerate()) {
+			break
+		}
+		after = objs[len(objs)-1].Key
+	}
+	c.stats, c.when = st, now
+	ret := *st
+	return &ret, nil
+}
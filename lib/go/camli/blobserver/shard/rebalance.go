@@ -0,0 +1,70 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// rebalance enumerates every backend and moves each blob which isn't
+// where the current placement wants it. If it finishes without error,
+// reads stop falling back to the previous placement.
+func (sto *shardStorage) rebalance() (moved int, err os.Error) {
+	for n, src := range sto.shards {
+		err = blobserver.EnumerateAll(src, func(sb blobref.SizedBlobRef) os.Error {
+			dst := sto.shardNum(sb.BlobRef)
+			if dst == n {
+				return nil
+			}
+			if err := sto.move(sb.BlobRef, n, dst); err != nil {
+				return err
+			}
+			moved++
+			if moved%1000 == 0 {
+				log.Printf("shard: rebalance has moved %d blobs", moved)
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, fmt.Errorf("shard: rebalancing %s: %v", sto.shardPrefixes[n], err)
+		}
+	}
+	sto.mu.Lock()
+	sto.prev = nil
+	sto.mu.Unlock()
+	return moved, nil
+}
+
+// move copies b from backend src to backend dst, then removes it
+// from src.
+func (sto *shardStorage) move(b *blobref.BlobRef, src, dst int) os.Error {
+	rc, _, err := sto.shards[src].FetchStreaming(b)
+	if err != nil {
+		return err
+	}
+	_, err = sto.shards[dst].ReceiveBlob(b, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return sto.shards[src].Remove([]*blobref.BlobRef{b})
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"camli/blobref"
+	"camli/jsonconfig"
+)
+
+// pointsPerWeight is the number of points on the hash ring for each
+// unit of a backend's weight.
+const pointsPerWeight = 100
+
+// A placement picks which backend a blob belongs on.
+type placement interface {
+	// pick returns the index into shardStorage.shards of
+	// the backend for b.
+	pick(b *blobref.BlobRef) int
+}
+
+// moduloPlacement is the original placement: the blob's hash modulo
+// the number of backends. Adding a backend moves almost every blob.
+type moduloPlacement []int
+
+func (p moduloPlacement) pick(b *blobref.BlobRef) int {
+	return p[b.Sum32()%uint32(len(p))]
+}
+
+// ringPlacement is a consistent hash ring. Each backend owns
+// pointsPerWeight*weight points on the ring, and a blob belongs to
+// the owner of the first point at or after its hash, so adding or
+// removing a backend only moves the blobs on its arcs.
+type ringPlacement struct {
+	points []uint32 // sorted
+	owners []int    // owners[i] owns points[i]
+}
+
+func (r *ringPlacement) Len() int           { return len(r.points) }
+func (r *ringPlacement) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *ringPlacement) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+// ringPoint hashes the v'th point of the backend named prefix. Points
+// depend only on the prefix, so a backend's points don't move when
+// other backends come and go.
+func ringPoint(prefix string, v int) uint32 {
+	h := sha1.New()
+	io.WriteString(h, fmt.Sprintf("%s-%d", prefix, v))
+	sum := h.Sum()
+	return uint32(sum[0])<<24 | uint32(sum[1])<<16 | uint32(sum[2])<<8 | uint32(sum[3])
+}
+
+func newRingPlacement(prefixes []string, indexes []int, weights []int) *ringPlacement {
+	r := new(ringPlacement)
+	for i, prefix := range prefixes {
+		for v := 0; v < weights[i]*pointsPerWeight; v++ {
+			r.points = append(r.points, ringPoint(prefix, v))
+			r.owners = append(r.owners, indexes[i])
+		}
+	}
+	sort.Sort(r)
+	return r
+}
+
+func (r *ringPlacement) pick(b *blobref.BlobRef) int {
+	h := b.Sum32()
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// placementConfig is the parsed configuration of a placement.
+type placementConfig struct {
+	prefixes   []string
+	consistent bool
+	weights    []int
+
+	weightsConfig jsonconfig.Obj
+}
+
+func parsePlacement(config jsonconfig.Obj) *placementConfig {
+	pc := &placementConfig{
+		prefixes:   config.RequiredList("backends"),
+		consistent: config.OptionalBool("consistent", false),
+	}
+	pc.weightsConfig = config.OptionalObject("weights")
+	pc.weights = make([]int, len(pc.prefixes))
+	for i, prefix := range pc.prefixes {
+		pc.weights[i] = pc.weightsConfig.OptionalInt(prefix, 1)
+	}
+	return pc
+}
+
+func (pc *placementConfig) validate() os.Error {
+	if err := pc.weightsConfig.Validate(); err != nil {
+		return fmt.Errorf("shard: weights: %v", err)
+	}
+	if len(pc.prefixes) == 0 {
+		return os.NewError("shard: need at least one shard")
+	}
+	for i, w := range pc.weights {
+		if w < 1 {
+			return fmt.Errorf("shard: weight of %q must be positive", pc.prefixes[i])
+		}
+		if w != 1 && !pc.consistent {
+			return fmt.Errorf("shard: weights require consistent hashing")
+		}
+	}
+	return nil
+}
+
+// build returns the placement, given the index into
+// shardStorage.shards of each prefix.
+func (pc *placementConfig) build(index map[string]int) placement {
+	indexes := make([]int, len(pc.prefixes))
+	for i, prefix := range pc.prefixes {
+		indexes[i] = index[prefix]
+	}
+	if pc.consistent {
+		return newRingPlacement(pc.prefixes, indexes, pc.weights)
+	}
+	return moduloPlacement(indexes)
+}
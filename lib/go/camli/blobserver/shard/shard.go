@@ -14,11 +14,45 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package shard registers the "shard" blobserver storage type, which
+spreads blobs over several backends.
+
+By default a blob goes to backend number Sum32() % len(backends).
+With "consistent" set, a weighted consistent hash ring is used
+instead, so adding a backend only moves a share of the blobs
+proportional to its weight.
+
+When changing the backends, put the old configuration in "previous".
+Reads then fall back to the old placement, and a rebalance (run at
+startup if "rebalance" is set) moves the misplaced blobs. Once it
+completes, the fallback is turned off and "previous" may be removed
+from the config.
+
+Example low-level config:
+
+     "/sharded/": {
+         "handler": "storage-shard",
+         "handlerArgs": {
+            "backends": ["/s1/", "/s2/", "/s3/"],
+            "consistent": true,
+            "weights": {"/s3/": 2},
+            "previous": {
+                "backends": ["/s1/", "/s2/"],
+                "consistent": true
+            },
+            "rebalance": true
+          }
+     },
+*/
 package shard
 
 import (
+	"fmt"
 	"io"
+	"log"
 	"os"
+	"sync"
 
 	"camli/blobref"
 	"camli/blobserver"
@@ -28,8 +62,13 @@ import (
 type shardStorage struct {
 	*blobserver.SimpleBlobHubPartitionMap
 
-	shardPrefixes []string
-	shards        []blobserver.Storage
+	shardPrefixes []string             // of all current and previous backends
+	shards        []blobserver.Storage // parallel to shardPrefixes
+
+	cur placement
+
+	mu   sync.Mutex // guards following
+	prev placement  // or nil, when not rebalancing
 }
 
 func (sto *shardStorage) GetBlobHub() blobserver.BlobHub {
@@ -37,37 +76,97 @@ func (sto *shardStorage) GetBlobHub() blobserver.BlobHub {
 }
 
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
-	sto := &shardStorage{
-		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+	cur := parsePlacement(config)
+	var prev *placementConfig
+	if prevConfig := config.OptionalObject("previous"); len(prevConfig) > 0 {
+		prev = parsePlacement(prevConfig)
+		if err := prevConfig.Validate(); err != nil {
+			return nil, err
+		}
 	}
-	sto.shardPrefixes = config.RequiredList("backends")
+	rebalance := config.OptionalBool("rebalance", false)
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
-	if len(sto.shardPrefixes) == 0 {
-		return nil, os.NewError("shard: need at least one shard")
+	if rebalance && prev == nil {
+		return nil, os.NewError("shard: rebalance requires a previous configuration")
 	}
-	sto.shards = make([]blobserver.Storage, len(sto.shardPrefixes))
-	for i, prefix := range sto.shardPrefixes {
-		shardSto, err := ld.GetStorage(prefix)
-		if err != nil {
+	sto, err := newShardStorage(ld, cur, prev)
+	if err != nil {
+		return nil, err
+	}
+	if rebalance {
+		go func() {
+			moved, err := sto.rebalance()
+			log.Printf("shard: rebalance moved %d blobs; error = %v", moved, err)
+		}()
+	}
+	return sto, nil
+}
+
+func newShardStorage(ld blobserver.Loader, cur, prev *placementConfig) (*shardStorage, os.Error) {
+	pcs := []*placementConfig{cur}
+	if prev != nil {
+		pcs = append(pcs, prev)
+	}
+	sto := &shardStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+	}
+	index := make(map[string]int)
+	for _, pc := range pcs {
+		if err := pc.validate(); err != nil {
 			return nil, err
 		}
-		sto.shards[i] = shardSto
+		for _, prefix := range pc.prefixes {
+			if _, ok := index[prefix]; ok {
+				continue
+			}
+			shardSto, err := ld.GetStorage(prefix)
+			if err != nil {
+				return nil, err
+			}
+			index[prefix] = len(sto.shards)
+			sto.shardPrefixes = append(sto.shardPrefixes, prefix)
+			sto.shards = append(sto.shards, shardSto)
+		}
+	}
+	sto.cur = cur.build(index)
+	if prev != nil {
+		sto.prev = prev.build(index)
 	}
 	return sto, nil
 }
 
 func (sto *shardStorage) shard(b *blobref.BlobRef) blobserver.Storage {
-	return sto.shards[int(sto.shardNum(b))]
+	return sto.shards[sto.shardNum(b)]
 }
 
-func (sto *shardStorage) shardNum(b *blobref.BlobRef) uint32 {
-	return b.Sum32() % uint32(len(sto.shards))
+func (sto *shardStorage) shardNum(b *blobref.BlobRef) int {
+	return sto.cur.pick(b)
+}
+
+// prevShardNum returns the backend b was on in the previous
+// placement, if a rebalance is pending and it differs from the
+// current one.
+func (sto *shardStorage) prevShardNum(b *blobref.BlobRef) (n int, ok bool) {
+	sto.mu.Lock()
+	prev := sto.prev
+	sto.mu.Unlock()
+	if prev == nil {
+		return 0, false
+	}
+	n = prev.pick(b)
+	return n, n != sto.shardNum(b)
 }
 
 func (sto *shardStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
-	return sto.shard(b).FetchStreaming(b)
+	file, size, err = sto.shard(b).FetchStreaming(b)
+	if err != nil {
+		if n, ok := sto.prevShardNum(b); ok {
+			return sto.shards[n].FetchStreaming(b)
+		}
+	}
+	return
 }
 
 func (sto *shardStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
@@ -80,9 +179,13 @@ func (sto *shardStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb b
 }
 
 func (sto *shardStorage) batchedShards(blobs []*blobref.BlobRef, fn func(blobserver.Storage, []*blobref.BlobRef) os.Error) os.Error {
-	m := make(map[uint32][]*blobref.BlobRef)
+	return sto.batched(blobs, sto.shardNum, fn)
+}
+
+func (sto *shardStorage) batched(blobs []*blobref.BlobRef, pick func(*blobref.BlobRef) int, fn func(blobserver.Storage, []*blobref.BlobRef) os.Error) os.Error {
+	m := make(map[int][]*blobref.BlobRef)
 	for _, b := range blobs {
-		sn := sto.shardNum(b)
+		sn := pick(b)
 		m[sn] = append(m[sn], b)
 	}
 	ch := make(chan os.Error, len(m))
@@ -102,22 +205,93 @@ func (sto *shardStorage) batchedShards(blobs []*blobref.BlobRef, fn func(blobser
 	return reterr
 }
 
+// prevBlobs returns the blobs which are in a different place in the
+// previous placement, during a rebalance.
+func (sto *shardStorage) prevBlobs(blobs []*blobref.BlobRef) (moved []*blobref.BlobRef, pick func(*blobref.BlobRef) int) {
+	sto.mu.Lock()
+	prev := sto.prev
+	sto.mu.Unlock()
+	if prev == nil {
+		return nil, nil
+	}
+	for _, b := range blobs {
+		if prev.pick(b) != sto.shardNum(b) {
+			moved = append(moved, b)
+		}
+	}
+	return moved, prev.pick
+}
+
 func (sto *shardStorage) Remove(blobs []*blobref.BlobRef) os.Error {
-	return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
+	remove := func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
 		return s.Remove(blobs)
-	})
+	}
+	err := sto.batchedShards(blobs, remove)
+	if moved, pick := sto.prevBlobs(blobs); len(moved) > 0 {
+		if perr := sto.batched(moved, pick, remove); err == nil {
+			err = perr
+		}
+	}
+	return err
 }
 
 func (sto *shardStorage) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
-	return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
+	moved, pick := sto.prevBlobs(blobs)
+	if len(moved) == 0 {
+		return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
+			return s.Stat(dest, blobs, waitSeconds)
+		})
+	}
+
+	// During a rebalance, a moved blob may still be in its
+	// previous place. Look there first, without waiting, so that
+	// only the blobs found in neither place wait on the new one.
+	ch := make(chan blobref.SizedBlobRef, len(moved))
+	perr := sto.batched(moved, pick, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
+		return s.Stat(ch, blobs, 0)
+	})
+	close(ch)
+	found := make(map[string]bool)
+	for sb := range ch {
+		if !found[sb.BlobRef.String()] {
+			found[sb.BlobRef.String()] = true
+			dest <- sb
+		}
+	}
+	var rest []*blobref.BlobRef
+	for _, b := range blobs {
+		if !found[b.String()] {
+			rest = append(rest, b)
+		}
+	}
+	err := sto.batchedShards(rest, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
 		return s.Stat(dest, blobs, waitSeconds)
 	})
+	if err == nil {
+		err = perr
+	}
+	return err
 }
 
 func (sto *shardStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
 	return blobserver.MergedEnumerate(dest, sto.shards, after, limit, waitSeconds)
 }
 
+// StorageStats sums the stats of all the backends, current and
+// previous. During a rebalance, a blob that's been copied but not yet
+// removed from its old backend is counted twice.
+func (sto *shardStorage) StorageStats() (*blobserver.StorageStats, os.Error) {
+	stats := make([]*blobserver.StorageStats, len(sto.shards))
+	for i, s := range sto.shards {
+		st, err := blobserver.GetStorageStats(s)
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %v", sto.shardPrefixes[i], err)
+		}
+		stats[i] = st
+	}
+	return blobserver.SumStorageStats(stats), nil
+}
+
 func init() {
 	blobserver.RegisterStorageConstructor("shard", blobserver.StorageConstructor(newFromConfig))
 }
@@ -0,0 +1,171 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+type testLoader map[string]blobserver.Storage
+
+func (ld testLoader) GetStorage(prefix string) (blobserver.Storage, os.Error) {
+	if sto, ok := ld[prefix]; ok {
+		return sto, nil
+	}
+	return nil, fmt.Errorf("no storage %q", prefix)
+}
+
+func (ld testLoader) GetHandlerType(prefix string) string { return "" }
+
+func (ld testLoader) GetHandler(prefix string) (interface{}, os.Error) {
+	return ld.GetStorage(prefix)
+}
+
+func newLoader(prefixes ...string) testLoader {
+	ld := make(testLoader)
+	for _, prefix := range prefixes {
+		ld[prefix] = memory.New(0)
+	}
+	return ld
+}
+
+func testBlobs(n int) []*test.Blob {
+	blobs := make([]*test.Blob, n)
+	for i := range blobs {
+		blobs[i] = &test.Blob{fmt.Sprintf("blob-%d", i)}
+	}
+	return blobs
+}
+
+func TestRingWeights(t *testing.T) {
+	ld := newLoader("/a/", "/b/")
+	sto, err := newShardStorage(ld, &placementConfig{
+		prefixes:   []string{"/a/", "/b/"},
+		consistent: true,
+		weights:    []int{1, 3},
+	}, nil)
+	AssertNil(t, err, "newShardStorage")
+	counts := make([]int, 2)
+	for _, tb := range testBlobs(2000) {
+		counts[sto.shardNum(tb.BlobRef())]++
+	}
+	Expect(t, counts[1] > 2*counts[0], fmt.Sprintf("weighted backend gets more blobs; got %v", counts))
+}
+
+func TestRingAddMovesFew(t *testing.T) {
+	ld := newLoader("/a/", "/b/", "/c/", "/d/")
+	before, err := newShardStorage(ld, &placementConfig{
+		prefixes: []string{"/a/", "/b/", "/c/"}, consistent: true, weights: []int{1, 1, 1},
+	}, nil)
+	AssertNil(t, err, "newShardStorage")
+	after, err := newShardStorage(ld, &placementConfig{
+		prefixes: []string{"/a/", "/b/", "/c/", "/d/"}, consistent: true, weights: []int{1, 1, 1, 1},
+	}, nil)
+	AssertNil(t, err, "newShardStorage")
+
+	const n = 2000
+	moved := 0
+	for _, tb := range testBlobs(n) {
+		b := tb.BlobRef()
+		was, is := before.shardPrefixes[before.shardNum(b)], after.shardPrefixes[after.shardNum(b)]
+		if was != is {
+			moved++
+			ExpectString(t, "/d/", is, "blobs only move to the new backend")
+		}
+	}
+	Expect(t, moved < n/2, fmt.Sprintf("moved %d of %d blobs", moved, n))
+}
+
+func TestRebalance(t *testing.T) {
+	ld := newLoader("/a/", "/b/", "/c/")
+	old, err := newShardStorage(ld, &placementConfig{prefixes: []string{"/a/", "/b/"}, weights: []int{1, 1}}, nil)
+	AssertNil(t, err, "newShardStorage")
+	blobs := testBlobs(100)
+	for _, tb := range blobs {
+		_, err := old.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+
+	sto, err := newShardStorage(ld,
+		&placementConfig{prefixes: []string{"/a/", "/b/", "/c/"}, consistent: true, weights: []int{1, 1, 1}},
+		&placementConfig{prefixes: []string{"/a/", "/b/"}, weights: []int{1, 1}})
+	AssertNil(t, err, "newShardStorage")
+
+	check := func(when string) {
+		for _, tb := range blobs {
+			rc, _, err := sto.FetchStreaming(tb.BlobRef())
+			if err != nil {
+				t.Fatalf("%s: fetch of %q: %v", when, tb.Contents, err)
+			}
+			data, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			ExpectString(t, tb.Contents, string(data), when)
+		}
+		ch := make(chan blobref.SizedBlobRef, len(blobs))
+		var refs []*blobref.BlobRef
+		for _, tb := range blobs {
+			refs = append(refs, tb.BlobRef())
+		}
+		AssertNil(t, sto.Stat(ch, refs, 0), "Stat")
+		ExpectInt(t, len(blobs), len(ch), when+": blobs found by Stat")
+
+		// Blobs found in either place don't wait.
+		ch = make(chan blobref.SizedBlobRef, len(blobs))
+		start := time.Nanoseconds()
+		AssertNil(t, sto.Stat(ch, refs, 2), "Stat")
+		Expect(t, time.Nanoseconds()-start < 1e9, when+": Stat of found blobs didn't wait")
+		ExpectInt(t, len(blobs), len(ch), when+": blobs found by waiting Stat")
+	}
+	check("before rebalance")
+
+	moved, err := sto.rebalance()
+	AssertNil(t, err, "rebalance")
+	Expect(t, moved > 0, "some blobs moved")
+	check("after rebalance")
+
+	for n, s := range sto.shards {
+		blobserver.EnumerateAll(s, func(sb blobref.SizedBlobRef) os.Error {
+			ExpectInt(t, n, sto.shardNum(sb.BlobRef), "blob on its current shard")
+			return nil
+		})
+	}
+	_, again := sto.prevShardNum(blobs[0].BlobRef())
+	Expect(t, !again, "no fallback after rebalance")
+}
+
+func TestStorageTest(t *testing.T) {
+	storagetest.Test(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto, err := newShardStorage(newLoader("/a/", "/b/"), &placementConfig{
+				prefixes: []string{"/a/", "/b/"}, consistent: true, weights: []int{1, 1},
+			}, nil)
+			AssertNil(t, err, "newShardStorage")
+			return sto, nil
+		},
+	})
+}
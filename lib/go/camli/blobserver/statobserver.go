@@ -0,0 +1,55 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"sync"
+
+	"camli/blobref"
+)
+
+// A StatObserver is told which blobs a client is about to stat, such
+// as a garbage collector that mustn't remove a blob a client was just
+// told exists.
+type StatObserver interface {
+	// WillStat is called before the storage is asked about blobs.
+	// The stat waits for it to return.
+	WillStat(blobs []*blobref.BlobRef)
+}
+
+var (
+	statObserversMu sync.Mutex
+	statObservers   = make(map[BlobStatter][]StatObserver)
+)
+
+// AddStatObserver has o told about the blobs clients stat on sto.
+func AddStatObserver(sto BlobStatter, o StatObserver) {
+	statObserversMu.Lock()
+	defer statObserversMu.Unlock()
+	statObservers[sto] = append(statObservers[sto], o)
+}
+
+// NotifyWillStat tells sto's observers that blobs are about to be
+// statted on it. Handlers serving clients' stats call it.
+func NotifyWillStat(sto BlobStatter, blobs []*blobref.BlobRef) {
+	statObserversMu.Lock()
+	obs := statObservers[sto]
+	statObserversMu.Unlock()
+	for _, o := range obs {
+		o.WillStat(blobs)
+	}
+}
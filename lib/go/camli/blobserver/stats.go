@@ -0,0 +1,51 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"os"
+)
+
+var ErrStatsUnsupported = os.NewError("storage doesn't support stats")
+
+// GetStorageStats returns sto's stats, or ErrStatsUnsupported if it
+// isn't a StorageStatser.
+func GetStorageStats(sto Storage) (*StorageStats, os.Error) {
+	ss, ok := sto.(StorageStatser)
+	if !ok {
+		return nil, ErrStatsUnsupported
+	}
+	return ss.StorageStats()
+}
+
+// SumStorageStats returns the stats of storages holding the given
+// stats' blobs between them, such as the shards of a sharded
+// storage. Its FreeBytes is unknown if any of theirs is.
+func SumStorageStats(stats []*StorageStats) *StorageStats {
+	sum := &StorageStats{}
+	for _, st := range stats {
+		sum.Blobs += st.Blobs
+		sum.Bytes += st.Bytes
+		if sum.FreeBytes >= 0 {
+			sum.FreeBytes += st.FreeBytes
+		}
+		if st.FreeBytes < 0 {
+			sum.FreeBytes = -1
+		}
+	}
+	return sum
+}
@@ -0,0 +1,411 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package storagetest checks blobserver.Storage implementations
+// against the interface's contract. Storage tests call Test with a
+// function returning fresh, empty instances.
+//
+// Index-only sinks such as mysqlindexer, which can't give back the
+// blobs they receive, aren't storage in this sense.
+package storagetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/test"
+)
+
+// Opts configures Test.
+type Opts struct {
+	// New returns a new, empty storage, and a function to clean
+	// it up (or nil).
+	New func(t *testing.T) (sto blobserver.Storage, cleanup func())
+
+	// SkipStatWait skips checking that Stat waits for blobs to
+	// arrive, for storage which can't long-poll.
+	SkipStatWait bool
+
+	// SkipRemove skips checking Remove, for storage which isn't
+	// configured to support it.
+	SkipRemove bool
+}
+
+// Test runs each conformance check against a new storage from
+// opts.New.
+func Test(t *testing.T, opts Opts) {
+	checks := []struct {
+		name string
+		fn   func(*prefixT, blobserver.Storage)
+	}{
+		{"receive", testReceive},
+		{"corrupt", testCorrupt},
+		{"duplicate", testDuplicate},
+		{"fetch", testFetch},
+		{"stat", testStat},
+		{"statWait", testStatWait},
+		{"enumerate", testEnumerate},
+		{"remove", testRemove},
+		{"queue", testQueue},
+		{"stats", testStats},
+	}
+	for _, c := range checks {
+		if (c.name == "statWait" && opts.SkipStatWait) || (c.name == "remove" && opts.SkipRemove) {
+			continue
+		}
+		sto, cleanup := opts.New(t)
+		c.fn(&prefixT{t, c.name}, sto)
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+}
+
+// A reporter is a *testing.T, or a prefixT wrapping one.
+type reporter interface {
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// prefixT prefixes errors with the name of the check.
+type prefixT struct {
+	t      *testing.T
+	prefix string
+}
+
+func (p *prefixT) Errorf(format string, args ...interface{}) {
+	p.t.Errorf("%s: %s", p.prefix, fmt.Sprintf(format, args...))
+}
+
+func (p *prefixT) Fatalf(format string, args ...interface{}) {
+	p.t.Fatalf("%s: %s", p.prefix, fmt.Sprintf(format, args...))
+}
+
+func testBlobs(n int) []*test.Blob {
+	blobs := make([]*test.Blob, n)
+	for i := range blobs {
+		blobs[i] = &test.Blob{fmt.Sprintf("storagetest blob %d", i)}
+	}
+	return blobs
+}
+
+func receive(t reporter, sto blobserver.Storage, tb *test.Blob) {
+	sb, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	if err != nil {
+		t.Fatalf("ReceiveBlob of %s: %v", tb.BlobRef(), err)
+	}
+	if sb.BlobRef.String() != tb.BlobRef().String() || sb.Size != tb.Size() {
+		t.Errorf("ReceiveBlob = %v, %d; want %v, %d", sb.BlobRef, sb.Size, tb.BlobRef(), tb.Size())
+	}
+}
+
+// stat returns the blobs sto.Stat finds, checking it doesn't close
+// the channel.
+func stat(t *prefixT, sto blobserver.Storage, blobs []*blobref.BlobRef, waitSeconds int) map[string]int64 {
+	ch := make(chan blobref.SizedBlobRef, len(blobs)+1)
+	if err := sto.Stat(ch, blobs, waitSeconds); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	got := make(map[string]int64)
+	for n := len(ch); n > 0; n-- {
+		sb := <-ch
+		got[sb.BlobRef.String()] = sb.Size
+	}
+	select {
+	case _, ok := <-ch:
+		if !ok {
+			t.Errorf("Stat closed its dest channel")
+		} else {
+			t.Errorf("Stat sent to its dest channel after returning")
+		}
+	default:
+	}
+	return got
+}
+
+// enumerate returns what sto.EnumerateBlobs sends, checking it closes
+// the channel.
+func enumerate(t reporter, sto blobserver.Storage, after string, limit uint) []blobref.SizedBlobRef {
+	ch := make(chan blobref.SizedBlobRef)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- sto.EnumerateBlobs(ch, after, limit, 0)
+	}()
+	var sbs []blobref.SizedBlobRef
+	timeout := time.After(10e9)
+	for {
+		select {
+		case sb, ok := <-ch:
+			if !ok {
+				if err := <-errch; err != nil {
+					t.Fatalf("EnumerateBlobs(%q, %d): %v", after, limit, err)
+				}
+				return sbs
+			}
+			sbs = append(sbs, sb)
+		case <-timeout:
+			t.Fatalf("EnumerateBlobs(%q, %d) didn't close its dest channel", after, limit)
+		}
+	}
+	panic("unreachable")
+}
+
+// fetch checks that sto holds tb.
+func fetch(t reporter, sto blobserver.Storage, tb *test.Blob) {
+	rc, size, err := sto.FetchStreaming(tb.BlobRef())
+	if err != nil {
+		t.Fatalf("FetchStreaming of %s: %v", tb.BlobRef(), err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Errorf("reading fetched blob: %v", err)
+	}
+	if string(data) != tb.Contents || size != tb.Size() {
+		t.Errorf("FetchStreaming = %q, size %d; want %q, size %d", data, size, tb.Contents, tb.Size())
+	}
+}
+
+// Upload uploads tb to sto, failing t unless it's received.
+func Upload(t *testing.T, sto blobserver.Storage, tb *test.Blob) {
+	receive(t, sto, tb)
+}
+
+// ExpectContents fails t unless sto holds tb.
+func ExpectContents(t *testing.T, sto blobserver.Storage, tb *test.Blob) {
+	fetch(t, sto, tb)
+}
+
+// Enumerate returns the blobs sto.EnumerateBlobs lists, without
+// waiting.
+func Enumerate(t *testing.T, sto blobserver.Storage, after string, limit uint) []blobref.SizedBlobRef {
+	return enumerate(t, sto, after, limit)
+}
+
+// EnumerateAll returns every blob in sto, in order.
+func EnumerateAll(t *testing.T, sto blobserver.Storage) []blobref.SizedBlobRef {
+	var sbs []blobref.SizedBlobRef
+	err := blobserver.EnumerateAll(sto, func(sb blobref.SizedBlobRef) os.Error {
+		sbs = append(sbs, sb)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EnumerateAll: %v", err)
+	}
+	return sbs
+}
+
+func testReceive(t *prefixT, sto blobserver.Storage) {
+	for _, tb := range testBlobs(3) {
+		receive(t, sto, tb)
+	}
+	empty := &test.Blob{""}
+	receive(t, sto, empty)
+}
+
+func testCorrupt(t *prefixT, sto blobserver.Storage) {
+	tb := &test.Blob{"the real contents"}
+	_, err := sto.ReceiveBlob(tb.BlobRef(), strings.NewReader("some other contents"))
+	if err == nil {
+		t.Errorf("ReceiveBlob of mismatched contents succeeded")
+	}
+	if got := stat(t, sto, tb.BlobRefSlice(), 0); len(got) != 0 {
+		t.Errorf("corrupt blob is present after failed ReceiveBlob")
+	}
+}
+
+func testDuplicate(t *prefixT, sto blobserver.Storage) {
+	tb := &test.Blob{"uploaded twice"}
+	receive(t, sto, tb)
+	receive(t, sto, tb)
+	sbs := enumerate(t, sto, "", 1000)
+	if len(sbs) != 1 {
+		t.Errorf("enumerated %d blobs after duplicate upload; want 1", len(sbs))
+	}
+}
+
+func testFetch(t *prefixT, sto blobserver.Storage) {
+	tb := &test.Blob{"fetch me"}
+	receive(t, sto, tb)
+	fetch(t, sto, tb)
+
+	missing := &test.Blob{"never uploaded"}
+	rc, _, err := sto.FetchStreaming(missing.BlobRef())
+	if err == nil {
+		rc.Close()
+		t.Errorf("FetchStreaming of missing blob succeeded")
+	} else if err != os.ENOENT {
+		t.Errorf("FetchStreaming of missing blob = %v; want os.ENOENT", err)
+	}
+}
+
+func testStat(t *prefixT, sto blobserver.Storage) {
+	blobs := testBlobs(3)
+	receive(t, sto, blobs[0])
+	receive(t, sto, blobs[2])
+	got := stat(t, sto, []*blobref.BlobRef{blobs[0].BlobRef(), blobs[1].BlobRef(), blobs[2].BlobRef()}, 0)
+	if len(got) != 2 {
+		t.Errorf("Stat found %d blobs; want 2", len(got))
+	}
+	for _, tb := range []*test.Blob{blobs[0], blobs[2]} {
+		if size, ok := got[tb.BlobRef().String()]; !ok || size != tb.Size() {
+			t.Errorf("Stat of %s = %d, %v; want %d", tb.BlobRef(), size, ok, tb.Size())
+		}
+	}
+	if got := stat(t, sto, nil, 0); len(got) != 0 {
+		t.Errorf("Stat of no blobs found %d", len(got))
+	}
+}
+
+func testStatWait(t *prefixT, sto blobserver.Storage) {
+	tb := &test.Blob{"arrives later"}
+	done := make(chan map[string]int64, 1)
+	go func() {
+		done <- stat(t, sto, tb.BlobRefSlice(), 5)
+	}()
+	time.Sleep(200e6)
+	receive(t, sto, tb)
+	select {
+	case got := <-done:
+		if len(got) != 1 {
+			t.Errorf("Stat waiting for a blob found %d blobs; want 1", len(got))
+		}
+	case <-time.After(10e9):
+		t.Fatalf("Stat with waitSeconds=5 didn't return")
+	}
+
+	// Nothing arriving: Stat should return after about waitSeconds.
+	missing := &test.Blob{"never arrives"}
+	start := time.Nanoseconds()
+	if got := stat(t, sto, missing.BlobRefSlice(), 1); len(got) != 0 {
+		t.Errorf("Stat of missing blob found it")
+	}
+	if d := time.Nanoseconds() - start; d < 500e6 || d > 5e9 {
+		t.Errorf("Stat with waitSeconds=1 took %.2f seconds", float64(d)/1e9)
+	}
+}
+
+func testEnumerate(t *prefixT, sto blobserver.Storage) {
+	if sbs := enumerate(t, sto, "", 1000); len(sbs) != 0 {
+		t.Errorf("enumerated %d blobs from empty storage", len(sbs))
+	}
+
+	blobs := testBlobs(5)
+	var want []string
+	size := make(map[string]int64)
+	for _, tb := range blobs {
+		receive(t, sto, tb)
+		want = append(want, tb.BlobRef().String())
+		size[tb.BlobRef().String()] = tb.Size()
+	}
+	sort.SortStrings(want)
+
+	check := func(after string, limit uint, want []string) {
+		sbs := enumerate(t, sto, after, limit)
+		var got []string
+		for _, sb := range sbs {
+			got = append(got, sb.BlobRef.String())
+			if sb.Size != size[sb.BlobRef.String()] {
+				t.Errorf("enumerated %s with size %d; want %d", sb.BlobRef, sb.Size, size[sb.BlobRef.String()])
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("EnumerateBlobs(%q, %d) = %v; want %v", after, limit, got, want)
+		}
+	}
+	check("", 1000, want)
+	check("", 2, want[:2])
+	check(want[1], 1000, want[2:])
+	check(want[1], 2, want[2:4])
+	check(want[4], 1000, nil)
+}
+
+func testRemove(t *prefixT, sto blobserver.Storage) {
+	blobs := testBlobs(3)
+	for _, tb := range blobs {
+		receive(t, sto, tb)
+	}
+	if err := sto.Remove([]*blobref.BlobRef{blobs[0].BlobRef(), blobs[1].BlobRef()}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	got := stat(t, sto, []*blobref.BlobRef{blobs[0].BlobRef(), blobs[1].BlobRef(), blobs[2].BlobRef()}, 0)
+	if len(got) != 1 {
+		t.Errorf("Stat after Remove found %d blobs; want 1", len(got))
+	}
+	if _, _, err := sto.FetchStreaming(blobs[0].BlobRef()); err == nil {
+		t.Errorf("FetchStreaming of removed blob succeeded")
+	}
+	if sbs := enumerate(t, sto, "", 1000); len(sbs) != 1 {
+		t.Errorf("enumerated %d blobs after Remove; want 1", len(sbs))
+	}
+
+	missing := &test.Blob{"never uploaded"}
+	if err := sto.Remove(missing.BlobRefSlice()); err != nil {
+		t.Errorf("Remove of missing blob: %v", err)
+	}
+}
+
+// testStats checks a StorageStatser counts each blob once. Stats are
+// only asked for once, as some storages cache them.
+func testStats(t *prefixT, sto blobserver.Storage) {
+	blobs := testBlobs(3)
+	var size int64
+	for _, tb := range blobs {
+		receive(t, sto, tb)
+		size += tb.Size()
+	}
+	receive(t, sto, blobs[0])
+	st, err := blobserver.GetStorageStats(sto)
+	if err == blobserver.ErrStatsUnsupported {
+		return
+	}
+	if err != nil {
+		t.Fatalf("StorageStats: %v", err)
+	}
+	if st.Blobs != 3 || st.Bytes != size {
+		t.Errorf("StorageStats = %d blobs, %d bytes; want 3, %d", st.Blobs, st.Bytes, size)
+	}
+	if st.FreeBytes < -1 {
+		t.Errorf("StorageStats FreeBytes = %d", st.FreeBytes)
+	}
+}
+
+func testQueue(t *prefixT, sto blobserver.Storage) {
+	qc, ok := sto.(blobserver.QueueCreator)
+	if !ok {
+		return
+	}
+	q, err := qc.CreateQueue("storagetest-queue")
+	if err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	if _, err := qc.CreateQueue("bogus/queue"); err == nil {
+		t.Errorf("CreateQueue accepted an invalid name")
+	}
+	tb := &test.Blob{"queued"}
+	receive(t, sto, tb)
+	sbs := enumerate(t, q, "", 1000)
+	if len(sbs) != 1 || sbs[0].BlobRef.String() != tb.BlobRef().String() {
+		t.Errorf("queue enumerated %v; want just %s", sbs, tb.BlobRef())
+	}
+}
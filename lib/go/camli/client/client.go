@@ -44,9 +44,16 @@ type Client struct {
 
 	httpClient *http.Client
 
+	// uploadBatchBytes is UploadMulti's size budget per request,
+	// or 0 for DefaultUploadBatchBytes.
+	uploadBatchBytes int64
+
 	statsMutex sync.Mutex
 	stats      Stats
 
+	fetchMultiMu sync.Mutex
+	noFetchMulti bool // the server has no fetch-blobs handler
+
 	log *log.Logger // not nil
 }
 
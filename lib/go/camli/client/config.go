@@ -178,6 +178,8 @@ func SignerPublicKeyBlobref() *blobref.BlobRef {
 		return nil
 	}
 
+	// A public key's blobref identifies its signer, so it stays
+	// sha1 whatever the preferred hash.
 	br := blobref.Sha1FromString(armored)
 
 	pubFile := filepath.Join(selfPubKeyDir, br.String() + ".camli")
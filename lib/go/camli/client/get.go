@@ -17,12 +17,18 @@ limitations under the License.
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"camli/blobref"
+	"camli/misc"
 	"fmt"
+	"http"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var _ = log.Printf
@@ -52,6 +58,10 @@ func (c *Client) FetchVia(b *blobref.BlobRef, v []*blobref.BlobRef) (io.ReadClos
 		return nil, 0, err
 	}
 
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, os.ENOENT
+	}
 	if resp.StatusCode != 200 {
 		return nil, 0, os.NewError(fmt.Sprintf("Got status code %d from blobserver for %s", resp.StatusCode, b))
 	}
@@ -63,3 +73,142 @@ func (c *Client) FetchVia(b *blobref.BlobRef, v []*blobref.BlobRef) (io.ReadClos
 
 	return resp.Body, size, nil
 }
+
+// maxFetchBlobs is the most blobs FetchMulti asks the server for in
+// one request.
+const maxFetchBlobs = 1000
+
+// errNoFetchMulti is returned by fetchMulti if the server has no
+// fetch-blobs handler.
+var errNoFetchMulti = os.NewError("server doesn't support fetch-blobs")
+
+// FetchMulti fetches blobs with the server's fetch-blobs handler,
+// calling fn with each of them the server has, in the order given;
+// missing blobs are skipped. The blob's contents are only readable
+// until fn returns. An error from fn stops the fetch and is returned.
+//
+// If the server has no fetch-blobs handler, FetchMulti fetches the
+// blobs one at a time, and so does every later call on c.
+func (c *Client) FetchMulti(blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error {
+	for len(blobs) > 0 {
+		if !c.canFetchMulti() {
+			return c.fetchEach(blobs, fn)
+		}
+		n := len(blobs)
+		if n > maxFetchBlobs {
+			n = maxFetchBlobs
+		}
+		err := c.fetchMulti(blobs[:n], fn)
+		if err == errNoFetchMulti {
+			c.fetchMultiMu.Lock()
+			c.noFetchMulti = true
+			c.fetchMultiMu.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		blobs = blobs[n:]
+	}
+	return nil
+}
+
+func (c *Client) canFetchMulti() bool {
+	c.fetchMultiMu.Lock()
+	defer c.fetchMultiMu.Unlock()
+	return !c.noFetchMulti
+}
+
+// fetchEach is FetchMulti for servers without a fetch-blobs handler.
+func (c *Client) fetchEach(blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error {
+	for _, br := range blobs {
+		rc, size, err := c.FetchStreaming(br)
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(blobref.SizedBlobRef{br, size}, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) fetchMulti(blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error {
+	requested := make(map[string]bool)
+	var buf bytes.Buffer
+	for n, blob := range blobs {
+		if n > 0 {
+			buf.WriteString("&")
+		}
+		fmt.Fprintf(&buf, "blob%d=%s", n+1, blob)
+		requested[blob.String()] = true
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/camli/fetch-blobs", c.server), strings.NewReader(buf.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = int64(buf.Len())
+	c.addAuthHeader(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch-blobs HTTP error: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+	case http.StatusNotFound, http.StatusBadRequest, http.StatusNotImplemented:
+		return errNoFetchMulti
+	default:
+		return fmt.Errorf("fetch-blobs response had http status %d", resp.StatusCode)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err == os.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("fetch-blobs response truncated: %v", err)
+		}
+		sb, ok := parseFetchHeader(line)
+		if !ok || !requested[sb.BlobRef.String()] {
+			return fmt.Errorf("fetch-blobs response had bad blob header %q", line)
+		}
+
+		read := int64(0)
+		r := misc.CountingReader{io.LimitReader(br, sb.Size), &read}
+		if err := fn(sb, r); err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, r)
+		if read != sb.Size {
+			return fmt.Errorf("fetch-blobs response truncated in %s: got %d of %d bytes",
+				sb.BlobRef, read, sb.Size)
+		}
+	}
+	panic("unreachable")
+}
+
+// parseFetchHeader parses the "<blobref> <size>" line before each blob
+// in a fetch-blobs response.
+func parseFetchHeader(line string) (sb blobref.SizedBlobRef, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return
+	}
+	br := blobref.Parse(fields[0])
+	size, err := strconv.Atoi64(fields[1])
+	if br == nil || err != nil || size < 0 {
+		return
+	}
+	return blobref.SizedBlobRef{br, size}, true
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"camli/blobref"
+)
+
+func TestFetchMultiFallback(t *testing.T) {
+	blobs := map[string]string{}
+	for _, s := range []string{"foo", "bar"} {
+		blobs[blobref.Sha1FromString(s).String()] = s
+	}
+	multiRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/camli/fetch-blobs" {
+			multiRequests++
+			http.NotFound(rw, req)
+			return
+		}
+		if !strings.HasPrefix(req.URL.Path, "/camli/") {
+			http.NotFound(rw, req)
+			return
+		}
+		s, ok := blobs[req.URL.Path[len("/camli/"):]]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Length", fmt.Sprint(len(s)))
+		io.WriteString(rw, s)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "")
+	refs := []*blobref.BlobRef{
+		blobref.Sha1FromString("baz"),
+		blobref.Sha1FromString("bar"),
+		blobref.Sha1FromString("foo"),
+	}
+	for i := 0; i < 2; i++ {
+		var got []string
+		err := c.FetchMulti(refs, func(sb blobref.SizedBlobRef, r io.Reader) os.Error {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			got = append(got, string(data))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("FetchMulti: %v", err)
+		}
+		if g := strings.Join(got, " "); g != "bar foo" {
+			t.Errorf("FetchMulti %d got %q; want %q", i, g, "bar foo")
+		}
+	}
+	if multiRequests != 1 {
+		t.Errorf("fetch-blobs asked %d times; want once", multiRequests)
+	}
+}
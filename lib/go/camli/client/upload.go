@@ -51,12 +51,21 @@ func (pr *PutResult) SizedBlobRef() blobref.SizedBlobRef {
 
 type statResponse struct {
 	HaveMap                    map[string]blobref.SizedBlobRef
+	partials                   map[string][]*partialUpload // by blobref
 	maxUploadSize              int64
 	uploadUrl                  string
 	uploadUrlExpirationSeconds int
 	canLongPoll                bool
 }
 
+// partialUpload is the start of a blob that the server offers to let
+// an upload resume from. See doc/protocol/blob-upload-resume.txt.
+type partialUpload struct {
+	size      int64
+	partRef   *blobref.BlobRef // of the first size bytes
+	resumeKey string
+}
+
 type ResponseFormatError os.Error
 
 func newResFormatError(s string, arg ...interface{}) ResponseFormatError {
@@ -126,11 +135,56 @@ func parseStatResponse(r io.Reader) (sr *statResponse, outerr os.Error) {
 		s.HaveMap[br.String()] = blobref.SizedBlobRef{br, int64(size)}
 	}
 
+	// Resuming is optional, so bad "alreadyHavePartially" items
+	// are just skipped.
+	s.partials = make(map[string][]*partialUpload)
+	partials, _ := jmap["alreadyHavePartially"].([]interface{})
+	for _, li := range partials {
+		m, _ := li.(map[string]interface{})
+		blobRefStr, _ := m["blobRef"].(string)
+		size, _ := m["size"].(float64)
+		partRefStr, _ := m["partBlobRef"].(string)
+		resumeKey, _ := m["resumeKey"].(string)
+		br, partRef := blobref.Parse(blobRefStr), blobref.Parse(partRefStr)
+		if br == nil || partRef == nil || size <= 0 || resumeKey == "" {
+			continue
+		}
+		s.partials[br.String()] = append(s.partials[br.String()],
+			&partialUpload{int64(size), partRef, resumeKey})
+	}
+
 	return s, nil
 }
 
+// findResumable returns the first of a blob's partial uploads on the
+// server that matches the start of contents, leaving contents just
+// after it, or nil, leaving contents where it was.
+func findResumable(contents io.ReadSeeker, h *UploadHandle, partials []*partialUpload) *partialUpload {
+	start, err := contents.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return nil
+	}
+	for _, p := range partials {
+		if p.size >= h.Size || p.partRef.HashName() != h.BlobRef.HashName() {
+			continue
+		}
+		hash := p.partRef.Hash()
+		if hash == nil {
+			continue
+		}
+		_, err := io.Copyn(hash, contents, p.size)
+		if err == nil && p.partRef.HashMatches(hash) {
+			return p
+		}
+		if _, err := contents.Seek(start, os.SEEK_SET); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
 func NewUploadHandleFromString(data string) *UploadHandle {
-	bref := blobref.Sha1FromString(data)
+	bref := blobref.FromString(data)
 	r := strings.NewReader(data)
 	return &UploadHandle{BlobRef: bref, Size: int64(len(data)), Contents: r}
 }
@@ -200,26 +254,50 @@ func (c *Client) Stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef
 	return nil
 }
 
-func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
-	error := func(msg string, arg ...interface{}) (*PutResult, os.Error) {
-		err := fmt.Errorf(msg, arg...)
-		c.log.Print(err.String())
-		return nil, err
-	}
+// uploadBoundary separates the parts of upload request bodies.
+// TODO: use a proper random boundary
+const uploadBoundary = "sdf8sd8f7s9df9s7df9sd7sdf9s879vs7d8v7sd8v7sd8v"
 
+// uploadPartHeader returns the header of the multipart form part
+// uploading br as formName.
+func uploadPartHeader(formName string, br *blobref.BlobRef) string {
+	// TODO-GO: add a multipart writer class.
+	return fmt.Sprintf(
+		"--%s\r\nContent-Type: application/octet-stream\r\n"+
+			"Content-Disposition: form-data; name=\"%s\"; filename=\"%s\"\r\n\r\n",
+		uploadBoundary,
+		formName, br)
+}
+
+const uploadFooter = "\r\n--" + uploadBoundary + "--\r\n"
+
+func (c *Client) noteUploadRequest(h *UploadHandle) {
 	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
 	c.stats.UploadRequests.Blobs++
 	if h.Size != -1 {
 		c.stats.UploadRequests.Bytes += h.Size
 	}
-	c.statsMutex.Unlock()
+}
 
-	blobRefString := h.BlobRef.String()
+func (c *Client) noteUploaded(size int64) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.Uploads.Blobs++
+	c.stats.Uploads.Bytes += size
+}
+
+// statForUpload does the pre-upload stat of blobs, which says which
+// of them the server already has and where to upload the others.
+func (c *Client) statForUpload(blobs []*blobref.BlobRef) (*statResponse, os.Error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "camliversion=1")
+	for n, blob := range blobs {
+		fmt.Fprintf(&buf, "&blob%d=%s", n+1, blob)
+	}
+	requestBody := buf.String()
 
-	// Pre-upload.  Check whether the blob already exists on the
-	// server and if not, the URL to upload it to.
 	url := fmt.Sprintf("%s/camli/stat", c.server)
-	requestBody := "camliversion=1&blob1=" + blobRefString
 	req := c.newRequest("POST", url)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Body = ioutil.NopCloser(strings.NewReader(requestBody))
@@ -228,108 +306,72 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return error("stat http error: %v", err)
+		return nil, fmt.Errorf("stat http error: %v", err)
 	}
 
 	if resp.StatusCode != 200 {
-		return error("stat response had http status %d", resp.StatusCode)
+		return nil, fmt.Errorf("stat response had http status %d", resp.StatusCode)
 	}
 
-	stat, err := parseStatResponse(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return parseStatResponse(resp.Body)
+}
 
-	pr := &PutResult{BlobRef: h.BlobRef, Size: h.Size}
-	if _, ok := stat.HaveMap[h.BlobRef.String()]; ok {
-		pr.Skipped = true
-
-		// Consume the buffer that was provided, just for
-		// consistency. But if it's a closer, do that
-		// instead. But if they didn't provide a size,
-		// we consume it anyway just to get the size
-		// for stats.
-		closer, _ := h.Contents.(io.Closer)
-		if h.Size >= 0 && closer != nil {
-			closer.Close()
-		} else {
-			n, err := io.Copy(ioutil.Discard, h.Contents)
-			if err != nil {
-				return nil, err
-			}
-			if h.Size == -1 {
-				pr.Size = n
-				c.statsMutex.Lock()
-				c.stats.UploadRequests.Bytes += pr.Size
-				c.statsMutex.Unlock()
-			}
+// skipUpload returns the result of uploading h when the server
+// already has its blob.
+func (c *Client) skipUpload(h *UploadHandle) (*PutResult, os.Error) {
+	pr := &PutResult{BlobRef: h.BlobRef, Size: h.Size, Skipped: true}
+
+	// Consume the buffer that was provided, just for
+	// consistency. But if it's a closer, do that
+	// instead. But if they didn't provide a size,
+	// we consume it anyway just to get the size
+	// for stats.
+	closer, _ := h.Contents.(io.Closer)
+	if h.Size >= 0 && closer != nil {
+		closer.Close()
+	} else {
+		n, err := io.Copy(ioutil.Discard, h.Contents)
+		if err != nil {
+			return nil, err
 		}
-		return pr, nil
-	}
-
-	// TODO: use a proper random boundary
-	boundary := "sdf8sd8f7s9df9s7df9sd7sdf9s879vs7d8v7sd8v7sd8v"
-
-	// TODO-GO: add a multipart writer class.
-	multiPartHeader := fmt.Sprintf(
-		"--%s\r\nContent-Type: application/octet-stream\r\n"+
-			"Content-Disposition: form-data; name=\"%s\"; filename=\"%s\"\r\n\r\n",
-		boundary,
-		h.BlobRef, h.BlobRef)
-	multiPartFooter := "\r\n--" + boundary + "--\r\n"
-
-	c.log.Printf("Uploading to URL: %s", stat.uploadUrl)
-	req = c.newRequest("POST", stat.uploadUrl)
-	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
-
-	contentsSize := int64(0)
-	req.Body = ioutil.NopCloser(io.MultiReader(
-		strings.NewReader(multiPartHeader),
-		misc.CountingReader{h.Contents, &contentsSize},
-		strings.NewReader(multiPartFooter)))
-
-	if h.Size >= 0 {
-		req.ContentLength = int64(len(multiPartHeader)) + h.Size + int64(len(multiPartFooter))
-	}
-	req.TransferEncoding = nil
-	resp, err = c.httpClient.Do(req)
-	if err != nil {
-		return error("upload http error: %v", err)
-	}
-
-	if h.Size >= 0 {
-		if contentsSize != h.Size {
-			return error("UploadHandle declared size %d but Contents length was %d", h.Size, contentsSize)
+		if h.Size == -1 {
+			pr.Size = n
+			c.statsMutex.Lock()
+			c.stats.UploadRequests.Bytes += pr.Size
+			c.statsMutex.Unlock()
 		}
-	} else {
-		h.Size = contentsSize
 	}
+	return pr, nil
+}
 
+// uploadResponse reads the response to an upload to uploadUrl,
+// returning the sizes of the blobs the server received, by blobref.
+func (c *Client) uploadResponse(uploadUrl string, resp *http.Response) (map[string]int64, os.Error) {
 	// The only valid HTTP responses are 200 and 303.
 	if resp.StatusCode != 200 && resp.StatusCode != 303 {
-		return error("invalid http response %d in upload response", resp.StatusCode)
+		return nil, fmt.Errorf("invalid http response %d in upload response", resp.StatusCode)
 	}
 
 	if resp.StatusCode == 303 {
 		otherLocation := resp.Header.Get("Location")
 		if otherLocation == "" {
-			return error("303 without a Location")
+			return nil, os.NewError("303 without a Location")
 		}
-		baseUrl, _ := http.ParseURL(stat.uploadUrl)
+		baseUrl, _ := http.ParseURL(uploadUrl)
 		absUrl, err := baseUrl.ParseURL(otherLocation)
 		if err != nil {
-			return error("303 Location URL relative resolve error: %v", err)
+			return nil, fmt.Errorf("303 Location URL relative resolve error: %v", err)
 		}
 		otherLocation = absUrl.String()
 		resp, err = http.Get(otherLocation)
 		if err != nil {
-			return error("error following 303 redirect after upload: %v", err)
+			return nil, fmt.Errorf("error following 303 redirect after upload: %v", err)
 		}
 	}
 
 	ures, err := c.jsonFromResponse("upload", resp)
 	if err != nil {
-		return error("json parse from upload error: %v", err)
+		return nil, fmt.Errorf("json parse from upload error: %v", err)
 	}
 
 	errorText, ok := ures["errorText"].(string)
@@ -339,35 +381,108 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 
 	received, ok := ures["received"].([]interface{})
 	if !ok {
-		return error("upload json validity error: no 'received'")
+		return nil, os.NewError("upload json validity error: no 'received'")
 	}
 
+	sizes := make(map[string]int64)
 	for _, rit := range received {
 		it, ok := rit.(map[string]interface{})
 		if !ok {
-			return error("upload json validity error: 'received' is malformed")
+			return nil, os.NewError("upload json validity error: 'received' is malformed")
+		}
+		blobRefString, ok := it["blobRef"].(string)
+		if !ok {
+			return nil, os.NewError("upload json validity error: 'received' is malformed")
 		}
-		if it["blobRef"] == blobRefString {
-			switch size := it["size"].(type) {
-			case nil:
-				return error("upload json validity error: 'received' is missing 'size'")
-			case float64:
-				if int64(size) == h.Size {
-					// Success!
-					c.statsMutex.Lock()
-					c.stats.Uploads.Blobs++
-					c.stats.Uploads.Bytes += h.Size
-					c.statsMutex.Unlock()
-					return pr, nil
-				} else {
-					return error("Server got blob, but reports wrong length (%v; expected %d)",
-						size, h.Size)
-				}
-			default:
-				return error("unsupported type of 'size' in received response")
-			}
+		switch size := it["size"].(type) {
+		case nil:
+			return nil, os.NewError("upload json validity error: 'received' is missing 'size'")
+		case float64:
+			sizes[blobRefString] = int64(size)
+		default:
+			return nil, os.NewError("unsupported type of 'size' in received response")
 		}
 	}
+	return sizes, nil
+}
+
+func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
+	error := func(msg string, arg ...interface{}) (*PutResult, os.Error) {
+		err := fmt.Errorf(msg, arg...)
+		c.log.Print(err.String())
+		return nil, err
+	}
+
+	c.noteUploadRequest(h)
+
+	blobRefString := h.BlobRef.String()
+
+	// Pre-upload.  Check whether the blob already exists on the
+	// server and if not, the URL to upload it to.
+	stat, err := c.statForUpload([]*blobref.BlobRef{h.BlobRef})
+	if err != nil {
+		if _, ok := err.(ResponseFormatError); ok {
+			return nil, err
+		}
+		return error("%v", err)
+	}
+
+	if _, ok := stat.HaveMap[blobRefString]; ok {
+		return c.skipUpload(h)
+	}
 
-	return nil, os.NewError("Server didn't receive blob.")
+	// If the server kept part of an earlier attempt, send just the
+	// rest, named by the part's resume key.
+	formName, skip := blobRefString, int64(0)
+	if rs, ok := h.Contents.(io.ReadSeeker); ok && h.Size > 0 {
+		if p := findResumable(rs, h, stat.partials[blobRefString]); p != nil {
+			c.log.Printf("Resuming upload of %s after %d bytes", blobRefString, p.size)
+			formName, skip = p.resumeKey, p.size
+		}
+	}
+
+	multiPartHeader := uploadPartHeader(formName, h.BlobRef)
+
+	c.log.Printf("Uploading to URL: %s", stat.uploadUrl)
+	req := c.newRequest("POST", stat.uploadUrl)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+uploadBoundary)
+
+	contentsSize := int64(0)
+	req.Body = ioutil.NopCloser(io.MultiReader(
+		strings.NewReader(multiPartHeader),
+		misc.CountingReader{h.Contents, &contentsSize},
+		strings.NewReader(uploadFooter)))
+
+	if h.Size >= 0 {
+		req.ContentLength = int64(len(multiPartHeader)) + h.Size - skip + int64(len(uploadFooter))
+	}
+	req.TransferEncoding = nil
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return error("upload http error: %v", err)
+	}
+
+	if h.Size >= 0 {
+		if skip+contentsSize != h.Size {
+			return error("UploadHandle declared size %d but Contents length was %d", h.Size, skip+contentsSize)
+		}
+	} else {
+		h.Size = contentsSize
+	}
+
+	received, err := c.uploadResponse(stat.uploadUrl, resp)
+	if err != nil {
+		return error("%v", err)
+	}
+	size, ok := received[blobRefString]
+	if !ok {
+		return nil, os.NewError("Server didn't receive blob.")
+	}
+	if size != h.Size {
+		return error("Server got blob, but reports wrong length (%d; expected %d)",
+			size, h.Size)
+	}
+	// Success!
+	c.noteUploaded(h.Size)
+	return &PutResult{BlobRef: h.BlobRef, Size: h.Size}, nil
 }
@@ -0,0 +1,186 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"camli/blobref"
+	"camli/misc"
+)
+
+// maxStatBlobs is the most blobs the server stats in one request.
+const maxStatBlobs = 1000
+
+// DefaultUploadBatchBytes is the default size budget of the blob
+// contents sent in one request by UploadMulti.
+const DefaultUploadBatchBytes = 8 << 20
+
+// SetUploadBatchBytes sets the size budget of the blob contents
+// UploadMulti sends in one request. Blobs bigger than that are
+// uploaded on their own, as by Upload.
+func (c *Client) SetUploadBatchBytes(n int64) {
+	c.uploadBatchBytes = n
+}
+
+// UploadMulti uploads many blobs with fewer round trips than calling
+// Upload for each: the blobs are statted together, and those the
+// server doesn't have are packed into as few multipart uploads as the
+// batch size budget allows. Blobs of unknown size (-1), or over the
+// budget, are uploaded on their own.
+//
+// The results are in the order of handles. On error, the results of
+// the handles not yet uploaded are nil.
+func (c *Client) UploadMulti(handles []*UploadHandle) ([]*PutResult, os.Error) {
+	results := make([]*PutResult, len(handles))
+	for start := 0; start < len(handles); start += maxStatBlobs {
+		end := start + maxStatBlobs
+		if end > len(handles) {
+			end = len(handles)
+		}
+		if err := c.uploadMulti(handles[start:end], results[start:end]); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+func (c *Client) uploadMulti(handles []*UploadHandle, results []*PutResult) os.Error {
+	blobs := make([]*blobref.BlobRef, len(handles))
+	for i, h := range handles {
+		blobs[i] = h.BlobRef
+	}
+	stat, err := c.statForUpload(blobs)
+	if err != nil {
+		c.log.Print(err.String())
+		return err
+	}
+
+	budget := c.uploadBatchBytes
+	if budget <= 0 {
+		budget = DefaultUploadBatchBytes
+	}
+	if stat.maxUploadSize > 0 && stat.maxUploadSize < budget {
+		budget = stat.maxUploadSize
+	}
+
+	var batch []int // indexes into handles
+	batchBytes := int64(0)
+	flush := func() os.Error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := c.uploadBatch(stat.uploadUrl, handles, results, batch)
+		batch, batchBytes = nil, 0
+		return err
+	}
+
+	queued := make(map[string]bool)
+	for i, h := range handles {
+		key := h.BlobRef.String()
+		if h.Size < 0 || h.Size > budget {
+			if results[i], err = c.Upload(h); err != nil {
+				return err
+			}
+			continue
+		}
+		c.noteUploadRequest(h)
+		if _, ok := stat.HaveMap[key]; ok || queued[key] {
+			if results[i], err = c.skipUpload(h); err != nil {
+				return err
+			}
+			continue
+		}
+		if batchBytes+h.Size > budget {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		queued[key] = true
+		batch = append(batch, i)
+		batchBytes += h.Size
+	}
+	return flush()
+}
+
+// uploadBatch uploads the blobs of the handles at the indexes in
+// batch in one request, setting their results.
+func (c *Client) uploadBatch(uploadUrl string, handles []*UploadHandle, results []*PutResult, batch []int) os.Error {
+	error := func(msg string, arg ...interface{}) os.Error {
+		err := fmt.Errorf(msg, arg...)
+		c.log.Print(err.String())
+		return err
+	}
+
+	readers := make([]io.Reader, 0, 2*len(batch)+1)
+	contentsSizes := make([]int64, len(batch))
+	length := int64(0)
+	for j, i := range batch {
+		h := handles[i]
+		header := uploadPartHeader(h.BlobRef.String(), h.BlobRef)
+		if j > 0 {
+			header = "\r\n" + header
+		}
+		readers = append(readers,
+			strings.NewReader(header),
+			misc.CountingReader{h.Contents, &contentsSizes[j]})
+		length += int64(len(header)) + h.Size
+	}
+	readers = append(readers, strings.NewReader(uploadFooter))
+	length += int64(len(uploadFooter))
+
+	c.log.Printf("Uploading %d blobs to URL: %s", len(batch), uploadUrl)
+	req := c.newRequest("POST", uploadUrl)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+uploadBoundary)
+	req.Body = ioutil.NopCloser(io.MultiReader(readers...))
+	req.ContentLength = length
+	req.TransferEncoding = nil
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return error("upload http error: %v", err)
+	}
+
+	for j, i := range batch {
+		if h := handles[i]; contentsSizes[j] != h.Size {
+			return error("UploadHandle of %s declared size %d but Contents length was %d",
+				h.BlobRef, h.Size, contentsSizes[j])
+		}
+	}
+
+	received, err := c.uploadResponse(uploadUrl, resp)
+	if err != nil {
+		return error("%v", err)
+	}
+	for _, i := range batch {
+		h := handles[i]
+		size, ok := received[h.BlobRef.String()]
+		if !ok {
+			return error("Server didn't receive blob %s.", h.BlobRef)
+		}
+		if size != h.Size {
+			return error("Server got blob %s, but reports wrong length (%d; expected %d)",
+				h.BlobRef, size, h.Size)
+		}
+		c.noteUploaded(h.Size)
+		results[i] = &PutResult{BlobRef: h.BlobRef, Size: h.Size}
+	}
+	return nil
+}
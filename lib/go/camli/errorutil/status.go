@@ -0,0 +1,108 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errorutil
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is how many errors a StatusLog remembers.
+const maxRecentErrors = 20
+
+type TimestampedError struct {
+	Time *time.Time
+	Err  os.Error
+}
+
+// StatusLog tracks what a background task is doing and the errors it
+// has hit, for its status page. The zero value is ready to use, and
+// a StatusLog is safe for concurrent use.
+type StatusLog struct {
+	mu           sync.Mutex // protects following
+	status       string
+	totalErrors  int64
+	recentErrors []TimestampedError // oldest first
+}
+
+// SetStatus sets the current status, prefixed with the time.
+func (s *StatusLog) SetStatus(format string, args ...interface{}) {
+	str := time.UTC().Format(time.RFC3339) + ": " + fmt.Sprintf(format, args...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = str
+}
+
+// AddError logs err and remembers it as one of the recent errors.
+func (s *StatusLog) AddError(err os.Error) {
+	log.Print(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totalErrors++
+	s.recentErrors = append(s.recentErrors, TimestampedError{time.UTC(), err})
+	if len(s.recentErrors) > maxRecentErrors {
+		copy(s.recentErrors, s.recentErrors[1:])
+		s.recentErrors = s.recentErrors[:maxRecentErrors]
+	}
+}
+
+// Status returns the current status, or "not started" if none has
+// been set.
+func (s *StatusLog) Status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == "" {
+		return "not started"
+	}
+	return s.status
+}
+
+// TotalErrors returns how many errors have been added, ever.
+func (s *StatusLog) TotalErrors() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalErrors
+}
+
+// RecentErrors returns a copy of the most recent errors, oldest
+// first.
+func (s *StatusLog) RecentErrors() []TimestampedError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TimestampedError(nil), s.recentErrors...)
+}
+
+// WriteRecentErrorsHTML writes the recent errors as an HTML list, or
+// nothing if there are none.
+func (s *StatusLog) WriteRecentErrorsHTML(w io.Writer) {
+	errs := s.RecentErrors()
+	if len(errs) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<h2>Recent Errors:</h2><ul>")
+	for _, te := range errs {
+		fmt.Fprintf(w, "<li>%s: %s</li>\n",
+			te.Time.Format(time.RFC3339),
+			html.EscapeString(te.Err.String()))
+	}
+	fmt.Fprintf(w, "</ul>")
+}
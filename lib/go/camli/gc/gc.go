@@ -0,0 +1,547 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gc implements mark-and-sweep garbage collection of a blob
+// storage.
+//
+// The roots are the signed schema blobs: permanodes, claims, shares
+// and "keep" objects. From those, the collector marks everything
+// reachable through a claim's permanode and value (which covers
+// camliContent), a share's or keep's target, a directory's entries,
+// a static-set's members, a file's contentParts and a signer's public
+// key. Everything else is unreferenced, and is swept once it has been
+// seen unreferenced for longer than the grace period.
+//
+// Blobs received while a collection is running, and everything they
+// reference, are marked before anything is swept. A client that
+// stats a blob and, finding it, uploads only what references it,
+// races the sweep: so statting or receiving an unreferenced blob
+// restarts its clock, and a stat of a blob being removed waits for
+// the removal, so the client finds it missing and uploads it again.
+// The grace period must still be longer than a client takes between
+// statting a blob and uploading what references it. Only stats made
+// through the stat handler of the collected storage count.
+package gc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/errorutil"
+	"camli/osutil"
+	"camli/schema"
+)
+
+const (
+	// maxSchemaSize is the largest blob considered as a possible
+	// schema blob. Bigger blobs are assumed to be data.
+	maxSchemaSize = 1 << 20
+
+	defaultGracePeriod = 24 * 60 * 60 // seconds
+
+	sweepBatch  = 100
+	maxReported = 1000 // swept blobrefs listed in a report
+)
+
+// gcSchema is the subset of a schema blob that holds references to
+// other blobs.
+type gcSchema struct {
+	Type   string "camliType"
+	Signer string "camliSigner"
+	Sig    string "camliSig"
+
+	Permanode string "permaNode" // claims
+	Value     string "value"     // claims; a blobref for camliContent
+
+	Target string "target" // shares and keeps
+
+	Entries      string                "entries"      // directories
+	Members      []string              "members"      // static-sets
+	ContentParts []*schema.ContentPart "contentParts" // files
+}
+
+// parseSchema returns the schema blob in data, or nil if data isn't
+// one.
+func parseSchema(data []byte) *gcSchema {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return nil
+	}
+	ss := new(gcSchema)
+	if err := json.Unmarshal(data, ss); err != nil || ss.Type == "" {
+		return nil
+	}
+	return ss
+}
+
+// isRoot reports whether the blob is a GC root. Any signed schema
+// blob is one: it's a statement by its signer, whatever its type.
+func (ss *gcSchema) isRoot() bool {
+	return ss.Signer != "" && ss.Sig != ""
+}
+
+// refs returns the blobrefs the blob references, as strings.
+func (ss *gcSchema) refs() []string {
+	var refs []string
+	add := func(s string) {
+		if br := blobref.Parse(s); br != nil {
+			refs = append(refs, br.String())
+		}
+	}
+	add(ss.Signer)
+	add(ss.Permanode)
+	add(ss.Value)
+	add(ss.Target)
+	add(ss.Entries)
+	for _, m := range ss.Members {
+		add(m)
+	}
+	for _, cp := range ss.ContentParts {
+		if cp == nil {
+			continue
+		}
+		if cp.BlobRef != nil {
+			refs = append(refs, cp.BlobRef.String())
+		}
+		if cp.SubBlobRef != nil {
+			refs = append(refs, cp.SubBlobRef.String())
+		}
+	}
+	return refs
+}
+
+// graph is the reference graph of a storage, as built by a mark
+// phase.
+type graph struct {
+	sizes     map[string]int64    // every enumerated blob
+	refs      map[string][]string // schema blob -> blobs it references
+	reachable map[string]bool
+}
+
+func newGraph() *graph {
+	return &graph{
+		sizes:     make(map[string]int64),
+		refs:      make(map[string][]string),
+		reachable: make(map[string]bool),
+	}
+}
+
+// mark marks key and everything reachable from it.
+func (g *graph) mark(key string) {
+	stack := []string{key}
+	for len(stack) > 0 {
+		key := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if g.reachable[key] {
+			continue
+		}
+		g.reachable[key] = true
+		stack = append(stack, g.refs[key]...)
+	}
+}
+
+// Report is the outcome of one collection.
+type Report struct {
+	DryRun     bool
+	Start, End *time.Time
+
+	Blobs, Bytes int64 // enumerated
+	Roots        int64
+	Reachable    int64
+	Received     int64 // blobs received during the collection
+
+	Unreachable, UnreachableBytes int64
+	InGrace                       int64 // unreachable, but not for long enough
+
+	// Swept counts the blobs removed, or that would have been in a
+	// dry run. SweptRefs lists the first maxReported of them.
+	Swept, SweptBytes int64
+	SweptRefs         []string
+}
+
+// Collector garbage collects a storage.
+type Collector struct {
+	sto         blobserver.Storage
+	gracePeriod int64  // seconds
+	stateFile   string // or empty, to keep state only in memory
+
+	now func() int64 // seconds; time.Seconds, except in tests
+
+	runMu sync.Mutex // held while collecting
+
+	status errorutil.StatusLog
+
+	lk         sync.Mutex // protects following
+	removed    *sync.Cond // on lk; signaled when removing is cleared
+	running    bool
+	removing   map[string]bool    // blobs being removed by the sweep
+	received   []*blobref.BlobRef // during the current collection
+	candidates map[string]int64   // unreachable blobref -> first seen unreachable, in seconds
+	runs       int64
+	lastReport *Report
+	totalSwept int64
+}
+
+// NewCollector returns a Collector for sto, which sweeps blobs that
+// have been unreachable for gracePeriod seconds. If stateFile is
+// non-empty, the times blobs were first seen unreachable are kept
+// there across restarts; otherwise a restart resets them.
+func NewCollector(sto blobserver.Storage, gracePeriod int64, stateFile string) (*Collector, os.Error) {
+	c := &Collector{
+		sto:         sto,
+		gracePeriod: gracePeriod,
+		stateFile:   stateFile,
+		now:         time.Seconds,
+		candidates:  make(map[string]int64),
+	}
+	c.removed = sync.NewCond(&c.lk)
+	if stateFile != "" {
+		if err := c.loadState(); err != nil {
+			return nil, err
+		}
+	}
+	ch := make(chan *blobref.BlobRef, 100)
+	sto.GetBlobHub().RegisterListener(ch)
+	go c.listen(ch)
+	blobserver.AddStatObserver(sto, c)
+	return c, nil
+}
+
+func (c *Collector) listen(ch <-chan *blobref.BlobRef) {
+	for br := range ch {
+		c.lk.Lock()
+		if c.running {
+			c.received = append(c.received, br)
+		}
+		c.restartClock(br.String())
+		c.lk.Unlock()
+	}
+}
+
+// WillStat restarts the clocks of any of blobs awaiting their grace
+// period, first waiting for the sweep to finish removing any of them.
+// It implements blobserver.StatObserver.
+func (c *Collector) WillStat(blobs []*blobref.BlobRef) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for c.removingAny(blobs) {
+		c.removed.Wait()
+	}
+	for _, br := range blobs {
+		c.restartClock(br.String())
+	}
+}
+
+func (c *Collector) removingAny(blobs []*blobref.BlobRef) bool {
+	if c.removing == nil {
+		return false
+	}
+	for _, br := range blobs {
+		if c.removing[br.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// restartClock makes key, if it's a candidate, newly unreachable.
+// c.lk must be held.
+func (c *Collector) restartClock(key string) {
+	if _, ok := c.candidates[key]; ok {
+		c.candidates[key] = c.now()
+	}
+}
+
+// fetchSchema returns the schema blob br, or nil if br isn't one or
+// no longer exists.
+func (c *Collector) fetchSchema(br *blobref.BlobRef) (*gcSchema, os.Error) {
+	rc, _, err := c.sto.FetchStreaming(br)
+	if err == os.ENOENT {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, maxSchemaSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSchemaSize {
+		return nil, nil
+	}
+	return parseSchema(data), nil
+}
+
+// Collect runs one collection, removing nothing if dryRun is set.
+// Collections don't overlap; a second caller waits for the first.
+func (c *Collector) Collect(dryRun bool) (r *Report, err os.Error) {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	c.lk.Lock()
+	c.running = true
+	c.received = nil
+	c.lk.Unlock()
+	defer func() {
+		c.lk.Lock()
+		defer c.lk.Unlock()
+		c.running = false
+		c.received = nil
+		if err == nil {
+			c.runs++
+			c.totalSwept += r.Swept
+			c.lastReport = r
+		}
+	}()
+
+	r = &Report{DryRun: dryRun, Start: time.UTC()}
+	g := newGraph()
+	if err = c.mark(g, r); err != nil {
+		c.status.AddError(err)
+		return nil, err
+	}
+	if err = c.sweep(g, r); err != nil {
+		c.status.AddError(err)
+		return nil, err
+	}
+	if c.stateFile != "" {
+		if err := c.saveState(); err != nil {
+			// The sweep happened; only the grace clocks are lost.
+			c.status.AddError(fmt.Errorf("gc: saving state: %v", err))
+		}
+	}
+	r.End = time.UTC()
+	return r, nil
+}
+
+// mark enumerates the storage into g and marks everything reachable
+// from the roots.
+func (c *Collector) mark(g *graph, r *Report) os.Error {
+	var roots []string
+	err := blobserver.EnumerateAll(c.sto, func(sb blobref.SizedBlobRef) os.Error {
+		key := sb.BlobRef.String()
+		g.sizes[key] = sb.Size
+		r.Blobs++
+		r.Bytes += sb.Size
+		if r.Blobs%1000 == 0 {
+			c.status.SetStatus("Marking; enumerated %d blobs", r.Blobs)
+		}
+		if sb.Size > maxSchemaSize {
+			return nil
+		}
+		ss, err := c.fetchSchema(sb.BlobRef)
+		if err != nil {
+			// Can't tell what it references, so can't safely
+			// sweep anything.
+			return fmt.Errorf("gc: fetching %s: %v", key, err)
+		}
+		if ss == nil {
+			return nil
+		}
+		g.refs[key] = ss.refs()
+		if ss.isRoot() {
+			roots = append(roots, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.Roots = int64(len(roots))
+	for _, key := range roots {
+		g.mark(key)
+	}
+	return c.markReceived(g, r)
+}
+
+// markReceived marks the blobs received since it was last called,
+// and everything they reference.
+func (c *Collector) markReceived(g *graph, r *Report) os.Error {
+	c.lk.Lock()
+	received := c.received
+	c.received = nil
+	c.lk.Unlock()
+
+	for _, br := range received {
+		r.Received++
+		key := br.String()
+		ss, err := c.fetchSchema(br)
+		if err != nil {
+			return fmt.Errorf("gc: fetching newly received %s: %v", key, err)
+		}
+		if ss != nil {
+			g.refs[key] = ss.refs()
+		}
+		// Mark its references even if it was already marked, as
+		// they weren't known then.
+		g.reachable[key] = true
+		for _, ref := range g.refs[key] {
+			g.mark(ref)
+		}
+	}
+	return nil
+}
+
+// sweep removes the blobs in g that have been unreachable for longer
+// than the grace period.
+func (c *Collector) sweep(g *graph, r *Report) os.Error {
+	now := c.now()
+
+	c.lk.Lock()
+	var doomed []string
+	for key := range c.candidates {
+		if _, ok := g.sizes[key]; !ok || g.reachable[key] {
+			c.candidates[key] = 0, false
+		}
+	}
+	for key, size := range g.sizes {
+		if g.reachable[key] {
+			continue
+		}
+		r.Unreachable++
+		r.UnreachableBytes += size
+		first, ok := c.candidates[key]
+		if !ok {
+			c.candidates[key] = now
+			first = now
+		}
+		if now-first < c.gracePeriod {
+			r.InGrace++
+			continue
+		}
+		doomed = append(doomed, key)
+	}
+	c.lk.Unlock()
+	sort.SortStrings(doomed)
+
+	for len(doomed) > 0 {
+		n := len(doomed)
+		if n > sweepBatch {
+			n = sweepBatch
+		}
+		batch := doomed[:n]
+		doomed = doomed[n:]
+
+		// Anything uploaded since marking may reference the
+		// batch.
+		if err := c.markReceived(g, r); err != nil {
+			return err
+		}
+		// Statting or receiving a blob since it was doomed
+		// restarts its clock, which spares it.
+		var brs []*blobref.BlobRef
+		var keys []string
+		c.lk.Lock()
+		batchNow := c.now()
+		for _, key := range batch {
+			if g.reachable[key] {
+				continue
+			}
+			if first, ok := c.candidates[key]; ok && batchNow-first < c.gracePeriod {
+				r.InGrace++
+				continue
+			}
+			brs = append(brs, blobref.Parse(key))
+			keys = append(keys, key)
+		}
+		if !r.DryRun {
+			c.removing = make(map[string]bool)
+			for _, key := range keys {
+				c.removing[key] = true
+			}
+		}
+		c.lk.Unlock()
+		if r.DryRun {
+			c.status.SetStatus("Dry run; would sweep %d blobs so far", r.Swept+int64(len(keys)))
+		} else {
+			c.status.SetStatus("Sweeping; removed %d blobs so far", r.Swept)
+			err := c.sto.Remove(brs)
+			c.lk.Lock()
+			c.removing = nil
+			c.removed.Broadcast()
+			c.lk.Unlock()
+			if err != nil {
+				return fmt.Errorf("gc: removing %d blobs: %v", len(brs), err)
+			}
+		}
+		c.lk.Lock()
+		for _, key := range keys {
+			r.Swept++
+			r.SweptBytes += g.sizes[key]
+			if len(r.SweptRefs) < maxReported {
+				r.SweptRefs = append(r.SweptRefs, key)
+			}
+			if !r.DryRun {
+				c.candidates[key] = 0, false
+			}
+		}
+		c.lk.Unlock()
+	}
+
+	// Blobs marked just now aren't candidates anymore.
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for key := range c.candidates {
+		if g.reachable[key] {
+			c.candidates[key] = 0, false
+		}
+	}
+	r.Reachable = int64(len(g.sizes)) - r.Unreachable
+	return nil
+}
+
+// loadState reads the unreachable blobs' first-seen times from the
+// state file, if it exists.
+func (c *Collector) loadState() os.Error {
+	f, err := os.Open(c.stateFile)
+	if osutil.ErrorIsNoEnt(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&c.candidates); err != nil {
+		return fmt.Errorf("gc: bad state file %s: %v", c.stateFile, err)
+	}
+	return nil
+}
+
+// saveState writes the state file atomically.
+func (c *Collector) saveState() os.Error {
+	c.lk.Lock()
+	data, err := json.Marshal(c.candidates)
+	c.lk.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(c.stateFile), "."+filepath.Base(c.stateFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.stateFile)
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+// The signatures aren't checked, so any will do.
+const fakeSig = `"camliSigner": %q, "camliSig": "fake"`
+
+type graphBlobs struct {
+	all []*test.Blob
+
+	pubKey, chunk, file, set, dir, permanode, claim, kept, keep *test.Blob
+	garbage, orphanChunk, orphanFile                            *test.Blob
+}
+
+func (gb *graphBlobs) add(contents string, args ...interface{}) *test.Blob {
+	tb := &test.Blob{fmt.Sprintf(contents, args...)}
+	gb.all = append(gb.all, tb)
+	return tb
+}
+
+// newGraphBlobs returns a permanode whose camliContent is a
+// directory of one file, a kept blob, and three unreferenced blobs.
+func newGraphBlobs() *graphBlobs {
+	gb := new(graphBlobs)
+	gb.pubKey = gb.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\n...")
+	signer := gb.pubKey.BlobRef().String()
+
+	gb.chunk = gb.add("file contents")
+	gb.file = gb.add(`{"camliVersion": 1, "camliType": "file", "fileName": "foo.txt",
+ "contentParts": [{"blobRef": %q, "size": 13}]}`, gb.chunk.BlobRef())
+	gb.set = gb.add(`{"camliVersion": 1, "camliType": "static-set", "members": [%q]}`, gb.file.BlobRef())
+	gb.dir = gb.add(`{"camliVersion": 1, "camliType": "directory", "fileName": "dir", "entries": %q}`,
+		gb.set.BlobRef())
+	gb.permanode = gb.add(`{"camliVersion": 1, "camliType": "permanode", "random": "1", `+fakeSig+`}`, signer)
+	gb.claim = gb.add(`{"camliVersion": 1, "camliType": "claim", "permaNode": %q,
+ "claimType": "set-attribute", "attribute": "camliContent", "value": %q, `+fakeSig+`}`,
+		gb.permanode.BlobRef(), gb.dir.BlobRef(), signer)
+	gb.kept = gb.add("keep me")
+	gb.keep = gb.add(`{"camliVersion": 1, "camliType": "keep", "target": %q, `+fakeSig+`}`,
+		gb.kept.BlobRef(), signer)
+
+	gb.garbage = gb.add("garbage")
+	gb.orphanChunk = gb.add("orphaned contents")
+	gb.orphanFile = gb.add(`{"camliVersion": 1, "camliType": "file", "fileName": "bar.txt",
+ "contentParts": [{"blobRef": %q, "size": 17}]}`, gb.orphanChunk.BlobRef())
+	return gb
+}
+
+func (gb *graphBlobs) receive(t *testing.T, sto blobserver.Storage) {
+	for _, tb := range gb.all {
+		_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+}
+
+func has(sto *memory.Storage, tb *test.Blob) bool {
+	rc, _, err := sto.FetchStreaming(tb.BlobRef())
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
+type fakeClock int64
+
+func (c *fakeClock) now() int64 { return int64(*c) }
+
+func newTestCollector(t *testing.T, sto blobserver.Storage, gracePeriod int64, clock *fakeClock) *Collector {
+	c, err := NewCollector(sto, gracePeriod, "")
+	AssertNil(t, err, "NewCollector")
+	c.now = clock.now
+	return c
+}
+
+func TestReachability(t *testing.T) {
+	sto := memory.New(0)
+	gb := newGraphBlobs()
+	gb.receive(t, sto)
+	clock := fakeClock(1000)
+	c := newTestCollector(t, sto, 0, &clock)
+
+	r, err := c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, len(gb.all), int(r.Blobs), "blobs")
+	ExpectInt(t, 3, int(r.Roots), "roots")
+	ExpectInt(t, 3, int(r.Swept), "swept")
+	ExpectInt(t, len(gb.all)-3, sto.NumBlobs(), "blobs left")
+	for _, tb := range []*test.Blob{gb.garbage, gb.orphanChunk, gb.orphanFile} {
+		Expect(t, !has(sto, tb), "unreferenced blob swept: "+tb.Contents)
+	}
+	for _, tb := range []*test.Blob{gb.pubKey, gb.chunk, gb.file, gb.set, gb.dir, gb.kept} {
+		Expect(t, has(sto, tb), "referenced blob kept: "+tb.Contents)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	sto := memory.New(0)
+	gb := newGraphBlobs()
+	gb.receive(t, sto)
+	clock := fakeClock(1000)
+	c := newTestCollector(t, sto, 100, &clock)
+
+	r, err := c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 0, int(r.Swept), "swept when first seen")
+	ExpectInt(t, 3, int(r.InGrace), "in grace period")
+
+	// Referencing a blob resets its clock.
+	ref := &test.Blob{fmt.Sprintf(`{"camliVersion": 1, "camliType": "keep", "target": %q, `+fakeSig+`}`,
+		gb.garbage.BlobRef(), gb.pubKey.BlobRef())}
+	_, err = sto.ReceiveBlob(ref.BlobRef(), ref.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	clock = 1050
+	r, err = c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 0, int(r.Swept), "swept within grace period")
+	ExpectInt(t, 2, int(r.InGrace), "in grace period")
+	sto.Remove(ref.BlobRefSlice())
+
+	clock = 1100
+	r, err = c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 2, int(r.Swept), "swept after grace period")
+	ExpectInt(t, 1, int(r.InGrace), "re-referenced blob back in grace period")
+	Expect(t, has(sto, gb.garbage), "re-referenced blob kept")
+}
+
+func TestDryRun(t *testing.T) {
+	sto := memory.New(0)
+	gb := newGraphBlobs()
+	gb.receive(t, sto)
+	clock := fakeClock(1000)
+	c := newTestCollector(t, sto, 0, &clock)
+
+	r, err := c.Collect(true)
+	AssertNil(t, err, "Collect")
+	Expect(t, r.DryRun, "report is a dry run")
+	ExpectInt(t, 3, int(r.Swept), "would sweep")
+	ExpectInt(t, 3, len(r.SweptRefs), "would-sweep list")
+	ExpectInt(t, len(gb.all), sto.NumBlobs(), "blobs left after dry run")
+
+	r, err = c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 3, int(r.Swept), "swept")
+	ExpectInt(t, len(gb.all)-3, sto.NumBlobs(), "blobs left")
+}
+
+// uploadingStorage receives a blob just after it's first enumerated,
+// as if a client uploaded it during a collection.
+type uploadingStorage struct {
+	*memory.Storage
+	upload func()
+}
+
+func (s *uploadingStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	err := s.Storage.EnumerateBlobs(dest, after, limit, waitSeconds)
+	if s.upload != nil {
+		s.upload()
+		s.upload = nil
+	}
+	return err
+}
+
+func TestConcurrentUpload(t *testing.T) {
+	sto := &uploadingStorage{Storage: memory.New(0)}
+	chunk := &test.Blob{"uploaded before its file"}
+	_, err := sto.ReceiveBlob(chunk.BlobRef(), chunk.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	clock := fakeClock(1000)
+	c := newTestCollector(t, sto, 0, &clock)
+
+	file := &test.Blob{fmt.Sprintf(`{"camliVersion": 1, "camliType": "file",
+ "contentParts": [{"blobRef": %q, "size": 24}]}`, chunk.BlobRef())}
+	sto.upload = func() {
+		_, err := sto.ReceiveBlob(file.BlobRef(), file.Reader())
+		ExpectNil(t, err, "ReceiveBlob")
+		// The hub notifies asynchronously.
+		for i := 0; i < 100; i++ {
+			c.lk.Lock()
+			n := len(c.received)
+			c.lk.Unlock()
+			if n > 0 {
+				return
+			}
+			time.Sleep(10e6)
+		}
+		t.Errorf("collector not notified of upload")
+	}
+
+	r, err := c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 1, int(r.Received), "blobs received during collection")
+	ExpectInt(t, 0, int(r.Swept), "swept")
+	Expect(t, has(sto.Storage, chunk), "chunk referenced by new upload kept")
+	Expect(t, has(sto.Storage, file), "new upload kept")
+}
+
+func TestStatRestartsClock(t *testing.T) {
+	sto := memory.New(0)
+	gb := newGraphBlobs()
+	gb.receive(t, sto)
+	clock := fakeClock(1000)
+	c := newTestCollector(t, sto, 100, &clock)
+
+	r, err := c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 3, int(r.InGrace), "in grace period")
+
+	// A client stats the old garbage, finds it, and so only uploads
+	// something referencing it after the next collection.
+	clock = 1100
+	blobserver.NotifyWillStat(sto, gb.garbage.BlobRefSlice())
+	r, err = c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 2, int(r.Swept), "swept after grace period")
+	Expect(t, has(sto, gb.garbage), "statted blob kept")
+
+	ref := &test.Blob{fmt.Sprintf(`{"camliVersion": 1, "camliType": "keep", "target": %q, `+fakeSig+`}`,
+		gb.garbage.BlobRef(), gb.pubKey.BlobRef())}
+	_, err = sto.ReceiveBlob(ref.BlobRef(), ref.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	clock = 1200
+	r, err = c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 0, int(r.Unreachable), "unreachable once referenced")
+	Expect(t, has(sto, gb.garbage), "referenced blob kept")
+}
+
+// blockingStorage blocks in Remove until unblocked.
+type blockingStorage struct {
+	*memory.Storage
+	removing, unblock chan bool
+}
+
+func (s *blockingStorage) Remove(blobs []*blobref.BlobRef) os.Error {
+	s.removing <- true
+	<-s.unblock
+	return s.Storage.Remove(blobs)
+}
+
+func TestStatWaitsForRemoval(t *testing.T) {
+	sto := &blockingStorage{memory.New(0), make(chan bool), make(chan bool)}
+	garbage := &test.Blob{"garbage"}
+	_, err := sto.ReceiveBlob(garbage.BlobRef(), garbage.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	clock := fakeClock(1000)
+	c := newTestCollector(t, sto, 0, &clock)
+
+	collected := make(chan bool)
+	go func() {
+		_, err := c.Collect(false)
+		ExpectNil(t, err, "Collect")
+		collected <- true
+	}()
+	<-sto.removing
+
+	statted := make(chan bool)
+	go func() {
+		blobserver.NotifyWillStat(sto, garbage.BlobRefSlice())
+		statted <- true
+	}()
+	select {
+	case <-statted:
+		t.Fatalf("stat didn't wait for the removal")
+	case <-time.After(50e6):
+	}
+	sto.unblock <- true
+	<-statted
+	Expect(t, !has(sto.Storage, garbage), "blob removed before the stat")
+	<-collected
+}
+
+func TestStateFile(t *testing.T) {
+	stateFile := fmt.Sprintf("%s/camli-gc-state-%d", os.TempDir(), os.Getpid())
+	defer os.Remove(stateFile)
+
+	sto := memory.New(0)
+	gb := newGraphBlobs()
+	gb.receive(t, sto)
+	c, err := NewCollector(sto, 100, stateFile)
+	AssertNil(t, err, "NewCollector")
+	c.now = func() int64 { return 1000 }
+	r, err := c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 3, int(r.InGrace), "in grace period")
+
+	c, err = NewCollector(sto, 100, stateFile)
+	AssertNil(t, err, "NewCollector with state")
+	ExpectInt(t, 3, len(c.candidates), "candidates loaded from state file")
+	c.now = func() int64 { return 1100 }
+	r, err = c.Collect(false)
+	AssertNil(t, err, "Collect")
+	ExpectInt(t, 3, int(r.Swept), "swept after restart")
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"fmt"
+	"html"
+	"http"
+	"os"
+	"time"
+
+	"camli/auth"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+// handler serves a collector's status and last report, and runs a
+// collection on a POST (with "dryRun=1" for a dry run). Both need
+// admin credentials.
+// Example config:
+//
+//     "/gc/": {
+//         "handler": "gc",
+//         "handlerArgs": {
+//             "storage": "/bs/",
+//             "gracePeriod": 86400,
+//             "interval": 604800,
+//             "dryRun": true,
+//             "stateFile": "/var/lib/camlistore/gc-state.json"
+//         }
+//     },
+//
+// gracePeriod and interval are in seconds. An interval of 0, the
+// default, collects only when asked. With dryRun set, periodic
+// collections only report what they would sweep.
+type handler struct {
+	name   string
+	c      *Collector
+	dryRun bool // for periodic collections
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("gc", newHandlerFromConfig)
+}
+
+func newHandlerFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, os.Error) {
+	name := conf.RequiredString("storage")
+	gracePeriod := conf.OptionalInt("gracePeriod", defaultGracePeriod)
+	interval := conf.OptionalInt("interval", 0)
+	dryRun := conf.OptionalBool("dryRun", false)
+	stateFile := conf.OptionalString("stateFile", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if gracePeriod < 0 || interval < 0 {
+		return nil, os.NewError("gc: gracePeriod and interval can't be negative")
+	}
+	sto, err := ld.GetStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCollector(sto, int64(gracePeriod), stateFile)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler{name: name, c: c, dryRun: dryRun}
+	if interval > 0 {
+		go h.loop(int64(interval) * 1e9)
+	}
+	return h, nil
+}
+
+func (h *handler) loop(interval int64) {
+	for {
+		time.Sleep(interval)
+		h.c.Collect(h.dryRun)
+		h.c.status.SetStatus("Idle; next collection in %d seconds", interval/1e9)
+	}
+}
+
+func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.IsAuthorized(req) {
+		auth.SendDenied(rw, req)
+		return
+	}
+	if req.Method == "POST" {
+		dryRun := req.FormValue("dryRun") == "1"
+		go func() {
+			h.c.Collect(dryRun)
+			h.c.status.SetStatus("Idle")
+		}()
+		http.Redirect(rw, req, req.URL.Path, http.StatusFound)
+		return
+	}
+
+	c := h.c
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	fmt.Fprintf(rw, "<h1>%s Garbage Collection</h1><p><b>Current status: </b>%s</p>",
+		h.name, html.EscapeString(c.status.Status()))
+
+	fmt.Fprintf(rw, "<h2>Stats:</h2><ul>")
+	fmt.Fprintf(rw, "<li>Grace period: %d seconds</li>", c.gracePeriod)
+	fmt.Fprintf(rw, "<li>Collections: %d</li>", c.runs)
+	fmt.Fprintf(rw, "<li>Blobs swept: %d</li>", c.totalSwept)
+	fmt.Fprintf(rw, "<li>Unreachable blobs awaiting grace period: %d</li>", len(c.candidates))
+	fmt.Fprintf(rw, "<li>Errors: %d</li>", c.status.TotalErrors())
+	fmt.Fprintf(rw, "</ul>")
+
+	if r := c.lastReport; r != nil {
+		kind := "Collection"
+		verb := "Swept"
+		if r.DryRun {
+			kind = "Dry Run"
+			verb = "Would sweep"
+		}
+		fmt.Fprintf(rw, "<h2>Last %s:</h2><ul>", kind)
+		fmt.Fprintf(rw, "<li>Started: %s</li>", r.Start.Format(time.RFC3339))
+		fmt.Fprintf(rw, "<li>Finished: %s</li>", r.End.Format(time.RFC3339))
+		fmt.Fprintf(rw, "<li>Blobs: %d (%d bytes)</li>", r.Blobs, r.Bytes)
+		fmt.Fprintf(rw, "<li>Roots: %d</li>", r.Roots)
+		fmt.Fprintf(rw, "<li>Reachable: %d</li>", r.Reachable)
+		fmt.Fprintf(rw, "<li>Received during collection: %d</li>", r.Received)
+		fmt.Fprintf(rw, "<li>Unreachable: %d (%d bytes)</li>", r.Unreachable, r.UnreachableBytes)
+		fmt.Fprintf(rw, "<li>Unreachable but within grace period: %d</li>", r.InGrace)
+		fmt.Fprintf(rw, "<li>%s: %d (%d bytes)</li>", verb, r.Swept, r.SweptBytes)
+		fmt.Fprintf(rw, "</ul>")
+		if len(r.SweptRefs) > 0 {
+			fmt.Fprintf(rw, "<h2>%s:</h2><ul>", verb)
+			for _, key := range r.SweptRefs {
+				fmt.Fprintf(rw, "<li>%s</li>\n", key)
+			}
+			if r.Swept > int64(len(r.SweptRefs)) {
+				fmt.Fprintf(rw, "<li>... and %d more</li>\n", r.Swept-int64(len(r.SweptRefs)))
+			}
+			fmt.Fprintf(rw, "</ul>")
+		}
+	}
+
+	fmt.Fprintf(rw, "<form method='POST'><input type='hidden' name='dryRun' value='1'>"+
+		"<input type='submit' value='Dry run'></form>")
+	fmt.Fprintf(rw, "<form method='POST'><input type='submit' value='Collect'></form>")
+
+	c.status.WriteRecentErrorsHTML(rw)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"fmt"
+	"http"
+	"strings"
+)
+
+// immutableMaxAge is how long, in seconds, responses that never
+// change may be cached: a year, the most RFC 2616 allows.
+const immutableMaxAge = 365 * 24 * 60 * 60
+
+// ServeImmutable sets the caching headers of a response to req that
+// never changes, such as a blob named by its blobref: its strong etag
+// and a Cache-Control letting it be cached for a year. private
+// responses, to requests that needed auth, aren't stored by shared
+// caches.
+//
+// If req is a GET or HEAD whose If-None-Match header matches etag, it's
+// answered with 304 Not Modified and ServeImmutable returns true.
+func ServeImmutable(conn http.ResponseWriter, req *http.Request, etag string, private bool) (notModified bool) {
+	scope := "public"
+	if private {
+		scope = "private"
+	}
+	return serveCached(conn, req, etag, fmt.Sprintf("%s, max-age=%d, immutable", scope, immutableMaxAge))
+}
+
+// ServeRevalidated is ServeImmutable for a response that doesn't
+// change but may stop being allowed, such as a blob fetched via a
+// share that can be revoked or used up. Only the client may cache it,
+// and it must ask again before each use of its copy.
+func ServeRevalidated(conn http.ResponseWriter, req *http.Request, etag string) (notModified bool) {
+	return serveCached(conn, req, etag, "private, no-cache")
+}
+
+func serveCached(conn http.ResponseWriter, req *http.Request, etag, cacheControl string) (notModified bool) {
+	h := conn.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", cacheControl)
+	if (req.Method != "GET" && req.Method != "HEAD") || !etagMatches(req.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	conn.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header value matches
+// etag, comparing weakly as RFC 2616 says it's compared for GETs.
+func etagMatches(inm, etag string) bool {
+	if inm == "" {
+		return false
+	}
+	for _, v := range strings.Split(inm, ",", -1) {
+		v = strings.TrimSpace(v)
+		if v == "*" || opaqueTag(v) == opaqueTag(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// opaqueTag returns etag without its weakness indicator, if any.
+func opaqueTag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return etag[2:]
+	}
+	return etag
+}
@@ -193,6 +193,21 @@ func (jc Obj) requiredList(key string, required bool) []string {
 	return sl
 }
 
+// RequiredStringOrList returns the value of key, which may be either a
+// string or a list of strings, as a list.
+func (jc Obj) RequiredStringOrList(key string) []string {
+	jc.noteKnownKey(key)
+	ei, ok := jc[key]
+	if !ok {
+		jc.appendError(fmt.Errorf("Missing required config key %q (string or list of strings)", key))
+		return nil
+	}
+	if s, ok := ei.(string); ok {
+		return []string{s}
+	}
+	return jc.requiredList(key, true)
+}
+
 func (jc Obj) noteKnownKey(key string) {
 	_, ok := jc["_knownkeys"]
 	if !ok {
@@ -31,6 +31,11 @@ var prefixTable = []prefixEntry{
 	{[]byte("\xff\xd8\xff\xe1"), "image/jpeg"},
 	{[]byte("\xff\xd8\xff\xe0"), "image/jpeg"},
 	{[]byte{137, 'P', 'N', 'G', '\r', '\n', 26, 10}, "image/png"},
+	{[]byte("GIF87a"), "image/gif"},
+	{[]byte("GIF89a"), "image/gif"},
+	{[]byte("\x1f\x8b"), "application/x-gzip"},
+	{[]byte("BZh"), "application/x-bzip2"},
+	{[]byte("PK\x03\x04"), "application/zip"},
 	{[]byte("-----BEGIN PGP PUBLIC KEY BLOCK---"), "text/x-openpgp-public-key"},
 }
 
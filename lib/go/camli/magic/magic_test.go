@@ -29,6 +29,9 @@ type magicTest struct {
 var tests = []magicTest{
 	{"smile.jpg", "image/jpeg"},
 	{"smile.png", "image/png"},
+	{"smile.gif", "image/gif"},
+	{"foo.tar.gz", "application/x-gzip"},
+	{"foo.zip", "application/zip"},
 }
 
 func TestGolden(t *testing.T) {
@@ -14,61 +14,283 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package httprange implements HTTP byte range requests (RFC 2616,
+// section 14.35): parsing the Range and If-Range headers and sending
+// 206 Partial Content responses, as multipart/byteranges for more
+// than one range.
 package httprange
 
 import (
+	"fmt"
 	"http"
-	"regexp"
+	"io"
+	"io/ioutil"
+	"os"
+	"rand"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// Default is {0, -1} to read all of a file.
+// ErrUnsatisfiable is returned by Parse when none of the requested
+// ranges overlap the content.
+var ErrUnsatisfiable = os.NewError("httprange: requested range not satisfiable")
+
+// maxRanges is the most ranges served in one response. Requests for
+// more get the whole content instead, as do requests whose ranges add
+// up to more than the whole content.
+const maxRanges = 64
+
+// Range is a satisfiable byte range of some content.
 type Range struct {
-	skipBytes  int64
-	limitBytes int64 // or -1 to read all
+	Start  int64 // offset of the first byte
+	Length int64 // at least 1
 }
 
-func (rr *Range) SkipBytes() int64 {
-	return rr.skipBytes
+// ContentRange returns r's Content-Range header value, for content
+// of the given size.
+func (r Range) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
 }
 
-// LimitBytes reads the max number of bytes to read, or -1 for no limit.
-func (rr *Range) LimitBytes() int64 {
-	return rr.limitBytes
+// Parse parses the value of a Range header for content of the given
+// size. Suffix ranges ("-500") and open-ended ranges ("9500-") are
+// supported, and ranges extending past the end are truncated.
+//
+// A syntactically invalid header, which must be ignored, returns no
+// ranges and a nil error, as does an empty one. If the header is valid
+// but none of its ranges are satisfiable, the error is
+// ErrUnsatisfiable.
+func Parse(s string, size int64) ([]Range, os.Error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, nil
+	}
+	var ranges []Range
+	specs := 0
+	for _, spec := range strings.Split(s[len(b):], ",", -1) {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, nil
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if first == "" {
+			n, ok := parseOffset(last)
+			if !ok {
+				return nil, nil
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				continue
+			}
+			ranges = append(ranges, Range{size - n, n})
+			continue
+		}
+		start, ok := parseOffset(first)
+		if !ok {
+			return nil, nil
+		}
+		end := size - 1
+		if last != "" {
+			if end, ok = parseOffset(last); !ok || end < start {
+				return nil, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, Range{start, end - start + 1})
+	}
+	if specs == 0 {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiable
+	}
+	return ranges, nil
 }
 
-func (rr *Range) IsWholeFile() bool {
-	return rr.skipBytes == 0 && rr.limitBytes == -1
+// parseOffset parses a byte offset, which unlike what strconv
+// accepts has no sign.
+func parseOffset(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi64(s)
+	return n, err == nil
 }
 
-var WholeRange = &Range{0, -1}
+// FromRequest returns the ranges of content of the given size that
+// req asks for, or none if it asks for the whole content. etag and
+// modTime (in seconds) are the content's validators for the If-Range
+// header; either may be empty or zero if the content has none.
+func FromRequest(req *http.Request, size int64, etag string, modTime int64) ([]Range, os.Error) {
+	s := req.Header.Get("Range")
+	if s == "" || !ifRangeMatches(req.Header.Get("If-Range"), etag, modTime) {
+		return nil, nil
+	}
+	ranges, err := Parse(s, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+	total := int64(0)
+	for _, ra := range ranges {
+		total += ra.Length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
 
-var rangePattern = regexp.MustCompile(`bytes=([0-9]+)-([0-9]*)`)
+// ifRangeMatches reports whether an If-Range header value still
+// matches the content, in which case its Range header is honored. Only
+// strong validators match: weak ETags never do, and a date must be
+// the content's exact modification time.
+func ifRangeMatches(ir, etag string, modTime int64) bool {
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etag != "" && ir == etag
+	}
+	t, err := time.Parse(http.TimeFormat, ir)
+	return err == nil && modTime != 0 && t.Seconds() == modTime
+}
+
+// ServeContent replies to req with content of the given size, or with
+// the ranges of it the request asks for. The Content-Type header, if
+// already set, is that of the content; the other entity headers are
+// set here. etag and modTime are as for FromRequest, and a non-empty
+// etag is also sent as the ETag header.
+//
+// content is seeked to each range if it's an io.Seeker. Otherwise it's
+// read and discarded up to each range, and requests whose ranges are
+// out of order or overlapping get the whole content.
+//
+// The returned error is from reading content or writing the response,
+// after the headers were sent.
+func ServeContent(w http.ResponseWriter, req *http.Request, content io.Reader, size int64, etag string, modTime int64) os.Error {
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	ranges, err := FromRequest(req, size, etag, modTime)
+	if err != nil {
+		h.Set("Content-Range", "bytes */"+strconv.Itoa64(size))
+		http.Error(w, err.String(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	if _, ok := content.(io.Seeker); !ok && !ascending(ranges) {
+		ranges = nil
+	}
+
+	cr := &contentReader{r: content}
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Length", strconv.Itoa64(size))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "HEAD" {
+			return nil
+		}
+		return cr.copyRange(w, Range{0, size})
+	case 1:
+		ra := ranges[0]
+		h.Set("Content-Range", ra.ContentRange(size))
+		h.Set("Content-Length", strconv.Itoa64(ra.Length))
+		w.WriteHeader(http.StatusPartialContent)
+		if req.Method == "HEAD" {
+			return nil
+		}
+		return cr.copyRange(w, ra)
+	}
+
+	partType := h.Get("Content-Type")
+	if partType == "" {
+		partType = "application/octet-stream"
+	}
+	boundary := fmt.Sprintf("%016x%016x", rand.Int63(), rand.Int63())
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, ra := range ranges {
+		delim := "--" + boundary
+		if i > 0 {
+			delim = "\r\n" + delim
+		}
+		partHeaders[i] = fmt.Sprintf("%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n",
+			delim, partType, ra.ContentRange(size))
+		length += int64(len(partHeaders[i])) + ra.Length
+	}
+	trailer := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(trailer))
 
-func FromRequest(req *http.Request) *Range {
-	rrange := req.Header.Get("Range")
-	if rrange == "" {
-		return WholeRange
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", strconv.Itoa64(length))
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method == "HEAD" {
+		return nil
+	}
+	for i, ra := range ranges {
+		if _, err := io.WriteString(w, partHeaders[i]); err != nil {
+			return err
+		}
+		if err := cr.copyRange(w, ra); err != nil {
+			return err
+		}
 	}
-	return FromString(rrange)
+	_, err = io.WriteString(w, trailer)
+	return err
+}
+
+// ascending reports whether each range starts after the previous one
+// ends, so they can all be read in one pass.
+func ascending(ranges []Range) bool {
+	for i := 1; i < len(ranges); i++ {
+		prev := ranges[i-1]
+		if ranges[i].Start < prev.Start+prev.Length {
+			return false
+		}
+	}
+	return true
+}
+
+// contentReader reads ranges of content.
+type contentReader struct {
+	r   io.Reader
+	pos int64 // offset of r
 }
 
-func FromString(rrange string) *Range {
-	matches := rangePattern.FindStringSubmatch(rrange)
-	if len(matches) == 0 {
-		return WholeRange
-	}
-	skipBytes, _ := strconv.Atoi64(matches[1])
-	lastByteInclusive := int64(-1)
-	if len(matches[2]) > 0 {
-		lastByteInclusive, _ = strconv.Atoi64(matches[2])
-	}
-	limitBytes := int64(-1)
-	if lastByteInclusive != -1 {
-		limitBytes = lastByteInclusive - skipBytes + 1
-		if limitBytes < 0 {
-			limitBytes = 0
+func (cr *contentReader) copyRange(w io.Writer, ra Range) os.Error {
+	if ra.Start != cr.pos {
+		if s, ok := cr.r.(io.Seeker); ok {
+			if _, err := s.Seek(ra.Start, os.SEEK_SET); err != nil {
+				return err
+			}
+		} else if _, err := io.Copyn(ioutil.Discard, cr.r, ra.Start-cr.pos); err != nil {
+			return fmt.Errorf("httprange: skipping to offset %d: %v", ra.Start, err)
 		}
+		cr.pos = ra.Start
 	}
-	return &Range{skipBytes, limitBytes}
+	n, err := io.Copyn(w, cr.r, ra.Length)
+	cr.pos += n
+	return err
 }
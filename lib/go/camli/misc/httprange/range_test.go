@@ -17,9 +17,184 @@ limitations under the License.
 package httprange
 
 import (
+	"bytes"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io"
+	"mime"
+	"os"
 	"testing"
+	"time"
+
+	. "camli/test/asserts"
 )
 
-func TestRange(t *testing.T) {
+const content = "0123456789abcdefghij"
+
+type parseTest struct {
+	header string
+	ranges string // formatted
+	err    os.Error
+}
+
+var parseTests = []parseTest{
+	parseTest{"", "[]", nil},
+	parseTest{"bytes=0-4", "[{0 5}]", nil},
+	parseTest{"bytes=15-", "[{15 5}]", nil},
+	parseTest{"bytes=-3", "[{17 3}]", nil},
+	parseTest{"bytes=-30", "[{0 20}]", nil},
+	parseTest{"bytes=5-100", "[{5 15}]", nil},
+	parseTest{"bytes=0-0, 2-3", "[{0 1} {2 2}]", nil},
+	parseTest{"bytes=30-40, 0-1", "[{0 2}]", nil},
+	parseTest{"bytes=20-", "[]", ErrUnsatisfiable},
+	parseTest{"bytes=-0", "[]", ErrUnsatisfiable},
+	parseTest{"bytes=5-3", "[]", nil},
+	parseTest{"bytes=x-3", "[]", nil},
+	parseTest{"bytes=+1-2", "[]", nil},
+	parseTest{"bytes=", "[]", nil},
+	parseTest{"items=0-4", "[]", nil},
+}
+
+func TestParse(t *testing.T) {
+	for _, pt := range parseTests {
+		ranges, err := Parse(pt.header, int64(len(content)))
+		if ranges == nil {
+			ranges = []Range{}
+		}
+		ExpectString(t, pt.ranges, fmt.Sprintf("%v", ranges), "ranges of "+pt.header)
+		Expect(t, err == pt.err, "error of "+pt.header)
+	}
+}
+
+// seekBuffer is content that can be seeked.
+type seekBuffer struct {
+	data string
+	off  int64
+}
+
+func (b *seekBuffer) Read(p []byte) (int, os.Error) {
+	if b.off >= int64(len(b.data)) {
+		return 0, os.EOF
+	}
+	n := copy(p, b.data[b.off:])
+	b.off += int64(n)
+	return n, nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, os.Error) {
+	if whence != os.SEEK_SET {
+		return 0, os.EINVAL
+	}
+	b.off = offset
+	return offset, nil
+}
+
+// serve serves content, seekable or not, for a request with the
+// given headers.
+func serve(t *testing.T, seekable bool, header map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "http://example.com/blob", nil)
+	AssertNil(t, err, "NewRequest")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	var r io.Reader = bytes.NewBufferString(content)
+	if seekable {
+		r = &seekBuffer{data: content}
+	}
+	wr := httptest.NewRecorder()
+	wr.Code = 200
+	err = ServeContent(wr, req, r, int64(len(content)), `"etag"`, 1e9)
+	ExpectNil(t, err, "ServeContent")
+	return wr
+}
+
+func TestServeWhole(t *testing.T) {
+	wr := serve(t, false, nil)
+	ExpectInt(t, 200, wr.Code, "status")
+	ExpectString(t, content, wr.Body.String(), "body")
+	ExpectString(t, "bytes", wr.HeaderMap.Get("Accept-Ranges"), "Accept-Ranges")
+	ExpectString(t, "20", wr.HeaderMap.Get("Content-Length"), "Content-Length")
+	ExpectString(t, `"etag"`, wr.HeaderMap.Get("ETag"), "ETag")
+}
+
+func TestServeRange(t *testing.T) {
+	for _, seekable := range []bool{false, true} {
+		wr := serve(t, seekable, map[string]string{"Range": "bytes=5-9"})
+		ExpectInt(t, 206, wr.Code, "status")
+		ExpectString(t, "56789", wr.Body.String(), "body")
+		ExpectString(t, "bytes 5-9/20", wr.HeaderMap.Get("Content-Range"), "Content-Range")
+		ExpectString(t, "5", wr.HeaderMap.Get("Content-Length"), "Content-Length")
+	}
+}
+
+func TestServeUnsatisfiable(t *testing.T) {
+	wr := serve(t, false, map[string]string{"Range": "bytes=20-"})
+	ExpectInt(t, 416, wr.Code, "status")
+	ExpectString(t, "bytes */20", wr.HeaderMap.Get("Content-Range"), "Content-Range")
+}
+
+// expectMultipart checks that wr is a multipart/byteranges response
+// of the given parts, each formatted as "<Content-Range>:<data>".
+func expectMultipart(t *testing.T, wr *httptest.ResponseRecorder, parts []string) {
+	ExpectInt(t, 206, wr.Code, "status")
+	mediaType, params := mime.ParseMediaType(wr.HeaderMap.Get("Content-Type"))
+	AssertString(t, "multipart/byteranges", mediaType, "Content-Type")
+	boundary := params["boundary"]
+	Expect(t, boundary != "", "boundary")
+
+	var want bytes.Buffer
+	for i, part := range parts {
+		if i > 0 {
+			want.WriteString("\r\n")
+		}
+		var cr, data string
+		for j := 0; j < len(part); j++ {
+			if part[j] == ':' {
+				cr, data = part[:j], part[j+1:]
+				break
+			}
+		}
+		fmt.Fprintf(&want, "--%s\r\nContent-Type: application/octet-stream\r\nContent-Range: %s\r\n\r\n%s",
+			boundary, cr, data)
+	}
+	fmt.Fprintf(&want, "\r\n--%s--\r\n", boundary)
+	ExpectString(t, want.String(), wr.Body.String(), "body")
+	ExpectString(t, fmt.Sprintf("%d", want.Len()), wr.HeaderMap.Get("Content-Length"), "Content-Length")
+}
+
+func TestServeMultipart(t *testing.T) {
+	wr := serve(t, false, map[string]string{"Range": "bytes=0-1,-2"})
+	expectMultipart(t, wr, []string{"bytes 0-1/20:01", "bytes 18-19/20:ij"})
+}
+
+func TestServeOutOfOrder(t *testing.T) {
+	header := map[string]string{"Range": "bytes=10-11,0-1"}
+	wr := serve(t, true, header)
+	expectMultipart(t, wr, []string{"bytes 10-11/20:ab", "bytes 0-1/20:01"})
+
+	// Without seeking, the whole content is sent instead.
+	wr = serve(t, false, header)
+	ExpectInt(t, 200, wr.Code, "status without seeking")
+	ExpectString(t, content, wr.Body.String(), "body without seeking")
+}
+
+func TestServeTooMuch(t *testing.T) {
+	wr := serve(t, true, map[string]string{"Range": "bytes=0-15,5-19"})
+	ExpectInt(t, 200, wr.Code, "status of overlapping ranges")
+}
 
+func TestIfRange(t *testing.T) {
+	codes := map[string]int{
+		`"etag"`:   206,
+		`"other"`:  200,
+		`W/"etag"`: 200,
+		time.SecondsToUTC(1e9).Format(http.TimeFormat):     206,
+		time.SecondsToUTC(1e9 - 1).Format(http.TimeFormat): 200,
+		"garbage": 200,
+	}
+	for ifRange, code := range codes {
+		wr := serve(t, false, map[string]string{"Range": "bytes=0-1", "If-Range": ifRange})
+		ExpectInt(t, code, wr.Code, "status with If-Range "+ifRange)
+	}
 }
@@ -24,10 +24,11 @@ import (
 	"http"
 	"path/filepath"
 	"mime"
-	"strconv"
 	"strings"
 	"time"
 	"utf8"
+
+	"camli/misc/httprange"
 )
 
 // The FileSystem interface represents the virtual filesystem subset
@@ -139,9 +140,6 @@ func serveFile(w http.ResponseWriter, r *http.Request, name string, fs FileSyste
 	}
 
 	// serve file
-	size := d.Size
-	code := http.StatusOK
-
 	// If Content-Type isn't set, use the file's extension to find it.
 	if w.Header().Get("Content-Type") == "" {
 		ctype := mime.TypeByExtension(filepath.Ext(name))
@@ -161,37 +159,9 @@ func serveFile(w http.ResponseWriter, r *http.Request, name string, fs FileSyste
 		w.Header().Set("Content-Type", ctype)
 	}
 
-	// handle Content-Range header.
-	// TODO(adg): handle multiple ranges
-	ranges, err := parseRange(r.Header.Get("Range"), size)
-	if err == nil && len(ranges) > 1 {
-		err = os.NewError("multiple ranges not supported")
-	}
-	if err != nil {
-		http.Error(w, err.String(), http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
-	if len(ranges) == 1 {
-		ra := ranges[0]
-		if _, err := f.Seek(ra.start, os.SEEK_SET); err != nil {
-			http.Error(w, err.String(), http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
-		size = ra.length
-		code = http.StatusPartialContent
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, d.Size))
-	}
-
-	w.Header().Set("Accept-Ranges", "bytes")
-	if w.Header().Get("Content-Encoding") == "" {
-		w.Header().Set("Content-Length", strconv.Itoa64(size))
-	}
-
-	w.WriteHeader(code)
-
-	if r.Method != "HEAD" {
-		io.Copyn(w, f, size)
-	}
+	// Ranges are served by httprange; If-Range dates are compared
+	// against the Last-Modified time sent above.
+	httprange.ServeContent(w, r, f, d.Size, "", d.Mtime_ns/1e9)
 }
 
 // Heuristic: b is text if it is valid UTF-8 and doesn't
@@ -220,65 +190,6 @@ func isText(b []byte) bool {
 	return true
 }
 
-// httpRange specifies the byte range to be sent to the client.
-type httpRange struct {
-	start, length int64
-}
-
-// parseRange parses a Range header string as per RFC 2616.
-func parseRange(s string, size int64) ([]httpRange, os.Error) {
-	if s == "" {
-		return nil, nil // header not present
-	}
-	const b = "bytes="
-	if !strings.HasPrefix(s, b) {
-		return nil, os.NewError("invalid range")
-	}
-	var ranges []httpRange
-	for _, ra := range strings.Split(s[len(b):], ",", -1) {
-		i := strings.Index(ra, "-")
-		if i < 0 {
-			return nil, os.NewError("invalid range")
-		}
-		start, end := ra[:i], ra[i+1:]
-		var r httpRange
-		if start == "" {
-			// If no start is specified, end specifies the
-			// range start relative to the end of the file.
-			i, err := strconv.Atoi64(end)
-			if err != nil {
-				return nil, os.NewError("invalid range")
-			}
-			if i > size {
-				i = size
-			}
-			r.start = size - i
-			r.length = size - r.start
-		} else {
-			i, err := strconv.Atoi64(start)
-			if err != nil || i > size || i < 0 {
-				return nil, os.NewError("invalid range")
-			}
-			r.start = i
-			if end == "" {
-				// If no end is specified, range extends to end of the file.
-				r.length = size - r.start
-			} else {
-				i, err := strconv.Atoi64(end)
-				if err != nil || r.start > i {
-					return nil, os.NewError("invalid range")
-				}
-				if i >= size {
-					i = size - 1
-				}
-				r.length = i - r.start + 1
-			}
-		}
-		ranges = append(ranges, r)
-	}
-	return ranges, nil
-}
-
 // ServeFile replies to the request with the contents of the named file or directory.
 func ServeFile(w http.ResponseWriter, r *http.Request, name string) {
 	serveFile(w, r, name, osFileSystem{}, false)
@@ -30,6 +30,9 @@ import (
 	mysql "camli/third_party/github.com/Philio/GoMySQL"
 )
 
+// Indexer is a blobserver.Storage that only indexes the blobs it
+// receives, in MySQL. It can't fetch or remove them, so it isn't
+// checked with storagetest, which needs both (and a MySQL server).
 type Indexer struct {
 	*blobserver.SimpleBlobHubPartitionMap
 
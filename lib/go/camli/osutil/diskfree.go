@@ -0,0 +1,35 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package osutil
+
+import (
+	"os"
+)
+
+// diskFree is set by an OS-specific file where free space can be
+// found.
+var diskFree func(path string) (int64, os.Error)
+
+// DiskFree returns the number of bytes available to unprivileged
+// users on the filesystem holding path, or -1 if that can't be found
+// on this OS.
+func DiskFree(path string) (int64, os.Error) {
+	if diskFree == nil {
+		return -1, nil
+	}
+	return diskFree(path)
+}
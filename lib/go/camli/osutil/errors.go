@@ -0,0 +1,33 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package osutil
+
+import (
+	"os"
+)
+
+// ErrorIsNoEnt reports whether err, possibly wrapped in an
+// *os.PathError, is os.ENOENT.
+func ErrorIsNoEnt(err os.Error) bool {
+	if err == os.ENOENT {
+		return true
+	}
+	if perr, ok := err.(*os.PathError); ok {
+		return ErrorIsNoEnt(perr.Error)
+	}
+	return false
+}
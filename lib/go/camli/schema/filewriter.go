@@ -19,7 +19,6 @@ package schema
 import (
 	"bufio"
 	"bytes"
-	"crypto"
 	"fmt"
 	"io"
 	"log"
@@ -54,9 +53,9 @@ func WriteFileFromReader(bs blobserver.Storage, filename string, r io.Reader) (*
 			break
 		}
 
-		hash := crypto.SHA1.New()
+		hash := blobref.NewHash()
 		io.Copy(hash, bytes.NewBuffer(buf.Bytes()))
-		br := blobref.FromHash("sha1", hash)
+		br := blobref.FromPreferredHash(hash)
 		hasBlob, err := serverHasBlob(bs, br)
 		if err != nil {
 			return nil, err
@@ -89,7 +88,7 @@ func WriteFileFromReader(bs blobserver.Storage, filename string, r io.Reader) (*
 	if err != nil {
 		return nil, err
 	}
-	br := blobref.Sha1FromString(json)
+	br := blobref.FromString(json)
 	sb, err := bs.ReceiveBlob(br, strings.NewReader(json))
 	if err != nil {
 		return nil, err
@@ -140,7 +139,7 @@ func WriteFileFromReaderRolling(bs blobserver.Storage, filename string, r io.Rea
 	buf := new(bytes.Buffer)
 
 	uploadString := func(s string) (*blobref.BlobRef, os.Error) {
-		br := blobref.Sha1FromString(s)
+		br := blobref.FromString(s)
 		hasIt, err := serverHasBlob(bs, br)
 		if err != nil {
 			return nil, err
@@ -19,7 +19,6 @@ package schema
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"json"
@@ -157,17 +156,17 @@ func (d *defaultStatHasher) Lstat(fileName string) (*os.FileInfo, os.Error) {
 }
 
 func (d *defaultStatHasher) Hash(fileName string) (*blobref.BlobRef, os.Error) {
-	s1 := sha1.New()
+	h := blobref.NewHash()
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	_, err = io.Copy(s1, file)
+	_, err = io.Copy(h, file)
 	if err != nil {
 		return nil, err
 	}
-	return blobref.FromHash("sha1", s1), nil
+	return blobref.FromPreferredHash(h), nil
 }
 
 type StaticSet struct {
@@ -340,6 +339,28 @@ func NewShareRef(authType string, target *blobref.BlobRef, transitive bool) map[
 	return m
 }
 
+// SetShareExpiration sets when a share made by NewShareRef expires,
+// in nanoseconds since the epoch.
+func SetShareExpiration(m map[string]interface{}, epochnanos int64) {
+	m["expires"] = RFC3339FromNanos(epochnanos)
+}
+
+// SetShareMaxUses sets how many times a share made by NewShareRef may
+// be opened, by fetching its target.
+func SetShareMaxUses(m map[string]interface{}, n int) {
+	m["maxUses"] = n
+}
+
+// NewRevokeClaim returns a claim revoking a share. Servers honor it
+// once it's signed by one of their owners.
+func NewRevokeClaim(share *blobref.BlobRef) map[string]interface{} {
+	m := newCamliMap(1, "claim")
+	m["claimType"] = "revoke"
+	m["target"] = share.String()
+	m["claimDate"] = RFC3339FromNanos(time.Nanoseconds())
+	return m
+}
+
 func NewClaim(permaNode *blobref.BlobRef, claimType string) map[string]interface{} {
 	m := newCamliMap(1, "claim")
 	m["permaNode"] = permaNode.String()
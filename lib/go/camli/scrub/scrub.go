@@ -0,0 +1,330 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scrub registers the "scrub" handler, which slowly re-reads
+// every blob of a storage and checks it against its digest, to find
+// bit rot before a client does.
+//
+// Corrupt blobs are moved to the storage's quarantine (so the storage
+// must be a blobserver.Quarantiner, as localdisk and diskpacked are)
+// and, if a replica is configured, replaced by a good copy from it.
+//
+// Example config:
+//
+//     "/scrub/": {
+//         "handler": "scrub",
+//         "handlerArgs": {
+//             "storage": "/bs/",
+//             "replica": "/s3/",
+//             "bytesPerSecond": 1048576,
+//             "interval": 86400
+//         }
+//     },
+//
+// bytesPerSecond is the I/O budget, or 0 for none. interval is the
+// time between the end of one pass over the storage and the start of
+// the next, in seconds.
+package scrub
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/errorutil"
+	"camli/jsonconfig"
+)
+
+const (
+	defaultBytesPerSecond = 1 << 20
+	defaultInterval       = 24 * 60 * 60 // seconds
+
+	scrubBatch     = 1000
+	maxCorruptions = 20 // listed on the status page
+)
+
+// corruption records a corrupt blob and what was done about it.
+type corruption struct {
+	t       *time.Time
+	blobRef string
+	outcome string
+}
+
+// Scrubber checks the blobs of a storage against their digests.
+type Scrubber struct {
+	name        string
+	sto         blobserver.Storage
+	q           blobserver.Quarantiner
+	replicaName string
+	replica     blobserver.Storage // or nil
+
+	bytesPerSecond int64 // or 0 for unlimited
+	interval       int64 // nanoseconds
+
+	now   func() int64 // nanoseconds; time.Nanoseconds, except in tests
+	sleep func(int64)
+
+	status errorutil.StatusLog
+
+	lk            sync.Mutex // protects following
+	passes        int64      // completed passes
+	lastPassStart *time.Time // or nil
+	lastPassEnd   *time.Time // or nil
+	position      string     // last blob checked in the current pass
+	checked       int64      // blobs checked in the current or last pass
+	checkedBytes  int64
+	totalChecked  int64
+	totalBytes    int64
+	skipped       int64 // blobs with unsupported digests, ever
+	corrupt       int64 // corrupt blobs found, ever
+	quarantined   int64
+	repaired      int64
+	corruptions   []corruption // most recent
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("scrub", newFromConfig)
+}
+
+func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, os.Error) {
+	name := conf.RequiredString("storage")
+	replicaName := conf.OptionalString("replica", "")
+	bytesPerSecond := conf.OptionalInt("bytesPerSecond", defaultBytesPerSecond)
+	interval := conf.OptionalInt("interval", defaultInterval)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	var replica blobserver.Storage
+	if replicaName != "" {
+		if replica, err = ld.GetStorage(replicaName); err != nil {
+			return nil, err
+		}
+	}
+	s, err := newScrubber(name, sto, replicaName, replica)
+	if err != nil {
+		return nil, err
+	}
+	s.bytesPerSecond = int64(bytesPerSecond)
+	s.interval = int64(interval) * 1e9
+	go s.loop()
+	return s, nil
+}
+
+func newScrubber(name string, sto blobserver.Storage, replicaName string, replica blobserver.Storage) (*Scrubber, os.Error) {
+	q, ok := sto.(blobserver.Quarantiner)
+	if !ok {
+		return nil, fmt.Errorf("scrub: prefix %s (type %T) doesn't support quarantining corrupt blobs", name, sto)
+	}
+	return &Scrubber{
+		name:           name,
+		sto:            sto,
+		q:              q,
+		replicaName:    replicaName,
+		replica:        replica,
+		bytesPerSecond: defaultBytesPerSecond,
+		interval:       defaultInterval * 1e9,
+		now:            time.Nanoseconds,
+		sleep:          func(ns int64) { time.Sleep(ns) },
+	}, nil
+}
+
+func (s *Scrubber) addCorruption(br *blobref.BlobRef, outcome string) {
+	log.Printf("scrub: corrupt blob %s in %s: %s", br, s.name, outcome)
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.corruptions = append(s.corruptions, corruption{time.UTC(), br.String(), outcome})
+	if len(s.corruptions) > maxCorruptions {
+		copy(s.corruptions[:maxCorruptions], s.corruptions[1:maxCorruptions+1])
+		s.corruptions = s.corruptions[:maxCorruptions]
+	}
+}
+
+func (s *Scrubber) incr(v *int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	*v++
+}
+
+func (s *Scrubber) loop() {
+	for {
+		s.pass()
+		s.status.SetStatus("Idle; next pass in %d seconds", s.interval/1e9)
+		s.sleep(s.interval)
+	}
+}
+
+// budget paces reads to an average number of bytes per second.
+type budget struct {
+	s     *Scrubber
+	start int64 // nanoseconds
+	n     int64 // bytes read since start
+}
+
+func (b *budget) spend(n int) {
+	rate := b.s.bytesPerSecond
+	if rate <= 0 {
+		return
+	}
+	b.n += int64(n)
+	due := b.start + int64(float64(b.n)/float64(rate)*1e9)
+	if d := due - b.s.now(); d > 0 {
+		b.s.sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	b *budget
+}
+
+func (tr *throttledReader) Read(p []byte) (n int, err os.Error) {
+	n, err = tr.r.Read(p)
+	tr.b.spend(n)
+	return
+}
+
+// pass checks every blob in the storage once.
+func (s *Scrubber) pass() {
+	s.lk.Lock()
+	s.lastPassStart = time.UTC()
+	s.position = ""
+	s.checked, s.checkedBytes = 0, 0
+	s.lk.Unlock()
+
+	b := &budget{s: s, start: s.now()}
+	after := ""
+	for {
+		s.status.SetStatus("Enumerating blobs after %q", after)
+		sbs, err := s.batch(after)
+		if err != nil {
+			s.status.AddError(fmt.Errorf("scrub: enumerating %s: %v", s.name, err))
+			return
+		}
+		if len(sbs) == 0 {
+			break
+		}
+		s.status.SetStatus("Checking blobs after %q", after)
+		for _, sb := range sbs {
+			s.check(sb, b)
+		}
+		after = sbs[len(sbs)-1].BlobRef.String()
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.passes++
+	s.lastPassEnd = time.UTC()
+}
+
+// batch returns the next blobs to check. They're enumerated up front,
+// rather than checked as they're enumerated, so a slow scrub doesn't
+// hold an enumeration open.
+func (s *Scrubber) batch(after string) ([]blobref.SizedBlobRef, os.Error) {
+	ch := make(chan blobref.SizedBlobRef, 16)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- s.sto.EnumerateBlobs(ch, after, scrubBatch, 0)
+	}()
+	var sbs []blobref.SizedBlobRef
+	for sb := range ch {
+		sbs = append(sbs, sb)
+	}
+	return sbs, <-errch
+}
+
+// check re-reads a blob and compares it to its digest.
+func (s *Scrubber) check(sb blobref.SizedBlobRef, b *budget) {
+	br := sb.BlobRef
+	hash := br.Hash()
+	if hash == nil {
+		s.incr(&s.skipped)
+		return
+	}
+	rc, size, err := s.sto.FetchStreaming(br)
+	if err == os.ENOENT {
+		// Removed since it was enumerated.
+		return
+	}
+	if err != nil {
+		s.status.AddError(fmt.Errorf("scrub: fetching %s: %v", br, err))
+		return
+	}
+	n, err := io.Copy(hash, &throttledReader{rc, b})
+	rc.Close()
+	if err != nil {
+		// Likely a failing disk, but not known to be corrupt,
+		// so leave it be.
+		s.status.AddError(fmt.Errorf("scrub: reading %s: %v", br, err))
+		return
+	}
+
+	s.lk.Lock()
+	s.position = br.String()
+	s.checked++
+	s.checkedBytes += n
+	s.totalChecked++
+	s.totalBytes += n
+	s.lk.Unlock()
+
+	switch {
+	case n != size:
+		s.repair(br, fmt.Sprintf("read %d bytes; expected %d", n, size))
+	case !br.HashMatches(hash):
+		s.repair(br, "digest mismatch")
+	}
+}
+
+// repair quarantines a corrupt blob and, if there's a replica,
+// replaces it with the replica's copy.
+func (s *Scrubber) repair(br *blobref.BlobRef, problem string) {
+	s.incr(&s.corrupt)
+	if err := s.q.Quarantine(br); err != nil {
+		s.status.AddError(fmt.Errorf("scrub: quarantining %s: %v", br, err))
+		s.addCorruption(br, problem+"; quarantine failed")
+		return
+	}
+	s.incr(&s.quarantined)
+	if s.replica == nil {
+		s.addCorruption(br, problem+"; quarantined")
+		return
+	}
+	rc, _, err := s.replica.FetchStreaming(br)
+	if err != nil {
+		s.status.AddError(fmt.Errorf("scrub: fetching %s from replica %s: %v", br, s.replicaName, err))
+		s.addCorruption(br, problem+"; quarantined; re-fetch failed")
+		return
+	}
+	defer rc.Close()
+	// ReceiveBlob checks the digest, so a bad replica copy is
+	// rejected too.
+	if _, err := s.sto.ReceiveBlob(br, rc); err != nil {
+		s.status.AddError(fmt.Errorf("scrub: receiving %s from replica %s: %v", br, s.replicaName, err))
+		s.addCorruption(br, problem+"; quarantined; re-fetch failed")
+		return
+	}
+	s.incr(&s.repaired)
+	s.addCorruption(br, problem+"; quarantined; re-fetched from "+s.replicaName)
+}
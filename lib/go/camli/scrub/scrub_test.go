@@ -0,0 +1,136 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scrub
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"camli/blobref"
+	"camli/blobserver/memory"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+// rottingStorage is a memory storage some of whose blobs read back
+// with a flipped bit.
+type rottingStorage struct {
+	*memory.Storage
+	rotten      map[string]bool
+	quarantined []string
+}
+
+func newRottingStorage() *rottingStorage {
+	return &rottingStorage{Storage: memory.New(0), rotten: make(map[string]bool)}
+}
+
+func (s *rottingStorage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	rc, size, err := s.Storage.FetchStreaming(br)
+	if err != nil || !s.rotten[br.String()] {
+		return rc, size, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	data[0] ^= 1
+	return ioutil.NopCloser(bytes.NewBuffer(data)), size, nil
+}
+
+func (s *rottingStorage) Quarantine(br *blobref.BlobRef) os.Error {
+	s.quarantined = append(s.quarantined, br.String())
+	s.rotten[br.String()] = false, false
+	return s.Storage.Remove([]*blobref.BlobRef{br})
+}
+
+var testBlobs = []*test.Blob{
+	&test.Blob{"0123456789"},
+	&test.Blob{"abcdefghij"},
+	&test.Blob{"ABCDEFGHIJ"},
+}
+
+func newTestScrubber(t *testing.T, replica *memory.Storage) (*Scrubber, *rottingStorage) {
+	sto := newRottingStorage()
+	for _, tb := range testBlobs {
+		_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+	sto.rotten[testBlobs[1].BlobRef().String()] = true
+
+	var s *Scrubber
+	var err os.Error
+	if replica != nil {
+		s, err = newScrubber("/bs/", sto, "/replica/", replica)
+	} else {
+		s, err = newScrubber("/bs/", sto, "", nil)
+	}
+	AssertNil(t, err, "newScrubber")
+	s.bytesPerSecond = 0
+	return s, sto
+}
+
+func TestQuarantine(t *testing.T) {
+	s, sto := newTestScrubber(t, nil)
+	s.pass()
+	ExpectInt(t, 1, int(s.passes), "passes")
+	ExpectInt(t, 3, int(s.checked), "blobs checked")
+	ExpectInt(t, 1, int(s.corrupt), "corrupt blobs")
+	ExpectInt(t, 1, int(s.quarantined), "quarantined blobs")
+	ExpectInt(t, 0, int(s.repaired), "repaired blobs")
+	ExpectInt(t, 1, len(sto.quarantined), "blobs quarantined by storage")
+	ExpectString(t, testBlobs[1].BlobRef().String(), sto.quarantined[0], "quarantined blob")
+	ExpectInt(t, 2, sto.NumBlobs(), "blobs left")
+}
+
+func TestRepair(t *testing.T) {
+	replica := memory.New(0)
+	for _, tb := range testBlobs {
+		_, err := replica.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob to replica")
+	}
+	s, sto := newTestScrubber(t, replica)
+	s.pass()
+	ExpectInt(t, 1, int(s.quarantined), "quarantined blobs")
+	ExpectInt(t, 1, int(s.repaired), "repaired blobs")
+	ExpectInt(t, 3, sto.NumBlobs(), "blobs after repair")
+
+	rc, _, err := sto.FetchStreaming(testBlobs[1].BlobRef())
+	AssertNil(t, err, "fetching repaired blob")
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	ExpectString(t, testBlobs[1].Contents, string(data), "repaired contents")
+
+	s.pass()
+	ExpectInt(t, 1, int(s.corrupt), "corrupt blobs after second pass")
+}
+
+func TestBudget(t *testing.T) {
+	s, _ := newTestScrubber(t, nil)
+	clock := int64(1e9)
+	s.now = func() int64 { return clock }
+	s.sleep = func(ns int64) { clock += ns }
+	s.bytesPerSecond = 10
+
+	s.pass()
+	ExpectInt(t, 3, int(s.checked), "blobs checked")
+	// 30 bytes at 10 bytes/second.
+	Expect(t, clock == 4e9, "clock after pass")
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scrub
+
+import (
+	"fmt"
+	"html"
+	"http"
+	"time"
+
+	"camli/auth"
+)
+
+func (s *Scrubber) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.IsAuthorized(req) {
+		auth.SendDenied(rw, req)
+		return
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	fmt.Fprintf(rw, "<h1>%s Scrub Status</h1><p><b>Current status: </b>%s</p>",
+		s.name, html.EscapeString(s.status.Status()))
+
+	fmt.Fprintf(rw, "<h2>Stats:</h2><ul>")
+	if s.bytesPerSecond > 0 {
+		fmt.Fprintf(rw, "<li>I/O budget: %d bytes/second</li>", s.bytesPerSecond)
+	}
+	if s.replica != nil {
+		fmt.Fprintf(rw, "<li>Repairing from: %s</li>", s.replicaName)
+	}
+	fmt.Fprintf(rw, "<li>Completed passes: %d</li>", s.passes)
+	if s.lastPassStart != nil {
+		fmt.Fprintf(rw, "<li>Current or last pass started: %s</li>", s.lastPassStart.Format(time.RFC3339))
+	}
+	if s.lastPassEnd != nil {
+		fmt.Fprintf(rw, "<li>Last pass ended: %s</li>", s.lastPassEnd.Format(time.RFC3339))
+	}
+	fmt.Fprintf(rw, "<li>Checked in current or last pass: %d blobs, %d bytes</li>", s.checked, s.checkedBytes)
+	if s.position != "" {
+		fmt.Fprintf(rw, "<li>Last blob checked: %s</li>", s.position)
+	}
+	fmt.Fprintf(rw, "<li>Checked ever: %d blobs, %d bytes</li>", s.totalChecked, s.totalBytes)
+	fmt.Fprintf(rw, "<li>Skipped (unsupported digest): %d</li>", s.skipped)
+	fmt.Fprintf(rw, "<li>Corrupt: %d</li>", s.corrupt)
+	fmt.Fprintf(rw, "<li>Quarantined: %d</li>", s.quarantined)
+	fmt.Fprintf(rw, "<li>Repaired: %d</li>", s.repaired)
+	fmt.Fprintf(rw, "<li>Errors: %d</li>", s.status.TotalErrors())
+	fmt.Fprintf(rw, "</ul>")
+
+	if len(s.corruptions) > 0 {
+		fmt.Fprintf(rw, "<h2>Recent Corrupt Blobs:</h2><ul>")
+		for _, c := range s.corruptions {
+			fmt.Fprintf(rw, "<li>%s: %s: %s</li>\n",
+				c.t.Format(time.RFC3339), c.blobRef, html.EscapeString(c.outcome))
+		}
+		fmt.Fprintf(rw, "</ul>")
+	}
+
+	s.status.WriteRecentErrorsHTML(rw)
+}
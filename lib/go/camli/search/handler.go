@@ -26,6 +26,7 @@ import (
 	"sync"
 	"time"
 
+	"camli/auth"
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/jsonconfig"
@@ -77,6 +78,10 @@ func jsonMapList() []map[string]interface{} {
 }
 
 func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.Allowed(req, auth.ScopeSearch, auth.ScopeRead) {
+		auth.SendDenied(rw, req)
+		return
+	}
 	_ = req.Header.Get("X-PrefixHandler-PathBase")
 	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
 
@@ -0,0 +1,184 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webserver
+
+import (
+	"http"
+	"os"
+	"strconv"
+	"strings"
+
+	"camli/jsonconfig"
+)
+
+// CORSPolicy says which cross-origin requests from browser apps are
+// allowed, per the Cross-Origin Resource Sharing spec
+// (http://www.w3.org/TR/cors/).
+type CORSPolicy struct {
+	AllowedOrigins   []string // such as "https://app.example.com", or "*" for any
+	AllowedMethods   []string
+	AllowedHeaders   []string // request headers apps may set
+	ExposedHeaders   []string // response headers apps may read
+	AllowCredentials bool     // whether cookies and HTTP auth are sent; not with "*"
+	MaxAgeSeconds    int      // how long browsers may cache preflight answers
+}
+
+var (
+	DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT"}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type", "Range", "If-Range", "If-None-Match"}
+
+	// DefaultCORSExposedHeaders are those of blob GET and upload
+	// responses, whose 303 redirects go to their Location.
+	DefaultCORSExposedHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range",
+		"ETag", "Location", "X-Camli-Contents"}
+)
+
+const defaultCORSMaxAgeSeconds = 600
+
+// NewCORSPolicyFromConfig returns the policy of a "cors" config
+// object. Only "allowedOrigins" is required; the lists default to
+// DefaultCORSMethods, DefaultCORSHeaders and
+// DefaultCORSExposedHeaders. "allowCredentials" can't be set with an
+// origin of "*", as any web page could then act with the user's
+// credentials.
+func NewCORSPolicyFromConfig(conf jsonconfig.Obj) (*CORSPolicy, os.Error) {
+	p := &CORSPolicy{
+		AllowedOrigins:   conf.RequiredList("allowedOrigins"),
+		AllowedMethods:   conf.OptionalList("allowedMethods"),
+		AllowedHeaders:   conf.OptionalList("allowedHeaders"),
+		ExposedHeaders:   conf.OptionalList("exposedHeaders"),
+		AllowCredentials: conf.OptionalBool("allowCredentials", false),
+		MaxAgeSeconds:    conf.OptionalInt("maxAgeSeconds", defaultCORSMaxAgeSeconds),
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if p.AllowCredentials && containsFold(p.AllowedOrigins, "", "*") {
+		return nil, os.NewError(`cors: "allowCredentials" needs its "allowedOrigins" listed, not "*"`)
+	}
+	if p.AllowedMethods == nil {
+		p.AllowedMethods = DefaultCORSMethods
+	}
+	if p.AllowedHeaders == nil {
+		p.AllowedHeaders = DefaultCORSHeaders
+	}
+	if p.ExposedHeaders == nil {
+		p.ExposedHeaders = DefaultCORSExposedHeaders
+	}
+	return p, nil
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	return origin != "" && containsFold(p.AllowedOrigins, origin, "*")
+}
+
+// containsFold reports whether list contains s or wildcard, ignoring
+// case.
+func containsFold(list []string, s, wildcard string) bool {
+	for _, v := range list {
+		if v == wildcard || strings.ToLower(v) == strings.ToLower(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPreflight reports whether req is a preflight request, asking
+// whether a cross-origin request may be made.
+func IsPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// varyOrigin marks the response as depending on the request's Origin,
+// as every response under a CORS policy does: the allowed origin is
+// echoed rather than "*", which isn't allowed with credentials, and
+// other origins get no CORS headers. Without it, a cache could give a
+// response meant for one origin, or none, to another.
+func varyOrigin(rw http.ResponseWriter) {
+	rw.Header().Add("Vary", "Origin")
+}
+
+// setOriginHeaders sets the headers allowing origin common to
+// preflight and actual responses.
+func (p *CORSPolicy) setOriginHeaders(rw http.ResponseWriter, origin string) {
+	h := rw.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// ServePreflight answers a preflight request, allowing it if its
+// origin, method and headers all are.
+func (p *CORSPolicy) ServePreflight(rw http.ResponseWriter, req *http.Request) {
+	varyOrigin(rw)
+	origin := req.Header.Get("Origin")
+	allowed := p.allowsOrigin(origin) &&
+		containsFold(p.AllowedMethods, req.Header.Get("Access-Control-Request-Method"), "")
+	for _, h := range strings.Split(req.Header.Get("Access-Control-Request-Headers"), ",", -1) {
+		if h = strings.TrimSpace(h); h != "" && !containsFold(p.AllowedHeaders, h, "*") {
+			allowed = false
+		}
+	}
+	if !allowed {
+		http.Error(rw, "Cross-origin request not allowed.", http.StatusForbidden)
+		return
+	}
+	p.setOriginHeaders(rw, origin)
+	h := rw.Header()
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+	h.Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAgeSeconds))
+	h.Set("Content-Length", "0")
+	rw.WriteHeader(http.StatusOK)
+}
+
+// SetHeaders sets the CORS headers of the response to an actual
+// (not preflight) request, if its origin is allowed, and in any case
+// its Vary header.
+func (p *CORSPolicy) SetHeaders(rw http.ResponseWriter, req *http.Request) {
+	varyOrigin(rw)
+	origin := req.Header.Get("Origin")
+	if !p.allowsOrigin(origin) {
+		return
+	}
+	p.setOriginHeaders(rw, origin)
+	rw.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+}
+
+// HandleCORS applies policy to requests under prefix, with or without
+// an Origin. It's a pre-mux handler, so preflight requests are
+// answered before the handlers, and their auth checks, see them.
+// Policies registered first take precedence, so those of longer
+// prefixes should be registered first.
+func (s *Server) HandleCORS(prefix string, policy *CORSPolicy) {
+	rest := len(s.premux) + 1 // pre-mux handlers after this one
+	s.RegisterPreMux(func(req *http.Request) (http.HandlerFunc, bool) {
+		if !strings.HasPrefix(req.URL.Path, prefix) {
+			return nil, false
+		}
+		return func(rw http.ResponseWriter, req *http.Request) {
+			if IsPreflight(req) {
+				policy.ServePreflight(rw, req)
+				return
+			}
+			policy.SetHeaders(rw, req)
+			s.serve(rw, req, s.premux[rest:])
+		}, true
+	})
+}
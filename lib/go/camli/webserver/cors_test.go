@@ -0,0 +1,140 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webserver
+
+import (
+	"http"
+	"http/httptest"
+	"testing"
+
+	"camli/jsonconfig"
+	. "camli/test/asserts"
+)
+
+func newCORSServer(t *testing.T) *Server {
+	s := New()
+	s.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	bs, err := NewCORSPolicyFromConfig(jsonconfig.Obj{
+		"allowedOrigins": []interface{}{"https://app.example.com"},
+	})
+	AssertNil(t, err, "bs policy")
+	any, err := NewCORSPolicyFromConfig(jsonconfig.Obj{
+		"allowedOrigins": []interface{}{"*"},
+		"allowedMethods": []interface{}{"GET"},
+	})
+	AssertNil(t, err, "any policy")
+	s.HandleCORS("/bs/", bs)
+	s.HandleCORS("/", any)
+	return s
+}
+
+func serveCORS(s *Server, method, path string, header map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://camli.example.com"+path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s := newCORSServer(t)
+	rw := serveCORS(s, "OPTIONS", "/bs/camli/upload", map[string]string{
+		"Origin":                         "https://app.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	})
+	ExpectInt(t, 200, rw.Code, "preflight status, without auth")
+	ExpectString(t, "https://app.example.com", rw.HeaderMap.Get("Access-Control-Allow-Origin"), "allowed origin")
+	ExpectString(t, "GET, HEAD, POST, PUT", rw.HeaderMap.Get("Access-Control-Allow-Methods"), "allowed methods")
+	ExpectString(t, "", rw.HeaderMap.Get("Access-Control-Allow-Credentials"), "allowed credentials")
+
+	rw = serveCORS(s, "OPTIONS", "/bs/camli/upload", map[string]string{
+		"Origin":                        "https://evil.example.com",
+		"Access-Control-Request-Method": "POST",
+	})
+	ExpectInt(t, 403, rw.Code, "preflight status of other origin")
+	ExpectString(t, "", rw.HeaderMap.Get("Access-Control-Allow-Origin"), "other origin allowed")
+	ExpectString(t, "Origin", rw.HeaderMap.Get("Vary"), "Vary of refused preflight")
+
+	rw = serveCORS(s, "OPTIONS", "/bs/camli/upload", map[string]string{
+		"Origin":                         "https://app.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "X-Other",
+	})
+	ExpectInt(t, 403, rw.Code, "preflight status with other header")
+
+	// The shorter prefix's policy applies outside of /bs/.
+	rw = serveCORS(s, "OPTIONS", "/ui/", map[string]string{
+		"Origin":                        "https://evil.example.com",
+		"Access-Control-Request-Method": "POST",
+	})
+	ExpectInt(t, 403, rw.Code, "preflight status of POST to /ui/")
+	rw = serveCORS(s, "OPTIONS", "/ui/", map[string]string{
+		"Origin":                        "https://evil.example.com",
+		"Access-Control-Request-Method": "GET",
+	})
+	ExpectInt(t, 200, rw.Code, "preflight status of GET to /ui/")
+	ExpectString(t, "https://evil.example.com", rw.HeaderMap.Get("Access-Control-Allow-Origin"), "echoed origin")
+	ExpectString(t, "", rw.HeaderMap.Get("Access-Control-Allow-Credentials"), "allowed credentials")
+}
+
+func TestCORSCredentials(t *testing.T) {
+	p, err := NewCORSPolicyFromConfig(jsonconfig.Obj{
+		"allowedOrigins":   []interface{}{"https://app.example.com"},
+		"allowCredentials": true,
+	})
+	AssertNil(t, err, "policy with credentials")
+	Expect(t, p.AllowCredentials, "credentials allowed")
+
+	_, err = NewCORSPolicyFromConfig(jsonconfig.Obj{
+		"allowedOrigins":   []interface{}{"https://app.example.com", "*"},
+		"allowCredentials": true,
+	})
+	ExpectErrorContains(t, err, "allowCredentials", "credentials for any origin")
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	s := newCORSServer(t)
+	rw := serveCORS(s, "GET", "/bs/camli/sha1-xxx", map[string]string{"Origin": "https://app.example.com"})
+	ExpectInt(t, 401, rw.Code, "status, still requiring auth")
+	ExpectString(t, "https://app.example.com", rw.HeaderMap.Get("Access-Control-Allow-Origin"), "allowed origin")
+	ExpectString(t, "Origin", rw.HeaderMap.Get("Vary"), "Vary")
+	ExpectString(t, "Accept-Ranges, Content-Length, Content-Range, ETag, Location, X-Camli-Contents",
+		rw.HeaderMap.Get("Access-Control-Expose-Headers"), "exposed headers")
+
+	rw = serveCORS(s, "GET", "/bs/camli/sha1-xxx", map[string]string{"Origin": "https://evil.example.com"})
+	ExpectInt(t, 401, rw.Code, "status of other origin")
+	ExpectString(t, "", rw.HeaderMap.Get("Access-Control-Allow-Origin"), "other origin allowed")
+	ExpectString(t, "Origin", rw.HeaderMap.Get("Vary"), "Vary of other origin")
+
+	// A cached response to a request without an Origin mustn't be
+	// given to one with an allowed Origin, which needs CORS headers.
+	rw = serveCORS(s, "GET", "/bs/camli/sha1-xxx", nil)
+	ExpectInt(t, 401, rw.Code, "status without an Origin")
+	ExpectString(t, "", rw.HeaderMap.Get("Access-Control-Allow-Origin"), "allowed origin without an Origin")
+	ExpectString(t, "Origin", rw.HeaderMap.Get("Vary"), "Vary without an Origin")
+
+	// Not a preflight request, so it's the handler's.
+	rw = serveCORS(s, "OPTIONS", "/bs/camli/sha1-xxx", map[string]string{"Origin": "https://app.example.com"})
+	ExpectInt(t, 401, rw.Code, "status of OPTIONS without a requested method")
+}
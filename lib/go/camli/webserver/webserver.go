@@ -41,6 +41,7 @@ type Server struct {
 
 	enableTLS               bool
 	tlsCertFile, tlsKeyFile string
+	tlsClientAuth           bool
 }
 
 func New() *Server {
@@ -56,6 +57,14 @@ func (s *Server) SetTLS(certFile, keyFile string) {
 	s.tlsKeyFile = keyFile
 }
 
+// RequestClientCerts makes the TLS server ask clients for a
+// certificate. A client that sends one must prove it holds its key,
+// but the certificate's issuer isn't checked; that's left to the
+// handlers, through the request's TLS connection state.
+func (s *Server) RequestClientCerts() {
+	s.tlsClientAuth = true
+}
+
 func (s *Server) BaseURL() string {
 	scheme := "http"
 	if s.enableTLS {
@@ -86,7 +95,12 @@ func (s *Server) Handle(pattern string, handler http.Handler) {
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	for _, hp := range s.premux {
+	s.serve(rw, req, s.premux)
+}
+
+// serve runs the first interested of premux, or the mux.
+func (s *Server) serve(rw http.ResponseWriter, req *http.Request, premux []HandlerPicker) {
+	for _, hp := range premux {
 		handler, ok := hp(req)
 		if ok {
 			handler(rw, req)
@@ -119,6 +133,7 @@ func (s *Server) Serve() {
 			Time:       time.Seconds,
 			NextProtos: []string{"http/1.1"},
 		}
+		config.AuthenticateClient = s.tlsClientAuth
 		config.Certificates = make([]tls.Certificate, 1)
 		config.Certificates[0], err = tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
 		if err != nil {
@@ -17,16 +17,21 @@ limitations under the License.
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"http"
+	"io"
+	"io/ioutil"
 	"json"
 	"log"
 	"path/filepath"
+	"sort"
 	"strings"
 	"os"
 
 	"camli/auth"
+	"camli/blobref"
 	"camli/blobserver"
 	"camli/blobserver/handlers"
 	"camli/errorutil"
@@ -36,14 +41,23 @@ import (
 	"camli/webserver"
 
 	// Storage options:
+	_ "camli/blobserver/cache"
+	_ "camli/blobserver/compress"
 	_ "camli/blobserver/cond"
+	_ "camli/blobserver/diskpacked"
+	_ "camli/blobserver/encrypt"
+	_ "camli/blobserver/erasure"
 	_ "camli/blobserver/localdisk"
+	_ "camli/blobserver/memory"
 	_ "camli/blobserver/remote"
 	_ "camli/blobserver/replica"
 	_ "camli/blobserver/s3"
 	_ "camli/blobserver/shard"
 	_ "camli/mysqlindexer" // indexer, but uses storage interface
 	// Handlers:
+	_ "camli/blobhub"
+	_ "camli/gc"
+	_ "camli/scrub"
 	_ "camli/search"
 
 )
@@ -77,8 +91,25 @@ func (s *storageAndConfig) Config() *blobserver.Config {
 	return s.config
 }
 
+func (s *storageAndConfig) StorageStats() (*blobserver.StorageStats, os.Error) {
+	return blobserver.GetStorageStats(s.Storage)
+}
+
+func (s *storageAndConfig) PartialUploadDir() string {
+	if pu, ok := s.Storage.(blobserver.PartialUploader); ok {
+		return pu.PartialUploadDir()
+	}
+	return ""
+}
+
+func (s *storageAndConfig) FetchMulti(blobs []*blobref.BlobRef, fn func(blobref.SizedBlobRef, io.Reader) os.Error) os.Error {
+	return blobserver.FetchMulti(s.Storage, blobs, fn)
+}
+
 // where prefix is like "/" or "/s3/" for e.g. "/camli/" or "/s3/camli/*"
-func makeCamliHandler(prefix, baseURL string, storage blobserver.Storage) http.Handler {
+// shares is nil if the storage's blobs can't be shared. It also
+// returns the storage's config, which is read as requests are served.
+func makeCamliHandler(prefix, baseURL string, storage blobserver.Storage, shares *handlers.ShareChecker) (http.Handler, *blobserver.Config) {
 	if !strings.HasSuffix(prefix, "/") {
 		panic("expected prefix to end in slash")
 	}
@@ -101,33 +132,41 @@ func makeCamliHandler(prefix, baseURL string, storage blobserver.Storage) http.H
 			unsupportedHandler(conn, req)
 			return
 		}
-		handleCamliUsingStorage(conn, req, action, storageConfig)
-	})
+		handleCamliUsingStorage(conn, req, action, storageConfig, shares)
+	}), storageConfig.config
 }
 
-func handleCamliUsingStorage(conn http.ResponseWriter, req *http.Request, action string, storage blobserver.StorageConfiger) {
+func handleCamliUsingStorage(conn http.ResponseWriter, req *http.Request, action string, storage blobserver.StorageConfiger, shares *handlers.ShareChecker) {
 	handler := unsupportedHandler
 	switch req.Method {
 	case "GET":
 		switch action {
 		case "enumerate-blobs":
-			handler = auth.RequireAuth(handlers.CreateEnumerateHandler(storage))
+			handler = auth.RequireScope(handlers.CreateEnumerateHandler(storage), auth.ScopeRead)
 		case "stat":
-			handler = auth.RequireAuth(handlers.CreateStatHandler(storage))
+			handler = auth.RequireScope(handlers.CreateStatHandler(storage), auth.ScopeRead, auth.ScopeUpload)
+		case "stats":
+			handler = auth.RequireScope(handlers.CreateStorageStatsHandler(storage), auth.ScopeRead)
+		case "fetch-blobs":
+			handler = handlers.CreateFetchBlobsHandler(storage, shares)
 		default:
-			handler = handlers.CreateGetHandler(storage)
+			handler = handlers.CreateGetHandler(storage, shares)
 		}
 	case "POST":
 		switch action {
 		case "stat":
-			handler = auth.RequireAuth(handlers.CreateStatHandler(storage))
+			handler = auth.RequireScope(handlers.CreateStatHandler(storage), auth.ScopeRead, auth.ScopeUpload)
+		case "fetch-blobs":
+			handler = handlers.CreateFetchBlobsHandler(storage, shares)
+		case "capability":
+			handler = auth.RequireScope(handlers.CreateCapabilityHandler(storage), auth.ScopeRead)
 		case "upload":
-			handler = auth.RequireAuth(handlers.CreateUploadHandler(storage))
+			handler = auth.RequireScope(handlers.CreateUploadHandler(storage), auth.ScopeUpload)
 		case "remove":
 			handler = auth.RequireAuth(handlers.CreateRemoveHandler(storage))
 		}
 	case "PUT": // no longer part of spec
-		handler = auth.RequireAuth(handlers.CreateNonStandardPutHandler(storage))
+		handler = auth.RequireScope(handlers.CreateNonStandardPutHandler(storage), auth.ScopeUpload)
 	}
 	handler(conn, req)
 }
@@ -145,6 +184,18 @@ type handlerConfig struct {
 	htype  string         // "localdisk", etc
 	conf   jsonconfig.Obj // never nil
 
+	// hubConf configures a storage's blob hub, or is empty for
+	// the default in-memory one.
+	hubConf jsonconfig.Obj
+
+	// sharesConf configures the sharing of a storage's blobs, or
+	// is empty if they can't be shared.
+	sharesConf jsonconfig.Obj
+
+	// cors is the prefix's policy for cross-origin requests from
+	// browser apps, or nil to add no CORS headers.
+	cors *webserver.CORSPolicy
+
 	settingUp, setupDone bool
 }
 
@@ -153,6 +204,8 @@ type handlerLoader struct {
 	baseURL string
 	config  map[string]*handlerConfig // prefix -> config
 	handler map[string]interface{}    // prefix -> http.Handler / func / blobserver.Storage
+
+	storageConfig map[string]*blobserver.Config // storage prefix -> its /camli/ handler's config
 }
 
 func main() {
@@ -192,6 +245,7 @@ func main() {
 	// Root configuration
 	config := jsonconfig.Obj(rootjson)
 
+	clientCAFile := config.OptionalString("TLSClientCAFile", "")
 	{
 		cert, key := config.OptionalString("TLSCertFile", ""), config.OptionalString("TLSKeyFile", "")
 		if (cert != "") != (key != "") {
@@ -200,22 +254,64 @@ func main() {
 		if cert != "" {
 			ws.SetTLS(cert, key)
 		}
+		if caFile := clientCAFile; caFile != "" {
+			if cert == "" {
+				exitFailure("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+			}
+			pemCerts, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				exitFailure("error reading TLSClientCAFile: %v", err)
+			}
+			if err := auth.SetClientCAs(pemCerts); err != nil {
+				exitFailure("error loading TLSClientCAFile %s: %v", caFile, err)
+			}
+			ws.RequestClientCerts()
+		}
 	}
 
 	auth.AccessPassword = config.OptionalString("password", "")
+	usersConf := config.OptionalObject("users")
+	clientCertsConf := config.OptionalObject("clientCerts")
+	capabilitySecret := config.OptionalString("capabilitySecret", "")
 	if url := config.OptionalString("baseURL", ""); url != "" {
 		baseURL = url
 	}
+	preferredHash := config.OptionalString("preferredHash", blobref.PreferredHash())
 	prefixes := config.RequiredObject("prefixes")
 	if err := config.Validate(); err != nil {
 		exitFailure("configuration error in root object's keys in %s: %v", configPath, err)
 	}
+	if err := blobref.SetPreferredHash(preferredHash); err != nil {
+		exitFailure("configuration error in %s: %v", configPath, err)
+	}
+	if err := addUsersFromConfig(usersConf); err != nil {
+		exitFailure("configuration error in users of %s: %v", configPath, err)
+	}
+	if len(clientCertsConf) > 0 && clientCAFile == "" {
+		// Without CAs to verify them against, client certificates
+		// would be silently ignored.
+		exitFailure("configuration error in %s: clientCerts requires TLSClientCAFile", configPath)
+	}
+	if err := addClientCertsFromConfig(clientCertsConf); err != nil {
+		exitFailure("configuration error in clientCerts of %s: %v", configPath, err)
+	}
+	if capabilitySecret == "" {
+		// Capabilities minted before a restart stop working.
+		buf := make([]byte, 20)
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			exitFailure("error generating capability secret: %v", err)
+		}
+		capabilitySecret = string(buf)
+	}
+	auth.SetCapabilitySecret([]byte(capabilitySecret))
 
 	hl := &handlerLoader{
 		ws:      ws,
 		baseURL: baseURL,
 		config:  make(map[string]*handlerConfig),
 		handler: make(map[string]interface{}),
+
+		storageConfig: make(map[string]*blobserver.Config),
 	}
 
 	for prefix, vei := range prefixes {
@@ -232,17 +328,35 @@ func main() {
 		pconf := jsonconfig.Obj(pmap)
 		handlerType := pconf.RequiredString("handler")
 		handlerArgs := pconf.OptionalObject("handlerArgs")
+		hubConf := pconf.OptionalObject("blobHub")
+		corsConf := pconf.OptionalObject("cors")
+		sharesConf := pconf.OptionalObject("shares")
 		if err := pconf.Validate(); err != nil {
 			exitFailure("configuration error in prefix %s: %v", prefix, err)
 		}
+		if len(hubConf) > 0 && !strings.HasPrefix(handlerType, "storage-") {
+			exitFailure("prefix %s has a blobHub but isn't a storage", prefix)
+		}
+		if len(sharesConf) > 0 && !strings.HasPrefix(handlerType, "storage-") {
+			exitFailure("prefix %s has shares but isn't a storage", prefix)
+		}
 		h := &handlerConfig{
-			prefix: prefix,
-			htype:  handlerType,
-			conf:   handlerArgs,
+			prefix:     prefix,
+			htype:      handlerType,
+			conf:       handlerArgs,
+			hubConf:    hubConf,
+			sharesConf: sharesConf,
+		}
+		if len(corsConf) > 0 {
+			if h.cors, err = webserver.NewCORSPolicyFromConfig(corsConf); err != nil {
+				exitFailure("configuration error in cors of prefix %s: %v", prefix, err)
+			}
 		}
 		hl.config[prefix] = h
 	}
+	hl.setupCORS()
 	hl.setupAll()
+	hl.setupDownloadURLs()
 	ws.Serve()
 }
 
@@ -252,6 +366,45 @@ func (hl *handlerLoader) setupAll() {
 	}
 }
 
+// setupDownloadURLs tells each storage a UI's blobRoot names where
+// the UI's download handler is, for download capabilities' URLs.
+func (hl *handlerLoader) setupDownloadURLs() {
+	for prefix, h := range hl.handler {
+		ui, ok := h.(*UIHandler)
+		if !ok || ui.BlobRoot == "" {
+			continue
+		}
+		if conf, ok := hl.storageConfig[ui.BlobRoot]; ok && conf.DownloadURLBase == "" {
+			conf.DownloadURLBase = strings.TrimRight(hl.baseURL, "/") + prefix + "download/"
+		}
+	}
+}
+
+// setupCORS applies the prefixes' CORS policies, such as:
+//
+//    "/bs/": {
+//        "handler": "storage-filesystem",
+//        "handlerArgs": { ... },
+//        "cors": { "allowedOrigins": ["https://app.example.com"] }
+//    }
+//
+// They're applied before any handler, so preflight requests are
+// answered before auth is required.
+func (hl *handlerLoader) setupCORS() {
+	var prefixes []string
+	for prefix, h := range hl.config {
+		if h.cors != nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	// A prefix sorts before the longer prefixes it's a prefix of,
+	// whose policies must take precedence.
+	sort.SortStrings(prefixes)
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		hl.ws.HandleCORS(prefixes[i], hl.config[prefixes[i]].cors)
+	}
+}
+
 func (hl *handlerLoader) configType(prefix string) string {
 	if h, ok := hl.config[prefix]; ok {
 		return h.htype
@@ -317,8 +470,20 @@ func (hl *handlerLoader) setupHandler(prefix string) {
 			exitFailure("error instantiating storage for prefix %q, type %q: %v",
 				h.prefix, stype, err)
 		}
+		if len(h.hubConf) > 0 {
+			hl.setupBlobHub(h, pstorage)
+		}
 		hl.handler[h.prefix] = pstorage
-		hl.ws.Handle(prefix+"camli/", makeCamliHandler(prefix, hl.baseURL, pstorage))
+		var shares *handlers.ShareChecker
+		if len(h.sharesConf) > 0 {
+			shares = hl.setupShares(h, pstorage)
+		} else {
+			log.Printf("Storage %s has no \"shares\" config; honoring any share blob, unsigned ones included", h.prefix)
+			shares = handlers.NewLegacyShareChecker(pstorage)
+		}
+		handler, conf := makeCamliHandler(prefix, hl.baseURL, pstorage, shares)
+		hl.storageConfig[prefix] = conf
+		hl.ws.Handle(prefix+"camli/", handler)
 		return
 	}
 
@@ -330,3 +495,58 @@ func (hl *handlerLoader) setupHandler(prefix string) {
 	hl.handler[prefix] = hh
 	hl.ws.Handle(prefix, &httputil.PrefixHandler{prefix, hh})
 }
+
+// setupShares returns the checker of shares configured in a storage
+// prefix's "shares" object, such as:
+//
+//     "/bs/": {
+//         "handler": "storage-filesystem",
+//         "handlerArgs": { "path": "/var/camlistore/blobs" },
+//         "shares": {
+//             "owners": ["sha1-<the owner's public key blobref>"],
+//             "stateFile": "/var/camlistore/shares.json"
+//         }
+//     },
+//
+// Only shares signed by one of the owners are honored. A storage
+// without "shares" honors any share blob, as before owners could be
+// configured (see doc/protocol/blob-get-protocol.txt).
+func (hl *handlerLoader) setupShares(h *handlerConfig, sto blobserver.Storage) *handlers.ShareChecker {
+	conf := h.sharesConf
+	ownerNames := conf.RequiredStringOrList("owners")
+	statePath := conf.OptionalString("stateFile", "")
+	if err := conf.Validate(); err != nil {
+		exitFailure("configuration error in shares of prefix %s: %v", h.prefix, err)
+	}
+	owners := make([]*blobref.BlobRef, len(ownerNames))
+	for i, name := range ownerNames {
+		if owners[i] = blobref.Parse(name); owners[i] == nil {
+			exitFailure("shares of prefix %s have an invalid owner %q", h.prefix, name)
+		}
+	}
+	shares, err := handlers.NewShareChecker(sto, owners, statePath)
+	if err != nil {
+		exitFailure("error setting up shares for prefix %q: %v", h.prefix, err)
+	}
+	return shares
+}
+
+// setupBlobHub replaces a storage's in-memory blob hub with the one
+// configured in its prefix's "blobHub" object, such as:
+//
+//     "/bs/": {
+//         "handler": "storage-filesystem",
+//         "handlerArgs": { "path": "/var/camlistore/blobs" },
+//         "blobHub": { "type": "inotify" }
+//     },
+func (hl *handlerLoader) setupBlobHub(h *handlerConfig, sto blobserver.Storage) {
+	setter, ok := sto.(blobserver.BlobHubSetter)
+	if !ok {
+		exitFailure("storage for prefix %q (type %T) doesn't support a configured blobHub", h.prefix, sto)
+	}
+	hub, err := blobserver.CreateBlobHub(sto, h.hubConf)
+	if err != nil {
+		exitFailure("error instantiating blobHub for prefix %q: %v", h.prefix, err)
+	}
+	setter.SetBlobHub(hub)
+}
@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"camli/auth"
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/blobserver/handlers"
@@ -156,6 +157,12 @@ func (h *JSONSignHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	case "POST":
 		switch subPath {
 		case "camli/sig/sign":
+			// Signing claims as the owner is as good as being
+			// the owner.
+			if !auth.IsAuthorized(req) {
+				auth.SendDenied(rw, req)
+				return
+			}
 			h.handleSign(rw, req)
 			return
 		case "camli/sig/verify":
@@ -17,15 +17,19 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"html"
 	"http"
+	"io"
+	"io/ioutil"
 	"os"
 	"log"
 	"strings"
 	"sync"
 	"time"
 
+	"camli/auth"
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/jsonconfig"
@@ -35,6 +39,14 @@ import (
 const queueSyncInterval = seconds(5)
 const maxErrors = 20
 
+// copyBatchSize is how many queued blobs a copier fetches from the
+// source at once, in one round trip if the source can.
+const copyBatchSize = 100
+
+// maxBatchedBlobSize is the biggest blob a copier holds in memory to
+// send to the destination along with others.
+const maxBatchedBlobSize = 64 << 10
+
 var _ = log.Printf
 
 // TODO: rate control + tunable
@@ -117,6 +129,10 @@ func createSyncHandler(fromName, toName string, from, to blobserver.Storage) (*S
 }
 
 func (sh *SyncHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.IsAuthorized(req) {
+		auth.SendDenied(rw, req)
+		return
+	}
 	sh.lk.Lock()
 	defer sh.lk.Unlock()
 
@@ -200,16 +216,29 @@ func (sh *SyncHandler) syncQueueLoop() {
 		nCopied := 0
 		toCopy := 0
 
-		workch := make(chan blobref.SizedBlobRef, 1000)
+		workch := make(chan []blobref.SizedBlobRef, 1000/copyBatchSize+1)
 		resch := make(chan copyResult, 8)
+		nWorkers := 0
+		var batch []blobref.SizedBlobRef
+		sendBatch := func() {
+			workch <- batch
+			batch = nil
+			if nWorkers < sh.copierPoolSize {
+				nWorkers++
+				go sh.copyWorker(resch, workch)
+			}
+		}
 		for sb := range enumch {
 			toCopy++
-			workch <- sb
-			if toCopy <= sh.copierPoolSize {
-				go sh.copyWorker(resch, workch)
+			batch = append(batch, sb)
+			if len(batch) == copyBatchSize {
+				sendBatch()
 			}
 			sh.setStatus("Enumerating queued blobs: %d", toCopy)
 		}
+		if len(batch) > 0 {
+			sendBatch()
+		}
 		close(workch)
 		for i := 0; i < toCopy; i++ {
 			sh.setStatus("Copied %d/%d of batch of queued blobs", nCopied, toCopy)
@@ -238,9 +267,86 @@ func (sh *SyncHandler) syncQueueLoop() {
 	})
 }
 
-func (sh *SyncHandler) copyWorker(res chan<- copyResult, work <-chan blobref.SizedBlobRef) {
-	for sb := range work {
-		res <- copyResult{sb, sh.copyBlob(sb)}
+func (sh *SyncHandler) copyWorker(res chan<- copyResult, work <-chan []blobref.SizedBlobRef) {
+	for batch := range work {
+		sh.copyBlobs(res, batch)
+	}
+}
+
+// copyBlobs copies a batch of blobs, fetching them from the source
+// together and sending the small ones to the destination together,
+// and sends the result of each copy to res.
+func (sh *SyncHandler) copyBlobs(res chan<- copyResult, batch []blobref.SizedBlobRef) {
+	blobs := make([]*blobref.BlobRef, len(batch))
+	pending := make(map[string]blobref.SizedBlobRef)
+	for i, sb := range batch {
+		blobs[i] = sb.BlobRef
+		pending[sb.BlobRef.String()] = sb
+		sh.setBlobStatus(sb.BlobRef.String(), status("sending GET to source"))
+	}
+	var small []blobref.SizedBlobRef
+	var smallData [][]byte
+	err := blobserver.FetchMulti(sh.from, blobs, func(fetched blobref.SizedBlobRef, r io.Reader) os.Error {
+		key := fetched.BlobRef.String()
+		sb, ok := pending[key]
+		if !ok {
+			return nil
+		}
+		pending[key] = sb, false
+		if fetched.Size != sb.Size || sb.Size > maxBatchedBlobSize {
+			res <- copyResult{sb, sh.copyBlob(sb, fetched.Size, r)}
+			return nil
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			sh.setBlobStatus(key, nil)
+			res <- copyResult{sb, sh.copyError(sb, "source fetch: %v", err)}
+			return nil
+		}
+		sh.setBlobStatus(key, status("fetched; waiting to send with others"))
+		small = append(small, sb)
+		smallData = append(smallData, data)
+		return nil
+	})
+	if err == nil {
+		err = os.ENOENT
+	}
+	for _, sb := range batch {
+		if _, ok := pending[sb.BlobRef.String()]; ok {
+			sh.setBlobStatus(sb.BlobRef.String(), nil)
+			res <- copyResult{sb, sh.copyError(sb, "source fetch: %v", err)}
+		}
+	}
+	sh.receiveBlobs(res, small, smallData)
+}
+
+// receiveBlobs sends blobs already fetched from the source to the
+// destination together, removes them from the queue, and sends the
+// result of each copy to res.
+func (sh *SyncHandler) receiveBlobs(res chan<- copyResult, blobs []blobref.SizedBlobRef, data [][]byte) {
+	if len(blobs) == 0 {
+		return
+	}
+	refs := make([]*blobref.BlobRef, len(blobs))
+	contents := make([]io.Reader, len(blobs))
+	for i, sb := range blobs {
+		refs[i] = sb.BlobRef
+		contents[i] = bytes.NewBuffer(data[i])
+		sh.setBlobStatus(sb.BlobRef.String(), status("copying with others"))
+	}
+	what := "dest write: %v"
+	err := blobserver.ReceiveBlobs(sh.to, blobs, contents)
+	if err == nil {
+		what = "source queue delete: %v"
+		err = sh.fromq.Remove(refs)
+	}
+	for _, sb := range blobs {
+		sh.setBlobStatus(sb.BlobRef.String(), nil)
+		if err != nil {
+			res <- copyResult{sb, sh.copyError(sb, what, err)}
+		} else {
+			res <- copyResult{sb, nil}
+		}
 	}
 }
 
@@ -256,7 +362,19 @@ func (s status) String() string {
 	return string(s)
 }
 
-func (sh *SyncHandler) copyBlob(sb blobref.SizedBlobRef) os.Error {
+// copyError logs and returns an error copying sb.
+func (sh *SyncHandler) copyError(sb blobref.SizedBlobRef, s string, args ...interface{}) os.Error {
+	// TODO: increment error stats
+	pargs := []interface{}{sh.fromqName, sb.BlobRef}
+	pargs = append(pargs, args...)
+	err := fmt.Errorf("replication error for queue %q, blob %s: "+s, pargs...)
+	sh.addErrorToLog(err)
+	return err
+}
+
+// copyBlob copies sb, read from the source as blobReader, to the
+// destination, and removes it from the queue.
+func (sh *SyncHandler) copyBlob(sb blobref.SizedBlobRef, fromSize int64, blobReader io.Reader) os.Error {
 	key := sb.BlobRef.String()
 	set := func(s fmt.Stringer) {
 		sh.setBlobStatus(key, s)
@@ -264,19 +382,9 @@ func (sh *SyncHandler) copyBlob(sb blobref.SizedBlobRef) os.Error {
 	defer set(nil)
 
 	error := func(s string, args ...interface{}) os.Error {
-		// TODO: increment error stats
-		pargs := []interface{}{sh.fromqName, sb.BlobRef}
-		pargs = append(pargs, args...)
-		err := fmt.Errorf("replication error for queue %q, blob %s: "+s, pargs...)
-		sh.addErrorToLog(err)
-		return err
+		return sh.copyError(sb, s, args...)
 	}
 
-	set(status("sending GET to source"))
-	blobReader, fromSize, err := sh.from.FetchStreaming(sb.BlobRef)
-	if err != nil {
-		return error("source fetch: %v", err)
-	}
 	if fromSize != sb.Size {
 		return error("source fetch size mismatch: get=%d, enumerate=%d", fromSize, sb.Size)
 	}
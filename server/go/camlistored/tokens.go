@@ -0,0 +1,174 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"http"
+	"os"
+
+	"camli/auth"
+	"camli/blobserver"
+	"camli/httputil"
+	"camli/jsonconfig"
+)
+
+// TokensHandler lists, issues and revokes access tokens. Its
+// endpoints are, relative to its prefix:
+//
+//   GET  camli/tokens         the issued tokens (without the tokens themselves)
+//   POST camli/tokens/issue   with "scope" (repeated), "user" and "label";
+//                             returns the new token, which isn't kept
+//   POST camli/tokens/revoke  with "hash", that of the token to revoke
+//
+// All need the admin scope.
+type TokensHandler struct {
+	store *auth.TokenStore
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("tokens", newTokensFromConfig)
+}
+
+func newTokensFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, os.Error) {
+	path := conf.RequiredString("path")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	store, err := auth.OpenTokenStore(path)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetTokenStore(store)
+	return &TokensHandler{store}, nil
+}
+
+func (h *TokensHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !auth.IsAuthorized(req) {
+		auth.SendDenied(rw, req)
+		return
+	}
+	subPath := req.Header.Get("X-PrefixHandler-PathSuffix")
+	switch {
+	case req.Method == "GET" && subPath == "camli/tokens":
+		httputil.ReturnJson(rw, map[string]interface{}{"tokens": h.store.Tokens()})
+	case req.Method == "POST" && subPath == "camli/tokens/issue":
+		h.handleIssue(rw, req)
+	case req.Method == "POST" && subPath == "camli/tokens/revoke":
+		h.handleRevoke(rw, req)
+	default:
+		http.Error(rw, "Unsupported path or method.", http.StatusBadRequest)
+	}
+}
+
+func (h *TokensHandler) handleIssue(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	scopes, err := auth.ParseScopes(req.Form["scope"])
+	if err != nil || len(scopes) == 0 {
+		httputil.BadRequestError(rw, "Missing or invalid \"scope\" parameter.")
+		return
+	}
+	secret, t, err := h.store.Issue(req.FormValue("user"), req.FormValue("label"), scopes)
+	if err != nil {
+		httputil.ServerError(rw, err)
+		return
+	}
+	httputil.ReturnJson(rw, map[string]interface{}{
+		"token":  secret,
+		"hash":   t.Hash,
+		"user":   t.User,
+		"label":  t.Label,
+		"scopes": t.Scopes,
+	})
+}
+
+func (h *TokensHandler) handleRevoke(rw http.ResponseWriter, req *http.Request) {
+	hash := req.FormValue("hash")
+	switch err := h.store.Revoke(hash); err {
+	case nil:
+		httputil.ReturnJson(rw, map[string]interface{}{"revoked": hash})
+	case auth.ErrNoToken:
+		httputil.BadRequestError(rw, "No token with hash %q.", hash)
+	default:
+		httputil.ServerError(rw, err)
+	}
+}
+
+// addUsersFromConfig adds the named users of the root config's "users"
+// object, such as:
+//
+//   "users": {
+//       "alice": { "password": "secret" },
+//       "backup": { "password": "other", "scopes": ["upload"] }
+//   }
+//
+// A user's scopes default to admin.
+func addUsersFromConfig(usersConf jsonconfig.Obj) os.Error {
+	for name, v := range usersConf {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("user %q value isn't an object", name)
+		}
+		uconf := jsonconfig.Obj(m)
+		password := uconf.RequiredString("password")
+		scopeNames := uconf.OptionalList("scopes")
+		if err := uconf.Validate(); err != nil {
+			return fmt.Errorf("user %q: %v", name, err)
+		}
+		scopes := []auth.Scope{auth.ScopeAdmin}
+		if scopeNames != nil {
+			var err os.Error
+			if scopes, err = auth.ParseScopes(scopeNames); err != nil {
+				return fmt.Errorf("user %q: %v", name, err)
+			}
+		}
+		auth.AddUser(&auth.User{Name: name, Password: password, Scopes: scopes})
+	}
+	return nil
+}
+
+// addClientCertsFromConfig gives TLS client certificates, issued by
+// one of the root config's "TLSClientCAFile" CAs, which it requires,
+// and for client authentication, the scopes listed in its
+// "clientCerts" object, such as:
+//
+//   "clientCerts": {
+//       "CN=laptop": ["read", "upload"],
+//       "sha1:0b1c...": ["admin"]
+//   }
+func addClientCertsFromConfig(certsConf jsonconfig.Obj) os.Error {
+	for match, v := range certsConf {
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("client cert %q value isn't a list of scopes", match)
+		}
+		names := make([]string, len(list))
+		for i, vi := range list {
+			if names[i], ok = vi.(string); !ok {
+				return fmt.Errorf("client cert %q scopes aren't strings", match)
+			}
+		}
+		scopes, err := auth.ParseScopes(names)
+		if err != nil {
+			return fmt.Errorf("client cert %q: %v", match, err)
+		}
+		if err := auth.AddClientCert(match, scopes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
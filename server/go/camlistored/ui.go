@@ -31,10 +31,12 @@ import (
 	"strconv"
 	"strings"
 
+	"camli/auth"
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/httputil"
 	"camli/jsonconfig"
+	"camli/misc/httprange"
 	"camli/misc/resize"
 	"camli/misc/vfs" // TODO: ditch this once pkg http gets it
 	"camli/schema"
@@ -266,6 +268,10 @@ func (ui *UIHandler) serveDownload(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Invalid blobref", 400)
 		return
 	}
+	if !auth.Allowed(req, auth.ScopeRead) && !auth.HasCapability(req, auth.CapabilityDownload, fbr.String()) {
+		auth.SendDenied(rw, req)
+		return
+	}
 
 	filename := m[2]
 	if len(filename) > 0 {
@@ -282,9 +288,9 @@ func (ui *UIHandler) serveDownload(rw http.ResponseWriter, req *http.Request) {
 	// TODO: fr.FileSchema() and guess a mime type?  For now:
 	schema := fr.FileSchema()
 	rw.Header().Set("Content-Type", "application/octet-stream")
-	rw.Header().Set("Content-Length", fmt.Sprintf("%d", schema.Size))
 
-	if req.Method == "HEAD" {
+	if req.Method == "HEAD" && req.FormValue("verifycontents") != "" {
+		rw.Header().Set("Content-Length", fmt.Sprintf("%d", schema.Size))
 		vbr := blobref.Parse(req.FormValue("verifycontents"))
 		if vbr == nil {
 			return
@@ -300,16 +306,15 @@ func (ui *UIHandler) serveDownload(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	n, err := io.Copy(rw, fr)
-	log.Printf("For %q request of %s: copied %d, %v", req.Method, req.URL.RawPath, n, err)
-	if err != nil {
-		log.Printf("error serving download of file schema %s: %v", fbr, err)
+	// The file schema blob's blobref names its contents, so it's a
+	// strong validator, for If-Range too.
+	etag := `"` + fbr.String() + `"`
+	if httputil.ServeImmutable(rw, req, etag, true) {
 		return
 	}
-	if n != int64(schema.Size) {
-		log.Printf("error serving download of file schema %s: sent %d, expected size of %d",
-			fbr, n, schema.Size)
-		return
+	err = httprange.ServeContent(rw, req, fr, int64(schema.Size), etag, 0)
+	if err != nil {
+		log.Printf("error serving download of file schema %s: %v", fbr, err)
 	}
 }
 
@@ -361,6 +366,12 @@ func (ui *UIHandler) serveThumbnail(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Thumbnails of a size never change either.
+	etag := fmt.Sprintf(`"%s-%dx%d"`, blobref, width, height)
+	if httputil.ServeImmutable(rw, req, etag, true) {
+		return
+	}
+
 	var buf bytes.Buffer
 	n, err := io.Copy(&buf, fr)
 	i, format, err := image.Decode(&buf)